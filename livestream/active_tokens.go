@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/v2/simplelru"
+	"golang.org/x/exp/slices"
+)
+
+// defaultMaxActiveTokens bounds ActiveTokens when no limit is given.
+const defaultMaxActiveTokens = 10000
+
+// ActiveTokens tracks which project tokens have sent events recently, dropping
+// the least recently seen past its size. Pinned tokens are always active.
+type ActiveTokens struct {
+	// TTL is how long a token stays active after its last event.
+	TTL time.Duration
+
+	mu     sync.Mutex
+	clock  Clock
+	pinned []string
+	// seen is ordered by last event, which is also the order tokens expire in.
+	seen *simplelru.LRU[string, *TokenActivity]
+}
+
+// TokenActivity is what is known about an active token. Count is the number
+// of events since it last became active.
+type TokenActivity struct {
+	Token    string     `json:"token"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	Count    int        `json:"count"`
+	Pinned   bool       `json:"pinned"`
+}
+
+// NewActiveTokens returns a tracker remembering up to maxTokens tokens besides
+// the pinned ones, or defaultMaxActiveTokens if maxTokens is not positive.
+func NewActiveTokens(ttl time.Duration, maxTokens int, pinned []string) *ActiveTokens {
+	if maxTokens <= 0 {
+		maxTokens = defaultMaxActiveTokens
+	}
+	// NewLRU only fails for a size below one.
+	seen, _ := simplelru.NewLRU[string, *TokenActivity](maxTokens, nil)
+	a := &ActiveTokens{
+		TTL:   ttl,
+		clock: realClock{},
+		seen:  seen,
+	}
+	for _, token := range pinned {
+		if token = strings.TrimSpace(token); token != "" && !slices.Contains(a.pinned, token) {
+			a.pinned = append(a.pinned, token)
+		}
+	}
+	return a
+}
+
+// Add records an event for token.
+func (a *ActiveTokens) Add(token string) {
+	if token == "" {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.clock.Now()
+	activity, ok := a.seen.Get(token)
+	if !ok || a.expired(activity, now) {
+		activity = &TokenActivity{Token: token}
+		a.seen.Add(token, activity)
+	}
+	activity.LastSeen = &now
+	activity.Count++
+}
+
+// Len returns how many tokens are remembered, not counting pinned ones
+// without traffic.
+func (a *ActiveTokens) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.seen.Len()
+}
+
+// Snapshot returns the pinned tokens and every token seen within the TTL,
+// sorted by token.
+func (a *ActiveTokens) Snapshot() []TokenActivity {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.clock.Now()
+	for {
+		_, oldest, ok := a.seen.GetOldest()
+		if !ok || !a.expired(oldest, now) {
+			break
+		}
+		a.seen.RemoveOldest()
+	}
+
+	var snapshot []TokenActivity
+	for _, activity := range a.seen.Values() {
+		snapshot = append(snapshot, *activity)
+	}
+	for _, token := range a.pinned {
+		if !a.seen.Contains(token) {
+			snapshot = append(snapshot, TokenActivity{Token: token})
+		}
+	}
+	for i := range snapshot {
+		snapshot[i].Pinned = slices.Contains(a.pinned, snapshot[i].Token)
+	}
+	slices.SortFunc(snapshot, func(x, y TokenActivity) int {
+		return strings.Compare(x.Token, y.Token)
+	})
+	return snapshot
+}
+
+// Active returns the tokens of Snapshot.
+func (a *ActiveTokens) Active() []string {
+	active := []string{}
+	for _, activity := range a.Snapshot() {
+		active = append(active, activity.Token)
+	}
+	return active
+}
+
+// IsPinned reports whether token is always active.
+func (a *ActiveTokens) IsPinned(token string) bool {
+	return slices.Contains(a.pinned, token)
+}
+
+func (a *ActiveTokens) expired(activity *TokenActivity, now time.Time) bool {
+	return now.Sub(*activity.LastSeen) >= a.TTL
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActiveTokensPinned(t *testing.T) {
+	clock := newFakeClock()
+	a := NewActiveTokens(time.Minute, 0, []string{"phc_demo", " phc_other ", "phc_demo", ""})
+	a.clock = clock
+
+	assert.Equal(t, []string{"phc_demo", "phc_other"}, a.Active())
+	assert.True(t, a.IsPinned("phc_demo"))
+	assert.False(t, a.IsPinned("phc_live"))
+
+	// Traffic for a pinned token does not list it twice, and it stays once
+	// the traffic stops.
+	a.Add("phc_demo")
+	a.Add("phc_live")
+	assert.Equal(t, []string{"phc_demo", "phc_live", "phc_other"}, a.Active())
+
+	clock.Advance(time.Hour)
+	assert.Equal(t, []string{"phc_demo", "phc_other"}, a.Active())
+}
+
+func TestActiveTokensExpire(t *testing.T) {
+	clock := newFakeClock()
+	a := NewActiveTokens(time.Minute, 0, nil)
+	a.clock = clock
+	a.Add("phc_a")
+	clock.Advance(30 * time.Second)
+	a.Add("phc_b")
+	a.Add("")
+
+	assert.Equal(t, []string{"phc_a", "phc_b"}, a.Active())
+
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, []string{"phc_b"}, a.Active())
+}
+
+func TestActiveTokensCountRestartsAfterExpiry(t *testing.T) {
+	clock := newFakeClock()
+	a := NewActiveTokens(time.Minute, 0, nil)
+	a.clock = clock
+	a.Add("phc_a")
+	a.Add("phc_a")
+	assert.Equal(t, 2, a.Snapshot()[0].Count)
+
+	clock.Advance(time.Minute)
+	a.Add("phc_a")
+	assert.Equal(t, 1, a.Snapshot()[0].Count)
+}
+
+func TestActiveTokensBounded(t *testing.T) {
+	clock := newFakeClock()
+	a := NewActiveTokens(time.Minute, 100, []string{"phc_pinned"})
+	a.clock = clock
+
+	for i := 0; i < 1000; i++ {
+		a.Add(fmt.Sprintf("phc_%d", i))
+		assert.LessOrEqual(t, a.Len(), 100)
+	}
+
+	// The most recently seen survive, and pinned tokens are not evicted.
+	active := a.Active()
+	assert.Len(t, active, 101)
+	assert.Contains(t, active, "phc_999")
+	assert.Contains(t, active, "phc_900")
+	assert.NotContains(t, active, "phc_899")
+	assert.Contains(t, active, "phc_pinned")
+}
+
+func TestActiveTokensEvictsLeastRecentlySeen(t *testing.T) {
+	clock := newFakeClock()
+	a := NewActiveTokens(time.Minute, 2, nil)
+	a.clock = clock
+
+	a.Add("phc_a")
+	a.Add("phc_b")
+	a.Add("phc_a")
+	a.Add("phc_c")
+
+	assert.Equal(t, []string{"phc_a", "phc_c"}, a.Active())
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+)
+
+// distinctIdHashes are the algorithms DistinctIdHasher can use.
+var distinctIdHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// DistinctIdHasher replaces distinct ids sent to clients with a salted hash,
+// so a public stream doesn't expose them. The same id always maps to the same
+// hash for a given salt, so clients can still tell users apart.
+type DistinctIdHasher struct {
+	salt    []byte
+	newHash func() hash.Hash
+}
+
+// NewDistinctIdHasher hashes with HMAC using algorithm, one of
+// distinctIdHashes, and salt as the key. An empty salt is replaced with a
+// random one, so hashes are only consistent until the process restarts.
+func NewDistinctIdHasher(algorithm, salt string) (*DistinctIdHasher, error) {
+	newHash, ok := distinctIdHashes[strings.ToLower(algorithm)]
+	if !ok {
+		names := make([]string, 0, len(distinctIdHashes))
+		for name := range distinctIdHashes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("must be one of %s, got %q", strings.Join(names, ", "), algorithm)
+	}
+
+	key := []byte(salt)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &DistinctIdHasher{salt: key, newHash: newHash}, nil
+}
+
+// Hash returns the hex encoded hash of distinctId. A nil hasher returns it
+// unchanged, and an empty id stays empty.
+func (h *DistinctIdHasher) Hash(distinctId string) string {
+	if h == nil || distinctId == "" {
+		return distinctId
+	}
+	mac := hmac.New(h.newHash, h.salt)
+	mac.Write([]byte(distinctId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
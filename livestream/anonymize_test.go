@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDistinctIdHasher(t *testing.T) {
+	hasher, err := NewDistinctIdHasher("sha256", "salt")
+	require.NoError(t, err)
+
+	mac := hmac.New(sha256.New, []byte("salt"))
+	mac.Write([]byte("user1"))
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	assert.Equal(t, expected, hasher.Hash("user1"))
+	assert.Equal(t, expected, hasher.Hash("user1"), "the same id must map to the same hash")
+	assert.NotEqual(t, expected, hasher.Hash("user2"))
+	assert.Empty(t, hasher.Hash(""))
+}
+
+func TestDistinctIdHasherSalt(t *testing.T) {
+	a, err := NewDistinctIdHasher("sha256", "a")
+	require.NoError(t, err)
+	b, err := NewDistinctIdHasher("sha256", "b")
+	require.NoError(t, err)
+	assert.NotEqual(t, a.Hash("user1"), b.Hash("user1"))
+
+	// Without a salt each hasher picks its own.
+	first, err := NewDistinctIdHasher("sha256", "")
+	require.NoError(t, err)
+	second, err := NewDistinctIdHasher("sha256", "")
+	require.NoError(t, err)
+	assert.Equal(t, first.Hash("user1"), first.Hash("user1"))
+	assert.NotEqual(t, first.Hash("user1"), second.Hash("user1"))
+}
+
+func TestDistinctIdHasherAlgorithms(t *testing.T) {
+	for algorithm, length := range map[string]int{"sha1": 40, "sha256": 64, "SHA512": 128} {
+		hasher, err := NewDistinctIdHasher(algorithm, "salt")
+		require.NoError(t, err, algorithm)
+		assert.Len(t, hasher.Hash("user1"), length, algorithm)
+	}
+
+	_, err := NewDistinctIdHasher("md4", "salt")
+	assert.ErrorContains(t, err, "sha1, sha256, sha512")
+}
+
+func TestDistinctIdHasherNil(t *testing.T) {
+	var hasher *DistinctIdHasher
+	assert.Equal(t, "user1", hasher.Hash("user1"))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// allTokens is the token to subscribe to, and authorize, for the events of
+// every project.
+const allTokens = "*"
+
+// apiKeyHeader carries the API key a streaming client is checked with when
+// an Authorizer is set.
+const apiKeyHeader = "X-Livestream-Api-Key"
+
+var (
+	// ErrUnauthenticated means an API key is not known at all.
+	ErrUnauthenticated = errors.New("invalid API key")
+	// ErrForbidden means an API key is known, but may not read the token.
+	ErrForbidden = errors.New("API key may not read this token")
+)
+
+// Authorizer decides whether the holder of an API key may stream the events
+// of a project token.
+type Authorizer interface {
+	// Authorize returns nil if apiKey may read token, ErrUnauthenticated if
+	// the key is unknown and ErrForbidden if it may not read token. Any other
+	// error means it could not tell. token is allTokens for a subscription to
+	// every project, which only admin keys should be allowed.
+	Authorize(ctx context.Context, apiKey, token string) error
+}
+
+// StaticAuthorizer allows a fixed set of API keys, each to its own tokens.
+// Keys are kept hashed, so looking one up takes the same time whatever it is.
+type StaticAuthorizer struct {
+	tokens map[[sha256.Size]byte][]string
+}
+
+// ParseStaticAuthorizer reads "key:token" specs, each letting key read token,
+// or with "key:*" any token and every token at once. A key can be listed once
+// per token.
+func ParseStaticAuthorizer(specs []string) (*StaticAuthorizer, error) {
+	tokens := make(map[[sha256.Size]byte][]string, len(specs))
+	for _, spec := range specs {
+		// The spec holds a secret, so it is left out of errors.
+		i := strings.LastIndexByte(spec, ':')
+		if i <= 0 {
+			return nil, errors.New("expected key:token")
+		}
+		key, token := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+		if key == "" || token == "" {
+			return nil, errors.New("expected key:token")
+		}
+		if token != allTokens {
+			if err := validateToken(token); err != nil {
+				return nil, fmt.Errorf("%w %q", err, token)
+			}
+		}
+		hash := sha256.Sum256([]byte(key))
+		tokens[hash] = append(tokens[hash], token)
+	}
+	return &StaticAuthorizer{tokens: tokens}, nil
+}
+
+func (a *StaticAuthorizer) Authorize(ctx context.Context, apiKey, token string) error {
+	tokens, ok := a.tokens[sha256.Sum256([]byte(apiKey))]
+	if !ok {
+		return ErrUnauthenticated
+	}
+	if !slices.Contains(tokens, allTokens) && !slices.Contains(tokens, token) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// authorize checks that the request's API key may read token, answering 401
+// for a missing or unknown key and 403 for a key that may not read it. A nil
+// auth lets everything through.
+func authorize(c echo.Context, auth Authorizer, token string) error {
+	if auth == nil {
+		return nil
+	}
+
+	apiKey := strings.TrimSpace(c.Request().Header.Get(apiKeyHeader))
+	if apiKey == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, apiKeyHeader+" header is required")
+	}
+	err := auth.Authorize(c.Request().Context(), apiKey, token)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, ErrUnauthenticated):
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	case errors.Is(err, ErrForbidden):
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAuthorizer lets each key in keys read its tokens, and records what it
+// was asked. err, when set, is returned for every key.
+type fakeAuthorizer struct {
+	keys  map[string][]string
+	err   error
+	calls [][2]string
+}
+
+func (a *fakeAuthorizer) Authorize(ctx context.Context, apiKey, token string) error {
+	a.calls = append(a.calls, [2]string{apiKey, token})
+	if a.err != nil {
+		return a.err
+	}
+	tokens, ok := a.keys[apiKey]
+	if !ok {
+		return ErrUnauthenticated
+	}
+	for _, allowed := range tokens {
+		if allowed == token {
+			return nil
+		}
+	}
+	return ErrForbidden
+}
+
+func TestNewSubscriptionAuthorizer(t *testing.T) {
+	viper.Set("jwt.secret", "test-secret")
+
+	tests := []struct {
+		name   string
+		query  string
+		jwt    string
+		apiKey string
+		err    error
+		status int
+	}{
+		{name: "Allowed", query: "?geo=true&token=phc_allowed", apiKey: "key1"},
+		{name: "Allowed with JWT", jwt: "phc_allowed", apiKey: "key1"},
+		{name: "Geo without token", query: "?geo=true"},
+		{name: "Missing key", query: "?geo=true&token=phc_allowed", status: http.StatusUnauthorized},
+		{name: "Unknown key", query: "?geo=true&token=phc_allowed", apiKey: "key2", status: http.StatusUnauthorized},
+		{name: "Other token", query: "?geo=true&token=phc_other", apiKey: "key1", status: http.StatusForbidden},
+		{name: "Other token with JWT", jwt: "phc_other", apiKey: "key1", status: http.StatusForbidden},
+		{name: "Authorizer failed", query: "?geo=true&token=phc_allowed", apiKey: "key1", err: errors.New("unreachable"), status: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &fakeAuthorizer{keys: map[string][]string{"key1": {"phc_allowed"}}, err: tt.err}
+			req := httptest.NewRequest(http.MethodGet, "/events"+tt.query, nil)
+			if tt.jwt != "" {
+				req.Header.Set("Authorization", "Bearer "+createProjectToken(t, 1, tt.jwt))
+			}
+			if tt.apiKey != "" {
+				req.Header.Set(apiKeyHeader, tt.apiKey)
+			}
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+
+			subscription, err := newSubscription(c, auth)
+
+			switch tt.status {
+			case 0:
+				require.NoError(t, err)
+				assert.NotNil(t, subscription.EventChan)
+			case http.StatusInternalServerError:
+				assert.ErrorIs(t, err, tt.err)
+			default:
+				var httpErr *echo.HTTPError
+				require.ErrorAs(t, err, &httpErr)
+				assert.Equal(t, tt.status, httpErr.Code)
+			}
+		})
+	}
+}
+
+func TestNewSubscriptionWithoutAuthorizer(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/events?geo=true&token=phc_any", nil)
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+
+	subscription, err := newSubscription(c, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "phc_any", subscription.Token)
+}
+
+func TestEventsHandlerDeniedNeverSubscribes(t *testing.T) {
+	subChan := make(chan Subscription, 1)
+	auth := &fakeAuthorizer{keys: map[string][]string{"key1": {"phc_allowed"}}}
+	e := echo.New()
+	e.GET("/events", eventsHandler(subChan, make(chan Subscription, 1), nil, auth, nil, 0, realClock{}))
+
+	req := httptest.NewRequest(http.MethodGet, "/events?geo=true&token=phc_other", nil)
+	req.Header.Set(apiKeyHeader, "key1")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Empty(t, subChan)
+	assert.Equal(t, [][2]string{{"key1", "phc_other"}}, auth.calls)
+}
+
+func TestNewSubscriptionAllTokens(t *testing.T) {
+	auth := &fakeAuthorizer{keys: map[string][]string{"admin": {allTokens}, "key1": {"phc_one"}}}
+
+	tests := []struct {
+		name   string
+		auth   Authorizer
+		apiKey string
+		status int
+	}{
+		{name: "Admin", auth: auth, apiKey: "admin"},
+		{name: "Not admin", auth: auth, apiKey: "key1", status: http.StatusForbidden},
+		{name: "Unknown key", auth: auth, apiKey: "key2", status: http.StatusUnauthorized},
+		{name: "No key", auth: auth, status: http.StatusUnauthorized},
+		{name: "No authorizer", apiKey: "admin", status: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/events?token=*", nil)
+			if tt.apiKey != "" {
+				req.Header.Set(apiKeyHeader, tt.apiKey)
+			}
+			c := echo.New().NewContext(req, httptest.NewRecorder())
+
+			subscription, err := newSubscription(c, tt.auth)
+
+			if tt.status == 0 {
+				require.NoError(t, err)
+				assert.Empty(t, subscription.Token)
+				assert.False(t, subscription.Geo)
+				return
+			}
+			var httpErr *echo.HTTPError
+			require.ErrorAs(t, err, &httpErr)
+			assert.Equal(t, tt.status, httpErr.Code)
+		})
+	}
+}
+
+func TestAllTokensSubscriptionGetsEveryEvent(t *testing.T) {
+	auth := &fakeAuthorizer{keys: map[string][]string{"admin": {allTokens}}}
+	req := httptest.NewRequest(http.MethodGet, "/events?token=*", nil)
+	req.Header.Set(apiKeyHeader, "admin")
+	subscription, err := newSubscription(echo.New().NewContext(req, httptest.NewRecorder()), auth)
+	require.NoError(t, err)
+
+	subChan := make(chan Subscription)
+	inboundChan := make(chan PostHogEvent)
+	filter := NewFilter(subChan, make(chan Subscription), inboundChan)
+	go filter.Run()
+	defer close(inboundChan)
+
+	subChan <- subscription
+	inboundChan <- PostHogEvent{Uuid: "1", Token: "phc_one", Event: "$pageview"}
+	inboundChan <- PostHogEvent{Uuid: "2", Token: "phc_two", Event: "$pageview"}
+
+	assert.Equal(t, "1", (<-subscription.EventChan).(ResponsePostHogEvent).Uuid)
+	assert.Equal(t, "2", (<-subscription.EventChan).(ResponsePostHogEvent).Uuid)
+}
+
+func TestStaticAuthorizer(t *testing.T) {
+	auth, err := ParseStaticAuthorizer([]string{"key1:phc_one", " key1 : phc_two ", "admin:*"})
+	require.NoError(t, err)
+
+	assert.NoError(t, auth.Authorize(context.Background(), "key1", "phc_one"))
+	assert.NoError(t, auth.Authorize(context.Background(), "key1", "phc_two"))
+	assert.ErrorIs(t, auth.Authorize(context.Background(), "key1", "phc_three"), ErrForbidden)
+	assert.NoError(t, auth.Authorize(context.Background(), "admin", "phc_three"))
+	assert.NoError(t, auth.Authorize(context.Background(), "admin", allTokens))
+	assert.ErrorIs(t, auth.Authorize(context.Background(), "key1", allTokens), ErrForbidden)
+	assert.ErrorIs(t, auth.Authorize(context.Background(), "key2", "phc_one"), ErrUnauthenticated)
+}
+
+func TestParseStaticAuthorizerErrors(t *testing.T) {
+	for _, spec := range []string{"key1", ":phc_one", "key1:", "secret-key:not a token"} {
+		_, err := ParseStaticAuthorizer([]string{spec})
+		assert.Error(t, err, spec)
+		assert.NotContains(t, err.Error(), "secret-key", spec)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+const defaultSchemaRegistryTimeout = 5 * time.Second
+
+// schemaRegistryHeaderSize is the length of the Confluent wire format header:
+// a zero magic byte and the 4-byte big-endian schema ID.
+const schemaRegistryHeaderSize = 5
+
+var errNotSchemaRegistryFramed = errors.New("message lacks the schema registry header")
+
+// isSchemaRegistryFramed reports whether value starts with the Confluent wire
+// format header. Neither JSON nor protobuf messages can start with a zero
+// byte, so this tells them apart.
+func isSchemaRegistryFramed(value []byte) bool {
+	return len(value) >= schemaRegistryHeaderSize && value[0] == 0
+}
+
+// SchemaRegistry fetches Avro schemas by ID from a Confluent Schema Registry,
+// caching them as schemas never change once registered. Credentials can be
+// given in the URL, as user:password@host.
+type SchemaRegistry struct {
+	url    string
+	client *http.Client
+
+	mu     sync.Mutex
+	codecs map[uint32]*goavro.Codec
+}
+
+func NewSchemaRegistry(url string, timeout time.Duration) *SchemaRegistry {
+	if timeout <= 0 {
+		timeout = defaultSchemaRegistryTimeout
+	}
+	return &SchemaRegistry{
+		url:    strings.TrimSuffix(url, "/"),
+		client: &http.Client{Timeout: timeout},
+		codecs: make(map[uint32]*goavro.Codec),
+	}
+}
+
+// Codec returns the codec for the schema with id, fetching the schema the
+// first time. Failed fetches are not cached, so they are tried again with the
+// next message.
+func (r *SchemaRegistry) Codec(id uint32) (*goavro.Codec, error) {
+	r.mu.Lock()
+	codec, ok := r.codecs[id]
+	r.mu.Unlock()
+	if ok {
+		return codec, nil
+	}
+
+	schema, err := r.fetch(id)
+	if err != nil {
+		schemaRegistryFetches.WithLabelValues("failure").Inc()
+		return nil, fmt.Errorf("fetching schema %d: %w", id, err)
+	}
+	schemaRegistryFetches.WithLabelValues("success").Inc()
+	// Unions decode to their value rather than to {"type": value}, so the
+	// record reads like JSON.
+	codec, err = goavro.NewCodecForStandardJSONFull(schema)
+	if err != nil {
+		return nil, fmt.Errorf("parsing schema %d: %w", id, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.codecs[id] = codec
+	return codec, nil
+}
+
+func (r *SchemaRegistry) fetch(id uint32) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/schemas/ids/%d", r.url, id), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		// Drained so the connection can be reused.
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return "", fmt.Errorf("schema registry answered %s", resp.Status)
+	}
+
+	var body struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	// The type is left out for Avro, the registry's original format.
+	if body.SchemaType != "" && !strings.EqualFold(body.SchemaType, "AVRO") {
+		return "", fmt.Errorf("schema is %s, not Avro", body.SchemaType)
+	}
+	return body.Schema, nil
+}
+
+// AvroDecoder reads Avro records in the Confluent wire format, with their
+// schema looked up in Registry. A record is read like a JSON message with the
+// same fields: either a PostHogEventWrapper with the event as a JSON string in
+// data, or a bare event with its properties as a map.
+type AvroDecoder struct {
+	Registry *SchemaRegistry
+}
+
+func (d AvroDecoder) Decode(value []byte) (PostHogEventWrapper, PostHogEvent, error) {
+	empty := PostHogEvent{Properties: make(map[string]interface{})}
+	if !isSchemaRegistryFramed(value) {
+		return PostHogEventWrapper{}, empty, errNotSchemaRegistryFramed
+	}
+
+	id := binary.BigEndian.Uint32(value[1:schemaRegistryHeaderSize])
+	codec, err := d.Registry.Codec(id)
+	if err != nil {
+		return PostHogEventWrapper{}, empty, err
+	}
+	native, _, err := codec.NativeFromBinary(value[schemaRegistryHeaderSize:])
+	if err != nil {
+		return PostHogEventWrapper{}, empty, fmt.Errorf("decoding avro event: %w", err)
+	}
+	text, err := codec.TextualFromNative(nil, native)
+	if err != nil {
+		return PostHogEventWrapper{}, empty, fmt.Errorf("decoding avro event: %w", err)
+	}
+	return JSONDecoder{}.Decode(text)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/linkedin/goavro/v2"
+	"github.com/posthog/posthog/livestream/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const avroEventSchema = `{
+	"type": "record",
+	"name": "Event",
+	"fields": [
+		{"name": "uuid", "type": "string"},
+		{"name": "distinct_id", "type": "string"},
+		{"name": "ip", "type": ["null", "string"], "default": null},
+		{"name": "api_key", "type": "string"},
+		{"name": "event", "type": "string"},
+		{"name": "properties", "type": {"type": "map", "values": ["null", "string", "long", "double", "boolean"]}},
+		{"name": "timestamp", "type": "long"}
+	]
+}`
+
+const avroWrapperSchema = `{
+	"type": "record",
+	"name": "Wrapper",
+	"fields": [
+		{"name": "uuid", "type": "string"},
+		{"name": "distinct_id", "type": "string"},
+		{"name": "ip", "type": "string"},
+		{"name": "token", "type": "string"},
+		{"name": "data", "type": "string"}
+	]
+}`
+
+// newSchemaRegistryServer serves schemas by ID like Schema Registry, counting
+// the requests for each.
+func newSchemaRegistryServer(t *testing.T, schemas map[int]string) (*httptest.Server, *atomic.Int64) {
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		for id, schema := range schemas {
+			if r.URL.Path == fmt.Sprintf("/schemas/ids/%d", id) {
+				_ = json.NewEncoder(w).Encode(map[string]string{"schema": schema})
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"error_code": 40403, "message": "Schema not found"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// avroMessage encodes record in the Confluent wire format, as written with
+// the schema registered under id.
+func avroMessage(t *testing.T, id uint32, schema string, record map[string]interface{}) []byte {
+	t.Helper()
+	codec, err := goavro.NewCodec(schema)
+	require.NoError(t, err)
+	value := make([]byte, schemaRegistryHeaderSize)
+	binary.BigEndian.PutUint32(value[1:], id)
+	value, err = codec.BinaryFromNative(value, record)
+	require.NoError(t, err)
+	return value
+}
+
+func TestAvroDecoder(t *testing.T) {
+	server, requests := newSchemaRegistryServer(t, map[int]string{1: avroEventSchema, 2: avroWrapperSchema})
+	decoder := AvroDecoder{Registry: NewSchemaRegistry(server.URL+"/", time.Second)}
+
+	t.Run("Bare event", func(t *testing.T) {
+		value := avroMessage(t, 1, avroEventSchema, map[string]interface{}{
+			"uuid":        "avro-uuid",
+			"distinct_id": "user1",
+			"ip":          goavro.Union("string", "192.0.2.1"),
+			"api_key":     "avro-token",
+			"event":       "$pageview",
+			"properties": map[string]interface{}{
+				"$current_url": goavro.Union("string", "https://example.com"),
+				"count":        goavro.Union("long", int64(3)),
+				"unset":        nil,
+			},
+			"timestamp": int64(1714566600000),
+		})
+		require.Equal(t, []byte{0, 0, 0, 0, 1}, value[:schemaRegistryHeaderSize])
+
+		wrapper, phEvent, err := decoder.Decode(value)
+		require.NoError(t, err)
+		assert.Equal(t, "avro-uuid", wrapper.Uuid)
+		assert.Equal(t, "user1", wrapper.DistinctId)
+		assert.Equal(t, "192.0.2.1", wrapper.Ip)
+		assert.Equal(t, "avro-token", phEvent.Token)
+		assert.Equal(t, "$pageview", phEvent.Event)
+		assert.Equal(t, map[string]interface{}{"$current_url": "https://example.com", "count": float64(3), "unset": nil}, phEvent.Properties)
+		assert.Equal(t, time.UnixMilli(1714566600000).UTC(), phEvent.Timestamp)
+	})
+
+	t.Run("Wrapper", func(t *testing.T) {
+		value := avroMessage(t, 2, avroWrapperSchema, map[string]interface{}{
+			"uuid":        "wrapped-uuid",
+			"distinct_id": "user2",
+			"ip":          "192.0.2.2",
+			"token":       "wrapped-token",
+			"data":        `{"event": "$autocapture", "properties": {"tag": "button"}}`,
+		})
+
+		wrapper, phEvent, err := decoder.Decode(value)
+		require.NoError(t, err)
+		assert.Equal(t, "wrapped-uuid", wrapper.Uuid)
+		assert.Equal(t, "wrapped-token", wrapper.Token)
+		assert.Equal(t, "$autocapture", phEvent.Event)
+		assert.Equal(t, "button", phEvent.Properties["tag"])
+	})
+
+	// Each schema was fetched once, however often it is used.
+	before := requests.Load()
+	_, _, err := decoder.Decode(avroMessage(t, 2, avroWrapperSchema, map[string]interface{}{
+		"uuid": "1", "distinct_id": "", "ip": "", "token": "", "data": "{}",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, before, requests.Load())
+	assert.Equal(t, int64(2), requests.Load())
+}
+
+func TestAvroDecoderErrors(t *testing.T) {
+	server, requests := newSchemaRegistryServer(t, map[int]string{1: avroEventSchema})
+	decoder := AvroDecoder{Registry: NewSchemaRegistry(server.URL, time.Second)}
+
+	tests := []struct {
+		name     string
+		value    []byte
+		expected string
+	}{
+		{name: "JSON", value: []byte(`{"uuid": "1"}`), expected: "schema registry header"},
+		{name: "Too short", value: []byte{0, 0, 0}, expected: "schema registry header"},
+		{name: "Unknown schema", value: []byte{0, 0, 0, 0, 9, 2}, expected: "404 Not Found"},
+		{name: "Truncated record", value: []byte{0, 0, 0, 0, 1, 20, 'a'}, expected: "decoding avro event"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, phEvent, err := decoder.Decode(tt.value)
+			assert.ErrorContains(t, err, tt.expected)
+			assert.NotNil(t, phEvent.Properties)
+		})
+	}
+
+	// A failed fetch is tried again.
+	before := requests.Load()
+	_, _, err := decoder.Decode([]byte{0, 0, 0, 0, 9, 2})
+	assert.Error(t, err)
+	assert.Equal(t, before+1, requests.Load())
+}
+
+func TestSchemaRegistryRejectsOtherSchemaTypes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"schema": "syntax = \"proto3\";", "schemaType": "PROTOBUF"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	_, err := NewSchemaRegistry(server.URL, time.Second).Codec(1)
+	assert.ErrorContains(t, err, "not Avro")
+}
+
+func TestPostHogKafkaConsumer_AvroFraming(t *testing.T) {
+	server, _ := newSchemaRegistryServer(t, map[int]string{1: avroEventSchema})
+	mockGeoLocator := mocks.NewGeoLocator(t)
+	mockGeoLocator.On("Lookup", "192.0.2.1").Return(37.7749, -122.4194, nil).Once()
+	// JSON stays the configured encoding; framed messages are read as Avro.
+	consumer := &PostHogKafkaConsumer{
+		geolocator: mockGeoLocator,
+		Decoder:    JSONDecoder{},
+		Avro:       AvroDecoder{Registry: NewSchemaRegistry(server.URL, time.Second)},
+	}
+
+	phEvent := consumer.parseMessage(&kafka.Message{Value: avroMessage(t, 1, avroEventSchema, map[string]interface{}{
+		"uuid":        "avro-uuid",
+		"distinct_id": "user1",
+		"ip":          goavro.Union("string", "192.0.2.1"),
+		"api_key":     "avro-token",
+		"event":       "$pageview",
+		"properties":  map[string]interface{}{},
+		"timestamp":   int64(1714566600000),
+	})})
+	assert.Equal(t, "avro-uuid", phEvent.Uuid)
+	assert.Equal(t, "avro-token", phEvent.Token)
+	assert.Equal(t, 37.7749, phEvent.Lat)
+
+	phEvent = consumer.parseMessage(&kafka.Message{Value: []byte(`{"uuid": "json-uuid", "token": "json-token", "data": "{\"event\": \"$pageview\"}"}`)})
+	assert.Equal(t, "json-uuid", phEvent.Uuid)
+	assert.Equal(t, "json-token", phEvent.Token)
+	assert.Equal(t, "$pageview", phEvent.Event)
+}
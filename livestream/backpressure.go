@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// BackpressurePolicy decides what the consumer does when a downstream channel
+// is full.
+type BackpressurePolicy int
+
+const (
+	// Block waits for room, stalling the consumer until the reader catches up.
+	Block BackpressurePolicy = iota
+	// DropNewest discards the event being sent.
+	DropNewest
+	// DropOldest discards the oldest buffered event to make room for the new
+	// one. On an unbuffered channel it behaves like DropNewest.
+	DropOldest
+)
+
+func (p BackpressurePolicy) String() string {
+	switch p {
+	case Block:
+		return "block"
+	case DropNewest:
+		return "drop_newest"
+	case DropOldest:
+		return "drop_oldest"
+	}
+	return fmt.Sprintf("BackpressurePolicy(%d)", int(p))
+}
+
+// ParseBackpressurePolicy parses the kafka.backpressure config value.
+func ParseBackpressurePolicy(s string) (BackpressurePolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "block":
+		return Block, nil
+	case "drop_newest":
+		return DropNewest, nil
+	case "drop_oldest":
+		return DropOldest, nil
+	}
+	return Block, fmt.Errorf("unknown backpressure policy %q", s)
+}
+
+// send puts v on ch according to policy. It reports whether v went on the
+// channel, and returns any older values evicted to make room for it. Only
+// Block waits, and only it can fail, when ctx is cancelled first.
+func send[T any](ctx context.Context, policy BackpressurePolicy, ch chan T, v T) (sent bool, evicted []T, err error) {
+	switch policy {
+	case DropNewest:
+		select {
+		case ch <- v:
+			return true, nil, nil
+		default:
+			return false, nil, nil
+		}
+
+	case DropOldest:
+		select {
+		case ch <- v:
+			return true, nil, nil
+		default:
+		}
+
+		select {
+		case old := <-ch:
+			evicted = append(evicted, old)
+		default:
+		}
+		select {
+		case ch <- v:
+			return true, evicted, nil
+		default:
+			return false, evicted, nil
+		}
+
+	default:
+		// A channel with room always takes v, even once ctx is cancelled;
+		// a select on both would pick either at random.
+		select {
+		case ch <- v:
+			return true, nil, nil
+		default:
+		}
+
+		select {
+		case ch <- v:
+			return true, nil, nil
+		case <-ctx.Done():
+			return false, nil, ctx.Err()
+		}
+	}
+}
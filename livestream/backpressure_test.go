@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBackpressurePolicy(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected BackpressurePolicy
+		wantErr  bool
+	}{
+		{input: "", expected: Block},
+		{input: "block", expected: Block},
+		{input: "drop_newest", expected: DropNewest},
+		{input: " DROP_OLDEST ", expected: DropOldest},
+		{input: "drop_everything", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			policy, err := ParseBackpressurePolicy(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, policy)
+		})
+	}
+}
+
+func TestSendFullChannel(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       BackpressurePolicy
+		wantSent     bool
+		wantEvicted  []int
+		wantBuffered []int
+	}{
+		{name: "DropNewest", policy: DropNewest, wantSent: false, wantEvicted: nil, wantBuffered: []int{1, 2}},
+		{name: "DropOldest", policy: DropOldest, wantSent: true, wantEvicted: []int{1}, wantBuffered: []int{2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := make(chan int, 2)
+			ch <- 1
+			ch <- 2
+
+			sent, evicted, err := send(context.Background(), tt.policy, ch, 3)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantSent, sent)
+			assert.Equal(t, tt.wantEvicted, evicted)
+
+			close(ch)
+			buffered := []int{}
+			for v := range ch {
+				buffered = append(buffered, v)
+			}
+			assert.Equal(t, tt.wantBuffered, buffered)
+		})
+	}
+}
+
+func TestSendFullChannelBlock(t *testing.T) {
+	ch := make(chan int, 1)
+	ch <- 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, _, err := send(ctx, Block, ch, 2)
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("send returned while the channel was full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Equal(t, 1, <-ch)
+	require.NoError(t, <-done)
+	assert.Equal(t, 2, <-ch)
+
+	ch <- 3
+	go func() {
+		_, _, err := send(ctx, Block, ch, 4)
+		done <- err
+	}()
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestSendBlockPrefersRoomOverCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for i := 0; i < 100; i++ {
+		ch := make(chan int, 1)
+		sent, _, err := send(ctx, Block, ch, i)
+		require.NoError(t, err)
+		assert.True(t, sent)
+	}
+}
+
+func TestSendUnbufferedDropOldest(t *testing.T) {
+	ch := make(chan int)
+
+	sent, evicted, err := send(context.Background(), DropOldest, ch, 1)
+	require.NoError(t, err)
+	assert.False(t, sent)
+	assert.Empty(t, evicted)
+}
+
+func TestPostHogKafkaConsumer_DeliverCountsDrops(t *testing.T) {
+	for _, policy := range []BackpressurePolicy{DropNewest, DropOldest} {
+		t.Run(policy.String(), func(t *testing.T) {
+			consumer := &PostHogKafkaConsumer{
+				outgoingChan: make(chan PostHogEvent, 1),
+				statsChan:    make(chan PostHogEvent, 10),
+				Backpressure: policy,
+			}
+
+			for _, event := range []string{"first", "second", "third"} {
+				require.NoError(t, consumer.deliver(context.Background(), PostHogEvent{Event: event}))
+			}
+
+			assert.Equal(t, int64(2), consumer.Dropped())
+			assert.Len(t, consumer.statsChan, 3)
+			expected := map[BackpressurePolicy]string{DropNewest: "first", DropOldest: "third"}[policy]
+			assert.Equal(t, expected, (<-consumer.outgoingChan).Event)
+		})
+	}
+}
+
+func TestPostHogKafkaConsumer_DeliverFullStatsDoesNotHoldBackOutgoing(t *testing.T) {
+	for _, policy := range []BackpressurePolicy{Block, DropNewest, DropOldest} {
+		t.Run(policy.String(), func(t *testing.T) {
+			consumer := &PostHogKafkaConsumer{
+				outgoingChan:      make(chan PostHogEvent, 1),
+				statsChan:         make(chan PostHogEvent, 1),
+				StatsBackpressure: policy,
+			}
+			consumer.statsChan <- PostHogEvent{Event: "stale"}
+
+			delivered := make(chan error, 1)
+			go func() {
+				delivered <- consumer.deliver(context.Background(), PostHogEvent{Event: "live"})
+			}()
+
+			select {
+			case event := <-consumer.outgoingChan:
+				assert.Equal(t, "live", event.Event)
+			case <-time.After(time.Second):
+				t.Fatal("outgoingChan did not receive the event while statsChan was full")
+			}
+
+			if policy == Block {
+				// Still waiting for statsChan, which then gets the event too.
+				assert.Equal(t, "stale", (<-consumer.statsChan).Event)
+				assert.Equal(t, "live", (<-consumer.statsChan).Event)
+			}
+			require.NoError(t, <-delivered)
+		})
+	}
+}
+
+func TestPostHogKafkaConsumer_DeliverFullOutgoingDoesNotHoldBackStats(t *testing.T) {
+	consumer := &PostHogKafkaConsumer{
+		outgoingChan: make(chan PostHogEvent),
+		statsChan:    make(chan PostHogEvent),
+	}
+
+	delivered := make(chan error, 1)
+	go func() {
+		delivered <- consumer.deliver(context.Background(), PostHogEvent{Event: "live"})
+	}()
+
+	// Both block; stats is read first and must not wait for outgoing.
+	select {
+	case event := <-consumer.statsChan:
+		assert.Equal(t, "live", event.Event)
+	case <-time.After(time.Second):
+		t.Fatal("statsChan did not receive the event while outgoingChan was full")
+	}
+	assert.Equal(t, "live", (<-consumer.outgoingChan).Event)
+	require.NoError(t, <-delivered)
+}
+
+func TestPostHogKafkaConsumer_DeliverBlockedCancelled(t *testing.T) {
+	consumer := &PostHogKafkaConsumer{
+		outgoingChan: make(chan PostHogEvent, 1),
+		statsChan:    make(chan PostHogEvent),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := consumer.deliver(ctx, PostHogEvent{Event: "live"})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Len(t, consumer.outgoingChan, 1)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// batchedPart marks, in Opaque, the messages splitMessage made for every
+// event of a batched message but the last, so they aren't committed before
+// the rest of the batch is delivered.
+type batchedPart struct{}
+
+// splitMessage returns the messages a producer batched into msg, one per
+// event, for when the value is a JSON array of events or holds one event per
+// line. They share msg's topic, partition and offset. Anything else,
+// including a message that fails to decode as either, is returned as it is,
+// for parseMessage to decode or dead-letter. So is an empty array, which
+// holds no event to deliver.
+func (c *PostHogKafkaConsumer) splitMessage(msg *kafka.Message) []*kafka.Message {
+	if c.oversized(msg) {
+		return []*kafka.Message{msg}
+	}
+	if _, isJSON := c.decoderFor(msg).(JSONDecoder); !isJSON {
+		return []*kafka.Message{msg}
+	}
+
+	values := splitJSONValues(msg.Value)
+	if len(values) == 0 {
+		return []*kafka.Message{msg}
+	}
+	batchedMessages.Inc()
+	parts := make([]*kafka.Message, len(values))
+	for i, value := range values {
+		part := *msg
+		part.Value = value
+		if i < len(values)-1 {
+			part.Opaque = batchedPart{}
+		}
+		parts[i] = &part
+	}
+	return parts
+}
+
+// splitJSONValues returns the elements of value when it is a JSON array, and
+// its lines when it holds more than one JSON value, one per line. It returns
+// nil otherwise, which is what it returns for a single event.
+func splitJSONValues(value []byte) []json.RawMessage {
+	trimmed := bytes.TrimSpace(value)
+	switch {
+	case len(trimmed) == 0:
+		return nil
+	case trimmed[0] == '[':
+		var elements []json.RawMessage
+		if err := json.Unmarshal(trimmed, &elements); err != nil {
+			return nil
+		}
+		return elements
+	case bytes.IndexByte(trimmed, '\n') < 0:
+		// Most messages are a single compact event, which this skips a
+		// second pass over.
+		return nil
+	}
+
+	var values []json.RawMessage
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	for {
+		var value json.RawMessage
+		err := decoder.Decode(&value)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil
+		}
+		values = append(values, value)
+	}
+	if len(values) < 2 {
+		// A single event spread over several lines.
+		return nil
+	}
+	return values
+}
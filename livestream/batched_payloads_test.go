@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/posthog/posthog/livestream/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitJSONValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected []string
+	}{
+		{name: "Object", value: `{"uuid": "1"}`},
+		{name: "Pretty-printed object", value: "{\n  \"uuid\": \"1\"\n}\n"},
+		{name: "Array", value: ` [{"uuid": "1"}, {"uuid": "2"}] `, expected: []string{`{"uuid": "1"}`, `{"uuid": "2"}`}},
+		{name: "Array of one", value: `[{"uuid": "1"}]`, expected: []string{`{"uuid": "1"}`}},
+		{name: "Empty array", value: `[]`, expected: []string{}},
+		{name: "Lines", value: "{\"uuid\": \"1\"}\n{\"uuid\": \"2\"}\n", expected: []string{`{"uuid": "1"}`, `{"uuid": "2"}`}},
+		{name: "Broken array", value: `[{"uuid": "1"}`},
+		{name: "Broken line", value: "{\"uuid\": \"1\"}\n{\"uuid\": "},
+		{name: "Empty", value: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := splitJSONValues([]byte(tt.value))
+			if tt.expected == nil {
+				assert.Nil(t, values)
+				return
+			}
+			actual := make([]string, len(values))
+			for i, value := range values {
+				actual[i] = string(value)
+			}
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
+
+func TestPostHogKafkaConsumer_BatchedPayloads(t *testing.T) {
+	event := func(uuid, token, ip string) map[string]string {
+		return map[string]string{"uuid": uuid, "token": token, "ip": ip, "data": `{"event": "$pageview"}`}
+	}
+	marshal := func(v interface{}) []byte {
+		value, err := json.Marshal(v)
+		require.NoError(t, err)
+		return value
+	}
+	var lines []byte
+	for _, e := range []map[string]string{event("5", "test-token", "192.0.2.1"), event("6", "test-token", "192.0.2.1")} {
+		lines = append(append(lines, marshal(e)...), '\n')
+	}
+
+	tests := []struct {
+		name     string
+		value    []byte
+		expected []string
+	}{
+		{name: "Single object", value: marshal(event("1", "test-token", "192.0.2.1")), expected: []string{"1"}},
+		{
+			name: "Array",
+			// Each element is checked on its own: the one without a token
+			// is dropped, the others geolocated.
+			value:    marshal([]map[string]string{event("2", "test-token", "192.0.2.1"), event("3", "", "192.0.2.1"), event("4", "other-token", "192.0.2.1")}),
+			expected: []string{"2", "4"},
+		},
+		{name: "Lines", value: lines, expected: []string{"5", "6"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockGeoLocator := new(mocks.GeoLocator)
+			mockGeoLocator.On("Lookup", "192.0.2.1").Return(37.7749, -122.4194, nil)
+			mockConsumer := mocks.NewKafkaConsumerInterface(t)
+			outgoingChan := make(chan PostHogEvent, 10)
+			consumer := &PostHogKafkaConsumer{
+				consumer:     mockConsumer,
+				topics:       []string{"test-topic"},
+				geolocator:   mockGeoLocator,
+				outgoingChan: outgoingChan,
+				statsChan:    make(chan PostHogEvent, 10),
+			}
+
+			topic := "test-topic"
+			msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 1, Offset: 7}, Value: tt.value}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.Anything).Return(nil)
+			mockConsumer.On("ReadMessage", mock.Anything).Return(msg, nil).Once()
+			mockConsumer.On("ReadMessage", mock.Anything).Run(func(mock.Arguments) { cancel() }).Return(nil, kafka.NewError(kafka.ErrTimedOut, "timed out", false))
+			// Committed once, after the last event of the message.
+			mockConsumer.On("CommitMessage", mock.MatchedBy(func(m *kafka.Message) bool {
+				return m.TopicPartition.Offset == 7 && m.Opaque == nil
+			})).Return(nil, nil).Once()
+			mockConsumer.On("Close").Return(nil)
+
+			require.NoError(t, consumer.Consume(ctx))
+
+			var uuids []string
+			for phEvent := range outgoingChan {
+				uuids = append(uuids, phEvent.Uuid)
+				assert.Equal(t, int64(7), phEvent.Offset)
+				assert.Equal(t, 37.7749, phEvent.Lat)
+			}
+			assert.Equal(t, tt.expected, uuids)
+		})
+	}
+}
+
+func TestPostHogKafkaConsumer_BatchedPayloadsProtobuf(t *testing.T) {
+	consumer := &PostHogKafkaConsumer{Decoder: ProtobufDecoder{}}
+	msg := &kafka.Message{Value: []byte(`[{"uuid": "1"}, {"uuid": "2"}]`)}
+
+	assert.Equal(t, []*kafka.Message{msg}, consumer.splitMessage(msg))
+}
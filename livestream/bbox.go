@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// bboxParams are the query params of a bounding box, in the order they are
+// validated.
+var bboxParams = []string{"minLat", "minLng", "maxLat", "maxLng"}
+
+// BoundingBox limits a subscription to events located inside it, boundary
+// included.
+type BoundingBox struct {
+	MinLat, MinLng float64
+	MaxLat, MaxLng float64
+	// IncludeMissing also lets through events without coordinates.
+	IncludeMissing bool
+}
+
+// parseBoundingBox builds a box from the minLat, minLng, maxLat and maxLng
+// values, keyed by param name. It returns nil if none of them are set.
+func parseBoundingBox(values map[string]string) (*BoundingBox, error) {
+	var set int
+	coords := make([]float64, len(bboxParams))
+	var errs []error
+	for i, param := range bboxParams {
+		raw := strings.TrimSpace(values[param])
+		if raw == "" {
+			continue
+		}
+		set++
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s must be a number, got %q", param, raw))
+			continue
+		}
+		coords[i] = v
+	}
+	if set == 0 && len(errs) == 0 {
+		return nil, nil
+	}
+	if set != len(bboxParams) {
+		errs = append(errs, fmt.Errorf("a bounding box needs all of %s", strings.Join(bboxParams, ", ")))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	box := &BoundingBox{MinLat: coords[0], MinLng: coords[1], MaxLat: coords[2], MaxLng: coords[3]}
+	if err := box.validate(); err != nil {
+		return nil, err
+	}
+	return box, nil
+}
+
+func (b *BoundingBox) validate() error {
+	var errs []error
+	for _, lat := range []float64{b.MinLat, b.MaxLat} {
+		if lat < -90 || lat > 90 {
+			errs = append(errs, fmt.Errorf("latitude %v is outside -90..90", lat))
+		}
+	}
+	for _, lng := range []float64{b.MinLng, b.MaxLng} {
+		if lng < -180 || lng > 180 {
+			errs = append(errs, fmt.Errorf("longitude %v is outside -180..180", lng))
+		}
+	}
+	if b.MinLat > b.MaxLat {
+		errs = append(errs, fmt.Errorf("minLat %v is greater than maxLat %v", b.MinLat, b.MaxLat))
+	}
+	if b.MinLng > b.MaxLng {
+		errs = append(errs, fmt.Errorf("minLng %v is greater than maxLng %v", b.MinLng, b.MaxLng))
+	}
+	return errors.Join(errs...)
+}
+
+// Contains reports whether the event's location is inside the box. Events
+// that were never geolocated, with both coordinates zero, only match when
+// IncludeMissing is set.
+func (b *BoundingBox) Contains(event PostHogEvent) bool {
+	if event.Lat == 0 && event.Lng == 0 {
+		return b.IncludeMissing
+	}
+	return event.Lat >= b.MinLat && event.Lat <= b.MaxLat &&
+		event.Lng >= b.MinLng && event.Lng <= b.MaxLng
+}
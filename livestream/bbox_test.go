@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBoundingBox(t *testing.T) {
+	box, err := parseBoundingBox(map[string]string{"minLat": "51.2", "minLng": "-0.6", "maxLat": " 51.7", "maxLng": "0.3"})
+	require.NoError(t, err)
+	assert.Equal(t, &BoundingBox{MinLat: 51.2, MinLng: -0.6, MaxLat: 51.7, MaxLng: 0.3}, box)
+
+	box, err = parseBoundingBox(map[string]string{})
+	assert.NoError(t, err)
+	assert.Nil(t, box)
+}
+
+func TestParseBoundingBoxErrors(t *testing.T) {
+	for name, values := range map[string]map[string]string{
+		"Partial":        {"minLat": "1", "minLng": "1"},
+		"Not a number":   {"minLat": "north", "minLng": "1", "maxLat": "2", "maxLng": "2"},
+		"Latitude":       {"minLat": "-91", "minLng": "1", "maxLat": "2", "maxLng": "2"},
+		"Longitude":      {"minLat": "1", "minLng": "1", "maxLat": "2", "maxLng": "181"},
+		"Inverted lat":   {"minLat": "3", "minLng": "1", "maxLat": "2", "maxLng": "2"},
+		"Inverted lng":   {"minLat": "1", "minLng": "3", "maxLat": "2", "maxLng": "2"},
+		"Bad lone param": {"minLat": "x"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			box, err := parseBoundingBox(values)
+			assert.Error(t, err)
+			assert.Nil(t, box)
+		})
+	}
+}
+
+func TestBoundingBoxContains(t *testing.T) {
+	box := &BoundingBox{MinLat: 10, MinLng: -20, MaxLat: 30, MaxLng: 40}
+
+	tests := []struct {
+		name     string
+		lat, lng float64
+		expected bool
+	}{
+		{name: "Inside", lat: 20, lng: 0, expected: true},
+		{name: "North", lat: 30.01, lng: 0},
+		{name: "South", lat: 9.99, lng: 0},
+		{name: "East", lat: 20, lng: 40.01},
+		{name: "West", lat: 20, lng: -20.01},
+		{name: "Min corner", lat: 10, lng: -20, expected: true},
+		{name: "Max corner", lat: 30, lng: 40, expected: true},
+		{name: "Edge", lat: 30, lng: 5, expected: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, box.Contains(PostHogEvent{Lat: tt.lat, Lng: tt.lng}))
+		})
+	}
+}
+
+func TestBoundingBoxMissingCoordinates(t *testing.T) {
+	// The box contains 0,0, but an event without coordinates is not there.
+	box := &BoundingBox{MinLat: -10, MinLng: -10, MaxLat: 10, MaxLng: 10}
+	assert.False(t, box.Contains(PostHogEvent{}))
+
+	box.IncludeMissing = true
+	assert.True(t, box.Contains(PostHogEvent{}))
+	assert.False(t, box.Contains(PostHogEvent{Lat: 50, Lng: 50}))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// maxErrorSignatures bounds how many distinct error messages ErrorReporter
+// remembers.
+const maxErrorSignatures = 1000
+
+// ErrorReporter sends each distinct error message to Sentry at most once per
+// Interval, with the number of occurrences it stands for.
+type ErrorReporter struct {
+	Interval time.Duration
+	// Disabled drops every error, for deployments that opted out of Sentry.
+	Disabled bool
+
+	clock Clock
+	send  func(err error, occurrences int)
+
+	mu   sync.Mutex
+	seen map[string]*errorSignature
+}
+
+type errorSignature struct {
+	lastSent time.Time
+	// suppressed counts the occurrences since lastSent that were not sent.
+	suppressed int
+}
+
+func NewErrorReporter(interval time.Duration) *ErrorReporter {
+	return &ErrorReporter{
+		Interval: interval,
+		clock:    realClock{},
+		send:     sendToSentry,
+		seen:     make(map[string]*errorSignature),
+	}
+}
+
+// reporter is shared by everything that reports errors; see captureException.
+var reporter = NewErrorReporter(time.Minute)
+
+// captureException reports err to Sentry, collapsing repeats of the same
+// message. Use it instead of sentry.CaptureException.
+func captureException(err error) {
+	reporter.Capture(err)
+}
+
+func (r *ErrorReporter) Capture(err error) {
+	if err == nil || r.Disabled {
+		return
+	}
+
+	r.mu.Lock()
+	now := r.clock.Now()
+	key := err.Error()
+	sig, ok := r.seen[key]
+	if ok && now.Sub(sig.lastSent) < r.Interval {
+		sig.suppressed++
+		r.mu.Unlock()
+		return
+	}
+	if !ok {
+		if len(r.seen) >= maxErrorSignatures {
+			r.forget(now)
+		}
+		sig = &errorSignature{}
+		r.seen[key] = sig
+	}
+	occurrences := sig.suppressed + 1
+	sig.lastSent = now
+	sig.suppressed = 0
+	r.mu.Unlock()
+
+	r.send(err, occurrences)
+}
+
+// forget drops signatures whose interval has passed.
+func (r *ErrorReporter) forget(now time.Time) {
+	for key, sig := range r.seen {
+		if now.Sub(sig.lastSent) >= r.Interval {
+			delete(r.seen, key)
+		}
+	}
+}
+
+func sendToSentry(err error, occurrences int) {
+	sentry.WithScope(func(scope *sentry.Scope) {
+		scope.SetExtra("occurrences", occurrences)
+		sentry.CaptureException(err)
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sentErrors struct {
+	messages    []string
+	occurrences []int
+}
+
+func (s *sentErrors) send(err error, occurrences int) {
+	s.messages = append(s.messages, err.Error())
+	s.occurrences = append(s.occurrences, occurrences)
+}
+
+func TestErrorReporterDedupes(t *testing.T) {
+	sent := &sentErrors{}
+	clock := newFakeClock()
+	r := NewErrorReporter(time.Minute)
+	r.clock = clock
+	r.send = sent.send
+
+	for i := 0; i < 1000; i++ {
+		r.Capture(errors.New("all brokers down"))
+		clock.Advance(10 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"all brokers down"}, sent.messages)
+	assert.Equal(t, []int{1}, sent.occurrences)
+
+	// Once the interval has passed the next one goes out with the count of
+	// everything suppressed in between.
+	clock.Advance(time.Minute)
+	r.Capture(errors.New("all brokers down"))
+	assert.Equal(t, []string{"all brokers down", "all brokers down"}, sent.messages)
+	assert.Equal(t, []int{1, 1000}, sent.occurrences)
+}
+
+func TestErrorReporterKeysByMessage(t *testing.T) {
+	sent := &sentErrors{}
+	r := NewErrorReporter(time.Minute)
+	r.clock = newFakeClock()
+	r.send = sent.send
+
+	r.Capture(errors.New("all brokers down"))
+	r.Capture(errors.New("unknown topic"))
+	r.Capture(errors.New("all brokers down"))
+	r.Capture(nil)
+
+	assert.Equal(t, []string{"all brokers down", "unknown topic"}, sent.messages)
+}
+
+func TestErrorReporterForgetsOldSignatures(t *testing.T) {
+	sent := &sentErrors{}
+	clock := newFakeClock()
+	r := NewErrorReporter(time.Minute)
+	r.clock = clock
+	r.send = sent.send
+
+	for i := 0; i < maxErrorSignatures; i++ {
+		r.Capture(fmt.Errorf("error %d", i))
+	}
+	clock.Advance(time.Minute)
+	r.Capture(errors.New("one more"))
+
+	assert.Len(t, sent.messages, maxErrorSignatures+1)
+	assert.Len(t, r.seen, 1)
+}
+
+func TestErrorReporterDisabled(t *testing.T) {
+	sent := &sentErrors{}
+	r := NewErrorReporter(time.Minute)
+	r.clock = newFakeClock()
+	r.send = sent.send
+	r.Disabled = true
+
+	r.Capture(errors.New("all brokers down"))
+	r.Capture(fmt.Errorf("wrapped: %w", errors.New("unknown topic")))
+
+	assert.Empty(t, sent.messages)
+}
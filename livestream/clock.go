@@ -0,0 +1,20 @@
+package main
+
+import "time"
+
+// Clock abstracts the passage of time so that code which waits or buckets by
+// time can be tested without sleeping.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
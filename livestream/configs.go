@@ -1,36 +1,633 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/getsentry/sentry-go"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"golang.org/x/exp/slices"
 )
 
-func loadConfigs() {
+// Config holds the settings that must be valid before anything starts. Every
+// key can come from configs/configs.yml, from a LIVESTREAM_ environment
+// variable, e.g. LIVESTREAM_KAFKA_BROKERS for kafka.brokers, or from a
+// command line flag such as --brokers; see flags.go.
+type Config struct {
+	Prod              bool
+	Brokers           string
+	SecurityProtocol  string
+	SASL              SASLConfig
+	TLS               TLSConfig
+	Offsets           OffsetConfig
+	GroupID           string
+	Topics            []string
+	EventsFile        string
+	EventsRealtime    bool
+	MMDBPath          string
+	MMDBFallbackPath  string
+	ChannelBuffer     int
+	StatsBuffer       int
+	Backpressure      BackpressurePolicy
+	StatsBackpressure BackpressurePolicy
+	Tokens            *TokenNormalizer
+	Sampler           *TokenSampler
+	DistinctIds       *DistinctIdHasher
+	Decoder           Decoder
+	// Avro decodes messages framed for Schema Registry, whatever Decoder is.
+	// Nil without kafka.schema_registry.url.
+	Avro          Decoder
+	Transform     *PropertyTransform
+	ListenAddress string
+	LogLevel      slog.Level
+	LogFormat     string
+	Pprof         PprofConfig
+	CORS          CORSConfig
+	Authorizer    Authorizer
+	Consumer      ConsumerConfig
+	GeoIP         GeoIPConfig
+	Stream        StreamConfig
+	Sinks         SinkConfig
+	HLLPrecision  int
+	// ActiveTokenTTL, MaxActiveTokens and PinnedTokens configure
+	// ActiveTokens.
+	ActiveTokenTTL      time.Duration
+	MaxActiveTokens     int
+	PinnedTokens        []string
+	ChannelFillInterval time.Duration
+	ShutdownGracePeriod time.Duration
+}
+
+// StreamConfig holds the stream.* settings for /events and /ws clients.
+type StreamConfig struct {
+	MaxConnections         int
+	MaxConnectionsPerIP    int
+	MaxConnectionsPerToken int
+	MaxEventsPerSecond     float64
+	// TrustedProxies may set X-Forwarded-For. Nil trusts no one.
+	TrustedProxies      []*net.IPNet
+	PropertyAllowlist   []string
+	PropertyDenylist    []string
+	GeohashPrecision    int
+	HideCoordinates     bool
+	IncludePartitionKey bool
+	IncludeRaw          bool
+	SSEHeartbeat        time.Duration
+	ReplaySize          int
+	ReplayTTL           time.Duration
+	ReplayMaxParked     int
+}
+
+var (
+	kafkaSecurityProtocols = []string{"PLAINTEXT", "SSL", "SASL_PLAINTEXT", "SASL_SSL"}
+	kafkaSASLMechanisms    = []string{"PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512"}
+	kafkaSSLEndpointChecks = []string{"https", "none"}
+	kafkaOffsetResets      = []string{"earliest", "latest", "error"}
+	ipListPicks            = []string{"leftmost", "rightmost"}
+)
+
+// loadConfigs reads the config file, environment and command line flags in
+// args into the global viper. Flags win over the environment, which wins
+// over the file.
+func loadConfigs(args []string) {
 	viper.SetConfigName("configs")
 	viper.AddConfigPath("configs/")
 
-	viper.SetDefault("kafka.group_id", "livestream")
-	viper.SetDefault("prod", false)
+	setDefaults(viper.GetViper())
 
 	err := viper.ReadInConfig()
-	if err != nil {
-		sentry.CaptureException(err)
+	var notFound viper.ConfigFileNotFoundError
+	switch {
+	case errors.As(err, &notFound):
+		// Fine when everything is set through the environment.
+		log.Println("No config file found, using defaults and environment")
+	case err != nil:
+		captureException(err)
 		log.Fatalf("fatal error config file: %v", err)
+	default:
+		viper.OnConfigChange(func(e fsnotify.Event) {
+			fmt.Println("Config file changed:", e.Name)
+		})
+		viper.WatchConfig()
 	}
 
-	viper.OnConfigChange(func(e fsnotify.Event) {
-		fmt.Println("Config file changed:", e.Name)
-	})
-	viper.WatchConfig()
+	bindEnv(viper.GetViper())
+
+	flags := newFlagSet(os.Args[0])
+	if err := bindFlags(viper.GetViper(), flags, args); err != nil {
+		// --help has already printed the usage.
+		if errors.Is(err, pflag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		flags.Usage()
+		os.Exit(2)
+	}
+}
 
-	viper.SetEnvPrefix("livestream") // will be uppercased automatically
+func setDefaults(v *viper.Viper) {
+	v.SetDefault("listen", ":8080")
+	v.SetDefault("log.level", "info")
+	v.SetDefault("log.format", "text")
+	v.SetDefault("kafka.group_id", "livestream")
+	v.SetDefault("kafka.auto_offset_reset", "latest")
+	v.SetDefault("kafka.enable_auto_commit", false)
+	v.SetDefault("kafka.commit_every", 100)
+	v.SetDefault("kafka.max_retries", 10)
+	v.SetDefault("kafka.backoff_cap", "30s")
+	v.SetDefault("kafka.batch_size", 0)
+	v.SetDefault("kafka.batch_flush_interval", "100ms")
+	v.SetDefault("kafka.lag_interval", "15s")
+	v.SetDefault("kafka.backpressure", "block")
+	v.SetDefault("kafka.channel_buffer", 0)
+	v.SetDefault("kafka.workers", 1)
+	v.SetDefault("kafka.geo_workers", 1)
+	v.SetDefault("kafka.max_event_age", "0s")
+	v.SetDefault("kafka.max_message_bytes", 0)
+	v.SetDefault("kafka.ip_properties", defaultIPProperties)
+	v.SetDefault("kafka.ip_list_pick", "leftmost")
+	v.SetDefault("kafka.fold_property_keys", false)
+	v.SetDefault("kafka.keep_raw", false)
+	v.SetDefault("kafka.transform", "")
+	v.SetDefault("kafka.dedupe.window", "0s")
+	v.SetDefault("kafka.dedupe.max_size", defaultDedupeMaxSize)
+	v.SetDefault("kafka.read_timeout", "500ms")
+	v.SetDefault("kafka.decode_errors.threshold", 0.0)
+	v.SetDefault("kafka.decode_errors.window", defaultDecodeErrorWindow.String())
+	v.SetDefault("kafka.decode_errors.min_messages", defaultDecodeErrorMinMessages)
+	v.SetDefault("kafka.events_file_realtime", false)
+	v.SetDefault("kafka.idle_after_timeouts", 120)
+	v.SetDefault("kafka.encoding", "json")
+	v.SetDefault("kafka.schema_registry.timeout", defaultSchemaRegistryTimeout.String())
+	v.SetDefault("kafka.no_token_sink", "")
+	v.SetDefault("kafka.token.lowercase", false)
+	v.SetDefault("kafka.token.max_length", maxTokenLength)
+	v.SetDefault("kafka.token.pattern", tokenPattern.String())
+	v.SetDefault("kafka.token.deep_scan", false)
+	v.SetDefault("mmdb.cache_size", 10000)
+	v.SetDefault("mmdb.retries", defaultGeoRetries)
+	v.SetDefault("mmdb.retry_backoff", defaultGeoRetryBackoff)
+	v.SetDefault("require_geoip", true)
+	v.SetDefault("stream.max_connections", 0)
+	v.SetDefault("stream.max_connections_per_ip", 20)
+	v.SetDefault("stream.max_connections_per_token", 0)
+	v.SetDefault("stream.max_events_per_second", 0)
+	v.SetDefault("stream.trusted_proxies", []string{})
+	v.SetDefault("stream.property_allowlist", []string{})
+	v.SetDefault("stream.sampling", []string{})
+	v.SetDefault("stream.api_keys", []string{})
+	v.SetDefault("stream.property_denylist", defaultDeniedProperties)
+	v.SetDefault("stream.geohash_precision", 0)
+	v.SetDefault("stream.hide_coordinates", false)
+	v.SetDefault("stream.include_partition_key", false)
+	v.SetDefault("stream.include_raw", false)
+	v.SetDefault("stream.anonymize_distinct_id", false)
+	v.SetDefault("stream.distinct_id_hash", "sha256")
+	v.SetDefault("stream.sse_heartbeat_interval", "15s")
+	v.SetDefault("stream.sse_replay_size", 50)
+	v.SetDefault("stream.sse_replay_ttl", "30s")
+	v.SetDefault("stream.sse_replay_max_parked", 1000)
+	v.SetDefault("stats.hll_precision", 10)
+	v.SetDefault("tokens.active_ttl", "60s")
+	v.SetDefault("tokens.max_active", defaultMaxActiveTokens)
+	v.SetDefault("tokens.pinned", []string{})
+	v.SetDefault("sentry.enabled", true)
+	v.SetDefault("sentry.traces_sample_rate", 0.0)
+	v.SetDefault("sentry.dedupe_interval", "1m")
+	v.SetDefault("sink.jsonl", "")
+	v.SetDefault("sink.flush_interval", "1s")
+	v.SetDefault("shutdown.grace_period", "10s")
+	v.SetDefault("sink.buffer", sinkBuffer)
+	v.SetDefault("sink.webhook.url", "")
+	v.SetDefault("sink.webhook.batch_size", defaultWebhookBatchSize)
+	v.SetDefault("sink.webhook.flush_interval", "1s")
+	v.SetDefault("sink.webhook.timeout", defaultWebhookTimeout.String())
+	v.SetDefault("sink.webhook.max_retries", defaultWebhookMaxRetries)
+	v.SetDefault("sink.webhook.dead_letter", "")
+	v.SetDefault("metrics.channel_fill_interval", "5s")
+	v.SetDefault("debug.pprof", false)
+	v.SetDefault("cors.allowed_origins", []string{})
+	v.SetDefault("cors.allow_credentials", false)
+	v.SetDefault("prod", false)
+}
+
+// unsetKeys are the settings without a default.
+var unsetKeys = []string{"jwt.secret", "postgres.url", "kafka.brokers", "kafka.topic", "kafka.events_file", "kafka.schema_registry.url", "kafka.security_protocol", "kafka.sasl.mechanism", "kafka.sasl.username", "kafka.sasl.password", "kafka.ssl.ca_location", "kafka.ssl.certificate_location", "kafka.ssl.key_location", "kafka.ssl.endpoint_identification_algorithm", "kafka.stats_buffer", "kafka.stats_backpressure", "stream.distinct_id_salt", "mmdb.path", "mmdb.fallback_path", "sentry.dsn", "sentry.environment", "debug.pprof_username", "debug.pprof_password"}
+
+func bindEnv(v *viper.Viper) {
+	v.SetEnvPrefix("livestream") // will be uppercased automatically
 	replacer := strings.NewReplacer(".", "_")
-	viper.SetEnvKeyReplacer(replacer)
-	viper.BindEnv("jwt.secret")   // read from LIVESTREAM_JWT_SECRET
-	viper.BindEnv("postgres.url") // read from LIVESTREAM_POSTGRES_URL
+	v.SetEnvKeyReplacer(replacer)
+	v.AutomaticEnv()
+	// Keys without a default or config file entry are only found by
+	// AutomaticEnv once bound.
+	for _, key := range unsetKeys {
+		v.BindEnv(key)
+	}
+	// Also accept the variables the Sentry SDK documents.
+	v.BindEnv("sentry.dsn", "LIVESTREAM_SENTRY_DSN", "SENTRY_DSN")
+	v.BindEnv("sentry.environment", "LIVESTREAM_SENTRY_ENVIRONMENT", "SENTRY_ENVIRONMENT")
+}
+
+// sentryOptions builds the Sentry client settings. The environment defaults
+// to production or development depending on prod.
+func sentryOptions(v *viper.Viper) sentry.ClientOptions {
+	environment := strings.TrimSpace(v.GetString("sentry.environment"))
+	if environment == "" {
+		environment = "development"
+		if v.GetBool("prod") {
+			environment = "production"
+		}
+	}
+
+	sampleRate := v.GetFloat64("sentry.traces_sample_rate")
+	return sentry.ClientOptions{
+		Dsn:              v.GetString("sentry.dsn"),
+		Environment:      environment,
+		Debug:            v.GetBool("prod"),
+		AttachStacktrace: true,
+		EnableTracing:    sampleRate > 0,
+		TracesSampleRate: sampleRate,
+	}
+}
+
+// newConfig reads and validates the startup settings from v. The error lists
+// every problem found, not just the first.
+func newConfig(v *viper.Viper) (Config, error) {
+	cfg := Config{
+		Prod:             v.GetBool("prod"),
+		Brokers:          strings.TrimSpace(v.GetString("kafka.brokers")),
+		SecurityProtocol: strings.ToUpper(strings.TrimSpace(v.GetString("kafka.security_protocol"))),
+		SASL: SASLConfig{
+			Mechanism: strings.ToUpper(strings.TrimSpace(v.GetString("kafka.sasl.mechanism"))),
+			Username:  v.GetString("kafka.sasl.username"),
+			Password:  v.GetString("kafka.sasl.password"),
+		},
+		TLS: TLSConfig{
+			CALocation:                      strings.TrimSpace(v.GetString("kafka.ssl.ca_location")),
+			CertificateLocation:             strings.TrimSpace(v.GetString("kafka.ssl.certificate_location")),
+			KeyLocation:                     strings.TrimSpace(v.GetString("kafka.ssl.key_location")),
+			EndpointIdentificationAlgorithm: strings.ToLower(strings.TrimSpace(v.GetString("kafka.ssl.endpoint_identification_algorithm"))),
+		},
+		Offsets: OffsetConfig{
+			AutoOffsetReset:  strings.ToLower(strings.TrimSpace(v.GetString("kafka.auto_offset_reset"))),
+			EnableAutoCommit: v.GetBool("kafka.enable_auto_commit"),
+		},
+		GroupID:          strings.TrimSpace(v.GetString("kafka.group_id")),
+		Topics:           parseTopics(v.GetString("kafka.topic")),
+		EventsFile:       strings.TrimSpace(v.GetString("kafka.events_file")),
+		EventsRealtime:   v.GetBool("kafka.events_file_realtime"),
+		MMDBPath:         strings.TrimSpace(v.GetString("mmdb.path")),
+		MMDBFallbackPath: strings.TrimSpace(v.GetString("mmdb.fallback_path")),
+		ChannelBuffer:    v.GetInt("kafka.channel_buffer"),
+		StatsBuffer:      v.GetInt("kafka.stats_buffer"),
+		ListenAddress:    v.GetString("listen"),
+		LogFormat:        strings.ToLower(strings.TrimSpace(v.GetString("log.format"))),
+		Pprof: PprofConfig{
+			Enabled:  v.GetBool("debug.pprof"),
+			Username: v.GetString("debug.pprof_username"),
+			Password: v.GetString("debug.pprof_password"),
+		},
+		CORS: CORSConfig{
+			AllowedOrigins:   v.GetStringSlice("cors.allowed_origins"),
+			AllowCredentials: v.GetBool("cors.allow_credentials"),
+		},
+		Consumer: ConsumerConfig{
+			CommitEvery:            v.GetInt("kafka.commit_every"),
+			MaxRetries:             v.GetInt("kafka.max_retries"),
+			BackoffCap:             v.GetDuration("kafka.backoff_cap"),
+			Workers:                v.GetInt("kafka.workers"),
+			GeoWorkers:             v.GetInt("kafka.geo_workers"),
+			MaxAge:                 v.GetDuration("kafka.max_event_age"),
+			MaxMessageSize:         v.GetInt("kafka.max_message_bytes"),
+			ReadTimeout:            v.GetDuration("kafka.read_timeout"),
+			IdleAfter:              v.GetInt("kafka.idle_after_timeouts"),
+			LagInterval:            v.GetDuration("kafka.lag_interval"),
+			BatchSize:              v.GetInt("kafka.batch_size"),
+			BatchFlushInterval:     v.GetDuration("kafka.batch_flush_interval"),
+			IPProperties:           v.GetStringSlice("kafka.ip_properties"),
+			FoldPropertyKeys:       v.GetBool("kafka.fold_property_keys"),
+			KeepRaw:                v.GetBool("kafka.keep_raw"),
+			DeepTokenScan:          v.GetBool("kafka.token.deep_scan"),
+			DedupeWindow:           v.GetDuration("kafka.dedupe.window"),
+			DedupeMaxSize:          v.GetInt("kafka.dedupe.max_size"),
+			DecodeErrorThreshold:   v.GetFloat64("kafka.decode_errors.threshold"),
+			DecodeErrorWindow:      v.GetDuration("kafka.decode_errors.window"),
+			DecodeErrorMinMessages: v.GetInt("kafka.decode_errors.min_messages"),
+			NoTokenSink:            strings.TrimSpace(v.GetString("kafka.no_token_sink")),
+		},
+		GeoIP: GeoIPConfig{
+			Required:     v.GetBool("require_geoip"),
+			CacheSize:    v.GetInt("mmdb.cache_size"),
+			Retries:      v.GetInt("mmdb.retries"),
+			RetryBackoff: v.GetDuration("mmdb.retry_backoff"),
+		},
+		Stream: StreamConfig{
+			MaxConnections:         v.GetInt("stream.max_connections"),
+			MaxConnectionsPerIP:    v.GetInt("stream.max_connections_per_ip"),
+			MaxConnectionsPerToken: v.GetInt("stream.max_connections_per_token"),
+			MaxEventsPerSecond:     v.GetFloat64("stream.max_events_per_second"),
+			PropertyAllowlist:      v.GetStringSlice("stream.property_allowlist"),
+			PropertyDenylist:       v.GetStringSlice("stream.property_denylist"),
+			GeohashPrecision:       v.GetInt("stream.geohash_precision"),
+			HideCoordinates:        v.GetBool("stream.hide_coordinates"),
+			IncludePartitionKey:    v.GetBool("stream.include_partition_key"),
+			IncludeRaw:             v.GetBool("stream.include_raw"),
+			SSEHeartbeat:           v.GetDuration("stream.sse_heartbeat_interval"),
+			ReplaySize:             v.GetInt("stream.sse_replay_size"),
+			ReplayTTL:              v.GetDuration("stream.sse_replay_ttl"),
+			ReplayMaxParked:        v.GetInt("stream.sse_replay_max_parked"),
+		},
+		Sinks: SinkConfig{
+			JSONL:         strings.TrimSpace(v.GetString("sink.jsonl")),
+			FlushInterval: v.GetDuration("sink.flush_interval"),
+			Buffer:        v.GetInt("sink.buffer"),
+			Webhook: WebhookConfig{
+				URL:           strings.TrimSpace(v.GetString("sink.webhook.url")),
+				BatchSize:     v.GetInt("sink.webhook.batch_size"),
+				FlushInterval: v.GetDuration("sink.webhook.flush_interval"),
+				Timeout:       v.GetDuration("sink.webhook.timeout"),
+				MaxRetries:    v.GetInt("sink.webhook.max_retries"),
+				DeadLetter:    strings.TrimSpace(v.GetString("sink.webhook.dead_letter")),
+			},
+		},
+		HLLPrecision:        v.GetInt("stats.hll_precision"),
+		ActiveTokenTTL:      v.GetDuration("tokens.active_ttl"),
+		MaxActiveTokens:     v.GetInt("tokens.max_active"),
+		PinnedTokens:        v.GetStringSlice("tokens.pinned"),
+		ChannelFillInterval: v.GetDuration("metrics.channel_fill_interval"),
+		ShutdownGracePeriod: v.GetDuration("shutdown.grace_period"),
+	}
+	if cfg.SecurityProtocol == "" {
+		cfg.SecurityProtocol = "PLAINTEXT"
+		if cfg.Prod {
+			cfg.SecurityProtocol = "SSL"
+		}
+	}
+
+	var errs []error
+	// Events read from a file need no broker.
+	if cfg.Brokers == "" && cfg.EventsFile == "" {
+		errs = append(errs, errors.New("kafka.brokers must be set"))
+	}
+	if !slices.Contains(kafkaSecurityProtocols, cfg.SecurityProtocol) {
+		errs = append(errs, fmt.Errorf("kafka.security_protocol must be one of %s, got %q", strings.Join(kafkaSecurityProtocols, ", "), cfg.SecurityProtocol))
+	}
+	if cfg.SASL.Mechanism != "" {
+		if !slices.Contains(kafkaSASLMechanisms, cfg.SASL.Mechanism) {
+			errs = append(errs, fmt.Errorf("kafka.sasl.mechanism must be one of %s, got %q", strings.Join(kafkaSASLMechanisms, ", "), cfg.SASL.Mechanism))
+		}
+		if cfg.SASL.Username == "" || cfg.SASL.Password == "" {
+			errs = append(errs, errors.New("kafka.sasl.username and kafka.sasl.password must be set with kafka.sasl.mechanism"))
+		}
+		if !strings.HasPrefix(cfg.SecurityProtocol, "SASL_") {
+			errs = append(errs, fmt.Errorf("kafka.sasl.mechanism needs a SASL_PLAINTEXT or SASL_SSL security protocol, got %q", cfg.SecurityProtocol))
+		}
+	}
+	errs = append(errs, validateTLS(cfg.TLS, cfg.SecurityProtocol)...)
+	if !slices.Contains(kafkaOffsetResets, cfg.Offsets.AutoOffsetReset) {
+		errs = append(errs, fmt.Errorf("kafka.auto_offset_reset must be one of %s, got %q", strings.Join(kafkaOffsetResets, ", "), cfg.Offsets.AutoOffsetReset))
+	}
+	if cfg.GroupID == "" {
+		errs = append(errs, errors.New("kafka.group_id must be set"))
+	}
+	if len(cfg.Topics) == 0 && cfg.EventsFile == "" {
+		errs = append(errs, errors.New("kafka.topic must be set"))
+	}
+	if cfg.ChannelBuffer < 0 {
+		errs = append(errs, fmt.Errorf("kafka.channel_buffer must not be negative, got %d", cfg.ChannelBuffer))
+	}
+	if !v.IsSet("kafka.stats_buffer") {
+		cfg.StatsBuffer = cfg.ChannelBuffer
+	} else if cfg.StatsBuffer < 0 {
+		errs = append(errs, fmt.Errorf("kafka.stats_buffer must not be negative, got %d", cfg.StatsBuffer))
+	}
+	pick := strings.ToLower(strings.TrimSpace(v.GetString("kafka.ip_list_pick")))
+	if !slices.Contains(ipListPicks, pick) {
+		errs = append(errs, fmt.Errorf("kafka.ip_list_pick must be one of %s, got %q", strings.Join(ipListPicks, ", "), pick))
+	}
+	cfg.Consumer.RightmostIP = pick == "rightmost"
+	if cfg.Consumer.DecodeErrorThreshold < 0 || cfg.Consumer.DecodeErrorThreshold >= 1 {
+		errs = append(errs, fmt.Errorf("kafka.decode_errors.threshold must be at least 0 and below 1, got %v", cfg.Consumer.DecodeErrorThreshold))
+	}
+	if cfg.Stream.IncludeRaw && !cfg.Consumer.KeepRaw {
+		errs = append(errs, errors.New("stream.include_raw needs kafka.keep_raw"))
+	}
+	if cfg.Stream.GeohashPrecision < 0 || cfg.Stream.GeohashPrecision > maxGeohashPrecision {
+		errs = append(errs, fmt.Errorf("stream.geohash_precision must be between 0 and %d, got %d", maxGeohashPrecision, cfg.Stream.GeohashPrecision))
+	}
+	if cfg.HLLPrecision < minHLLPrecision || cfg.HLLPrecision > maxHLLPrecision {
+		errs = append(errs, fmt.Errorf("stats.hll_precision must be between %d and %d, got %d", minHLLPrecision, maxHLLPrecision, cfg.HLLPrecision))
+	}
+	for _, setting := range []struct {
+		key   string
+		value int
+	}{
+		{"kafka.commit_every", cfg.Consumer.CommitEvery},
+		{"kafka.max_retries", cfg.Consumer.MaxRetries},
+		{"kafka.workers", cfg.Consumer.Workers},
+		{"kafka.geo_workers", cfg.Consumer.GeoWorkers},
+		{"kafka.max_message_bytes", cfg.Consumer.MaxMessageSize},
+		{"kafka.idle_after_timeouts", cfg.Consumer.IdleAfter},
+		{"kafka.batch_size", cfg.Consumer.BatchSize},
+		{"kafka.decode_errors.min_messages", cfg.Consumer.DecodeErrorMinMessages},
+		{"mmdb.cache_size", cfg.GeoIP.CacheSize},
+		{"mmdb.retries", cfg.GeoIP.Retries},
+		{"stream.max_connections", cfg.Stream.MaxConnections},
+		{"stream.max_connections_per_ip", cfg.Stream.MaxConnectionsPerIP},
+		{"stream.max_connections_per_token", cfg.Stream.MaxConnectionsPerToken},
+		{"stream.sse_replay_size", cfg.Stream.ReplaySize},
+		{"stream.sse_replay_max_parked", cfg.Stream.ReplayMaxParked},
+		{"tokens.max_active", cfg.MaxActiveTokens},
+		{"sink.buffer", cfg.Sinks.Buffer},
+		{"sink.webhook.max_retries", cfg.Sinks.Webhook.MaxRetries},
+	} {
+		if setting.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %d", setting.key, setting.value))
+		}
+	}
+	if cfg.Stream.MaxEventsPerSecond < 0 {
+		errs = append(errs, fmt.Errorf("stream.max_events_per_second must not be negative, got %v", cfg.Stream.MaxEventsPerSecond))
+	}
+	for _, setting := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"kafka.backoff_cap", cfg.Consumer.BackoffCap},
+		{"kafka.max_event_age", cfg.Consumer.MaxAge},
+		{"kafka.dedupe.window", cfg.Consumer.DedupeWindow},
+		{"mmdb.retry_backoff", cfg.GeoIP.RetryBackoff},
+		{"stream.sse_heartbeat_interval", cfg.Stream.SSEHeartbeat},
+		{"stream.sse_replay_ttl", cfg.Stream.ReplayTTL},
+		{"sink.flush_interval", cfg.Sinks.FlushInterval},
+		{"sink.webhook.flush_interval", cfg.Sinks.Webhook.FlushInterval},
+		{"sink.webhook.timeout", cfg.Sinks.Webhook.Timeout},
+	} {
+		if setting.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %v", setting.key, setting.value))
+		}
+	}
+	for _, setting := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"kafka.read_timeout", cfg.Consumer.ReadTimeout},
+		{"kafka.lag_interval", cfg.Consumer.LagInterval},
+		{"kafka.decode_errors.window", cfg.Consumer.DecodeErrorWindow},
+		{"tokens.active_ttl", cfg.ActiveTokenTTL},
+		{"metrics.channel_fill_interval", cfg.ChannelFillInterval},
+		{"shutdown.grace_period", cfg.ShutdownGracePeriod},
+	} {
+		if setting.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %v", setting.key, setting.value))
+		}
+	}
+	if cfg.Consumer.BatchSize > 0 && cfg.Consumer.BatchFlushInterval <= 0 {
+		errs = append(errs, fmt.Errorf("kafka.batch_flush_interval must be positive with kafka.batch_size, got %v", cfg.Consumer.BatchFlushInterval))
+	}
+	if cfg.Consumer.BatchSize > 0 && (cfg.Sinks.JSONL != "" || cfg.Sinks.Webhook.URL != "") {
+		// Batches go straight to the filter, so the sinks would get nothing.
+		errs = append(errs, errors.New("sink.jsonl and sink.webhook need kafka.batch_size 0"))
+	}
+	if cfg.Consumer.DedupeMaxSize <= 0 {
+		errs = append(errs, fmt.Errorf("kafka.dedupe.max_size must be positive, got %d", cfg.Consumer.DedupeMaxSize))
+	}
+	backpressure, err := ParseBackpressurePolicy(v.GetString("kafka.backpressure"))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("kafka.backpressure: %w", err))
+	}
+	cfg.Backpressure = backpressure
+	cfg.StatsBackpressure = backpressure
+	if v.IsSet("kafka.stats_backpressure") {
+		cfg.StatsBackpressure, err = ParseBackpressurePolicy(v.GetString("kafka.stats_backpressure"))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("kafka.stats_backpressure: %w", err))
+		}
+	}
+	if registry := strings.TrimSpace(v.GetString("kafka.schema_registry.url")); registry != "" {
+		if u, err := url.Parse(registry); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("kafka.schema_registry.url must be an http or https URL"))
+		} else {
+			cfg.Avro = AvroDecoder{Registry: NewSchemaRegistry(registry, v.GetDuration("kafka.schema_registry.timeout"))}
+		}
+	}
+	cfg.Decoder, err = ParseDecoder(v.GetString("kafka.encoding"), cfg.Avro)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("kafka.encoding: %w", err))
+	}
+	cfg.Tokens = &TokenNormalizer{
+		Lowercase: v.GetBool("kafka.token.lowercase"),
+		MaxLength: v.GetInt("kafka.token.max_length"),
+	}
+	if cfg.Tokens.MaxLength < 0 {
+		errs = append(errs, fmt.Errorf("kafka.token.max_length must not be negative, got %d", cfg.Tokens.MaxLength))
+	}
+	if pattern := v.GetString("kafka.token.pattern"); pattern != "" {
+		cfg.Tokens.Pattern, err = regexp.Compile(pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("kafka.token.pattern: %w", err))
+		}
+	}
+	cfg.Transform, err = ParsePropertyTransform(v.GetString("kafka.transform"))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("kafka.transform: %w", err))
+	}
+	cfg.Sampler, err = ParseTokenSampler(v.GetStringSlice("stream.sampling"))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("stream.sampling: %w", err))
+	}
+	if specs := v.GetStringSlice("stream.api_keys"); len(specs) > 0 {
+		// Left nil on error, so it doesn't hold a nil *StaticAuthorizer.
+		if authorizer, err := ParseStaticAuthorizer(specs); err != nil {
+			errs = append(errs, fmt.Errorf("stream.api_keys: %w", err))
+		} else {
+			cfg.Authorizer = authorizer
+		}
+	}
+	if v.GetBool("stream.anonymize_distinct_id") {
+		cfg.DistinctIds, err = NewDistinctIdHasher(v.GetString("stream.distinct_id_hash"), v.GetString("stream.distinct_id_salt"))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("stream.distinct_id_hash: %w", err))
+		}
+	}
+	cfg.LogLevel, err = parseLogLevel(v.GetString("log.level"))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	if !slices.Contains(logFormats, cfg.LogFormat) {
+		errs = append(errs, fmt.Errorf("log.format must be one of %s, got %q", strings.Join(logFormats, ", "), cfg.LogFormat))
+	}
+	if rate := v.GetFloat64("sentry.traces_sample_rate"); rate < 0 || rate > 1 {
+		errs = append(errs, fmt.Errorf("sentry.traces_sample_rate must be between 0 and 1, got %v", rate))
+	}
+	if (cfg.Pprof.Username == "") != (cfg.Pprof.Password == "") {
+		errs = append(errs, errors.New("debug.pprof_username and debug.pprof_password must be set together"))
+	}
+	errs = append(errs, validateCORS(cfg.CORS)...)
+	for _, proxy := range v.GetStringSlice("stream.trusted_proxies") {
+		_, network, err := net.ParseCIDR(proxy)
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			network, err = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("stream.trusted_proxies must hold IPs or CIDR ranges, got %q", proxy))
+			continue
+		}
+		cfg.Stream.TrustedProxies = append(cfg.Stream.TrustedProxies, network)
+	}
+	if webhook := cfg.Sinks.Webhook.URL; webhook != "" {
+		if u, err := url.Parse(webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("sink.webhook.url must be an http or https URL"))
+		}
+	}
+	if cfg.Sinks.Webhook.BatchSize <= 0 {
+		errs = append(errs, fmt.Errorf("sink.webhook.batch_size must be positive, got %d", cfg.Sinks.Webhook.BatchSize))
+	}
+	if _, _, err := net.SplitHostPort(cfg.ListenAddress); err != nil {
+		errs = append(errs, fmt.Errorf("listen must be host:port, got %q", cfg.ListenAddress))
+	}
+
+	return cfg, errors.Join(errs...)
+}
+
+// validateTLS checks the Kafka SSL settings, including that every file they
+// name can be read.
+func validateTLS(tls TLSConfig, securityProtocol string) []error {
+	var errs []error
+	for _, file := range []struct{ key, path string }{
+		{"kafka.ssl.ca_location", tls.CALocation},
+		{"kafka.ssl.certificate_location", tls.CertificateLocation},
+		{"kafka.ssl.key_location", tls.KeyLocation},
+	} {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", file.key, err))
+		}
+	}
+	if (tls.CertificateLocation == "") != (tls.KeyLocation == "") {
+		errs = append(errs, errors.New("kafka.ssl.certificate_location and kafka.ssl.key_location must be set together"))
+	}
+	if tls.EndpointIdentificationAlgorithm != "" && !slices.Contains(kafkaSSLEndpointChecks, tls.EndpointIdentificationAlgorithm) {
+		errs = append(errs, fmt.Errorf("kafka.ssl.endpoint_identification_algorithm must be one of %s, got %q", strings.Join(kafkaSSLEndpointChecks, ", "), tls.EndpointIdentificationAlgorithm))
+	}
+	if tls != (TLSConfig{}) && !strings.HasSuffix(securityProtocol, "SSL") {
+		errs = append(errs, fmt.Errorf("kafka.ssl settings need an SSL or SASL_SSL security protocol, got %q", securityProtocol))
+	}
+	return errs
 }
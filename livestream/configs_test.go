@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestViper() *viper.Viper {
+	v := viper.New()
+	setDefaults(v)
+	bindEnv(v)
+	return v
+}
+
+func TestNewConfig(t *testing.T) {
+	t.Setenv("LIVESTREAM_KAFKA_BROKERS", "kafka-1:9092,kafka-2:9092")
+	t.Setenv("LIVESTREAM_KAFKA_TOPIC", "events-eu, events-us")
+	t.Setenv("LIVESTREAM_MMDB_PATH", "/data/mmdb.db")
+	t.Setenv("LIVESTREAM_KAFKA_CHANNEL_BUFFER", "500")
+	t.Setenv("LIVESTREAM_KAFKA_BACKPRESSURE", "drop_oldest")
+
+	cfg, err := newConfig(newTestViper())
+	require.NoError(t, err)
+
+	assert.Equal(t, Config{
+		Prod:              false,
+		Brokers:           "kafka-1:9092,kafka-2:9092",
+		SecurityProtocol:  "PLAINTEXT",
+		Offsets:           OffsetConfig{AutoOffsetReset: "latest"},
+		GroupID:           "livestream",
+		Topics:            []string{"events-eu", "events-us"},
+		MMDBPath:          "/data/mmdb.db",
+		ChannelBuffer:     500,
+		StatsBuffer:       500,
+		Backpressure:      DropOldest,
+		StatsBackpressure: DropOldest,
+		Tokens:            &TokenNormalizer{MaxLength: maxTokenLength, Pattern: tokenPattern},
+		Decoder:           JSONDecoder{},
+		ListenAddress:     ":8080",
+		LogLevel:          slog.LevelInfo,
+		LogFormat:         "text",
+		CORS:              CORSConfig{AllowedOrigins: []string{}},
+		Consumer: ConsumerConfig{
+			CommitEvery:            100,
+			MaxRetries:             10,
+			BackoffCap:             30 * time.Second,
+			Workers:                1,
+			GeoWorkers:             1,
+			ReadTimeout:            500 * time.Millisecond,
+			IdleAfter:              120,
+			LagInterval:            15 * time.Second,
+			BatchFlushInterval:     100 * time.Millisecond,
+			IPProperties:           defaultIPProperties,
+			DedupeMaxSize:          defaultDedupeMaxSize,
+			DecodeErrorWindow:      5 * time.Minute,
+			DecodeErrorMinMessages: 100,
+		},
+		GeoIP: GeoIPConfig{
+			Required:     true,
+			CacheSize:    10000,
+			Retries:      defaultGeoRetries,
+			RetryBackoff: defaultGeoRetryBackoff,
+		},
+		Stream: StreamConfig{
+			MaxConnectionsPerIP: 20,
+			PropertyAllowlist:   []string{},
+			PropertyDenylist:    defaultDeniedProperties,
+			SSEHeartbeat:        15 * time.Second,
+			ReplaySize:          50,
+			ReplayTTL:           30 * time.Second,
+			ReplayMaxParked:     1000,
+		},
+		Sinks: SinkConfig{
+			FlushInterval: time.Second,
+			Buffer:        sinkBuffer,
+			Webhook: WebhookConfig{
+				BatchSize:     defaultWebhookBatchSize,
+				FlushInterval: time.Second,
+				Timeout:       defaultWebhookTimeout,
+				MaxRetries:    defaultWebhookMaxRetries,
+			},
+		},
+		HLLPrecision:        10,
+		ActiveTokenTTL:      time.Minute,
+		MaxActiveTokens:     defaultMaxActiveTokens,
+		PinnedTokens:        []string{},
+		ChannelFillInterval: 5 * time.Second,
+		ShutdownGracePeriod: 10 * time.Second,
+	}, cfg)
+}
+
+func TestNewConfigSecurityProtocol(t *testing.T) {
+	t.Setenv("LIVESTREAM_KAFKA_BROKERS", "localhost:9092")
+	t.Setenv("LIVESTREAM_KAFKA_TOPIC", "events")
+	t.Setenv("LIVESTREAM_MMDB_PATH", "mmdb.db")
+
+	t.Setenv("LIVESTREAM_PROD", "true")
+	cfg, err := newConfig(newTestViper())
+	require.NoError(t, err)
+	assert.Equal(t, "SSL", cfg.SecurityProtocol)
+
+	t.Setenv("LIVESTREAM_KAFKA_SECURITY_PROTOCOL", "sasl_ssl")
+	cfg, err = newConfig(newTestViper())
+	require.NoError(t, err)
+	assert.Equal(t, "SASL_SSL", cfg.SecurityProtocol)
+}
+
+func TestNewConfigErrors(t *testing.T) {
+	t.Setenv("LIVESTREAM_KAFKA_GROUP_ID", " ")
+	t.Setenv("LIVESTREAM_KAFKA_SECURITY_PROTOCOL", "carrier_pigeon")
+	t.Setenv("LIVESTREAM_KAFKA_CHANNEL_BUFFER", "-1")
+	t.Setenv("LIVESTREAM_KAFKA_STATS_BUFFER", "-1")
+	t.Setenv("LIVESTREAM_KAFKA_BACKPRESSURE", "panic")
+	t.Setenv("LIVESTREAM_KAFKA_STATS_BACKPRESSURE", "drop_all")
+	t.Setenv("LIVESTREAM_LISTEN", "8080")
+	t.Setenv("LIVESTREAM_LOG_LEVEL", "verbose")
+	t.Setenv("LIVESTREAM_LOG_FORMAT", "xml")
+	t.Setenv("LIVESTREAM_KAFKA_ENCODING", "avro")
+	t.Setenv("LIVESTREAM_KAFKA_TOKEN_MAX_LENGTH", "-1")
+	t.Setenv("LIVESTREAM_KAFKA_TOKEN_PATTERN", "[a-z")
+	t.Setenv("LIVESTREAM_STREAM_SAMPLING", "phc_big:0")
+	t.Setenv("LIVESTREAM_KAFKA_READ_TIMEOUT", "0s")
+	t.Setenv("LIVESTREAM_KAFKA_IDLE_AFTER_TIMEOUTS", "-1")
+	t.Setenv("LIVESTREAM_KAFKA_MAX_MESSAGE_BYTES", "-1")
+	t.Setenv("LIVESTREAM_KAFKA_DECODE_ERRORS_THRESHOLD", "1.5")
+	t.Setenv("LIVESTREAM_KAFKA_DECODE_ERRORS_WINDOW", "0s")
+	t.Setenv("LIVESTREAM_STREAM_INCLUDE_RAW", "true")
+	t.Setenv("LIVESTREAM_KAFKA_DEDUPE_WINDOW", "-1m")
+	t.Setenv("LIVESTREAM_KAFKA_DEDUPE_MAX_SIZE", "0")
+	t.Setenv("LIVESTREAM_KAFKA_TRANSFORM", "{{ . | omit }}")
+	t.Setenv("LIVESTREAM_KAFKA_IP_LIST_PICK", "middle")
+	t.Setenv("LIVESTREAM_CORS_ALLOWED_ORIGINS", "* app.example.com")
+	t.Setenv("LIVESTREAM_CORS_ALLOW_CREDENTIALS", "true")
+	t.Setenv("LIVESTREAM_STREAM_API_KEYS", "key-without-token")
+	t.Setenv("LIVESTREAM_DEBUG_PPROF_USERNAME", "admin")
+	t.Setenv("LIVESTREAM_KAFKA_AUTO_OFFSET_RESET", "oldest")
+	t.Setenv("LIVESTREAM_STREAM_ANONYMIZE_DISTINCT_ID", "true")
+	t.Setenv("LIVESTREAM_STREAM_DISTINCT_ID_HASH", "md4")
+	t.Setenv("LIVESTREAM_SINK_WEBHOOK_URL", "hooks.example.com/events")
+	t.Setenv("LIVESTREAM_SINK_WEBHOOK_BATCH_SIZE", "0")
+	t.Setenv("LIVESTREAM_SINK_WEBHOOK_MAX_RETRIES", "-1")
+	t.Setenv("LIVESTREAM_MMDB_RETRIES", "-1")
+	t.Setenv("LIVESTREAM_KAFKA_SCHEMA_REGISTRY_URL", "registry:8081")
+	t.Setenv("LIVESTREAM_STREAM_TRUSTED_PROXIES", "10.0.0.0/8 lb.example.com")
+	t.Setenv("LIVESTREAM_KAFKA_WORKERS", "-1")
+	t.Setenv("LIVESTREAM_KAFKA_BATCH_SIZE", "10")
+	t.Setenv("LIVESTREAM_STREAM_GEOHASH_PRECISION", "13")
+	t.Setenv("LIVESTREAM_STATS_HLL_PRECISION", "2")
+	t.Setenv("LIVESTREAM_STREAM_SSE_REPLAY_TTL", "-1s")
+	t.Setenv("LIVESTREAM_SHUTDOWN_GRACE_PERIOD", "0s")
+
+	_, err := newConfig(newTestViper())
+	require.Error(t, err)
+
+	for _, problem := range []string{
+		"kafka.brokers must be set",
+		"kafka.security_protocol must be one of",
+		"kafka.group_id must be set",
+		"kafka.topic must be set",
+		"kafka.channel_buffer must not be negative",
+		"mmdb.retries must not be negative",
+		"kafka.schema_registry.url must be an http or https URL",
+		"kafka.stats_buffer must not be negative",
+		"kafka.backpressure",
+		"kafka.stats_backpressure",
+		"listen must be host:port",
+		"log.level",
+		"log.format must be one of",
+		"kafka.encoding",
+		"kafka.token.max_length must not be negative",
+		"kafka.token.pattern",
+		"stream.sampling",
+		"stream.distinct_id_hash",
+		"kafka.read_timeout must be positive",
+		"kafka.idle_after_timeouts must not be negative",
+		"kafka.max_message_bytes must not be negative",
+		"kafka.decode_errors.threshold must be at least 0 and below 1",
+		"kafka.decode_errors.window must be positive",
+		"stream.include_raw needs kafka.keep_raw",
+		"kafka.dedupe.window must not be negative",
+		"kafka.dedupe.max_size must be positive",
+		"kafka.transform",
+		"kafka.ip_list_pick must be one of leftmost, rightmost",
+		"cors.allow_credentials needs explicit cors.allowed_origins",
+		"stream.api_keys: expected key:token",
+		`cors.allowed_origins must be scheme://host[:port] or *, got "app.example.com"`,
+		"debug.pprof_username and debug.pprof_password must be set together",
+		"kafka.auto_offset_reset must be one of",
+		"sink.webhook.url must be an http or https URL",
+		"sink.webhook.batch_size must be positive",
+		"sink.webhook.max_retries must not be negative",
+		`stream.trusted_proxies must hold IPs or CIDR ranges, got "lb.example.com"`,
+		"kafka.workers must not be negative",
+		"sink.jsonl and sink.webhook need kafka.batch_size 0",
+		"stream.geohash_precision must be between 0 and 12",
+		"stats.hll_precision must be between",
+		"stream.sse_replay_ttl must not be negative",
+		"shutdown.grace_period must be positive",
+	} {
+		assert.Contains(t, err.Error(), problem)
+	}
+}
+
+func TestNewConfigSASL(t *testing.T) {
+	t.Setenv("LIVESTREAM_KAFKA_BROKERS", "kafka:9096")
+	t.Setenv("LIVESTREAM_KAFKA_TOPIC", "events")
+	t.Setenv("LIVESTREAM_MMDB_PATH", "mmdb.db")
+	t.Setenv("LIVESTREAM_KAFKA_SECURITY_PROTOCOL", "SASL_SSL")
+	t.Setenv("LIVESTREAM_KAFKA_SASL_MECHANISM", "scram-sha-512")
+	t.Setenv("LIVESTREAM_KAFKA_SASL_USERNAME", "livestream")
+	t.Setenv("LIVESTREAM_KAFKA_SASL_PASSWORD", "hunter2")
+
+	cfg, err := newConfig(newTestViper())
+	require.NoError(t, err)
+	assert.Equal(t, SASLConfig{Mechanism: "SCRAM-SHA-512", Username: "livestream", Password: "hunter2"}, cfg.SASL)
+}
+
+func TestNewConfigSASLErrors(t *testing.T) {
+	t.Setenv("LIVESTREAM_KAFKA_BROKERS", "kafka:9096")
+	t.Setenv("LIVESTREAM_KAFKA_TOPIC", "events")
+	t.Setenv("LIVESTREAM_MMDB_PATH", "mmdb.db")
+	t.Setenv("LIVESTREAM_KAFKA_SECURITY_PROTOCOL", "SSL")
+	t.Setenv("LIVESTREAM_KAFKA_SASL_MECHANISM", "GSSAPI")
+	t.Setenv("LIVESTREAM_KAFKA_SASL_PASSWORD", "hunter2")
+
+	_, err := newConfig(newTestViper())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "kafka.sasl.mechanism must be one of")
+	assert.Contains(t, err.Error(), "kafka.sasl.username and kafka.sasl.password must be set")
+	assert.Contains(t, err.Error(), "needs a SASL_PLAINTEXT or SASL_SSL security protocol")
+	assert.NotContains(t, err.Error(), "hunter2")
+}
+
+func TestNewConfigTLS(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"ca.pem", "client.pem", "client.key"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("test"), 0o600))
+	}
+	t.Setenv("LIVESTREAM_KAFKA_BROKERS", "kafka:9093")
+	t.Setenv("LIVESTREAM_KAFKA_TOPIC", "events")
+	t.Setenv("LIVESTREAM_KAFKA_SECURITY_PROTOCOL", "SSL")
+	t.Setenv("LIVESTREAM_KAFKA_SSL_CA_LOCATION", filepath.Join(dir, "ca.pem"))
+	t.Setenv("LIVESTREAM_KAFKA_SSL_CERTIFICATE_LOCATION", filepath.Join(dir, "client.pem"))
+	t.Setenv("LIVESTREAM_KAFKA_SSL_KEY_LOCATION", filepath.Join(dir, "client.key"))
+	t.Setenv("LIVESTREAM_KAFKA_SSL_ENDPOINT_IDENTIFICATION_ALGORITHM", "HTTPS")
+
+	cfg, err := newConfig(newTestViper())
+	require.NoError(t, err)
+	assert.Equal(t, TLSConfig{
+		CALocation:                      filepath.Join(dir, "ca.pem"),
+		CertificateLocation:             filepath.Join(dir, "client.pem"),
+		KeyLocation:                     filepath.Join(dir, "client.key"),
+		EndpointIdentificationAlgorithm: "https",
+	}, cfg.TLS)
+}
+
+func TestNewConfigTLSErrors(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	t.Setenv("LIVESTREAM_KAFKA_BROKERS", "kafka:9092")
+	t.Setenv("LIVESTREAM_KAFKA_TOPIC", "events")
+	t.Setenv("LIVESTREAM_KAFKA_SECURITY_PROTOCOL", "PLAINTEXT")
+	t.Setenv("LIVESTREAM_KAFKA_SSL_CA_LOCATION", missing)
+	t.Setenv("LIVESTREAM_KAFKA_SSL_CERTIFICATE_LOCATION", missing)
+	t.Setenv("LIVESTREAM_KAFKA_SSL_ENDPOINT_IDENTIFICATION_ALGORITHM", "dns")
+
+	_, err := newConfig(newTestViper())
+	require.Error(t, err)
+	for _, problem := range []string{
+		"kafka.ssl.ca_location: stat " + missing,
+		"kafka.ssl.certificate_location: stat " + missing,
+		"kafka.ssl.certificate_location and kafka.ssl.key_location must be set together",
+		"kafka.ssl.endpoint_identification_algorithm must be one of https, none",
+		"need an SSL or SASL_SSL security protocol",
+	} {
+		assert.Contains(t, err.Error(), problem)
+	}
+}
+
+func TestNewConfigOffsets(t *testing.T) {
+	t.Setenv("LIVESTREAM_KAFKA_BROKERS", "localhost:9092")
+	t.Setenv("LIVESTREAM_KAFKA_TOPIC", "events")
+	t.Setenv("LIVESTREAM_KAFKA_AUTO_OFFSET_RESET", " Earliest")
+	t.Setenv("LIVESTREAM_KAFKA_ENABLE_AUTO_COMMIT", "true")
+
+	cfg, err := newConfig(newTestViper())
+	require.NoError(t, err)
+	assert.Equal(t, OffsetConfig{AutoOffsetReset: "earliest", EnableAutoCommit: true}, cfg.Offsets)
+}
+
+func TestNewConfigTokens(t *testing.T) {
+	t.Setenv("LIVESTREAM_KAFKA_BROKERS", "localhost:9092")
+	t.Setenv("LIVESTREAM_KAFKA_TOPIC", "events")
+	t.Setenv("LIVESTREAM_KAFKA_TOKEN_LOWERCASE", "true")
+	t.Setenv("LIVESTREAM_KAFKA_TOKEN_MAX_LENGTH", "8")
+	t.Setenv("LIVESTREAM_KAFKA_TOKEN_PATTERN", "^phc_[a-z0-9]+$")
+
+	cfg, err := newConfig(newTestViper())
+	require.NoError(t, err)
+	assert.True(t, cfg.Tokens.Lowercase)
+	assert.Equal(t, 8, cfg.Tokens.MaxLength)
+	assert.Equal(t, "^phc_[a-z0-9]+$", cfg.Tokens.Pattern.String())
+}
+
+func TestNewConfigStatsBuffer(t *testing.T) {
+	t.Setenv("LIVESTREAM_KAFKA_BROKERS", "localhost:9092")
+	t.Setenv("LIVESTREAM_KAFKA_TOPIC", "events")
+	t.Setenv("LIVESTREAM_KAFKA_CHANNEL_BUFFER", "100")
+	t.Setenv("LIVESTREAM_KAFKA_STATS_BUFFER", "0")
+
+	cfg, err := newConfig(newTestViper())
+	require.NoError(t, err)
+	assert.Equal(t, 100, cfg.ChannelBuffer)
+	assert.Equal(t, 0, cfg.StatsBuffer)
+}
+
+func TestNewConfigAPIKeys(t *testing.T) {
+	t.Setenv("LIVESTREAM_KAFKA_BROKERS", "localhost:9092")
+	t.Setenv("LIVESTREAM_KAFKA_TOPIC", "events")
+
+	cfg, err := newConfig(newTestViper())
+	require.NoError(t, err)
+	assert.Nil(t, cfg.Authorizer)
+
+	t.Setenv("LIVESTREAM_STREAM_API_KEYS", "key1:phc_one key1:phc_two")
+	cfg, err = newConfig(newTestViper())
+	require.NoError(t, err)
+	require.NotNil(t, cfg.Authorizer)
+	assert.NoError(t, cfg.Authorizer.Authorize(context.Background(), "key1", "phc_two"))
+}
+
+func TestNewConfigTrustedProxies(t *testing.T) {
+	t.Setenv("LIVESTREAM_KAFKA_BROKERS", "localhost:9092")
+	t.Setenv("LIVESTREAM_KAFKA_TOPIC", "events")
+	t.Setenv("LIVESTREAM_STREAM_TRUSTED_PROXIES", "10.0.0.0/8 192.0.2.1 2001:db8::1")
+
+	cfg, err := newConfig(newTestViper())
+	require.NoError(t, err)
+	var proxies []string
+	for _, proxy := range cfg.Stream.TrustedProxies {
+		proxies = append(proxies, proxy.String())
+	}
+	assert.Equal(t, []string{"10.0.0.0/8", "192.0.2.1/32", "2001:db8::1/128"}, proxies)
+}
+
+func TestNewConfigStatsBackpressure(t *testing.T) {
+	t.Setenv("LIVESTREAM_KAFKA_BROKERS", "localhost:9092")
+	t.Setenv("LIVESTREAM_KAFKA_TOPIC", "events")
+	t.Setenv("LIVESTREAM_KAFKA_STATS_BACKPRESSURE", "drop_newest")
+
+	cfg, err := newConfig(newTestViper())
+	require.NoError(t, err)
+	assert.Equal(t, Block, cfg.Backpressure)
+	assert.Equal(t, DropNewest, cfg.StatsBackpressure)
+}
+
+func TestNewConfigEventsFile(t *testing.T) {
+	t.Setenv("LIVESTREAM_KAFKA_EVENTS_FILE", "testdata/events.jsonl")
+	t.Setenv("LIVESTREAM_KAFKA_EVENTS_FILE_REALTIME", "true")
+
+	// No brokers or topic are needed to read a file.
+	cfg, err := newConfig(newTestViper())
+	require.NoError(t, err)
+	assert.Equal(t, "testdata/events.jsonl", cfg.EventsFile)
+	assert.True(t, cfg.EventsRealtime)
+}
+
+func TestNewConfigAvro(t *testing.T) {
+	t.Setenv("LIVESTREAM_KAFKA_BROKERS", "localhost:9092")
+	t.Setenv("LIVESTREAM_KAFKA_TOPIC", "events")
+	t.Setenv("LIVESTREAM_KAFKA_SCHEMA_REGISTRY_URL", "http://registry:8081")
+
+	// The registry alone only reads the messages framed for it as Avro.
+	cfg, err := newConfig(newTestViper())
+	require.NoError(t, err)
+	assert.Equal(t, JSONDecoder{}, cfg.Decoder)
+	require.IsType(t, AvroDecoder{}, cfg.Avro)
+	assert.Equal(t, "http://registry:8081", cfg.Avro.(AvroDecoder).Registry.url)
+
+	t.Setenv("LIVESTREAM_KAFKA_ENCODING", "avro")
+	cfg, err = newConfig(newTestViper())
+	require.NoError(t, err)
+	assert.Equal(t, cfg.Avro, cfg.Decoder)
+}
+
+func TestSentryOptions(t *testing.T) {
+	t.Setenv("SENTRY_DSN", "https://key@sentry.example.com/1")
+	t.Setenv("SENTRY_ENVIRONMENT", "staging")
+	t.Setenv("LIVESTREAM_SENTRY_TRACES_SAMPLE_RATE", "0.25")
+
+	v := newTestViper()
+	assert.True(t, v.GetBool("sentry.enabled"))
+
+	opts := sentryOptions(v)
+	assert.Equal(t, "https://key@sentry.example.com/1", opts.Dsn)
+	assert.Equal(t, "staging", opts.Environment)
+	assert.True(t, opts.EnableTracing)
+	assert.Equal(t, 0.25, opts.TracesSampleRate)
+}
+
+func TestSentryOptionsDefaultEnvironment(t *testing.T) {
+	v := newTestViper()
+	assert.Equal(t, "development", sentryOptions(v).Environment)
+	assert.False(t, sentryOptions(v).EnableTracing)
+
+	v.Set("prod", true)
+	assert.Equal(t, "production", sentryOptions(v).Environment)
+}
+
+func TestSentryDisabled(t *testing.T) {
+	t.Setenv("LIVESTREAM_SENTRY_ENABLED", "false")
+	assert.False(t, newTestViper().GetBool("sentry.enabled"))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// CORSConfig controls which other origins browsers let read the streams and
+// stats. With no AllowedOrigins only pages of the same origin can, like the
+// bundled index.html.
+type CORSConfig struct {
+	// AllowedOrigins are origins such as https://app.example.com, or "*" for
+	// any origin.
+	AllowedOrigins []string
+	// AllowCredentials lets browsers send cookies and HTTP auth along. It
+	// can't be used with "*".
+	AllowCredentials bool
+}
+
+// validateCORS checks that every allowed origin is "*" or scheme://host with
+// an optional port, as browsers send them.
+func validateCORS(cfg CORSConfig) []error {
+	var errs []error
+	for _, origin := range cfg.AllowedOrigins {
+		if origin == "*" {
+			if cfg.AllowCredentials {
+				errs = append(errs, fmt.Errorf("cors.allow_credentials needs explicit cors.allowed_origins, not %q", origin))
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+			errs = append(errs, fmt.Errorf("cors.allowed_origins must be scheme://host[:port] or *, got %q", origin))
+		}
+	}
+	return errs
+}
+
+// registerCORS answers preflight requests and sets the CORS headers on every
+// route for the allowed origins. Without any, it adds nothing and browsers
+// keep cross-origin pages out.
+func registerCORS(e *echo.Echo, cfg CORSConfig) {
+	if len(cfg.AllowedOrigins) == 0 {
+		return
+	}
+
+	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins:     cfg.AllowedOrigins,
+		AllowMethods:     []string{http.MethodGet, http.MethodHead},
+		AllowCredentials: cfg.AllowCredentials,
+	}))
+}
+
+// checkOrigin applies the same policy to WebSocket upgrades, which browsers
+// make without asking. Requests without an Origin header don't come from a
+// browser page, so are let through.
+func (cfg CORSConfig) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || slices.Contains(cfg.AllowedOrigins, "*") || slices.Contains(cfg.AllowedOrigins, origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
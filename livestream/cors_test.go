@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func corsServer(cfg CORSConfig) *echo.Echo {
+	e := echo.New()
+	registerCORS(e, cfg)
+	e.GET("/stats", func(c echo.Context) error { return c.String(http.StatusOK, "{}") })
+	return e
+}
+
+func corsRequest(e *echo.Echo, method, origin string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/stats", nil)
+	req.Header.Set(echo.HeaderOrigin, origin)
+	if method == http.MethodOptions {
+		req.Header.Set(echo.HeaderAccessControlRequestMethod, http.MethodGet)
+		req.Header.Set(echo.HeaderAccessControlRequestHeaders, "Authorization")
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCORSAllowedOrigin(t *testing.T) {
+	e := corsServer(CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, AllowCredentials: true})
+
+	rec := corsRequest(e, http.MethodGet, "https://app.example.com")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "https://app.example.com", rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
+	assert.Equal(t, "true", rec.Header().Get(echo.HeaderAccessControlAllowCredentials))
+}
+
+func TestCORSDisallowedOrigin(t *testing.T) {
+	e := corsServer(CORSConfig{AllowedOrigins: []string{"https://app.example.com"}})
+
+	rec := corsRequest(e, http.MethodGet, "https://evil.example.com")
+	// Served, but without the headers the browser needs to let the page read it.
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
+}
+
+func TestCORSPreflight(t *testing.T) {
+	e := corsServer(CORSConfig{AllowedOrigins: []string{"https://app.example.com"}})
+
+	rec := corsRequest(e, http.MethodOptions, "https://app.example.com")
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "https://app.example.com", rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
+	assert.Equal(t, "GET,HEAD", rec.Header().Get(echo.HeaderAccessControlAllowMethods))
+	assert.Equal(t, "Authorization", rec.Header().Get(echo.HeaderAccessControlAllowHeaders))
+
+	rec = corsRequest(e, http.MethodOptions, "https://evil.example.com")
+	assert.Empty(t, rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
+}
+
+func TestCORSSameOriginByDefault(t *testing.T) {
+	e := corsServer(CORSConfig{})
+
+	rec := corsRequest(e, http.MethodGet, "https://app.example.com")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
+
+	rec = corsRequest(e, http.MethodOptions, "https://app.example.com")
+	assert.Empty(t, rec.Header().Get(echo.HeaderAccessControlAllowOrigin))
+}
+
+func TestCORSCheckOrigin(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      CORSConfig
+		origin   string
+		expected bool
+	}{
+		{name: "No origin", origin: "", expected: true},
+		{name: "Same origin", origin: "http://livestream.example.com", expected: true},
+		{name: "Other origin", origin: "https://app.example.com", expected: false},
+		{name: "Allowed", cfg: CORSConfig{AllowedOrigins: []string{"https://app.example.com"}}, origin: "https://app.example.com", expected: true},
+		{name: "Wildcard", cfg: CORSConfig{AllowedOrigins: []string{"*"}}, origin: "https://app.example.com", expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://livestream.example.com/ws", nil)
+			if tt.origin != "" {
+				req.Header.Set(echo.HeaderOrigin, tt.origin)
+			}
+			assert.Equal(t, tt.expected, tt.cfg.checkOrigin(req))
+		})
+	}
+}
+
+func TestValidateCORS(t *testing.T) {
+	assert.Empty(t, validateCORS(CORSConfig{AllowedOrigins: []string{"*"}}))
+	assert.Empty(t, validateCORS(CORSConfig{AllowedOrigins: []string{"https://app.example.com", "http://localhost:8000"}, AllowCredentials: true}))
+	assert.Len(t, validateCORS(CORSConfig{AllowedOrigins: []string{"app.example.com", "https://app.example.com/path"}}), 2)
+	assert.Len(t, validateCORS(CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}), 1)
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 
-	"github.com/getsentry/sentry-go"
 	"github.com/jackc/pgx/v5"
 	"github.com/spf13/viper"
 )
@@ -12,7 +11,7 @@ func getPGConn() (*pgx.Conn, error) {
 	url := viper.GetString("postgres.url")
 	conn, err := pgx.Connect(context.Background(), url)
 	if err != nil {
-		sentry.CaptureException(err)
+		captureException(err)
 		return nil, err
 	}
 	return conn, nil
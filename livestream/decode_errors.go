@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDecodeErrorWindow      = 5 * time.Minute
+	defaultDecodeErrorMinMessages = 100
+	// decodeErrorBuckets is how many steps the window expires in.
+	decodeErrorBuckets = 10
+)
+
+// DecodeErrorMonitor reports once when the share of messages failing to
+// decode within a rolling window goes over Threshold.
+type DecodeErrorMonitor struct {
+	// Threshold is the rate, from 0 to 1, above which to alert. 0 disables
+	// alerting.
+	Threshold float64
+	// MinMessages is how many messages the window must hold to alert.
+	MinMessages int
+
+	capture func(error)
+	clock   Clock
+
+	mu         sync.Mutex
+	bucketSize time.Duration
+	buckets    [decodeErrorBuckets]decodeErrorBucket
+	alerting   bool
+}
+
+// decodeErrorBucket counts the messages of one step of the window.
+type decodeErrorBucket struct {
+	start           time.Time
+	decoded, failed int
+}
+
+func NewDecodeErrorMonitor(threshold float64, window time.Duration, clock Clock) *DecodeErrorMonitor {
+	if window <= 0 {
+		window = defaultDecodeErrorWindow
+	}
+	return &DecodeErrorMonitor{
+		Threshold:   threshold,
+		MinMessages: defaultDecodeErrorMinMessages,
+		capture:     captureException,
+		clock:       clock,
+		bucketSize:  max(window/decodeErrorBuckets, 1),
+	}
+}
+
+// Window is how far back the rate looks.
+func (m *DecodeErrorMonitor) Window() time.Duration {
+	return m.bucketSize * decodeErrorBuckets
+}
+
+// Record counts a message, failed if it could not be decoded. A nil monitor
+// records nothing.
+func (m *DecodeErrorMonitor) Record(failed bool) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	now := m.clock.Now()
+	start := now.Truncate(m.bucketSize)
+	bucket := &m.buckets[int(start.UnixNano()/int64(m.bucketSize))%decodeErrorBuckets]
+	if !bucket.start.Equal(start) {
+		*bucket = decodeErrorBucket{start: start}
+	}
+	if failed {
+		bucket.failed++
+	} else {
+		bucket.decoded++
+	}
+	if m.Threshold <= 0 {
+		m.mu.Unlock()
+		return
+	}
+
+	failures, total := m.counts(now)
+	rate := float64(failures) / float64(total)
+	alert := rate > m.Threshold && total >= m.MinMessages && !m.alerting
+	if rate <= m.Threshold {
+		m.alerting = false
+	} else if alert {
+		m.alerting = true
+	}
+	m.mu.Unlock()
+
+	if alert {
+		err := fmt.Errorf("decode error rate %.1f%% is over %.1f%%: %d of %d messages in the last %v failed to decode",
+			100*rate, 100*m.Threshold, failures, total, m.Window())
+		log.Printf("Decode errors over threshold: %v", err)
+		m.capture(err)
+	}
+}
+
+// Rate returns the share of messages within the window that failed to
+// decode, or 0 for a nil monitor.
+func (m *DecodeErrorMonitor) Rate() float64 {
+	if m == nil {
+		return 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	failures, total := m.counts(m.clock.Now())
+	if total == 0 {
+		return 0
+	}
+	return float64(failures) / float64(total)
+}
+
+// counts sums the buckets within the window. m.mu must be held.
+func (m *DecodeErrorMonitor) counts(now time.Time) (failed, total int) {
+	for _, bucket := range m.buckets {
+		if now.Sub(bucket.start) < m.Window() {
+			failed += bucket.failed
+			total += bucket.decoded + bucket.failed
+		}
+	}
+	return failed, total
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func record(monitor *DecodeErrorMonitor, decoded, failed int) {
+	for i := 0; i < decoded; i++ {
+		monitor.Record(false)
+	}
+	for i := 0; i < failed; i++ {
+		monitor.Record(true)
+	}
+}
+
+func TestDecodeErrorMonitorAlertsOnce(t *testing.T) {
+	monitor := NewDecodeErrorMonitor(0.2, time.Minute, newFakeClock())
+	monitor.MinMessages = 10
+	var captured []error
+	monitor.capture = func(err error) { captured = append(captured, err) }
+
+	record(monitor, 16, 4)
+	assert.Empty(t, captured, "20% is not over the threshold")
+	assert.Equal(t, 0.2, monitor.Rate())
+
+	// Every further failure stays over the threshold, but only the first
+	// reports.
+	record(monitor, 0, 20)
+	require.Len(t, captured, 1)
+	assert.EqualError(t, captured[0], "decode error rate 23.8% is over 20.0%: 5 of 21 messages in the last 1m0s failed to decode")
+	assert.Equal(t, 0.6, monitor.Rate())
+}
+
+func TestDecodeErrorMonitorAlertsAgainAfterRecovering(t *testing.T) {
+	clock := newFakeClock()
+	monitor := NewDecodeErrorMonitor(0.2, time.Minute, clock)
+	monitor.MinMessages = 10
+	var captured []error
+	monitor.capture = func(err error) { captured = append(captured, err) }
+
+	record(monitor, 5, 5)
+	require.Len(t, captured, 1)
+
+	// The failures expire from the window.
+	clock.Advance(time.Minute)
+	record(monitor, 10, 0)
+	assert.Zero(t, monitor.Rate())
+
+	record(monitor, 0, 5)
+	assert.Len(t, captured, 2)
+}
+
+func TestDecodeErrorMonitorMinMessages(t *testing.T) {
+	monitor := NewDecodeErrorMonitor(0.2, time.Minute, newFakeClock())
+	monitor.MinMessages = 10
+	var captured []error
+	monitor.capture = func(err error) { captured = append(captured, err) }
+
+	record(monitor, 0, 9)
+	assert.Empty(t, captured, "too few messages to tell")
+	record(monitor, 0, 1)
+	assert.Len(t, captured, 1)
+}
+
+func TestDecodeErrorMonitorWithoutThreshold(t *testing.T) {
+	monitor := NewDecodeErrorMonitor(0, time.Minute, newFakeClock())
+	monitor.MinMessages = 10
+	var captured []error
+	monitor.capture = func(err error) { captured = append(captured, err) }
+
+	record(monitor, 0, 20)
+	assert.Empty(t, captured)
+	assert.Equal(t, 1.0, monitor.Rate())
+
+	var nilMonitor *DecodeErrorMonitor
+	assert.NotPanics(t, func() { nilMonitor.Record(true) })
+	assert.Zero(t, nilMonitor.Rate())
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Decoder turns the value of a Kafka message into the event it carries. The
+// wrapper holds the fields that sit beside the event, like the uuid and IP.
+// On error the results hold whatever was decoded before the failure.
+type Decoder interface {
+	Decode(value []byte) (PostHogEventWrapper, PostHogEvent, error)
+}
+
+// ParseDecoder returns the Decoder for the kafka.encoding config value. avro
+// is the decoder for "avro", nil when no schema registry is configured.
+func ParseDecoder(s string, avro Decoder) (Decoder, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "json":
+		return JSONDecoder{}, nil
+	case "protobuf":
+		return ProtobufDecoder{}, nil
+	case "avro":
+		if avro == nil {
+			return nil, errors.New("avro needs kafka.schema_registry.url")
+		}
+		return avro, nil
+	}
+	return nil, fmt.Errorf("unknown encoding %q", s)
+}
+
+// decoderForContentType maps a content-type header to a Decoder. Parameters
+// such as charset are ignored.
+func decoderForContentType(contentType string) (Decoder, bool) {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch strings.ToLower(strings.TrimSpace(mediaType)) {
+	case "application/json":
+		return JSONDecoder{}, true
+	case "application/protobuf", "application/x-protobuf", "application/vnd.google.protobuf":
+		return ProtobufDecoder{}, true
+	}
+	return nil, false
+}
+
+// JSONDecoder reads a PostHogEventWrapper whose data field holds the event as
+// a JSON string, or a bare JSON event without the wrapper.
+type JSONDecoder struct{}
+
+// jsonEnvelope reads the wrapper fields and what isBareEvent looks at in a
+// single pass over the message.
+type jsonEnvelope struct {
+	PostHogEventWrapper
+	// Data shadows the wrapper's, to tell a missing data field from an empty
+	// one.
+	Data   *string         `json:"data"`
+	Event  json.RawMessage `json:"event"`
+	ApiKey json.RawMessage `json:"api_key"`
+}
+
+func (d JSONDecoder) Decode(value []byte) (PostHogEventWrapper, PostHogEvent, error) {
+	var envelope jsonEnvelope
+	if err := json.Unmarshal(value, &envelope); err != nil {
+		// Either invalid, or a bare event with fields that don't fit the
+		// wrapper; the slower path tells them apart.
+		return d.decodeSlow(value)
+	}
+
+	wrapper := envelope.PostHogEventWrapper
+	if envelope.Data == nil && (envelope.Event != nil || envelope.ApiKey != nil) {
+		return d.decodeEvent(wrapper, value)
+	}
+	if envelope.Data != nil {
+		wrapper.Data = *envelope.Data
+	}
+
+	// The event is usually most of the message, so the bytes it is decoded
+	// from are reused rather than allocated for every message.
+	buf := dataBuffers.Get().(*[]byte)
+	*buf = append((*buf)[:0], wrapper.Data...)
+	wrapper, phEvent, err := d.decodeEvent(wrapper, *buf)
+	if cap(*buf) <= maxPooledDataBuffer {
+		dataBuffers.Put(buf)
+	}
+	return wrapper, phEvent, err
+}
+
+// maxPooledDataBuffer keeps an occasional huge event from pinning its buffer
+// in the pool.
+const maxPooledDataBuffer = 64 << 10
+
+// dataBuffers holds the byte slices JSONDecoder copies event data into.
+// Unmarshal does not keep references to its input, so they can be reused as
+// soon as it returns.
+var dataBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 4<<10)
+		return &buf
+	},
+}
+
+func (d JSONDecoder) decodeSlow(value []byte) (PostHogEventWrapper, PostHogEvent, error) {
+	bare := isBareEvent(value)
+
+	var wrapper PostHogEventWrapper
+	// A bare event's fields need not fit the wrapper; the ones that do, like
+	// uuid and distinct_id, are still picked up.
+	if err := json.Unmarshal(value, &wrapper); err != nil && !bare {
+		return wrapper, PostHogEvent{Properties: make(map[string]interface{})}, err
+	}
+
+	data := []byte(wrapper.Data)
+	if bare {
+		data = value
+	}
+	return d.decodeEvent(wrapper, data)
+}
+
+func (JSONDecoder) decodeEvent(wrapper PostHogEventWrapper, data []byte) (PostHogEventWrapper, PostHogEvent, error) {
+	phEvent := PostHogEvent{Properties: make(map[string]interface{})}
+	if err := json.Unmarshal(data, &phEvent); err != nil {
+		return wrapper, phEvent, fmt.Errorf("decoding event data: %w", err)
+	}
+	return wrapper, phEvent, nil
+}
+
+// isBareEvent reports whether value is an event sent as is rather than inside
+// a PostHogEventWrapper: it has an event or api_key but no data string.
+func isBareEvent(value []byte) bool {
+	var probe struct {
+		Data   json.RawMessage `json:"data"`
+		Event  json.RawMessage `json:"event"`
+		ApiKey json.RawMessage `json:"api_key"`
+	}
+	if err := json.Unmarshal(value, &probe); err != nil {
+		return false
+	}
+	if len(probe.Data) > 0 && probe.Data[0] == '"' {
+		return false
+	}
+	return probe.Event != nil || probe.ApiKey != nil
+}
+
+// ProtobufDecoder reads the Event message defined in proto/event.proto.
+// Unknown fields are skipped.
+type ProtobufDecoder struct{}
+
+func (ProtobufDecoder) Decode(value []byte) (PostHogEventWrapper, PostHogEvent, error) {
+	var wrapper PostHogEventWrapper
+	phEvent := PostHogEvent{Properties: make(map[string]interface{})}
+
+	for len(value) > 0 {
+		num, typ, n := protowire.ConsumeTag(value)
+		if n < 0 {
+			return wrapper, phEvent, fmt.Errorf("decoding protobuf event: %w", protowire.ParseError(n))
+		}
+		value = value[n:]
+
+		var field *string
+		switch num {
+		case 1:
+			field = &wrapper.Uuid
+		case 2:
+			field = &wrapper.DistinctId
+		case 3:
+			field = &wrapper.Ip
+		case 4:
+			field = &wrapper.Token
+		case 5:
+			field = &phEvent.Event
+		}
+
+		switch {
+		case field != nil && typ == protowire.BytesType:
+			*field, n = protowire.ConsumeString(value)
+		case num == 6 && typ == protowire.BytesType:
+			var b []byte
+			b, n = protowire.ConsumeBytes(value)
+			if n >= 0 {
+				var properties structpb.Struct
+				if err := proto.Unmarshal(b, &properties); err != nil {
+					return wrapper, phEvent, fmt.Errorf("decoding protobuf event properties: %w", err)
+				}
+				phEvent.Properties = properties.AsMap()
+			}
+		case num == 7 && typ == protowire.VarintType:
+			var ms uint64
+			ms, n = protowire.ConsumeVarint(value)
+			phEvent.Timestamp = time.UnixMilli(int64(ms)).UTC()
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, value)
+		}
+		if n < 0 {
+			return wrapper, phEvent, fmt.Errorf("decoding protobuf event field %d: %w", num, protowire.ParseError(n))
+		}
+		value = value[n:]
+	}
+	return wrapper, phEvent, nil
+}
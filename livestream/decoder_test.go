@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// protobufEvent encodes an Event as defined in proto/event.proto.
+func protobufEvent(t *testing.T, uuid, distinctId, ip, token, event string, properties map[string]interface{}, timestamp time.Time) []byte {
+	t.Helper()
+
+	var b []byte
+	for num, value := range []string{uuid, distinctId, ip, token, event} {
+		b = protowire.AppendTag(b, protowire.Number(num+1), protowire.BytesType)
+		b = protowire.AppendString(b, value)
+	}
+
+	props, err := structpb.NewStruct(properties)
+	require.NoError(t, err)
+	encoded, err := proto.Marshal(props)
+	require.NoError(t, err)
+	b = protowire.AppendTag(b, 6, protowire.BytesType)
+	b = protowire.AppendBytes(b, encoded)
+
+	b = protowire.AppendTag(b, 7, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(timestamp.UnixMilli()))
+}
+
+func TestDecodersProduceEquivalentEvents(t *testing.T) {
+	timestamp := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	properties := map[string]interface{}{"$current_url": "https://example.com", "$screen_width": 1440.0}
+
+	jsonWrapper, jsonEvent, err := JSONDecoder{}.Decode([]byte(`{"uuid": "test-uuid", "distinct_id": "user1", "ip": "192.0.2.1", "token": "test-token", "data": "{\"event\": \"$pageview\", \"timestamp\": \"2024-05-01T12:30:00.000Z\", \"properties\": {\"$current_url\": \"https://example.com\", \"$screen_width\": 1440}}"}`))
+	require.NoError(t, err)
+
+	protoWrapper, protoEvent, err := ProtobufDecoder{}.Decode(protobufEvent(t, "test-uuid", "user1", "192.0.2.1", "test-token", "$pageview", properties, timestamp))
+	require.NoError(t, err)
+
+	jsonWrapper.Data = ""
+	assert.Equal(t, jsonWrapper, protoWrapper)
+	assert.Equal(t, jsonEvent, protoEvent)
+	assert.Equal(t, "$pageview", protoEvent.Event)
+	assert.Equal(t, timestamp, protoEvent.Timestamp)
+	assert.Equal(t, properties, protoEvent.Properties)
+}
+
+func TestProtobufDecoderSkipsUnknownFields(t *testing.T) {
+	b := protowire.AppendTag(nil, 99, protowire.BytesType)
+	b = protowire.AppendString(b, "from a newer producer")
+	b = protowire.AppendTag(b, 5, protowire.BytesType)
+	b = protowire.AppendString(b, "$pageview")
+
+	_, phEvent, err := ProtobufDecoder{}.Decode(b)
+	require.NoError(t, err)
+	assert.Equal(t, "$pageview", phEvent.Event)
+}
+
+func TestProtobufDecoderErrors(t *testing.T) {
+	for name, value := range map[string][]byte{
+		"Truncated":      {0x0a, 0x05, 'a'},
+		"Bad tag":        {0xff},
+		"Bad properties": append(protowire.AppendTag(nil, 6, protowire.BytesType), 0x02, 0xff, 0xff),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := ProtobufDecoder{}.Decode(value)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseDecoder(t *testing.T) {
+	for input, expected := range map[string]Decoder{
+		"":          JSONDecoder{},
+		"json":      JSONDecoder{},
+		" Protobuf": ProtobufDecoder{},
+	} {
+		decoder, err := ParseDecoder(input, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, decoder)
+	}
+
+	_, err := ParseDecoder("avro", nil)
+	assert.ErrorContains(t, err, "kafka.schema_registry.url")
+	avro := AvroDecoder{Registry: NewSchemaRegistry("http://registry:8081", 0)}
+	decoder, err := ParseDecoder("Avro", avro)
+	assert.NoError(t, err)
+	assert.Equal(t, avro, decoder)
+
+	_, err = ParseDecoder("thrift", nil)
+	assert.Error(t, err)
+}
+
+func TestPostHogKafkaConsumer_ProtobufDecoder(t *testing.T) {
+	consumer := &PostHogKafkaConsumer{geolocator: NoOpGeoLocator{}, Decoder: ProtobufDecoder{}}
+
+	phEvent := consumer.parseMessage(&kafka.Message{
+		Value: protobufEvent(t, "test-uuid", "user1", "192.0.2.1", "test-token", "$pageview", nil, time.UnixMilli(1714566600000)),
+	})
+
+	assert.Equal(t, "test-uuid", phEvent.Uuid)
+	assert.Equal(t, "user1", phEvent.DistinctId)
+	assert.Equal(t, "test-token", phEvent.Token)
+	assert.Equal(t, "$pageview", phEvent.Event)
+	assert.Equal(t, time.UnixMilli(1714566600000).UTC(), phEvent.Timestamp)
+}
+
+func TestIsBareEvent(t *testing.T) {
+	assert.True(t, isBareEvent([]byte(`{"event": "$pageview"}`)))
+	assert.True(t, isBareEvent([]byte(`{"api_key": "token"}`)))
+	assert.False(t, isBareEvent([]byte(`{"event": "$pageview", "data": "{}"}`)))
+	assert.False(t, isBareEvent([]byte(`{"uuid": "test-uuid", "data": "{}"}`)))
+	assert.False(t, isBareEvent([]byte(`{"uuid": "test-uuid"}`)))
+	assert.False(t, isBareEvent([]byte(`not json`)))
+}
+
+func TestDecoderForContentType(t *testing.T) {
+	for contentType, expected := range map[string]Decoder{
+		"application/json":                JSONDecoder{},
+		"Application/JSON; charset=utf-8": JSONDecoder{},
+		"application/x-protobuf":          ProtobufDecoder{},
+		"application/protobuf":            ProtobufDecoder{},
+	} {
+		decoder, ok := decoderForContentType(contentType)
+		assert.True(t, ok, contentType)
+		assert.Equal(t, expected, decoder, contentType)
+	}
+
+	for _, contentType := range []string{"", "text/plain", "application/avro"} {
+		_, ok := decoderForContentType(contentType)
+		assert.False(t, ok, contentType)
+	}
+}
+
+func TestJSONDecoderSinglePassMatchesSlowPath(t *testing.T) {
+	for _, value := range []string{
+		`{"uuid": "1", "token": "t", "data": "{\"event\": \"$pageview\", \"properties\": {\"a\": 1}}"}`,
+		`{"uuid": "1", "event": "$pageview", "api_key": "t", "properties": {"a": 1}}`,
+		`{"uuid": "1", "api_key": "t"}`,
+		`{"uuid": "1", "data": "", "event": "$pageview"}`,
+		`{"uuid": "1", "data": {"event": "$pageview"}, "event": "$pageview"}`,
+		`{"uuid": 1, "event": "$pageview", "api_key": "t"}`,
+		`{"uuid": 1, "data": "{}"}`,
+		`{"uuid": "1"}`,
+		`{"uuid": "1", "data": "not json"}`,
+		`not json`,
+	} {
+		t.Run(value, func(t *testing.T) {
+			wrapper, event, err := JSONDecoder{}.Decode([]byte(value))
+			slowWrapper, slowEvent, slowErr := JSONDecoder{}.decodeSlow([]byte(value))
+			assert.Equal(t, slowWrapper, wrapper)
+			assert.Equal(t, slowEvent, event)
+			assert.Equal(t, slowErr, err)
+		})
+	}
+}
+
+func TestJSONDecoderPooledBuffersMatchEncodingJSON(t *testing.T) {
+	// Decoded one after the other, so each message reuses the buffer the one
+	// before it left in the pool, including a shorter one after a longer one.
+	values := []string{
+		`{"uuid": "1", "token": "t", "data": "{\"event\": \"$pageview\", \"properties\": {\"$current_url\": \"https://example.com/a-much-longer-path\", \"$lat\": 52.52, \"$lon\": 13.4}}"}`,
+		`{"uuid": "2", "token": "t", "data": "{\"event\": \"$click\", \"properties\": {\"a\": 1}}"}`,
+		`{"uuid": "3", "token": "t", "data": "{\"event\": \"caf\u00e9\", \"properties\": {\"nested\": {\"list\": [1, \"two\", null]}}}"}`,
+		`{"uuid": "4", "event": "$pageview", "api_key": "t", "properties": {"a": 1}}`,
+	}
+	for i := 0; i < 2; i++ {
+		for _, value := range values {
+			wrapper, event, err := JSONDecoder{}.Decode([]byte(value))
+			require.NoError(t, err)
+			slowWrapper, slowEvent, err := JSONDecoder{}.decodeSlow([]byte(value))
+			require.NoError(t, err)
+			assert.Equal(t, slowWrapper, wrapper)
+			assert.Equal(t, slowEvent, event)
+
+			encoded, err := json.Marshal(event)
+			require.NoError(t, err)
+			expected, err := json.Marshal(slowEvent)
+			require.NoError(t, err)
+			assert.Equal(t, string(expected), string(encoded))
+		}
+	}
+}
+
+func BenchmarkJSONDecoder(b *testing.B) {
+	wrapped := []byte(`{"uuid": "0190b7b6-ec1d-7d6b-a0c6-0f5b7e0b3b8e", "distinct_id": "user-1", "ip": "192.0.2.1", "token": "phc_test", "data": "{\"event\": \"$pageview\", \"properties\": {\"$current_url\": \"https://example.com/pricing\", \"$browser\": \"Firefox\", \"$os\": \"Linux\", \"$lib\": \"web\", \"$referrer\": \"https://example.com/\"}}"}`)
+	bare := []byte(`{"uuid": "0190b7b6-ec1d-7d6b-a0c6-0f5b7e0b3b8e", "distinct_id": "user-1", "event": "$pageview", "api_key": "phc_test", "properties": {"$current_url": "https://example.com/pricing", "$browser": "Firefox", "$os": "Linux", "$lib": "web", "$referrer": "https://example.com/"}}`)
+
+	properties := map[string]interface{}{}
+	for i := 0; i < 100; i++ {
+		properties[fmt.Sprintf("$property_%d", i)] = strings.Repeat("x", 50)
+	}
+	data, err := json.Marshal(PostHogEvent{Event: "$pageview", Properties: properties})
+	require.NoError(b, err)
+	large, err := json.Marshal(PostHogEventWrapper{Uuid: "1", Token: "phc_test", Data: string(data)})
+	require.NoError(b, err)
+
+	for name, value := range map[string][]byte{"Wrapped": wrapped, "Bare": bare, "Large": large} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := (JSONDecoder{}).Decode(value); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
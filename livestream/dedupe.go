@@ -0,0 +1,84 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultDedupeMaxSize = 100000
+
+// Deduplicator remembers the event uuids seen within Window, so the copies
+// that producer retries and Kafka redeliveries make are only counted once.
+// At most MaxSize uuids are remembered; past that the oldest are forgotten
+// early.
+type Deduplicator struct {
+	Window  time.Duration
+	MaxSize int
+
+	clock Clock
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+	// order holds the uuids of seen in the order they were first seen, which
+	// is also the order they expire in.
+	order []seenUuid
+}
+
+type seenUuid struct {
+	uuid string
+	at   time.Time
+}
+
+func NewDeduplicator(window time.Duration, maxSize int, clock Clock) *Deduplicator {
+	if maxSize <= 0 {
+		maxSize = defaultDedupeMaxSize
+	}
+	return &Deduplicator{
+		Window:  window,
+		MaxSize: maxSize,
+		clock:   clock,
+		seen:    make(map[string]time.Time),
+	}
+}
+
+// Duplicate reports whether uuid was already seen within the window, and
+// remembers it if not. The window starts when a uuid is first seen, copies
+// don't extend it. Events without a uuid, and any given to a nil
+// Deduplicator, are never duplicates.
+func (d *Deduplicator) Duplicate(uuid string) bool {
+	if d == nil || uuid == "" {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock.Now()
+	d.expire(now)
+	if _, ok := d.seen[uuid]; ok {
+		return true
+	}
+	d.seen[uuid] = now
+	d.order = append(d.order, seenUuid{uuid: uuid, at: now})
+	return false
+}
+
+// Len returns how many uuids are remembered.
+func (d *Deduplicator) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.seen)
+}
+
+// expire forgets the uuids seen before the window, and the oldest ones while
+// there are MaxSize, to make room for one more.
+func (d *Deduplicator) expire(now time.Time) {
+	n := 0
+	for n < len(d.order) && (now.Sub(d.order[n].at) >= d.Window || len(d.seen) >= d.MaxSize) {
+		delete(d.seen, d.order[n].uuid)
+		n++
+	}
+	// The expired entries are left behind in the array until append next
+	// moves the rest to a new one.
+	d.order = d.order[n:]
+}
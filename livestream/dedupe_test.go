@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeduplicatorWindow(t *testing.T) {
+	clock := newFakeClock()
+	dedupe := NewDeduplicator(time.Minute, 0, clock)
+
+	assert.False(t, dedupe.Duplicate("1"))
+	clock.Advance(30 * time.Second)
+	assert.True(t, dedupe.Duplicate("1"), "within the window")
+	assert.False(t, dedupe.Duplicate("2"))
+
+	// The window runs from the first copy, not the latest.
+	clock.Advance(30 * time.Second)
+	assert.False(t, dedupe.Duplicate("1"), "outside the window")
+	assert.True(t, dedupe.Duplicate("2"))
+	assert.Equal(t, 2, dedupe.Len())
+}
+
+func TestDeduplicatorMaxSize(t *testing.T) {
+	dedupe := NewDeduplicator(time.Hour, 2, newFakeClock())
+
+	assert.False(t, dedupe.Duplicate("1"))
+	assert.False(t, dedupe.Duplicate("2"))
+	assert.False(t, dedupe.Duplicate("3"))
+	assert.Equal(t, 2, dedupe.Len())
+
+	// The oldest was forgotten to make room.
+	assert.True(t, dedupe.Duplicate("3"))
+	assert.False(t, dedupe.Duplicate("1"))
+}
+
+func TestDeduplicatorNoUuid(t *testing.T) {
+	dedupe := NewDeduplicator(time.Minute, 0, newFakeClock())
+	assert.False(t, dedupe.Duplicate(""))
+	assert.False(t, dedupe.Duplicate(""))
+
+	var nilDedupe *Deduplicator
+	assert.False(t, nilDedupe.Duplicate("1"))
+	assert.False(t, nilDedupe.Duplicate("1"))
+}
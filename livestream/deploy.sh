@@ -1,5 +1,6 @@
 #!/bin/bash
 
-env GOOS=linux GOARCH=arm64 go build -o dist/livestream
+env GOOS=linux GOARCH=arm64 go build -o dist/livestream \
+    -ldflags "-X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
 scp dist/livestream ubuntu@172.31.40.65:
 
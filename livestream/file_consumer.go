@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// errNotKafka is returned by the FileConsumer methods that only make sense
+// against a broker, such as those Replay needs.
+var errNotKafka = errors.New("not supported when reading events from a file")
+
+// FileConsumer is a KafkaConsumerInterface reading newline-delimited
+// PostHogEventWrapper JSON from a file instead of Kafka, so the whole pipeline
+// can run locally without a broker. Every line is a message of partition 0,
+// offset by line. Once the file is read, reads time out like on a quiet
+// topic.
+type FileConsumer struct {
+	topic  string
+	file   io.ReadCloser
+	reader *bufio.Reader
+	clock  Clock
+	// Realtime spaces messages out like the timestamps of their events, so
+	// the stream plays back at the pace it was recorded. Otherwise messages
+	// are read as fast as they are asked for.
+	Realtime bool
+
+	offset int64
+	// pending is the next message, held back until due when Realtime.
+	pending *kafka.Message
+	due     time.Time
+	// start and first pair the wall time with the first event timestamp,
+	// which later messages are due relative to.
+	start time.Time
+	first time.Time
+}
+
+// NewFileConsumer opens path for reading. Messages are tagged with path as
+// their topic.
+func NewFileConsumer(path string, realtime bool) (*FileConsumer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &FileConsumer{
+		topic:    path,
+		file:     file,
+		reader:   bufio.NewReader(file),
+		clock:    realClock{},
+		Realtime: realtime,
+	}, nil
+}
+
+// NewFileKafkaConsumer is like NewPostHogKafkaConsumer but reads the events
+// from a file, see FileConsumer.
+func NewFileKafkaConsumer(path string, realtime bool, geolocator GeoLocator, outgoingChan chan PostHogEvent, statsChan chan PostHogEvent) (*PostHogKafkaConsumer, error) {
+	consumer, err := NewFileConsumer(path, realtime)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PostHogKafkaConsumer{
+		consumer:     consumer,
+		topics:       []string{path},
+		geolocator:   geolocator,
+		outgoingChan: outgoingChan,
+		statsChan:    statsChan,
+		clock:        realClock{},
+	}, nil
+}
+
+func (f *FileConsumer) SubscribeTopics(topics []string, rebalanceCb kafka.RebalanceCb) error {
+	return nil
+}
+
+// ReadMessage returns the next line of the file. It waits up to timeout for
+// a message that is not due yet, and then for as long at the end of the file,
+// before reporting a timeout.
+func (f *FileConsumer) ReadMessage(timeout time.Duration) (*kafka.Message, error) {
+	if f.pending == nil {
+		msg, err := f.next()
+		if errors.Is(err, io.EOF) {
+			<-f.clock.After(timeout)
+			return nil, kafka.NewError(kafka.ErrTimedOut, "end of file", false)
+		}
+		if err != nil {
+			return nil, err
+		}
+		f.pending, f.due = msg, f.dueAt(msg)
+	}
+
+	if wait := f.due.Sub(f.clock.Now()); wait > 0 {
+		if wait > timeout {
+			<-f.clock.After(timeout)
+			return nil, kafka.NewError(kafka.ErrTimedOut, "next event not due yet", false)
+		}
+		<-f.clock.After(wait)
+	}
+	msg := f.pending
+	f.pending = nil
+	return msg, nil
+}
+
+// next reads the next non-blank line into a message.
+func (f *FileConsumer) next() (*kafka.Message, error) {
+	for {
+		line, err := f.reader.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			msg := &kafka.Message{
+				TopicPartition: kafka.TopicPartition{Topic: &f.topic, Offset: kafka.Offset(f.offset)},
+				Value:          line,
+			}
+			f.offset++
+			return msg, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// dueAt returns when msg should be read. Messages are due right away unless
+// Realtime, and then too when their event has no timestamp or one earlier
+// than the first event's.
+func (f *FileConsumer) dueAt(msg *kafka.Message) time.Time {
+	now := f.clock.Now()
+	if !f.Realtime {
+		return now
+	}
+	_, event, err := JSONDecoder{}.Decode(msg.Value)
+	if err != nil || event.Timestamp.IsZero() {
+		return now
+	}
+	msg.Timestamp = event.Timestamp
+
+	if f.first.IsZero() {
+		f.start, f.first = now, event.Timestamp
+	}
+	return f.start.Add(event.Timestamp.Sub(f.first))
+}
+
+// CommitMessage does nothing, the file is read from the start every time.
+func (f *FileConsumer) CommitMessage(msg *kafka.Message) ([]kafka.TopicPartition, error) {
+	return nil, nil
+}
+
+// Assignment is empty, so there is no lag to report.
+func (f *FileConsumer) Assignment() ([]kafka.TopicPartition, error) {
+	return nil, nil
+}
+
+func (f *FileConsumer) Committed(partitions []kafka.TopicPartition, timeoutMs int) ([]kafka.TopicPartition, error) {
+	return nil, errNotKafka
+}
+
+func (f *FileConsumer) QueryWatermarkOffsets(topic string, partition int32, timeoutMs int) (int64, int64, error) {
+	return 0, 0, errNotKafka
+}
+
+func (f *FileConsumer) GetMetadata(topic *string, allTopics bool, timeoutMs int) (*kafka.Metadata, error) {
+	return nil, errNotKafka
+}
+
+func (f *FileConsumer) Assign(partitions []kafka.TopicPartition) error {
+	return errNotKafka
+}
+
+func (f *FileConsumer) OffsetsForTimes(times []kafka.TopicPartition, timeoutMs int) ([]kafka.TopicPartition, error) {
+	return nil, errNotKafka
+}
+
+func (f *FileConsumer) Close() error {
+	return f.file.Close()
+}
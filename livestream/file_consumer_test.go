@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileKafkaConsumer(t *testing.T) {
+	geolocator, err := NewMaxMindGeoLocator("testdata/city.mmdb")
+	require.NoError(t, err)
+	consumer, err := NewFileKafkaConsumer("testdata/events.jsonl", false, geolocator, make(chan PostHogEvent), make(chan PostHogEvent, 3))
+	require.NoError(t, err)
+
+	events := consumeAll(t, consumer, 3)
+
+	uuids := make([]string, len(events))
+	for i, event := range events {
+		uuids[i] = event.Uuid
+		assert.Equal(t, "phc_test", event.Token)
+		assert.Equal(t, "testdata/events.jsonl", event.Topic)
+	}
+	assert.Equal(t, []string{"1", "2", "3"}, uuids)
+	assert.Equal(t, "$autocapture", events[1].Event)
+	assert.Equal(t, "s1", events[1].SessionId)
+	assert.Equal(t, int64(1), events[1].Offset)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 5, 0, time.UTC), events[2].Timestamp)
+	assert.Equal(t, "London", events[0].City)
+	assert.Equal(t, "Milton", events[2].City)
+}
+
+func TestFileConsumerAsFastAsPossible(t *testing.T) {
+	consumer, err := NewFileConsumer("testdata/events.jsonl", false)
+	require.NoError(t, err)
+	defer consumer.Close()
+	clock := newFakeClock()
+	consumer.clock = clock
+
+	for offset := 0; offset < 3; offset++ {
+		msg, err := consumer.ReadMessage(time.Second)
+		require.NoError(t, err)
+		assert.Equal(t, kafka.Offset(offset), msg.TopicPartition.Offset)
+	}
+	assert.Empty(t, clock.Waits())
+
+	// At the end of the file, reads time out like on a quiet topic.
+	_, err = consumer.ReadMessage(time.Second)
+	assert.True(t, isIdleRead(err))
+	assert.Equal(t, []time.Duration{time.Second}, clock.Waits())
+}
+
+func TestFileConsumerRealtime(t *testing.T) {
+	consumer, err := NewFileConsumer("testdata/events.jsonl", true)
+	require.NoError(t, err)
+	defer consumer.Close()
+	clock := newFakeClock()
+	consumer.clock = clock
+
+	read := func(timeout time.Duration) string {
+		t.Helper()
+		msg, err := consumer.ReadMessage(timeout)
+		require.NoError(t, err)
+		_, event, err := JSONDecoder{}.Decode(msg.Value)
+		require.NoError(t, err)
+		return event.Event
+	}
+
+	assert.Equal(t, "$pageview", read(time.Second))
+	// 2s after the first event.
+	assert.Equal(t, "$autocapture", read(5*time.Second))
+	// 3s later, but reads time out every second until then.
+	_, err = consumer.ReadMessage(time.Second)
+	assert.True(t, isIdleRead(err))
+	_, err = consumer.ReadMessage(time.Second)
+	assert.True(t, isIdleRead(err))
+	assert.Equal(t, "$pageleave", read(time.Second))
+
+	assert.Equal(t, []time.Duration{2 * time.Second, time.Second, time.Second, time.Second}, clock.Waits())
+}
+
+func TestFileConsumerMissingFile(t *testing.T) {
+	_, err := NewFileConsumer("testdata/missing.jsonl", false)
+	assert.Error(t, err)
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"maps"
+	"sync"
 	"sync/atomic"
 
 	"github.com/gofrs/uuid/v5"
 	"golang.org/x/exp/slices"
+	"golang.org/x/time/rate"
 )
 
 type Subscription struct {
@@ -18,8 +22,17 @@ type Subscription struct {
 	Token      string
 	DistinctId string
 	EventTypes []string
+	// Box, when set, only lets through events located inside it.
+	Box *BoundingBox
 
 	Geo bool
+	// Format is the shape non-geo events are sent in. The zero value is
+	// FormatFull.
+	Format OutputFormat
+
+	// RateLimit caps how many events per second the client is sent. Events
+	// over the limit are dropped. Nil means no limit.
+	RateLimit *rate.Limiter
 
 	// Channels
 	EventChan   chan interface{}
@@ -33,37 +46,115 @@ type ResponsePostHogEvent struct {
 	PersonId   string                 `json:"person_id"`
 	Event      string                 `json:"event"`
 	Properties map[string]interface{} `json:"properties"`
+	// PartitionKey is only sent when the filter includes partition keys.
+	PartitionKey string `json:"partition_key,omitempty"`
+	// Raw is only sent when the filter includes raw messages.
+	Raw json.RawMessage `json:"raw,omitempty"`
 }
 
 type ResponseGeoEvent struct {
-	Lat   float64 `json:"lat"`
-	Lng   float64 `json:"lng"`
-	Count uint    `json:"count"`
+	Lat         float64 `json:"lat"`
+	Lng         float64 `json:"lng"`
+	Geohash     string  `json:"geohash,omitempty"`
+	City        string  `json:"city,omitempty"`
+	Region      string  `json:"region,omitempty"`
+	CountryCode string  `json:"country_code,omitempty"`
+	Count       uint    `json:"count"`
 }
 
 type Filter struct {
 	inboundChan chan PostHogEvent
 	subChan     chan Subscription
 	unSubChan   chan Subscription
-	subs        []Subscription
+	// subs groups subscriptions by the token they filter on. Subscriptions
+	// for every token are stored under "".
+	subs map[string][]Subscription
+	// subscriberCounts mirrors how many subscriptions subs holds per token,
+	// for Subscribers to read while Run owns subs.
+	subscriberMu     sync.Mutex
+	subscriberCounts map[string]int
+
+	// inboundBatchChan optionally carries batches from a consumer with
+	// batching enabled. Each event is filtered exactly like inboundChan's.
+	inboundBatchChan chan []PostHogEvent
+	// properties strips properties clients should not see. It defaults to
+	// denying defaultDeniedProperties.
+	properties *PropertyFilter
+	// geohashPrecision, when positive, adds a geohash with that many
+	// characters to geo events. hideCoordinates zeroes their exact lat/lng.
+	geohashPrecision int
+	hideCoordinates  bool
+	// includePartitionKey adds the Kafka message key to non-geo events.
+	includePartitionKey bool
+	// includeRaw adds the original message to non-geo events, for those that
+	// the consumer kept it for.
+	includeRaw bool
+	// distinctIds, when set, hashes the distinct ids sent to clients. Nil
+	// sends them as they are.
+	distinctIds *DistinctIdHasher
+	// sampler thins out the events of high-volume tokens before they are
+	// dispatched. Nil streams every event.
+	sampler *TokenSampler
+
+	// done is closed when Run returns.
+	done chan struct{}
 }
 
 func NewFilter(subChan chan Subscription, unSubChan chan Subscription, inboundChan chan PostHogEvent) *Filter {
-	return &Filter{subChan: subChan, unSubChan: unSubChan, inboundChan: inboundChan, subs: make([]Subscription, 0)}
+	return &Filter{
+		subChan:     subChan,
+		unSubChan:   unSubChan,
+		inboundChan: inboundChan,
+		subs:        make(map[string][]Subscription),
+		// Allocated here so Subscribers can be called before Run.
+		subscriberCounts: make(map[string]int),
+		properties:       NewPropertyFilter(nil, defaultDeniedProperties),
+		done:             make(chan struct{}),
+	}
+}
+
+// Write queues an event for Run to send to the matching subscriptions.
+func (c *Filter) Write(event PostHogEvent) error {
+	c.inboundChan <- event
+	return nil
+}
+
+// Close stops Run and waits until it has sent everything written before to
+// the subscriptions.
+func (c *Filter) Close() error {
+	close(c.inboundChan)
+	<-c.done
+	return nil
 }
 
 func convertToResponseGeoEvent(event PostHogEvent) *ResponseGeoEvent {
 	return &ResponseGeoEvent{
-		Lat:   event.Lat,
-		Lng:   event.Lng,
-		Count: 1,
+		Lat:         event.Lat,
+		Lng:         event.Lng,
+		City:        event.City,
+		Region:      event.Region,
+		CountryCode: event.CountryCode,
+		Count:       1,
 	}
 }
 
+// coarsen applies the filter's location privacy settings to a location
+// before it leaves the server, returning its geohash if one is wanted.
+func (c *Filter) coarsen(lat *float64, lng *float64) (geohash string) {
+	if c.geohashPrecision > 0 {
+		geohash = encodeGeohash(*lat, *lng, c.geohashPrecision)
+	}
+	if c.hideCoordinates {
+		*lat = 0
+		*lng = 0
+	}
+	return geohash
+}
+
 func convertToResponsePostHogEvent(event PostHogEvent, teamId int) *ResponsePostHogEvent {
 	return &ResponsePostHogEvent{
 		Uuid:       event.Uuid,
-		Timestamp:  event.Timestamp,
+		Timestamp:  event.Timestamp.Format(timestampLayout),
 		DistinctId: event.DistinctId,
 		PersonId:   uuidFromDistinctId(teamId, event.DistinctId),
 		Event:      event.Event,
@@ -88,70 +179,168 @@ func uuidFromDistinctId(teamId int, distinctId string) string {
 }
 
 func removeSubscription(clientId string, subs []Subscription) []Subscription {
-	var lighterSubs []Subscription
-	for i, sub := range subs {
-		if clientId == sub.ClientId {
-			lighterSubs = slices.Delete(subs, i, i+1)
-		}
-	}
-	return lighterSubs
+	return slices.DeleteFunc(subs, func(sub Subscription) bool {
+		return sub.ClientId == clientId
+	})
 }
 
 func (c *Filter) Run() {
+	defer close(c.done)
 	for {
 		select {
 		case newSub := <-c.subChan:
-			c.subs = append(c.subs, newSub)
+			c.subs[newSub.Token] = append(c.subs[newSub.Token], newSub)
+			c.countSubscribers(newSub.Token)
+			activeSubscribers.Inc()
 		case unSub := <-c.unSubChan:
-			c.subs = removeSubscription(unSub.ClientId, c.subs)
-		case event := <-c.inboundChan:
-			var responseEvent *ResponsePostHogEvent
-			var responseGeoEvent *ResponseGeoEvent
-
-			for _, sub := range c.subs {
-				if sub.ShouldClose.Load() {
-					log.Println("User has unsubscribed, but not been removed from the slice of subs")
-					continue
-				}
+			before := len(c.subs[unSub.Token])
+			remaining := removeSubscription(unSub.ClientId, c.subs[unSub.Token])
+			activeSubscribers.Sub(float64(before - len(remaining)))
+			if len(remaining) == 0 {
+				delete(c.subs, unSub.Token)
+			} else {
+				c.subs[unSub.Token] = remaining
+			}
+			c.countSubscribers(unSub.Token)
+		case event, ok := <-c.inboundChan:
+			if !ok {
+				return
+			}
+			c.dispatch(event)
+		case batch, ok := <-c.inboundBatchChan:
+			if !ok {
+				return
+			}
+			for _, event := range batch {
+				c.dispatch(event)
+			}
+		}
+	}
+}
 
-				// log.Printf("event.Token: %s, sub.Token: %s", event.Token, sub.Token)
-				if sub.Token != "" && event.Token != sub.Token {
-					continue
-				}
+// countSubscribers updates subscriberCounts after the subscriptions for token
+// changed.
+func (c *Filter) countSubscribers(token string) {
+	c.subscriberMu.Lock()
+	defer c.subscriberMu.Unlock()
+	if n := len(c.subs[token]); n > 0 {
+		c.subscriberCounts[token] = n
+	} else {
+		delete(c.subscriberCounts, token)
+	}
+}
 
-				if sub.DistinctId != "" && event.DistinctId != sub.DistinctId {
+// Subscribers returns how many clients are subscribed, for each token they
+// filter on. Clients subscribed to every token are counted under "".
+func (c *Filter) Subscribers() map[string]int {
+	c.subscriberMu.Lock()
+	defer c.subscriberMu.Unlock()
+	return maps.Clone(c.subscriberCounts)
+}
+
+// dispatch forwards the event to every subscription whose filters match. Only
+// subscriptions for the event's token, or for all tokens, are looked at.
+func (c *Filter) dispatch(event PostHogEvent) {
+	if !c.sampler.Keep(event) {
+		eventsSampledOut.Inc()
+		return
+	}
+	c.dispatchTo(c.subs[event.Token], event)
+	if event.Token != "" {
+		c.dispatchTo(c.subs[""], event)
+	}
+}
+
+func (c *Filter) dispatchTo(subs []Subscription, event PostHogEvent) {
+	var responseEvent *ResponsePostHogEvent
+	var responseGeoEvent *ResponseGeoEvent
+	var compactEvent *CompactEvent
+	// distinctId is the id clients see, hashed when distinctIds is set. It
+	// is worked out for the first subscriber filtering on it.
+	var distinctId *string
+
+	for _, sub := range subs {
+		if sub.ShouldClose.Load() {
+			log.Println("User has unsubscribed, but not been removed from the slice of subs")
+			continue
+		}
+
+		if sub.DistinctId != "" {
+			if distinctId == nil {
+				id := c.distinctIds.Hash(event.DistinctId)
+				distinctId = &id
+			}
+			if *distinctId != sub.DistinctId {
+				continue
+			}
+		}
+
+		if len(sub.EventTypes) > 0 && !slices.Contains(sub.EventTypes, event.Event) {
+			continue
+		}
+
+		if sub.Box != nil && !sub.Box.Contains(event) {
+			continue
+		}
+
+		if sub.Geo {
+			if event.Lat != 0.0 {
+				if sub.RateLimit != nil && !sub.RateLimit.Allow() {
 					continue
 				}
+				if responseGeoEvent == nil {
+					responseGeoEvent = convertToResponseGeoEvent(event)
+					responseGeoEvent.Geohash = c.coarsen(&responseGeoEvent.Lat, &responseGeoEvent.Lng)
+				}
 
-				if len(sub.EventTypes) > 0 && !slices.Contains(sub.EventTypes, event.Event) {
-					continue
+				select {
+				case sub.EventChan <- *responseGeoEvent:
+				default:
+					// Don't block
 				}
+			}
+		} else if sub.Format == FormatCompact {
+			if sub.RateLimit != nil && !sub.RateLimit.Allow() {
+				continue
+			}
+			if compactEvent == nil {
+				compactEvent = convertToCompactEvent(event)
+				compactEvent.Geohash = c.coarsen(&compactEvent.Lat, &compactEvent.Lng)
+			}
 
-				if sub.Geo {
-					if event.Lat != 0.0 {
-						if responseGeoEvent == nil {
-							responseGeoEvent = convertToResponseGeoEvent(event)
-						}
-
-						select {
-						case sub.EventChan <- *responseGeoEvent:
-						default:
-							// Don't block
-						}
-					}
-				} else {
-					if responseEvent == nil {
-						responseEvent = convertToResponsePostHogEvent(event, sub.TeamId)
-					}
-
-					select {
-					case sub.EventChan <- *responseEvent:
-					default:
-						// Don't block
-					}
+			select {
+			case sub.EventChan <- *compactEvent:
+			default:
+				// Don't block
+			}
+		} else {
+			if sub.RateLimit != nil && !sub.RateLimit.Allow() {
+				continue
+			}
+			if responseEvent == nil {
+				responseEvent = convertToResponsePostHogEvent(event, sub.TeamId)
+				responseEvent.Properties = c.properties.Apply(event.Properties)
+				if c.distinctIds != nil {
+					responseEvent.DistinctId = c.distinctIds.Hash(event.DistinctId)
+					// Derived from the real distinct id, so it would give it
+					// away to anyone who can look it up.
+					responseEvent.PersonId = ""
+				}
+				if c.includePartitionKey {
+					// Usually the distinct id, so it is hashed the same way.
+					responseEvent.PartitionKey = c.distinctIds.Hash(event.PartitionKey)
+				}
+				// The original message still holds the real distinct id.
+				if c.includeRaw && c.distinctIds == nil {
+					responseEvent.Raw = event.Raw
 				}
 			}
 
+			select {
+			case sub.EventChan <- *responseEvent:
+			default:
+				// Don't block
+			}
 		}
 	}
 }
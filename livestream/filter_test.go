@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"testing"
 	"time"
 
@@ -38,6 +40,17 @@ func TestRemoveSubscription(t *testing.T) {
 	assert.Equal(t, "3", result[1].ClientId)
 }
 
+func TestRemoveSubscriptionNotFound(t *testing.T) {
+	subs := []Subscription{
+		{ClientId: "1"},
+		{ClientId: "2"},
+	}
+
+	result := removeSubscription("3", subs)
+
+	assert.Len(t, result, 2)
+}
+
 func TestUuidFromDistinctId(t *testing.T) {
 	result1 := uuidFromDistinctId(1, "user1")
 	result2 := uuidFromDistinctId(1, "user1")
@@ -64,7 +77,7 @@ func TestConvertToResponseGeoEvent(t *testing.T) {
 }
 
 func TestConvertToResponsePostHogEvent(t *testing.T) {
-	timestamp := "2023-01-01T00:00:00Z"
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
 	event := PostHogEvent{
 		Uuid:       "123",
 		Timestamp:  timestamp,
@@ -76,7 +89,7 @@ func TestConvertToResponsePostHogEvent(t *testing.T) {
 	result := convertToResponsePostHogEvent(event, 1)
 
 	assert.Equal(t, "123", result.Uuid)
-	assert.Equal(t, "2023-01-01T00:00:00Z", result.Timestamp)
+	assert.Equal(t, "2023-01-01T00:00:00.000Z", result.Timestamp)
 	assert.Equal(t, "user1", result.DistinctId)
 	assert.NotEmpty(t, result.PersonId)
 	assert.Equal(t, "pageview", result.Event)
@@ -109,7 +122,7 @@ func TestFilterRun(t *testing.T) {
 	time.Sleep(10 * time.Millisecond)
 
 	// Test event filtering
-	timestamp := "2023-01-01T00:00:00Z"
+	timestamp := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
 	event := PostHogEvent{
 		Uuid:       "123",
 		Timestamp:  timestamp,
@@ -141,6 +154,32 @@ func TestFilterRun(t *testing.T) {
 	assert.Empty(t, filter.subs)
 }
 
+func TestFilterSubscribers(t *testing.T) {
+	subChan := make(chan Subscription)
+	unSubChan := make(chan Subscription)
+	filter := NewFilter(subChan, unSubChan, make(chan PostHogEvent))
+	go filter.Run()
+
+	sub := func(clientId, token string) Subscription {
+		return Subscription{ClientId: clientId, Token: token, EventChan: make(chan interface{}, 1), ShouldClose: &atomic.Bool{}}
+	}
+	assert.Empty(t, filter.Subscribers())
+
+	subChan <- sub("1", "token1")
+	subChan <- sub("2", "token1")
+	subChan <- sub("3", "")
+	// Sending the next one waits until Run is done with the last.
+	unSubChan <- sub("unknown", "token2")
+	assert.Equal(t, map[string]int{"token1": 2, "": 1}, filter.Subscribers())
+
+	unSubChan <- sub("1", "token1")
+	unSubChan <- sub("1", "token1")
+	unSubChan <- sub("3", "")
+	subChan <- sub("4", "token2")
+	unSubChan <- sub("unknown", "token2")
+	assert.Equal(t, map[string]int{"token1": 1, "token2": 1}, filter.Subscribers())
+}
+
 func TestFilterRunWithGeoEvent(t *testing.T) {
 	subChan := make(chan Subscription)
 	unSubChan := make(chan Subscription)
@@ -183,3 +222,388 @@ func TestFilterRunWithGeoEvent(t *testing.T) {
 		t.Fatal("Timed out waiting for geo event")
 	}
 }
+
+func TestFilterRunStopsWhenInboundClosed(t *testing.T) {
+	inboundChan := make(chan PostHogEvent)
+	filter := NewFilter(make(chan Subscription), make(chan Subscription), inboundChan)
+
+	done := make(chan struct{})
+	go func() {
+		filter.Run()
+		close(done)
+	}()
+
+	close(inboundChan)
+
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Filter.Run did not return after the inbound channel was closed")
+	}
+}
+
+func TestFilterRunWithBatches(t *testing.T) {
+	batchChan := make(chan []PostHogEvent)
+	filter := NewFilter(make(chan Subscription), make(chan Subscription), make(chan PostHogEvent))
+	filter.inboundBatchChan = batchChan
+
+	go filter.Run()
+
+	eventChan := make(chan interface{}, 2)
+	filter.subChan <- Subscription{
+		ClientId:    "1",
+		Token:       "token1",
+		EventChan:   eventChan,
+		ShouldClose: &atomic.Bool{},
+	}
+
+	batchChan <- []PostHogEvent{
+		{Uuid: "1", Token: "token1", Event: "pageview"},
+		{Uuid: "2", Token: "token2", Event: "pageview"},
+		{Uuid: "3", Token: "token1", Event: "pageview"},
+	}
+
+	for _, want := range []string{"1", "3"} {
+		select {
+		case receivedEvent := <-eventChan:
+			responseEvent, ok := receivedEvent.(ResponsePostHogEvent)
+			require.True(t, ok)
+			assert.Equal(t, want, responseEvent.Uuid)
+		case <-time.After(100 * time.Millisecond):
+			t.Fatal("Timed out waiting for event")
+		}
+	}
+	assert.Empty(t, eventChan)
+}
+
+func TestFilterRunIsolatesTokens(t *testing.T) {
+	subChan := make(chan Subscription)
+	unSubChan := make(chan Subscription)
+	inboundChan := make(chan PostHogEvent)
+
+	filter := NewFilter(subChan, unSubChan, inboundChan)
+	go filter.Run()
+
+	chanA := make(chan interface{}, 10)
+	chanB := make(chan interface{}, 10)
+	chanAll := make(chan interface{}, 10)
+	subChan <- Subscription{ClientId: "a", Token: "tokenA", EventChan: chanA, ShouldClose: &atomic.Bool{}}
+	subChan <- Subscription{ClientId: "b", Token: "tokenB", EventChan: chanB, ShouldClose: &atomic.Bool{}}
+	subChan <- Subscription{ClientId: "all", EventChan: chanAll, ShouldClose: &atomic.Bool{}}
+
+	for i, token := range []string{"tokenB", "tokenA", "tokenB", "tokenC"} {
+		inboundChan <- PostHogEvent{Uuid: fmt.Sprint(i), Token: token, Event: "pageview"}
+	}
+	// An unsubscribe is only handled after every earlier event was dispatched.
+	unSubChan <- Subscription{ClientId: "all"}
+
+	received := func(ch chan interface{}) []string {
+		var uuids []string
+		for len(ch) > 0 {
+			uuids = append(uuids, (<-ch).(ResponsePostHogEvent).Uuid)
+		}
+		return uuids
+	}
+
+	assert.Equal(t, []string{"1"}, received(chanA))
+	assert.Equal(t, []string{"0", "2"}, received(chanB))
+	assert.Equal(t, []string{"0", "1", "2", "3"}, received(chanAll))
+}
+
+func TestFilterRunEventTypes(t *testing.T) {
+	tests := []struct {
+		name       string
+		eventTypes []string
+		expected   []string
+	}{
+		{name: "Single", eventTypes: []string{"$pageview"}, expected: []string{"$pageview"}},
+		{name: "Multiple", eventTypes: []string{"$pageview", "$autocapture"}, expected: []string{"$pageview", "$autocapture"}},
+		{name: "Empty", eventTypes: []string{}, expected: []string{"$pageview", "$autocapture", "$pageleave", "$Pageview"}},
+		{name: "Case sensitive", eventTypes: []string{"$Pageview"}, expected: []string{"$Pageview"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subChan := make(chan Subscription)
+			unSubChan := make(chan Subscription)
+			inboundChan := make(chan PostHogEvent)
+
+			filter := NewFilter(subChan, unSubChan, inboundChan)
+			go filter.Run()
+			defer close(inboundChan)
+
+			eventChan := make(chan interface{}, 10)
+			subChan <- Subscription{ClientId: "1", Token: "token1", EventTypes: tt.eventTypes, EventChan: eventChan, ShouldClose: &atomic.Bool{}}
+
+			for _, event := range []string{"$pageview", "$autocapture", "$pageleave", "$Pageview"} {
+				inboundChan <- PostHogEvent{Token: "token1", Event: event}
+			}
+			unSubChan <- Subscription{ClientId: "1", Token: "token1"}
+
+			received := []string{}
+			for len(eventChan) > 0 {
+				received = append(received, (<-eventChan).(ResponsePostHogEvent).Event)
+			}
+			assert.Equal(t, tt.expected, received)
+		})
+	}
+}
+
+func TestFilterRunBoundingBox(t *testing.T) {
+	subChan := make(chan Subscription)
+	unSubChan := make(chan Subscription)
+	inboundChan := make(chan PostHogEvent)
+
+	filter := NewFilter(subChan, unSubChan, inboundChan)
+	go filter.Run()
+	defer close(inboundChan)
+
+	eventChan := make(chan interface{}, 10)
+	box := &BoundingBox{MinLat: 40, MinLng: -10, MaxLat: 60, MaxLng: 10}
+	subChan <- Subscription{ClientId: "1", Token: "token1", Geo: true, Box: box, EventChan: eventChan, ShouldClose: &atomic.Bool{}}
+
+	inboundChan <- PostHogEvent{Token: "token1", Lat: 51.5, Lng: -0.1}
+	inboundChan <- PostHogEvent{Token: "token1", Lat: 40.7, Lng: -74}
+	inboundChan <- PostHogEvent{Token: "token1", Lat: 60, Lng: 10}
+	unSubChan <- Subscription{ClientId: "1", Token: "token1"}
+
+	received := []float64{}
+	for len(eventChan) > 0 {
+		received = append(received, (<-eventChan).(ResponseGeoEvent).Lat)
+	}
+	assert.Equal(t, []float64{51.5, 60}, received)
+}
+
+func TestFilterRunPartitionKey(t *testing.T) {
+	for _, include := range []bool{false, true} {
+		t.Run(fmt.Sprint(include), func(t *testing.T) {
+			subChan := make(chan Subscription)
+			unSubChan := make(chan Subscription)
+			inboundChan := make(chan PostHogEvent)
+
+			filter := NewFilter(subChan, unSubChan, inboundChan)
+			filter.includePartitionKey = include
+			go filter.Run()
+			defer close(inboundChan)
+
+			eventChan := make(chan interface{}, 1)
+			subChan <- Subscription{ClientId: "1", Token: "token1", EventChan: eventChan, ShouldClose: &atomic.Bool{}}
+			inboundChan <- PostHogEvent{Token: "token1", Event: "$pageview", PartitionKey: "user1"}
+
+			payload, err := json.Marshal(<-eventChan)
+			require.NoError(t, err)
+			if include {
+				assert.Contains(t, string(payload), `"partition_key":"user1"`)
+			} else {
+				assert.NotContains(t, string(payload), "partition_key")
+			}
+		})
+	}
+}
+
+func TestFilterRunRaw(t *testing.T) {
+	raw := json.RawMessage(`{"uuid": "1", "event": "$pageview"}`)
+	for _, include := range []bool{false, true} {
+		t.Run(fmt.Sprint(include), func(t *testing.T) {
+			subChan := make(chan Subscription)
+			inboundChan := make(chan PostHogEvent)
+
+			filter := NewFilter(subChan, make(chan Subscription), inboundChan)
+			filter.includeRaw = include
+			go filter.Run()
+			defer close(inboundChan)
+
+			eventChan := make(chan interface{}, 1)
+			subChan <- Subscription{ClientId: "1", Token: "token1", EventChan: eventChan, ShouldClose: &atomic.Bool{}}
+			inboundChan <- PostHogEvent{Token: "token1", Event: "$pageview", Raw: raw}
+
+			payload, err := json.Marshal(<-eventChan)
+			require.NoError(t, err)
+			if include {
+				assert.Contains(t, string(payload), `"raw":{"uuid":"1","event":"$pageview"}`)
+			} else {
+				assert.NotContains(t, string(payload), "raw")
+			}
+		})
+	}
+}
+
+func TestFilterRunFormats(t *testing.T) {
+	subChan := make(chan Subscription)
+	unSubChan := make(chan Subscription)
+	inboundChan := make(chan PostHogEvent)
+
+	filter := NewFilter(subChan, unSubChan, inboundChan)
+	go filter.Run()
+	defer close(inboundChan)
+
+	fullChan := make(chan interface{}, 1)
+	compactChan := make(chan interface{}, 1)
+	subChan <- Subscription{ClientId: "1", Token: "token1", EventChan: fullChan, ShouldClose: &atomic.Bool{}}
+	subChan <- Subscription{ClientId: "2", Token: "token1", Format: FormatCompact, EventChan: compactChan, ShouldClose: &atomic.Bool{}}
+	inboundChan <- PostHogEvent{
+		Uuid:       "123",
+		Token:      "token1",
+		Event:      "$pageview",
+		DistinctId: "user1",
+		Properties: map[string]interface{}{"$browser": "Firefox"},
+		Lat:        52.52,
+		Lng:        13.405,
+		Timestamp:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	var full map[string]interface{}
+	payload, err := marshalPayload(<-fullChan)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(payload, &full))
+	assert.ElementsMatch(t, []string{"uuid", "timestamp", "distinct_id", "person_id", "event", "properties"}, keys(full))
+	assert.Equal(t, map[string]interface{}{"$browser": "Firefox"}, full["properties"])
+
+	payload, err = marshalPayload(<-compactChan)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"event":"$pageview","token":"token1","lat":52.52,"lng":13.405,"ts":"2024-01-02T03:04:05.000Z"}`, string(payload))
+}
+
+func TestFilterRunCompactHidesCoordinates(t *testing.T) {
+	subChan := make(chan Subscription)
+	unSubChan := make(chan Subscription)
+	inboundChan := make(chan PostHogEvent)
+
+	filter := NewFilter(subChan, unSubChan, inboundChan)
+	filter.hideCoordinates = true
+	go filter.Run()
+	defer close(inboundChan)
+
+	eventChan := make(chan interface{}, 1)
+	subChan <- Subscription{ClientId: "1", Format: FormatCompact, EventChan: eventChan, ShouldClose: &atomic.Bool{}}
+	inboundChan <- PostHogEvent{Token: "token1", Event: "$pageview", Lat: 52.52, Lng: 13.405}
+
+	event := (<-eventChan).(CompactEvent)
+	assert.Zero(t, event.Lat)
+	assert.Zero(t, event.Lng)
+}
+
+func keys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestFilterRunDistinctId(t *testing.T) {
+	subChan := make(chan Subscription)
+	unSubChan := make(chan Subscription)
+	inboundChan := make(chan PostHogEvent)
+
+	filter := NewFilter(subChan, unSubChan, inboundChan)
+	go filter.Run()
+	defer close(inboundChan)
+
+	eventChan := make(chan interface{}, 10)
+	subChan <- Subscription{ClientId: "1", TeamId: 1, Token: "token1", DistinctId: "user1", EventChan: eventChan, ShouldClose: &atomic.Bool{}}
+	inboundChan <- PostHogEvent{Uuid: "1", Token: "token1", Event: "$pageview", DistinctId: "user2"}
+	inboundChan <- PostHogEvent{Uuid: "2", Token: "token1", Event: "$pageview", DistinctId: "User1"}
+	inboundChan <- PostHogEvent{Uuid: "3", Token: "token2", Event: "$pageview", DistinctId: "user1"}
+	inboundChan <- PostHogEvent{Uuid: "4", Token: "token1", Event: "$pageview", DistinctId: "user1"}
+	inboundChan <- PostHogEvent{Uuid: "5", Token: "token1", Event: "$pageview"}
+	inboundChan <- PostHogEvent{Uuid: "6", Token: "token1", Event: "$pageleave", DistinctId: "user1"}
+
+	// Only the events of user1 in token1's project get through.
+	assert.Equal(t, "4", (<-eventChan).(ResponsePostHogEvent).Uuid)
+	assert.Equal(t, "6", (<-eventChan).(ResponsePostHogEvent).Uuid)
+	assert.Empty(t, eventChan)
+}
+
+func TestFilterRunAnonymizesDistinctId(t *testing.T) {
+	subChan := make(chan Subscription)
+	unSubChan := make(chan Subscription)
+	inboundChan := make(chan PostHogEvent)
+
+	filter := NewFilter(subChan, unSubChan, inboundChan)
+	filter.distinctIds, _ = NewDistinctIdHasher("sha256", "salt")
+	go filter.Run()
+	defer close(inboundChan)
+
+	eventChan := make(chan interface{}, 2)
+	// Clients filter on the id they are sent, so guessing the real one
+	// matches nothing.
+	guessed := make(chan interface{}, 2)
+	subChan <- Subscription{ClientId: "1", TeamId: 1, DistinctId: filter.distinctIds.Hash("user1"), EventChan: eventChan, ShouldClose: &atomic.Bool{}}
+	subChan <- Subscription{ClientId: "2", TeamId: 1, DistinctId: "user1", EventChan: guessed, ShouldClose: &atomic.Bool{}}
+	inboundChan <- PostHogEvent{Token: "token1", Event: "$pageview", DistinctId: "user1"}
+	inboundChan <- PostHogEvent{Token: "token1", Event: "$pageview", DistinctId: "user2"}
+	inboundChan <- PostHogEvent{Token: "token1", Event: "$pageleave", DistinctId: "user1"}
+
+	first := (<-eventChan).(ResponsePostHogEvent)
+	second := (<-eventChan).(ResponsePostHogEvent)
+	assert.Equal(t, filter.distinctIds.Hash("user1"), first.DistinctId)
+	assert.NotContains(t, first.DistinctId, "user1")
+	assert.Equal(t, first.DistinctId, second.DistinctId)
+	assert.Empty(t, first.PersonId)
+	assert.Empty(t, eventChan)
+	assert.Empty(t, guessed)
+}
+
+func TestFilterRunAnonymizesPartitionKeyAndRaw(t *testing.T) {
+	subChan := make(chan Subscription)
+	unSubChan := make(chan Subscription)
+	inboundChan := make(chan PostHogEvent)
+
+	filter := NewFilter(subChan, unSubChan, inboundChan)
+	filter.distinctIds, _ = NewDistinctIdHasher("sha256", "salt")
+	filter.includePartitionKey = true
+	filter.includeRaw = true
+	go filter.Run()
+	defer close(inboundChan)
+
+	eventChan := make(chan interface{}, 1)
+	subChan <- Subscription{ClientId: "1", TeamId: 1, EventChan: eventChan, ShouldClose: &atomic.Bool{}}
+	inboundChan <- PostHogEvent{
+		Token:        "token1",
+		Event:        "$pageview",
+		DistinctId:   "user1",
+		PartitionKey: "user1",
+		Raw:          json.RawMessage(`{"distinct_id":"user1"}`),
+	}
+
+	event := (<-eventChan).(ResponsePostHogEvent)
+	assert.Equal(t, event.DistinctId, event.PartitionKey)
+	assert.Nil(t, event.Raw)
+}
+
+func TestFilterRunSampling(t *testing.T) {
+	subChan := make(chan Subscription)
+	unSubChan := make(chan Subscription)
+	inboundChan := make(chan PostHogEvent)
+
+	filter := NewFilter(subChan, unSubChan, inboundChan)
+	filter.sampler, _ = ParseTokenSampler([]string{"token1:2"})
+	go filter.Run()
+	defer close(inboundChan)
+
+	eventChan := make(chan interface{}, 100)
+	subChan <- Subscription{ClientId: "1", EventChan: eventChan, ShouldClose: &atomic.Bool{}}
+
+	expected := map[string][]string{}
+	for i := 0; i < 20; i++ {
+		for _, token := range []string{"token1", "token2"} {
+			event := PostHogEvent{Token: token, Uuid: fmt.Sprintf("%s-%d", token, i)}
+			if filter.sampler.Keep(event) {
+				expected[token] = append(expected[token], event.Uuid)
+			}
+			inboundChan <- event
+		}
+	}
+	unSubChan <- Subscription{ClientId: "1"}
+
+	received := map[string][]string{}
+	for len(eventChan) > 0 {
+		uuid := (<-eventChan).(ResponsePostHogEvent).Uuid
+		token := uuid[:len("token1")]
+		received[token] = append(received[token], uuid)
+	}
+	assert.Equal(t, expected, received)
+	assert.Len(t, received["token2"], 20)
+	assert.Less(t, len(received["token1"]), 20)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"golang.org/x/exp/slices"
+)
+
+// flagNames shortens the flags of the most used settings. Every other key
+// gets a flag named after it, e.g. --kafka-commit-every for
+// kafka.commit_every.
+var flagNames = map[string]string{
+	"kafka.brokers":  "brokers",
+	"kafka.topic":    "topic",
+	"kafka.group_id": "group-id",
+	"mmdb.path":      "geodb",
+}
+
+func flagName(key string) string {
+	if name, ok := flagNames[key]; ok {
+		return name
+	}
+	return strings.NewReplacer(".", "-", "_", "-").Replace(key)
+}
+
+// newFlagSet returns a flag set that reports errors instead of exiting, so
+// the caller decides how to fail.
+func newFlagSet(name string) *pflag.FlagSet {
+	flags := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	flags.SortFlags = true
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", name)
+		fmt.Fprintln(os.Stderr, "Every flag can also be set with its LIVESTREAM_ environment variable or in configs/configs.yml.")
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// bindFlags adds a flag for every config key to flags, parses args and binds
+// the flags to v. Flags that are not given leave the environment and config
+// file to decide.
+func bindFlags(v *viper.Viper, flags *pflag.FlagSet, args []string) error {
+	// Flag defaults come from a viper with nothing but the defaults, so that
+	// usage never prints a secret from the environment.
+	defaults := viper.New()
+	setDefaults(defaults)
+
+	keys := append(defaults.AllKeys(), unsetKeys...)
+	slices.Sort(keys)
+	for _, key := range slices.Compact(keys) {
+		name := flagName(key)
+		usage := fmt.Sprintf("sets %s", key)
+		switch value := defaults.Get(key).(type) {
+		case bool:
+			flags.Bool(name, value, usage)
+		case int:
+			flags.Int(name, value, usage)
+		case float64:
+			flags.Float64(name, value, usage)
+		case []string:
+			flags.StringSlice(name, value, usage)
+		case nil:
+			flags.String(name, "", usage)
+		default:
+			flags.String(name, fmt.Sprint(value), usage)
+		}
+		if err := v.BindPFlag(key, flags.Lookup(name)); err != nil {
+			return err
+		}
+	}
+
+	return flags.Parse(args)
+}
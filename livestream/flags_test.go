@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBindFlags(t *testing.T) {
+	v := newTestViper()
+	flags := newFlagSet("livestream")
+	require.NoError(t, bindFlags(v, flags, []string{
+		"--brokers", "kafka-1:9092,kafka-2:9092",
+		"--topic=events-eu,events-us",
+		"--group-id", "debugging",
+		"--geodb", "/data/mmdb.db",
+		"--listen", "127.0.0.1:9090",
+		"--kafka-channel-buffer", "50",
+		"--kafka-backpressure", "drop_newest",
+		"--log-level", "debug",
+		"--prod",
+	}))
+
+	cfg, err := newConfig(v)
+	require.NoError(t, err)
+	assert.Equal(t, "kafka-1:9092,kafka-2:9092", cfg.Brokers)
+	assert.Equal(t, []string{"events-eu", "events-us"}, cfg.Topics)
+	assert.Equal(t, "debugging", cfg.GroupID)
+	assert.Equal(t, "/data/mmdb.db", cfg.MMDBPath)
+	assert.Equal(t, "127.0.0.1:9090", cfg.ListenAddress)
+	assert.Equal(t, 50, cfg.ChannelBuffer)
+	assert.Equal(t, DropNewest, cfg.Backpressure)
+	assert.True(t, cfg.Prod)
+	assert.Equal(t, "debug", v.GetString("log.level"))
+}
+
+func TestBindFlagsFallBackToEnv(t *testing.T) {
+	t.Setenv("LIVESTREAM_KAFKA_BROKERS", "env-kafka:9092")
+	t.Setenv("LIVESTREAM_KAFKA_TOPIC", "env-events")
+
+	v := newTestViper()
+	require.NoError(t, bindFlags(v, newFlagSet("livestream"), []string{"--topic", "flag-events"}))
+
+	cfg, err := newConfig(v)
+	require.NoError(t, err)
+	assert.Equal(t, "env-kafka:9092", cfg.Brokers)
+	assert.Equal(t, []string{"flag-events"}, cfg.Topics)
+	assert.Equal(t, "livestream", cfg.GroupID)
+	assert.Equal(t, 1, v.GetInt("kafka.workers"))
+}
+
+func TestBindFlagsErrors(t *testing.T) {
+	for name, args := range map[string][]string{
+		"Unknown flag":  {"--bogus"},
+		"Bad int":       {"--kafka-workers", "many"},
+		"Missing value": {"--brokers"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, bindFlags(newTestViper(), newFlagSet("livestream"), args))
+		})
+	}
+}
+
+func TestFlagName(t *testing.T) {
+	assert.Equal(t, "geodb", flagName("mmdb.path"))
+	assert.Equal(t, "kafka-commit-every", flagName("kafka.commit_every"))
+	assert.Equal(t, "listen", flagName("listen"))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// OutputFormat is the shape a subscription's events are sent in.
+type OutputFormat string
+
+const (
+	// FormatFull sends events as ResponsePostHogEvent. It is the default.
+	FormatFull OutputFormat = "full"
+	// FormatCompact sends events as CompactEvent, with only what a live map
+	// or ticker needs.
+	FormatCompact OutputFormat = "compact"
+)
+
+// parseOutputFormat reads the format query param. An empty string is
+// FormatFull.
+func parseOutputFormat(raw string) (OutputFormat, error) {
+	switch format := OutputFormat(raw); format {
+	case "":
+		return FormatFull, nil
+	case FormatFull, FormatCompact:
+		return format, nil
+	default:
+		return "", fmt.Errorf("format must be %s or %s, got %q", FormatFull, FormatCompact, raw)
+	}
+}
+
+// CompactEvent is an event with its location, as sent to subscriptions in
+// FormatCompact. It encodes itself rather than going through reflection, as
+// it is meant for the busiest streams.
+type CompactEvent struct {
+	Event     string    `json:"event"`
+	Token     string    `json:"token"`
+	Lat       float64   `json:"lat"`
+	Lng       float64   `json:"lng"`
+	Geohash   string    `json:"geohash,omitempty"`
+	Timestamp time.Time `json:"ts"`
+}
+
+func convertToCompactEvent(event PostHogEvent) *CompactEvent {
+	return &CompactEvent{
+		Event:     event.Event,
+		Token:     event.Token,
+		Lat:       event.Lat,
+		Lng:       event.Lng,
+		Timestamp: event.Timestamp,
+	}
+}
+
+// AppendJSON appends the event's JSON encoding to b. The timestamp is in
+// timestampLayout, like the full format's.
+func (e CompactEvent) AppendJSON(b []byte) ([]byte, error) {
+	if !isFinite(e.Lat) || !isFinite(e.Lng) {
+		return nil, fmt.Errorf("compact event: unsupported coordinates %v, %v", e.Lat, e.Lng)
+	}
+
+	b = append(b, `{"event":`...)
+	b = appendJSONString(b, e.Event)
+	b = append(b, `,"token":`...)
+	b = appendJSONString(b, e.Token)
+	b = append(b, `,"lat":`...)
+	b = strconv.AppendFloat(b, e.Lat, 'f', -1, 64)
+	b = append(b, `,"lng":`...)
+	b = strconv.AppendFloat(b, e.Lng, 'f', -1, 64)
+	if e.Geohash != "" {
+		b = append(b, `,"geohash":`...)
+		b = appendJSONString(b, e.Geohash)
+	}
+	b = append(b, `,"ts":"`...)
+	b = e.Timestamp.UTC().AppendFormat(b, timestampLayout)
+	b = append(b, `"}`...)
+	return b, nil
+}
+
+func (e CompactEvent) MarshalJSON() ([]byte, error) {
+	return e.AppendJSON(make([]byte, 0, 128))
+}
+
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString appends s to b as a JSON string. Invalid UTF-8 is replaced
+// with U+FFFD, as encoding/json does.
+func appendJSONString(b []byte, s string) []byte {
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' {
+				i++
+				continue
+			}
+			b = append(b, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				b = append(b, '\\', c)
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			case '\t':
+				b = append(b, '\\', 't')
+			default:
+				b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, s[start:i]...)
+			b = append(b, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
+
+// marshalPayload encodes a payload for a client. Compact events skip
+// encoding/json, which would reflect on them and then validate their output.
+func marshalPayload(payload interface{}) ([]byte, error) {
+	if event, ok := payload.(CompactEvent); ok {
+		return event.MarshalJSON()
+	}
+	return json.Marshal(payload)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOutputFormat(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected OutputFormat
+		wantErr  bool
+	}{
+		{raw: "", expected: FormatFull},
+		{raw: "full", expected: FormatFull},
+		{raw: "compact", expected: FormatCompact},
+		{raw: "Compact", wantErr: true},
+		{raw: "xml", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			format, err := parseOutputFormat(tt.raw)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, format)
+		})
+	}
+}
+
+func TestCompactEventJSON(t *testing.T) {
+	event := CompactEvent{
+		Event:     "$pageview",
+		Token:     "token1",
+		Lat:       52.5200,
+		Lng:       -13.405,
+		Timestamp: time.Date(2024, 1, 2, 3, 4, 5, 6e6, time.UTC),
+	}
+
+	data, err := json.Marshal(event)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"event":"$pageview","token":"token1","lat":52.52,"lng":-13.405,"ts":"2024-01-02T03:04:05.006Z"}`, string(data))
+
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &fields))
+	assert.Len(t, fields, 5)
+}
+
+func TestCompactEventEscapesStrings(t *testing.T) {
+	names := []string{
+		"plain",
+		`quote " and backslash \`,
+		"new\nline\ttab\rreturn",
+		"control \x00\x01\x1f",
+		"unicode ✓ 👋",
+		"invalid \xff utf-8",
+		"",
+	}
+
+	for _, name := range names {
+		data, err := CompactEvent{Event: name, Token: name}.AppendJSON(nil)
+		require.NoError(t, err)
+
+		var decoded struct {
+			Event string `json:"event"`
+			Token string `json:"token"`
+		}
+		require.NoError(t, json.Unmarshal(data, &decoded), string(data))
+		want := strings.ToValidUTF8(name, "\ufffd")
+		assert.Equal(t, want, decoded.Event)
+		assert.Equal(t, want, decoded.Token)
+	}
+}
+
+func TestCompactEventRejectsNonFiniteCoordinates(t *testing.T) {
+	_, err := CompactEvent{Lat: math.NaN()}.AppendJSON(nil)
+	assert.Error(t, err)
+	_, err = CompactEvent{Lng: math.Inf(1)}.AppendJSON(nil)
+	assert.Error(t, err)
+}
+
+func TestMarshalPayload(t *testing.T) {
+	compact := CompactEvent{Event: "$pageview", Token: "token1", Lat: 1.5, Lng: 2.5}
+	data, err := marshalPayload(compact)
+	require.NoError(t, err)
+	expected, err := json.Marshal(compact)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), string(data))
+
+	data, err = marshalPayload(ResponseGeoEvent{Lat: 1, Lng: 2, Count: 1})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"lat":1,"lng":2,"count":1}`, string(data))
+}
+
+func BenchmarkCompactEvent(b *testing.B) {
+	event := CompactEvent{
+		Event:     "$pageview",
+		Token:     "phc_0123456789abcdef",
+		Lat:       52.52,
+		Lng:       13.405,
+		Timestamp: time.Date(2024, 1, 2, 3, 4, 5, 6e6, time.UTC),
+	}
+	full := ResponsePostHogEvent{
+		Uuid:       "0190a7b2-6b1f-7c1e-9d8e-2f4b5c6d7e8f",
+		Timestamp:  "2024-01-02T03:04:05.006Z",
+		DistinctId: "user1",
+		Event:      "$pageview",
+		Properties: map[string]interface{}{"$current_url": "https://example.com"},
+	}
+
+	b.Run("Compact", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := marshalPayload(event); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Full", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := marshalPayload(full); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// geoQueueSize is how many messages can be between Consume and delivery while
+// they are geolocated, before Consume stops reading from Kafka.
+const geoQueueSize = 100
+
+// geoJob is a message on its way through a geoPool. seq is the order it was
+// read in.
+type geoJob struct {
+	seq   uint64
+	msg   *kafka.Message
+	event PostHogEvent
+}
+
+// geoPool decodes and geolocates messages on several goroutines, so a slow
+// lookup doesn't hold up reading from Kafka. Unlike workerPool it keeps the
+// order messages were read in across partitions: results are put back in
+// sequence before a single goroutine delivers them.
+type geoPool struct {
+	in  chan geoJob
+	out chan geoJob
+	// slots bounds how many messages are in the pool, so one slow lookup
+	// can't leave an unbounded number of results waiting behind it.
+	slots chan struct{}
+	// next is the sequence number of the next dispatched message.
+	next uint64
+	// inflight counts dispatched messages not yet processed.
+	inflight sync.WaitGroup
+	// delivered is closed once every result has been delivered.
+	delivered chan struct{}
+}
+
+// startGeoWorkers starts n goroutines geolocating messages, and one delivering
+// them in order, until stop is called.
+func (c *PostHogKafkaConsumer) startGeoWorkers(ctx context.Context, n int) *geoPool {
+	pool := &geoPool{
+		in:        make(chan geoJob, geoQueueSize),
+		out:       make(chan geoJob, geoQueueSize),
+		slots:     make(chan struct{}, geoQueueSize),
+		delivered: make(chan struct{}),
+	}
+
+	results := make(chan geoJob, geoQueueSize)
+	var workers sync.WaitGroup
+	for i := 0; i < n; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range pool.in {
+				job.event = c.parseMessage(job.msg)
+				results <- job
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+	go reorder(results, pool.out)
+
+	go func() {
+		defer close(pool.delivered)
+		// Once a delivery fails the rest is skipped, so that nothing is
+		// committed ahead of the message that was not delivered.
+		failed := false
+		for job := range pool.out {
+			if !failed && c.handle(ctx, job.msg, job.event) != nil {
+				failed = true
+			}
+			<-pool.slots
+			pool.inflight.Done()
+		}
+	}()
+	return pool
+}
+
+// reorder sends the jobs from results on out by sequence number, starting at
+// zero, holding back those that finished early. It closes out once results is
+// closed.
+func reorder(results <-chan geoJob, out chan<- geoJob) {
+	defer close(out)
+	pending := make(map[uint64]geoJob)
+	var next uint64
+	for job := range results {
+		pending[job.seq] = job
+		for {
+			job, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			out <- job
+			next++
+		}
+	}
+}
+
+// dispatch queues msg for geolocation. It fails only if ctx is cancelled
+// while the pool is full.
+func (p *geoPool) dispatch(ctx context.Context, msg *kafka.Message) error {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	p.inflight.Add(1)
+	// Never blocks, in has room for every slot.
+	p.in <- geoJob{seq: p.next, msg: msg}
+	p.next++
+	return nil
+}
+
+// drain waits until every message dispatched so far is delivered. It must be
+// called from the goroutine that dispatches.
+func (p *geoPool) drain() {
+	p.inflight.Wait()
+}
+
+// stop waits for the pool to deliver what is queued.
+func (p *geoPool) stop() {
+	close(p.in)
+	<-p.delivered
+}
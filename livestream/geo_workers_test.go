@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostHogKafkaConsumer_GeoWorkersKeepReadOrder(t *testing.T) {
+	const partitions, perPartition = 3, 50
+
+	read := func(geoWorkers int) []string {
+		fake := newFakeKafkaConsumer("events", time.Now(), partitionedUuids(partitions, perPartition)...)
+		consumer := &PostHogKafkaConsumer{
+			consumer:     fake,
+			topics:       []string{"events"},
+			geolocator:   slowGeoLocator{max: 200 * time.Microsecond},
+			outgoingChan: make(chan PostHogEvent),
+			statsChan:    make(chan PostHogEvent, partitions*perPartition),
+			GeoWorkers:   geoWorkers,
+		}
+
+		var uuids []string
+		for _, event := range consumeAll(t, consumer, partitions*perPartition) {
+			assert.Equal(t, 1.0, event.Lat, "event %s was not geolocated", event.Uuid)
+			uuids = append(uuids, event.Uuid)
+		}
+		assert.Equal(t, partitions*perPartition, fake.committed)
+		return uuids
+	}
+
+	assert.Equal(t, read(1), read(4))
+}
+
+func TestReorder(t *testing.T) {
+	const n = 200
+	results := make(chan geoJob, n)
+	for _, seq := range rand.Perm(n) {
+		results <- geoJob{seq: uint64(seq)}
+	}
+	close(results)
+
+	out := make(chan geoJob, n)
+	reorder(results, out)
+
+	var next uint64
+	for job := range out {
+		assert.Equal(t, next, job.seq)
+		next++
+	}
+	assert.Equal(t, uint64(n), next)
+}
+
+// BenchmarkConsumeGeoWorkers reads a single partition, where Workers can't
+// help, with lookups slow enough to dominate.
+func BenchmarkConsumeGeoWorkers(b *testing.B) {
+	for _, geoWorkers := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("geo_workers=%d", geoWorkers), func(b *testing.B) {
+			fake := newFakeKafkaConsumer("events", time.Now(), partitionedUuids(1, b.N)...)
+			consumer := &PostHogKafkaConsumer{
+				consumer:     fake,
+				topics:       []string{"events"},
+				geolocator:   slowGeoLocator{max: 50 * time.Microsecond},
+				outgoingChan: make(chan PostHogEvent, 1000),
+				statsChan:    make(chan PostHogEvent, 1000),
+				CommitEvery:  1000,
+				GeoWorkers:   geoWorkers,
+			}
+			go func() {
+				for range consumer.statsChan {
+				}
+			}()
+
+			b.ResetTimer()
+			consumeAll(b, consumer, b.N)
+		})
+	}
+}
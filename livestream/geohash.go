@@ -0,0 +1,43 @@
+package main
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// maxGeohashPrecision is the longest geohash encodeGeohash produces, about
+// 4cm at the equator.
+const maxGeohashPrecision = 12
+
+// encodeGeohash returns the geohash of lat/lng with the given number of
+// characters, clamped to 1..maxGeohashPrecision. Each extra character narrows
+// the cell; 3 is roughly 150km across and 5 roughly 5km.
+func encodeGeohash(lat float64, lng float64, precision int) string {
+	precision = min(max(precision, 1), maxGeohashPrecision)
+
+	latRange := [2]float64{-90, 90}
+	lngRange := [2]float64{-180, 180}
+
+	hash := make([]byte, 0, precision)
+	bits, ch := 0, 0
+	evenBit := true // Bits alternate between longitude and latitude.
+	for len(hash) < precision {
+		r, v := &latRange, lat
+		if evenBit {
+			r, v = &lngRange, lng
+		}
+
+		mid := (r[0] + r[1]) / 2
+		ch <<= 1
+		if v >= mid {
+			ch |= 1
+			r[0] = mid
+		} else {
+			r[1] = mid
+		}
+		evenBit = !evenBit
+
+		if bits++; bits == 5 {
+			hash = append(hash, geohashAlphabet[ch])
+			bits, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
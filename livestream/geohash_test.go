@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeGeohash(t *testing.T) {
+	tests := []struct {
+		name      string
+		lat       float64
+		lng       float64
+		precision int
+		expected  string
+	}{
+		{name: "Jutland", lat: 57.64911, lng: 10.40744, precision: 11, expected: "u4pruydqqvj"},
+		{name: "Spain", lat: 42.6, lng: -5.6, precision: 5, expected: "ezs42"},
+		{name: "Precision 3", lat: 57.64911, lng: 10.40744, precision: 3, expected: "u4p"},
+		{name: "Below minimum", lat: 57.64911, lng: 10.40744, precision: 0, expected: "u"},
+		{name: "Origin", lat: 0, lng: 0, precision: 4, expected: "s000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, encodeGeohash(tt.lat, tt.lng, tt.precision))
+		})
+	}
+}
+
+func TestEncodeGeohashPrecision(t *testing.T) {
+	full := encodeGeohash(-33.8688, 151.2093, maxGeohashPrecision)
+	assert.Equal(t, full, encodeGeohash(-33.8688, 151.2093, 20), "precision is capped")
+	for precision := 1; precision <= maxGeohashPrecision; precision++ {
+		hash := encodeGeohash(-33.8688, 151.2093, precision)
+		assert.Len(t, hash, precision)
+		// A shorter geohash is the cell containing the longer one.
+		assert.Equal(t, full[:precision], hash)
+	}
+}
+
+func TestFilterRunGeohash(t *testing.T) {
+	tests := []struct {
+		name            string
+		precision       int
+		hideCoordinates bool
+		expected        ResponseGeoEvent
+	}{
+		{name: "Disabled", expected: ResponseGeoEvent{Lat: 57.64911, Lng: 10.40744, Count: 1}},
+		{name: "Geohash", precision: 5, expected: ResponseGeoEvent{Lat: 57.64911, Lng: 10.40744, Geohash: "u4pru", Count: 1}},
+		{name: "Geohash only", precision: 3, hideCoordinates: true, expected: ResponseGeoEvent{Geohash: "u4p", Count: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subChan := make(chan Subscription)
+			unSubChan := make(chan Subscription)
+			inboundChan := make(chan PostHogEvent)
+
+			filter := NewFilter(subChan, unSubChan, inboundChan)
+			filter.geohashPrecision = tt.precision
+			filter.hideCoordinates = tt.hideCoordinates
+			go filter.Run()
+			defer close(inboundChan)
+
+			eventChan := make(chan interface{}, 1)
+			subChan <- Subscription{ClientId: "1", Geo: true, EventChan: eventChan, ShouldClose: &atomic.Bool{}}
+
+			event := PostHogEvent{Token: "token1", Lat: 57.64911, Lng: 10.40744}
+			inboundChan <- event
+
+			received := <-eventChan
+			assert.Equal(t, tt.expected, received)
+
+			payload, err := json.Marshal(received)
+			require.NoError(t, err)
+			if tt.hideCoordinates {
+				assert.NotContains(t, string(payload), "57.64911")
+			}
+			// The event the stats keeper sees keeps its exact coordinates.
+			assert.Equal(t, 57.64911, event.Lat)
+		})
+	}
+}
+
+func TestFilterRunCompactGeohash(t *testing.T) {
+	subChan := make(chan Subscription)
+	unSubChan := make(chan Subscription)
+	inboundChan := make(chan PostHogEvent)
+
+	filter := NewFilter(subChan, unSubChan, inboundChan)
+	filter.geohashPrecision = 5
+	filter.hideCoordinates = true
+	go filter.Run()
+	defer close(inboundChan)
+
+	eventChan := make(chan interface{}, 1)
+	subChan <- Subscription{ClientId: "1", Format: FormatCompact, EventChan: eventChan, ShouldClose: &atomic.Bool{}}
+	inboundChan <- PostHogEvent{
+		Token:     "token1",
+		Event:     "$pageview",
+		Lat:       57.64911,
+		Lng:       10.40744,
+		Timestamp: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	payload, err := marshalPayload(<-eventChan)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"event":"$pageview","token":"token1","lat":0,"lng":0,"geohash":"u4pru","ts":"2024-01-02T03:04:05.000Z"}`, string(payload))
+}
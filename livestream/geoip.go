@@ -3,18 +3,67 @@ package main
 import (
 	"errors"
 	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/oschwald/maxminddb-golang"
 )
 
+// ErrInvalidIP is returned by Lookup when the input can't be parsed as an IPv4
+// or IPv6 address. A bad IP in an event is not an error on our side.
+var ErrInvalidIP = errors.New("invalid IP address")
+
 type MaxMindLocator struct {
+	mu sync.RWMutex
 	db *maxminddb.Reader
 }
 
+// GeoIPConfig sets how the MMDBs are read, see newMaxMindGeoLocation.
+type GeoIPConfig struct {
+	// Required makes a database that can't be opened an error.
+	Required     bool
+	CacheSize    int
+	Retries      int
+	RetryBackoff time.Duration
+}
+
 type GeoLocator interface {
 	Lookup(ipString string) (float64, float64, error)
 }
 
+// GeoResult is everything known about where an IP is. Names are in English
+// and empty when the database has none.
+type GeoResult struct {
+	Lat         float64
+	Lng         float64
+	City        string
+	Region      string
+	CountryCode string
+}
+
+// lookupGeo uses the locator's LookupFull method when it has one, to name the
+// place the IP is in, and falls back to coordinates from Lookup otherwise.
+func lookupGeo(locator GeoLocator, ipString string) (GeoResult, error) {
+	if full, ok := locator.(interface {
+		LookupFull(ipString string) (GeoResult, error)
+	}); ok {
+		return full.LookupFull(ipString)
+	}
+	lat, lng, err := locator.Lookup(ipString)
+	return GeoResult{Lat: lat, Lng: lng}, err
+}
+
+// NoOpGeoLocator places every IP at 0,0. It stands in for MaxMind when no
+// database is configured, e.g. in local development.
+type NoOpGeoLocator struct{}
+
+func (NoOpGeoLocator) Lookup(string) (float64, float64, error) {
+	return 0, 0, nil
+}
+
 func NewMaxMindGeoLocator(dbPath string) (*MaxMindLocator, error) {
 	db, err := maxminddb.Open(dbPath)
 	if err != nil {
@@ -27,21 +76,119 @@ func NewMaxMindGeoLocator(dbPath string) (*MaxMindLocator, error) {
 }
 
 func (g *MaxMindLocator) Lookup(ipString string) (float64, float64, error) {
-	ip := net.ParseIP(ipString)
+	result, err := g.LookupFull(ipString)
+	return result.Lat, result.Lng, err
+}
+
+func (g *MaxMindLocator) LookupFull(ipString string) (GeoResult, error) {
+	ip := parseIP(ipString)
 	if ip == nil {
-		return 0, 0, errors.New("invalid IP address")
+		return GeoResult{}, ErrInvalidIP
 	}
 
 	var record struct {
+		City struct {
+			Names map[string]string `maxminddb:"names"`
+		} `maxminddb:"city"`
+		Subdivisions []struct {
+			Names map[string]string `maxminddb:"names"`
+		} `maxminddb:"subdivisions"`
+		Country struct {
+			IsoCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
 		Location struct {
 			Latitude  float64 `maxminddb:"latitude"`
 			Longitude float64 `maxminddb:"longitude"`
 		} `maxminddb:"location"`
 	}
 
+	g.mu.RLock()
 	err := g.db.Lookup(ip, &record)
+	g.mu.RUnlock()
+	if err != nil {
+		return GeoResult{}, err
+	}
+
+	result := GeoResult{
+		Lat:         record.Location.Latitude,
+		Lng:         record.Location.Longitude,
+		City:        record.City.Names["en"],
+		CountryCode: record.Country.IsoCode,
+	}
+	// The first subdivision is the largest, e.g. a state or constituent country.
+	if len(record.Subdivisions) > 0 {
+		result.Region = record.Subdivisions[0].Names["en"]
+	}
+	return result, nil
+}
+
+// Reload opens the database at dbPath and swaps it in for the current one.
+// Lookups in flight finish against the old database, which is closed once
+// they are done. On error the current database is kept.
+func (g *MaxMindLocator) Reload(dbPath string) error {
+	db, err := maxminddb.Open(dbPath)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	old := g.db
+	g.db = db
+	g.mu.Unlock()
+
+	return old.Close()
+}
+
+// eventGeoProperties returns the location in an event's $geoip_ properties,
+// which are set when the event was geolocated before reaching Kafka. ok is
+// false unless $geoip_latitude and $geoip_longitude are numbers in range.
+func eventGeoProperties(properties map[string]interface{}) (result GeoResult, ok bool) {
+	lat, latOk := properties["$geoip_latitude"].(float64)
+	lng, lngOk := properties["$geoip_longitude"].(float64)
+	if !latOk || !lngOk || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return GeoResult{}, false
+	}
+
+	result = GeoResult{Lat: lat, Lng: lng}
+	result.City, _ = properties["$geoip_city_name"].(string)
+	result.Region, _ = properties["$geoip_subdivision_1_name"].(string)
+	result.CountryCode, _ = properties["$geoip_country_code"].(string)
+	return result, true
+}
+
+// pickIP returns the first valid address in a comma-separated list such as an
+// X-Forwarded-For chain "client, proxy1, proxy2", from the left, or from the
+// right when rightmost is set. Entries are trimmed. A value without any valid
+// address is returned as it is, for the lookup to reject.
+func pickIP(value string, rightmost bool) string {
+	if !strings.Contains(value, ",") {
+		return value
+	}
+
+	entries := strings.Split(value, ",")
+	if rightmost {
+		slices.Reverse(entries)
+	}
+	for _, entry := range entries {
+		if entry = strings.TrimSpace(entry); parseIP(entry) != nil {
+			return entry
+		}
+	}
+	return value
+}
+
+// parseIP parses IPv4 and IPv6 addresses, tolerating surrounding whitespace,
+// brackets ([::1]) and zones (fe80::1%eth0). IPv4-mapped IPv6 addresses such
+// as ::ffff:1.2.3.4 are returned as plain IPv4. Returns nil if unparseable.
+func parseIP(ipString string) net.IP {
+	s := strings.TrimSpace(ipString)
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+
+	addr, err := netip.ParseAddr(s)
 	if err != nil {
-		return 0, 0, err
+		return nil
 	}
-	return record.Location.Latitude, record.Location.Longitude, nil
+	return net.IP(addr.WithZone("").Unmap().AsSlice())
 }
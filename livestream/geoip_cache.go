@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+type cachedLookup struct {
+	result GeoResult
+	err    error
+}
+
+// CachingGeoLocator memoizes another GeoLocator's results per IP string in a
+// fixed-size LRU cache. Invalid IPs are cached as well, other errors are not so
+// that a transient failure is retried on the next lookup.
+type CachingGeoLocator struct {
+	locator GeoLocator
+	cache   *lru.Cache[string, cachedLookup]
+}
+
+func NewCachingGeoLocator(locator GeoLocator, size int) (*CachingGeoLocator, error) {
+	cache, err := lru.New[string, cachedLookup](size)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CachingGeoLocator{
+		locator: locator,
+		cache:   cache,
+	}, nil
+}
+
+func (g *CachingGeoLocator) Lookup(ipString string) (float64, float64, error) {
+	result, err := g.LookupFull(ipString)
+	return result.Lat, result.Lng, err
+}
+
+// LookupFull caches whatever the wrapped locator knows: the full result when
+// it has LookupFull and the coordinates otherwise.
+func (g *CachingGeoLocator) LookupFull(ipString string) (GeoResult, error) {
+	if cached, ok := g.cache.Get(ipString); ok {
+		geoCacheLookups.WithLabelValues("hit").Inc()
+		return cached.result, cached.err
+	}
+	geoCacheLookups.WithLabelValues("miss").Inc()
+
+	result, err := lookupGeo(g.locator, ipString)
+	if err == nil || errors.Is(err, ErrInvalidIP) {
+		g.cache.Add(ipString, cachedLookup{result: result, err: err})
+		geoCacheSize.Set(float64(g.cache.Len()))
+	}
+	return result, err
+}
+
+// Purge drops every cached result, e.g. after the underlying database changed.
+func (g *CachingGeoLocator) Purge() {
+	g.cache.Purge()
+	geoCacheSize.Set(0)
+}
+
+func (g *CachingGeoLocator) Len() int {
+	return g.cache.Len()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/posthog/posthog/livestream/mocks"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cacheLookups returns the cache's hit and miss counters.
+func cacheLookups() (float64, float64) {
+	return testutil.ToFloat64(geoCacheLookups.WithLabelValues("hit")), testutil.ToFloat64(geoCacheLookups.WithLabelValues("miss"))
+}
+
+func TestCachingGeoLocator_LooksUpEachIPOnce(t *testing.T) {
+	mockLocator := mocks.NewGeoLocator(t)
+	mockLocator.EXPECT().Lookup("192.0.2.1").Return(40.7128, -74.0060, nil).Once()
+	mockLocator.EXPECT().Lookup("192.0.2.2").Return(51.5074, -0.1278, nil).Once()
+
+	locator, err := NewCachingGeoLocator(mockLocator, 10)
+	require.NoError(t, err)
+	hits, misses := cacheLookups()
+
+	for i := 0; i < 3; i++ {
+		lat, lng, err := locator.Lookup("192.0.2.1")
+		assert.NoError(t, err)
+		assert.Equal(t, 40.7128, lat)
+		assert.Equal(t, -74.0060, lng)
+
+		lat, lng, err = locator.Lookup("192.0.2.2")
+		assert.NoError(t, err)
+		assert.Equal(t, 51.5074, lat)
+		assert.Equal(t, -0.1278, lng)
+	}
+
+	newHits, newMisses := cacheLookups()
+	assert.Equal(t, hits+4, newHits)
+	assert.Equal(t, misses+2, newMisses)
+	assert.Equal(t, 2, locator.Len())
+}
+
+func TestCachingGeoLocator_CachesInvalidIP(t *testing.T) {
+	mockLocator := mocks.NewGeoLocator(t)
+	mockLocator.EXPECT().Lookup("invalid_ip").Return(0.0, 0.0, ErrInvalidIP).Once()
+
+	locator, err := NewCachingGeoLocator(mockLocator, 10)
+	require.NoError(t, err)
+	hits, misses := cacheLookups()
+
+	for i := 0; i < 3; i++ {
+		_, _, err := locator.Lookup("invalid_ip")
+		assert.ErrorIs(t, err, ErrInvalidIP)
+	}
+
+	newHits, newMisses := cacheLookups()
+	assert.Equal(t, hits+2, newHits)
+	assert.Equal(t, misses+1, newMisses)
+}
+
+func TestCachingGeoLocator_DoesNotCacheOtherErrors(t *testing.T) {
+	mockLocator := mocks.NewGeoLocator(t)
+	mockLocator.EXPECT().Lookup("192.0.2.1").Return(0.0, 0.0, errors.New("database error")).Once()
+	mockLocator.EXPECT().Lookup("192.0.2.1").Return(40.7128, -74.0060, nil).Once()
+
+	locator, err := NewCachingGeoLocator(mockLocator, 10)
+	require.NoError(t, err)
+	hits, misses := cacheLookups()
+
+	_, _, err = locator.Lookup("192.0.2.1")
+	assert.EqualError(t, err, "database error")
+
+	lat, _, err := locator.Lookup("192.0.2.1")
+	assert.NoError(t, err)
+	assert.Equal(t, 40.7128, lat)
+
+	newHits, newMisses := cacheLookups()
+	assert.Equal(t, hits, newHits)
+	assert.Equal(t, misses+2, newMisses)
+}
+
+func TestCachingGeoLocator_EvictsLeastRecentlyUsed(t *testing.T) {
+	mockLocator := mocks.NewGeoLocator(t)
+	mockLocator.EXPECT().Lookup("192.0.2.1").Return(1.0, 1.0, nil).Twice()
+	mockLocator.EXPECT().Lookup("192.0.2.2").Return(2.0, 2.0, nil).Once()
+
+	locator, err := NewCachingGeoLocator(mockLocator, 1)
+	require.NoError(t, err)
+
+	_, _, _ = locator.Lookup("192.0.2.1")
+	_, _, _ = locator.Lookup("192.0.2.2")
+	_, _, _ = locator.Lookup("192.0.2.1")
+
+	assert.Equal(t, 1, locator.Len())
+}
+
+func TestCachingGeoLocator_Purge(t *testing.T) {
+	mockLocator := mocks.NewGeoLocator(t)
+	mockLocator.EXPECT().Lookup("192.0.2.1").Return(1.0, 1.0, nil).Twice()
+
+	locator, err := NewCachingGeoLocator(mockLocator, 10)
+	require.NoError(t, err)
+	hits, misses := cacheLookups()
+
+	_, _, _ = locator.Lookup("192.0.2.1")
+	locator.Purge()
+	_, _, _ = locator.Lookup("192.0.2.1")
+
+	newHits, newMisses := cacheLookups()
+	assert.Equal(t, hits, newHits)
+	assert.Equal(t, misses+2, newMisses)
+}
+
+func TestNewCachingGeoLocator_InvalidSize(t *testing.T) {
+	_, err := NewCachingGeoLocator(mocks.NewGeoLocator(t), 0)
+
+	assert.Error(t, err)
+}
+
+func TestCachingGeoLocator_LookupFull(t *testing.T) {
+	maxmind, err := NewMaxMindGeoLocator("testdata/city.mmdb")
+	require.NoError(t, err)
+	locator, err := NewCachingGeoLocator(maxmind, 10)
+	require.NoError(t, err)
+	hits, misses := cacheLookups()
+
+	for i := 0; i < 2; i++ {
+		result, err := locator.LookupFull("81.2.69.142")
+		require.NoError(t, err)
+		assert.Equal(t, "London", result.City)
+		assert.Equal(t, "GB", result.CountryCode)
+	}
+	newHits, newMisses := cacheLookups()
+	assert.Equal(t, hits+1, newHits)
+	assert.Equal(t, misses+1, newMisses)
+}
@@ -0,0 +1,43 @@
+package main
+
+// GeoProvider is a GeoLocator with the name its lookups are counted under.
+type GeoProvider struct {
+	Name string
+	GeoLocator
+}
+
+// ChainedGeoLocator asks its providers in order and returns the first result
+// that is neither an error nor 0,0, so a second database can place the IPs
+// the first one can't. Each provider's lookups are counted in
+// livestream_geoip_provider_lookups_total.
+type ChainedGeoLocator struct {
+	providers []GeoProvider
+}
+
+func NewChainedGeoLocator(providers ...GeoProvider) *ChainedGeoLocator {
+	return &ChainedGeoLocator{providers: providers}
+}
+
+func (g *ChainedGeoLocator) Lookup(ipString string) (float64, float64, error) {
+	result, err := g.LookupFull(ipString)
+	return result.Lat, result.Lng, err
+}
+
+// LookupFull returns the first provider's answer when none of them placed the
+// IP, so an invalid IP is still reported as ErrInvalidIP.
+func (g *ChainedGeoLocator) LookupFull(ipString string) (GeoResult, error) {
+	var first GeoResult
+	var firstErr error
+	for i, provider := range g.providers {
+		result, err := lookupGeo(provider.GeoLocator, ipString)
+		if err == nil && (result.Lat != 0 || result.Lng != 0) {
+			geoProviderLookups.WithLabelValues(provider.Name, "success").Inc()
+			return result, nil
+		}
+		geoProviderLookups.WithLabelValues(provider.Name, "failure").Inc()
+		if i == 0 {
+			first, firstErr = result, err
+		}
+	}
+	return first, firstErr
+}
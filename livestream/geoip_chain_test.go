@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/posthog/posthog/livestream/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChainedGeoLocator_FallsBack(t *testing.T) {
+	tests := []struct {
+		name    string
+		lat     float64
+		lng     float64
+		primary error
+	}{
+		{name: "Invalid IP", primary: ErrInvalidIP},
+		{name: "Error", primary: errors.New("lookup failed")},
+		{name: "Zero coordinates"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := mocks.NewGeoLocator(t)
+			primary.EXPECT().Lookup("192.0.2.1").Return(tt.lat, tt.lng, tt.primary).Once()
+			fallback := mocks.NewGeoLocator(t)
+			fallback.EXPECT().Lookup("192.0.2.1").Return(51.5074, -0.1278, nil).Once()
+			locator := NewChainedGeoLocator(GeoProvider{Name: "test_primary", GeoLocator: primary}, GeoProvider{Name: "test_fallback", GeoLocator: fallback})
+
+			before := scrapeMetrics(t)
+			lat, lng, err := locator.Lookup("192.0.2.1")
+			require.NoError(t, err)
+			assert.Equal(t, 51.5074, lat)
+			assert.Equal(t, -0.1278, lng)
+
+			after := scrapeMetrics(t)
+			delta := func(name string) float64 { return after[name] - before[name] }
+			assert.Equal(t, 1.0, delta(`livestream_geoip_provider_lookups_total{provider="test_primary",result="failure"}`))
+			assert.Equal(t, 0.0, delta(`livestream_geoip_provider_lookups_total{provider="test_primary",result="success"}`))
+			assert.Equal(t, 1.0, delta(`livestream_geoip_provider_lookups_total{provider="test_fallback",result="success"}`))
+		})
+	}
+}
+
+func TestChainedGeoLocator_StopsAtFirstSuccess(t *testing.T) {
+	primary := mocks.NewGeoLocator(t)
+	primary.EXPECT().Lookup("192.0.2.1").Return(40.7128, -74.0060, nil).Once()
+	// The fallback mock fails the test if it is called.
+	fallback := mocks.NewGeoLocator(t)
+	locator := NewChainedGeoLocator(GeoProvider{Name: "primary", GeoLocator: primary}, GeoProvider{Name: "fallback", GeoLocator: fallback})
+
+	lat, lng, err := locator.Lookup("192.0.2.1")
+	require.NoError(t, err)
+	assert.Equal(t, 40.7128, lat)
+	assert.Equal(t, -74.0060, lng)
+}
+
+func TestChainedGeoLocator_AllFail(t *testing.T) {
+	primary := mocks.NewGeoLocator(t)
+	primary.EXPECT().Lookup("not-an-ip").Return(0.0, 0.0, ErrInvalidIP).Once()
+	fallback := mocks.NewGeoLocator(t)
+	fallback.EXPECT().Lookup("not-an-ip").Return(0.0, 0.0, errors.New("lookup failed")).Once()
+	locator := NewChainedGeoLocator(GeoProvider{Name: "primary", GeoLocator: primary}, GeoProvider{Name: "fallback", GeoLocator: fallback})
+
+	_, _, err := locator.Lookup("not-an-ip")
+	assert.ErrorIs(t, err, ErrInvalidIP, "the primary's error is the one returned")
+}
+
+func TestChainedGeoLocator_LookupFull(t *testing.T) {
+	primary := mocks.NewGeoLocator(t)
+	primary.EXPECT().Lookup("81.2.69.142").Return(0.0, 0.0, nil).Once()
+	maxmind, err := NewMaxMindGeoLocator("testdata/city.mmdb")
+	require.NoError(t, err)
+	locator := NewChainedGeoLocator(GeoProvider{Name: "primary", GeoLocator: primary}, GeoProvider{Name: "fallback", GeoLocator: maxmind})
+
+	result, err := lookupGeo(locator, "81.2.69.142")
+	require.NoError(t, err)
+	assert.Equal(t, "London", result.City)
+	assert.Equal(t, "GB", result.CountryCode)
+}
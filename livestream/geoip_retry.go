@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	defaultGeoRetries      = 2
+	defaultGeoRetryBackoff = 10 * time.Millisecond
+)
+
+// RetryingGeoLocator retries failed lookups up to Retries times, doubling
+// Backoff each time. Invalid IPs are not retried.
+type RetryingGeoLocator struct {
+	locator GeoLocator
+	clock   Clock
+
+	Retries int
+	Backoff time.Duration
+}
+
+func NewRetryingGeoLocator(locator GeoLocator, retries int, backoff time.Duration) *RetryingGeoLocator {
+	return &RetryingGeoLocator{
+		locator: locator,
+		clock:   realClock{},
+		Retries: retries,
+		Backoff: backoff,
+	}
+}
+
+func (g *RetryingGeoLocator) Lookup(ipString string) (float64, float64, error) {
+	result, err := g.LookupFull(ipString)
+	return result.Lat, result.Lng, err
+}
+
+// LookupFull returns the first successful result, or the last error once the
+// retries are used up.
+func (g *RetryingGeoLocator) LookupFull(ipString string) (GeoResult, error) {
+	backoff := g.Backoff
+	for attempt := 0; ; attempt++ {
+		result, err := lookupGeo(g.locator, ipString)
+		if err == nil || errors.Is(err, ErrInvalidIP) {
+			return result, err
+		}
+		if attempt >= g.Retries {
+			geoLookupErrors.Inc()
+			return result, err
+		}
+		geoRetries.Inc()
+		<-g.clock.After(backoff)
+		backoff *= 2
+	}
+}
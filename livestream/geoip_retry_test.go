@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/posthog/posthog/livestream/mocks"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+var errGeoRead = errors.New("unexpected EOF reading MMDB")
+
+func TestRetryingGeoLocator_SucceedsOnRetry(t *testing.T) {
+	mockLocator := mocks.NewGeoLocator(t)
+	mockLocator.EXPECT().Lookup("192.0.2.1").Return(0.0, 0.0, errGeoRead).Once()
+	mockLocator.EXPECT().Lookup("192.0.2.1").Return(40.7128, -74.0060, nil).Once()
+	clock := newFakeClock()
+	locator := NewRetryingGeoLocator(mockLocator, 2, 10*time.Millisecond)
+	locator.clock = clock
+
+	retries, failures := testutil.ToFloat64(geoRetries), testutil.ToFloat64(geoLookupErrors)
+	lat, lng, err := locator.Lookup("192.0.2.1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, 40.7128, lat)
+	assert.Equal(t, -74.0060, lng)
+	assert.Equal(t, []time.Duration{10 * time.Millisecond}, clock.Waits())
+	assert.Equal(t, retries+1, testutil.ToFloat64(geoRetries))
+	assert.Equal(t, failures, testutil.ToFloat64(geoLookupErrors))
+}
+
+func TestRetryingGeoLocator_GivesUp(t *testing.T) {
+	mockLocator := mocks.NewGeoLocator(t)
+	mockLocator.EXPECT().Lookup("192.0.2.1").Return(0.0, 0.0, errGeoRead).Times(3)
+	clock := newFakeClock()
+	locator := NewRetryingGeoLocator(mockLocator, 2, 10*time.Millisecond)
+	locator.clock = clock
+
+	retries, failures := testutil.ToFloat64(geoRetries), testutil.ToFloat64(geoLookupErrors)
+	_, _, err := locator.Lookup("192.0.2.1")
+
+	assert.ErrorIs(t, err, errGeoRead)
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}, clock.Waits())
+	assert.Equal(t, retries+2, testutil.ToFloat64(geoRetries))
+	assert.Equal(t, failures+1, testutil.ToFloat64(geoLookupErrors))
+}
+
+func TestRetryingGeoLocator_DoesNotRetryInvalidIP(t *testing.T) {
+	mockLocator := mocks.NewGeoLocator(t)
+	mockLocator.EXPECT().Lookup("invalid_ip").Return(0.0, 0.0, ErrInvalidIP).Once()
+	clock := newFakeClock()
+	locator := NewRetryingGeoLocator(mockLocator, 2, 10*time.Millisecond)
+	locator.clock = clock
+
+	retries, failures := testutil.ToFloat64(geoRetries), testutil.ToFloat64(geoLookupErrors)
+	_, _, err := locator.Lookup("invalid_ip")
+
+	assert.ErrorIs(t, err, ErrInvalidIP)
+	assert.Empty(t, clock.Waits())
+	assert.Equal(t, retries, testutil.ToFloat64(geoRetries))
+	assert.Equal(t, failures, testutil.ToFloat64(geoLookupErrors))
+}
+
+func TestRetryingGeoLocator_NoRetries(t *testing.T) {
+	mockLocator := mocks.NewGeoLocator(t)
+	mockLocator.EXPECT().Lookup("192.0.2.1").Return(0.0, 0.0, errGeoRead).Once()
+	locator := NewRetryingGeoLocator(mockLocator, 0, 10*time.Millisecond)
+	locator.clock = newFakeClock()
+
+	_, _, err := locator.Lookup("192.0.2.1")
+	assert.ErrorIs(t, err, errGeoRead)
+}
@@ -2,10 +2,12 @@ package main
 
 import (
 	"errors"
+	"sync"
 	"testing"
 
 	"github.com/posthog/posthog/livestream/mocks"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMaxMindLocator_Lookup_Success(t *testing.T) {
@@ -44,12 +46,238 @@ func TestMaxMindLocator_Lookup_DatabaseError(t *testing.T) {
 }
 
 func TestNewMaxMindGeoLocator_Success(t *testing.T) {
-	// This test would require mocking the maxminddb.Open function, which is not possible with the current setup.
-	// In a real scenario, you might use a test database file or mock the file system.
-	t.Skip("Skipping NewMaxMindGeoLocator test as it requires filesystem interaction")
+	locator, err := NewMaxMindGeoLocator("testdata/city.mmdb")
+
+	require.NoError(t, err)
+	assert.NotNil(t, locator)
 }
 
 func TestNewMaxMindGeoLocator_Error(t *testing.T) {
-	// Similar to the success case, this test would require mocking filesystem operations.
-	t.Skip("Skipping NewMaxMindGeoLocator error test as it requires filesystem interaction")
+	locator, err := NewMaxMindGeoLocator("testdata/missing.mmdb")
+
+	assert.Error(t, err)
+	assert.Nil(t, locator)
+}
+
+func TestMaxMindLocator_Lookup(t *testing.T) {
+	locator, err := NewMaxMindGeoLocator("testdata/city.mmdb")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		ip          string
+		expectedLat float64
+		expectedLng float64
+		expectedErr error
+	}{
+		{name: "IPv4", ip: "81.2.69.142", expectedLat: 51.5142, expectedLng: -0.0931},
+		{name: "IPv4 padded", ip: " 216.160.83.58 ", expectedLat: 47.2513, expectedLng: -122.3149},
+		{name: "IPv6", ip: "2a02:cf40::1", expectedLat: 59.9127, expectedLng: 10.7461},
+		{name: "IPv6 uppercase", ip: "2001:480:10::FFFF", expectedLat: 32.7157, expectedLng: -117.1611},
+		{name: "IPv6 bracketed", ip: "[2a02:cf40::1]", expectedLat: 59.9127, expectedLng: 10.7461},
+		{name: "IPv6 with zone", ip: "2a02:cf40::1%eth0", expectedLat: 59.9127, expectedLng: 10.7461},
+		{name: "IPv4-mapped IPv6", ip: "::ffff:81.2.69.142", expectedLat: 51.5142, expectedLng: -0.0931},
+		{name: "IPv4-mapped IPv6 hex", ip: "::ffff:5102:458e", expectedLat: 51.5142, expectedLng: -0.0931},
+		{name: "Unknown IPv4", ip: "192.0.2.1"},
+		{name: "Unknown IPv6", ip: "2001:db8::1"},
+		{name: "Empty", ip: "", expectedErr: ErrInvalidIP},
+		{name: "Hostname", ip: "example.com", expectedErr: ErrInvalidIP},
+		{name: "IPv4 out of range", ip: "256.1.1.1", expectedErr: ErrInvalidIP},
+		{name: "IPv4 with port", ip: "81.2.69.142:8080", expectedErr: ErrInvalidIP},
+		{name: "IPv6 too many groups", ip: "2a02:cf40:0:0:0:0:0:0:1", expectedErr: ErrInvalidIP},
+		{name: "Unclosed bracket", ip: "[2a02:cf40::1", expectedErr: ErrInvalidIP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lat, lng, err := locator.Lookup(tt.ip)
+
+			if tt.expectedErr != nil {
+				assert.ErrorIs(t, err, tt.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expectedLat, lat)
+			assert.Equal(t, tt.expectedLng, lng)
+		})
+	}
+}
+
+func TestMaxMindLocator_Reload(t *testing.T) {
+	locator, err := NewMaxMindGeoLocator("testdata/city.mmdb")
+	require.NoError(t, err)
+
+	lat, lng, err := locator.Lookup("81.2.69.142")
+	require.NoError(t, err)
+	assert.Equal(t, 51.5142, lat)
+	assert.Equal(t, -0.0931, lng)
+
+	require.NoError(t, locator.Reload("testdata/city-updated.mmdb"))
+
+	lat, lng, err = locator.Lookup("81.2.69.142")
+	require.NoError(t, err)
+	assert.Equal(t, 53.4808, lat)
+	assert.Equal(t, -2.2426, lng)
+}
+
+func TestMaxMindLocator_ReloadError(t *testing.T) {
+	locator, err := NewMaxMindGeoLocator("testdata/city.mmdb")
+	require.NoError(t, err)
+
+	assert.Error(t, locator.Reload("testdata/missing.mmdb"))
+
+	lat, _, err := locator.Lookup("81.2.69.142")
+	require.NoError(t, err)
+	assert.Equal(t, 51.5142, lat, "A failed reload should keep the current database")
+}
+
+func TestMaxMindLocator_ReloadDuringLookups(t *testing.T) {
+	locator, err := NewMaxMindGeoLocator("testdata/city.mmdb")
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				lat, _, err := locator.Lookup("2a02:cf40::1")
+				if !assert.NoError(t, err) {
+					return
+				}
+				if lat != 59.9127 && lat != 60.3913 {
+					t.Errorf("Unexpected latitude %v mid-swap", lat)
+					return
+				}
+			}
+		}()
+	}
+
+	dbs := []string{"testdata/city-updated.mmdb", "testdata/city.mmdb"}
+	for i := 0; i < 50; i++ {
+		require.NoError(t, locator.Reload(dbs[i%2]))
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestNoOpGeoLocator(t *testing.T) {
+	var locator GeoLocator = NoOpGeoLocator{}
+
+	for _, ip := range []string{"81.2.69.142", "2a02:cf40::1", "not-an-ip", ""} {
+		lat, lng, err := locator.Lookup(ip)
+		assert.NoError(t, err)
+		assert.Zero(t, lat)
+		assert.Zero(t, lng)
+	}
+}
+
+func TestEventGeoProperties(t *testing.T) {
+	tests := []struct {
+		name       string
+		properties map[string]interface{}
+		expected   GeoResult
+		ok         bool
+	}{
+		{
+			name:       "Present",
+			properties: map[string]interface{}{"$geoip_latitude": 51.5142, "$geoip_longitude": -0.0931},
+			expected:   GeoResult{Lat: 51.5142, Lng: -0.0931},
+			ok:         true,
+		},
+		{
+			name: "With names",
+			properties: map[string]interface{}{
+				"$geoip_latitude": 51.5142, "$geoip_longitude": -0.0931,
+				"$geoip_city_name": "London", "$geoip_subdivision_1_name": "England", "$geoip_country_code": "GB",
+			},
+			expected: GeoResult{Lat: 51.5142, Lng: -0.0931, City: "London", Region: "England", CountryCode: "GB"},
+			ok:       true,
+		},
+		{name: "Absent", properties: map[string]interface{}{}},
+		{name: "Only latitude", properties: map[string]interface{}{"$geoip_latitude": 51.5142}},
+		{name: "Only city", properties: map[string]interface{}{"$geoip_city_name": "London"}},
+		{name: "Not numbers", properties: map[string]interface{}{"$geoip_latitude": "51.5142", "$geoip_longitude": "-0.0931"}},
+		{name: "Out of range", properties: map[string]interface{}{"$geoip_latitude": 91.0, "$geoip_longitude": -0.0931}},
+		{name: "Nil properties"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, ok := eventGeoProperties(tt.properties)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestPickIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		value     string
+		leftmost  string
+		rightmost string
+	}{
+		{name: "Single", value: "192.0.2.1", leftmost: "192.0.2.1", rightmost: "192.0.2.1"},
+		{name: "Empty", value: "", leftmost: "", rightmost: ""},
+		{name: "List", value: "192.0.2.1, 198.51.100.1,203.0.113.1", leftmost: "192.0.2.1", rightmost: "203.0.113.1"},
+		{name: "IPv6", value: " 2001:db8::1 , 192.0.2.1", leftmost: "2001:db8::1", rightmost: "192.0.2.1"},
+		{name: "Leading invalid", value: "unknown, 192.0.2.1, 198.51.100.1", leftmost: "192.0.2.1", rightmost: "198.51.100.1"},
+		{name: "Trailing invalid", value: "192.0.2.1, 198.51.100.1, ", leftmost: "192.0.2.1", rightmost: "198.51.100.1"},
+		{name: "None valid", value: "unknown, proxy", leftmost: "unknown, proxy", rightmost: "unknown, proxy"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.leftmost, pickIP(tt.value, false))
+			assert.Equal(t, tt.rightmost, pickIP(tt.value, true))
+		})
+	}
+}
+
+func TestMaxMindLocator_LookupFull(t *testing.T) {
+	locator, err := NewMaxMindGeoLocator("testdata/city.mmdb")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		ip       string
+		expected GeoResult
+		err      error
+	}{
+		{name: "London", ip: "81.2.69.142", expected: GeoResult{Lat: 51.5142, Lng: -0.0931, City: "London", Region: "England", CountryCode: "GB"}},
+		{name: "Milton", ip: "216.160.83.58", expected: GeoResult{Lat: 47.2513, Lng: -122.3149, City: "Milton", Region: "Washington", CountryCode: "US"}},
+		{name: "Oslo", ip: "2a02:cf40::1", expected: GeoResult{Lat: 59.9127, Lng: 10.7461, City: "Oslo", Region: "Oslo", CountryCode: "NO"}},
+		{name: "Unknown", ip: "192.0.2.1"},
+		{name: "Invalid", ip: "example.com", err: ErrInvalidIP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := locator.LookupFull(tt.ip)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestLookupGeoFallsBackToLookup(t *testing.T) {
+	mockLocator := mocks.NewGeoLocator(t)
+	mockLocator.EXPECT().Lookup("192.0.2.1").Return(40.7128, -74.0060, nil)
+
+	result, err := lookupGeo(mockLocator, "192.0.2.1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, GeoResult{Lat: 40.7128, Lng: -74.0060}, result)
 }
@@ -1,11 +1,328 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 )
 
+// tokenHeader can be used instead of the token query param to pick the
+// project a client subscribes to.
+const tokenHeader = "X-Livestream-Token"
+
 func index(c echo.Context) error {
 	return c.String(http.StatusOK, "RealTime Hog 3000")
 }
+
+// requestedToken returns the project token a client asked to subscribe to,
+// from the token query param or the X-Livestream-Token header. An empty
+// string means no token was requested, and allTokens every token.
+func requestedToken(c echo.Context) (string, error) {
+	token := c.QueryParam("token")
+	if token == "" {
+		token = c.Request().Header.Get(tokenHeader)
+	}
+
+	token = strings.TrimSpace(token)
+	if token == "" || token == allTokens {
+		return token, nil
+	}
+	if err := validateToken(token); err != nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return token, nil
+}
+
+// requestedDistinctId returns the distinct id a client wants events of, from
+// the distinct_id query param or the older distinctId. It is matched exactly,
+// so it is not trimmed; empty means every user.
+func requestedDistinctId(c echo.Context) string {
+	if distinctId := c.QueryParam("distinct_id"); distinctId != "" {
+		return distinctId
+	}
+	return c.QueryParam("distinctId")
+}
+
+// requestedEventTypes returns the event names a client wants from the
+// comma-separated event query param, or the older eventType. Names are matched
+// exactly; an empty list means every event.
+func requestedEventTypes(c echo.Context) []string {
+	raw := c.QueryParam("event")
+	if raw == "" {
+		raw = c.QueryParam("eventType")
+	}
+
+	eventTypes := []string{}
+	for _, eventType := range strings.Split(raw, ",") {
+		if eventType = strings.TrimSpace(eventType); eventType != "" {
+			eventTypes = append(eventTypes, eventType)
+		}
+	}
+	return eventTypes
+}
+
+// requestedBoundingBox returns the box from the minLat, minLng, maxLat and
+// maxLng query params, or nil if there is none. Events without coordinates
+// are left out unless includeMissingCoords is true.
+func requestedBoundingBox(c echo.Context) (*BoundingBox, error) {
+	values := make(map[string]string, len(bboxParams))
+	for _, param := range bboxParams {
+		values[param] = c.QueryParam(param)
+	}
+	box, err := parseBoundingBox(values)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if box == nil {
+		return nil, nil
+	}
+	if raw := c.QueryParam("includeMissingCoords"); raw != "" {
+		if box.IncludeMissing, err = strconv.ParseBool(raw); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("includeMissingCoords must be true or false, got %q", raw))
+		}
+	}
+	return box, nil
+}
+
+// requestedFormat returns the output format from the format query param,
+// full or compact. Geo subscriptions have a shape of their own, so they can't
+// pick one.
+func requestedFormat(c echo.Context, geo bool) (OutputFormat, error) {
+	raw := c.QueryParam("format")
+	format, err := parseOutputFormat(raw)
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if geo && raw != "" {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "format is not supported with geo=true")
+	}
+	return format, nil
+}
+
+// newSubscription builds the subscription a streaming client asked for. Geo
+// subscriptions are open to everyone; the rest need a JWT whose api_token
+// sets the project. When auth is set, a subscription to a token, geo or not,
+// also needs an API key that auth allows to read it. Subscribing to
+// allTokens needs no JWT, only an API key auth allows to read allTokens.
+func newSubscription(c echo.Context, auth Authorizer) (Subscription, error) {
+	var teamId string
+	distinctId := requestedDistinctId(c)
+	geo := c.QueryParam("geo")
+
+	teamIdInt := 0
+	token := ""
+	geoOnly := false
+
+	requested, err := requestedToken(c)
+	if err != nil {
+		return Subscription{}, err
+	}
+
+	if requested == allTokens {
+		if auth == nil {
+			return Subscription{}, echo.NewHTTPError(http.StatusForbidden, "subscribing to every token needs stream.api_keys")
+		}
+		if err := authorize(c, auth, allTokens); err != nil {
+			return Subscription{}, err
+		}
+		// The filter sends subscriptions without a token every event.
+		geoOnly = strings.ToLower(geo) == "true" || geo == "1"
+	} else if strings.ToLower(geo) == "true" || geo == "1" {
+		geoOnly = true
+		token = requested
+	} else {
+		teamId = ""
+
+		authHeader := c.Request().Header.Get("Authorization")
+		if authHeader == "" {
+			return Subscription{}, errors.New("authorization header is required")
+		}
+
+		claims, err := decodeAuthToken(authHeader)
+		if err != nil {
+			return Subscription{}, err
+		}
+		teamId = strconv.Itoa(int(claims["team_id"].(float64)))
+		token = fmt.Sprint(claims["api_token"])
+
+		if teamId == "" {
+			return Subscription{}, errors.New("teamId is required unless geo=true")
+		}
+
+		if requested != "" && requested != token {
+			return Subscription{}, echo.NewHTTPError(http.StatusForbidden, "token does not match authorization")
+		}
+	}
+
+	if token != "" {
+		if err := authorize(c, auth, token); err != nil {
+			return Subscription{}, err
+		}
+	}
+
+	eventTypes := requestedEventTypes(c)
+
+	box, err := requestedBoundingBox(c)
+	if err != nil {
+		return Subscription{}, err
+	}
+
+	format, err := requestedFormat(c, geoOnly)
+	if err != nil {
+		return Subscription{}, err
+	}
+
+	return Subscription{
+		TeamId:      teamIdInt,
+		Token:       token,
+		ClientId:    c.Response().Header().Get(echo.HeaderXRequestID),
+		DistinctId:  distinctId,
+		Geo:         geoOnly,
+		EventTypes:  eventTypes,
+		Box:         box,
+		Format:      format,
+		EventChan:   make(chan interface{}, 100),
+		ShouldClose: &atomic.Bool{},
+	}, nil
+}
+
+// gzipMiddleware compresses responses for clients that send
+// Accept-Encoding: gzip. Streams stay usable because every Flush also flushes
+// the gzip writer. WebSocket upgrades are skipped, they negotiate
+// permessage-deflate instead.
+func gzipMiddleware() echo.MiddlewareFunc {
+	return middleware.GzipWithConfig(middleware.GzipConfig{
+		Level: 9, // Set compression level to maximum
+		Skipper: func(c echo.Context) bool {
+			return strings.EqualFold(c.Request().Header.Get(echo.HeaderUpgrade), "websocket")
+		},
+	})
+}
+
+// eventsHandler streams the events matching the subscription as SSE. A client
+// reconnecting with Last-Event-ID gets its stream back from replay, starting
+// with the events it missed. When heartbeat is positive, a keepalive comment
+// is sent after that long without an event, so proxies don't drop quiet
+// streams as idle.
+func eventsHandler(subChan chan Subscription, unSubChan chan Subscription, limiter *ClientLimiter, auth Authorizer, replay *ReplayBuffers, heartbeat time.Duration, clock Clock) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		log.Printf("SSE client connected, ip: %v", c.RealIP())
+
+		subscription, err := newSubscription(c, auth)
+		if err != nil {
+			return err
+		}
+
+		if err := limiter.acquire(c, subscription.Token); err != nil {
+			return err
+		}
+		defer limiter.Release(c.RealIP(), subscription.Token)
+		subscription.RateLimit = limiter.EventLimit()
+
+		ctx := c.Request().Context()
+		stream, missed := replay.Resume(c.Request().Header.Get("Last-Event-ID"), subscription)
+		if stream != nil {
+			subscription = stream.Subscription()
+		} else {
+			select {
+			case subChan <- subscription:
+			case <-ctx.Done():
+				return nil
+			}
+			stream = replay.NewStream(subscription)
+		}
+		defer func() {
+			if shuttingDown(ctx) {
+				// The filter has stopped, there is nothing to unsubscribe from.
+				return
+			}
+			if !replay.Park(stream, unSubChan) {
+				unSubChan <- subscription
+				subscription.ShouldClose.Store(true)
+			}
+		}()
+
+		w := c.Response()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		// Send the headers right away rather than with the first event, which
+		// may be a while for a quiet project.
+		w.WriteHeader(http.StatusOK)
+		for _, event := range missed {
+			if err := event.WriteTo(w); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+
+		var idle <-chan time.Time
+		if heartbeat > 0 {
+			idle = clock.After(heartbeat)
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				if shuttingDown(ctx) {
+					return sendBuffered(w, stream, subscription.EventChan)
+				}
+				log.Printf("SSE client disconnected, ip: %v", c.RealIP())
+				return nil
+			case payload := <-subscription.EventChan:
+				if err := sendEvent(w, stream, payload); err != nil {
+					return err
+				}
+			case <-idle:
+				event := Event{
+					Comment: []byte("keepalive"),
+				}
+				if err := event.WriteTo(w); err != nil {
+					return err
+				}
+				w.Flush()
+			}
+			if heartbeat > 0 {
+				idle = clock.After(heartbeat)
+			}
+		}
+	}
+}
+
+// sendEvent numbers payload on stream and writes it to the client.
+func sendEvent(w *echo.Response, stream *ReplayStream, payload interface{}) error {
+	event, err := stream.Add(payload)
+	if err != nil {
+		captureException(err)
+		log.Println("Error marshalling payload", err)
+		return nil
+	}
+
+	if err := event.WriteTo(w); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+// sendBuffered writes the events already waiting in events, so a client of a
+// server shutting down gets everything dispatched to it.
+func sendBuffered(w *echo.Response, stream *ReplayStream, events chan interface{}) error {
+	for {
+		select {
+		case payload := <-events:
+			if err := sendEvent(w, stream, payload); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
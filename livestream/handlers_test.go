@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestedToken(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         string
+		header        string
+		expected      string
+		expectedError bool
+	}{
+		{name: "None", expected: ""},
+		{name: "Query param", query: "?token=phc_abc", expected: "phc_abc"},
+		{name: "Header", header: "phc_def", expected: "phc_def"},
+		{name: "Query param wins", query: "?token=phc_abc", header: "phc_def", expected: "phc_abc"},
+		{name: "Trimmed", header: "  phc_def ", expected: "phc_def"},
+		{name: "Invalid", query: "?token=not%20a%20token", expectedError: true},
+		{name: "All tokens", query: "?token=*", expected: allTokens},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/events"+tt.query, nil)
+			if tt.header != "" {
+				req.Header.Set(tokenHeader, tt.header)
+			}
+			c := e.NewContext(req, httptest.NewRecorder())
+
+			token, err := requestedToken(c)
+
+			if tt.expectedError {
+				var httpErr *echo.HTTPError
+				if assert.ErrorAs(t, err, &httpErr) {
+					assert.Equal(t, http.StatusBadRequest, httpErr.Code)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, token)
+		})
+	}
+}
+
+func TestRequestedEventTypes(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{name: "None", query: "", expected: []string{}},
+		{name: "Empty", query: "?event=", expected: []string{}},
+		{name: "Single", query: "?event=$pageview", expected: []string{"$pageview"}},
+		{name: "Multiple", query: "?event=$pageview,$autocapture", expected: []string{"$pageview", "$autocapture"}},
+		{name: "Blank entries", query: "?event=$pageview,%20,,$autocapture,", expected: []string{"$pageview", "$autocapture"}},
+		{name: "Legacy param", query: "?eventType=$pageview", expected: []string{"$pageview"}},
+		{name: "Event wins over legacy", query: "?event=$pageleave&eventType=$pageview", expected: []string{"$pageleave"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/events"+tt.query, nil)
+			c := e.NewContext(req, httptest.NewRecorder())
+
+			assert.Equal(t, tt.expected, requestedEventTypes(c))
+		})
+	}
+}
+
+func TestRequestedDistinctId(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected string
+	}{
+		{name: "None", query: "", expected: ""},
+		{name: "Param", query: "?distinct_id=user1", expected: "user1"},
+		{name: "Not trimmed", query: "?distinct_id=%20user1", expected: " user1"},
+		{name: "Legacy param", query: "?distinctId=user1", expected: "user1"},
+		{name: "Param wins over legacy", query: "?distinct_id=user1&distinctId=user2", expected: "user1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/events"+tt.query, nil)
+			c := e.NewContext(req, httptest.NewRecorder())
+
+			assert.Equal(t, tt.expected, requestedDistinctId(c))
+		})
+	}
+}
+
+// streamEvent starts an /events stream with the given Accept-Encoding,
+// publishes a single event to it and returns the response.
+func streamEvent(t *testing.T, acceptEncoding string) *http.Response {
+	t.Helper()
+	viper.Set("jwt.secret", "test-secret")
+
+	subChan := make(chan Subscription)
+	e := echo.New()
+	e.Use(gzipMiddleware())
+	e.GET("/events", eventsHandler(subChan, make(chan Subscription, 1), nil, nil, nil, 0, realClock{}))
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	go func() {
+		sub := <-subChan
+		sub.EventChan <- ResponsePostHogEvent{Uuid: "forwarded", Event: "$pageview"}
+	}()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+createProjectToken(t, 1, "test-token"))
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	// The transport must not decompress on its own, the test looks at the
+	// bytes as sent.
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}, Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	return resp
+}
+
+// readDataLine reads the stream up to the first SSE data line.
+func readDataLine(t *testing.T, r io.Reader) string {
+	t.Helper()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+			return strings.TrimPrefix(line, "data: ")
+		}
+	}
+	require.NoError(t, scanner.Err())
+	t.Fatal("Stream ended without an event")
+	return ""
+}
+
+func TestEventsHandlerGzip(t *testing.T) {
+	resp := streamEvent(t, "gzip")
+	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	gz, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, readDataLine(t, gz), `"uuid":"forwarded"`)
+}
+
+func TestEventsHandlerPlaintext(t *testing.T) {
+	resp := streamEvent(t, "")
+	assert.Empty(t, resp.Header.Get("Content-Encoding"))
+	assert.Contains(t, readDataLine(t, resp.Body), `"uuid":"forwarded"`)
+}
+
+func TestEventsHandlerHeartbeat(t *testing.T) {
+	viper.Set("jwt.secret", "test-secret")
+
+	clock := newFakeClock()
+	start := clock.Now()
+	e := echo.New()
+	e.GET("/events", eventsHandler(make(chan Subscription, 1), make(chan Subscription, 1), nil, nil, nil, 30*time.Second, clock))
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+createProjectToken(t, 1, "test-token"))
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	// No event is ever published, so the first thing on the stream is a
+	// keepalive comment, once the clock has moved past the idle interval.
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, ": keepalive\n", line)
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\n", line)
+
+	assert.Equal(t, 30*time.Second, clock.Waits()[0])
+	assert.False(t, clock.Now().Before(start.Add(30*time.Second)))
+}
+
+// readSSEEvents reads n events off an SSE stream, returning their id and
+// data lines.
+func readSSEEvents(t *testing.T, r *bufio.Reader, n int) [][2]string {
+	t.Helper()
+	var events [][2]string
+	var id string
+	for len(events) < n {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		if strings.HasPrefix(line, "id: ") {
+			id = strings.TrimPrefix(line, "id: ")
+		} else if strings.HasPrefix(line, "data: ") {
+			events = append(events, [2]string{id, strings.TrimPrefix(line, "data: ")})
+		}
+	}
+	return events
+}
+
+func TestEventsHandlerResume(t *testing.T) {
+	viper.Set("jwt.secret", "test-secret")
+
+	subChan := make(chan Subscription, 2)
+	replay := NewReplayBuffers(10, time.Minute, 10)
+	e := echo.New()
+	e.Use(middleware.RequestID())
+	e.GET("/events", eventsHandler(subChan, make(chan Subscription, 2), nil, nil, replay, 0, realClock{}))
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	connect := func(lastEventId string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+createProjectToken(t, 1, "test-token"))
+		if lastEventId != "" {
+			req.Header.Set("Last-Event-ID", lastEventId)
+		}
+		resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp
+	}
+
+	resp := connect("")
+	sub := <-subChan
+	sub.EventChan <- ResponsePostHogEvent{Uuid: "1"}
+	sub.EventChan <- ResponsePostHogEvent{Uuid: "2"}
+	events := readSSEEvents(t, bufio.NewReader(resp.Body), 2)
+	assert.Equal(t, sub.ClientId+":1", events[0][0])
+	assert.Equal(t, sub.ClientId+":2", events[1][0])
+
+	// The client only saw the first event before the connection dropped, and
+	// one more event comes in while it is away.
+	resp.Body.Close()
+	assert.Eventually(t, func() bool { return replay.Parked() == 1 }, time.Second, time.Millisecond)
+	sub.EventChan <- ResponsePostHogEvent{Uuid: "3"}
+
+	resp = connect(events[0][0])
+	defer resp.Body.Close()
+	events = readSSEEvents(t, bufio.NewReader(resp.Body), 2)
+	assert.Equal(t, sub.ClientId+":2", events[0][0])
+	assert.Contains(t, events[0][1], `"uuid":"2"`)
+	assert.Equal(t, sub.ClientId+":3", events[1][0])
+	assert.Contains(t, events[1][1], `"uuid":"3"`)
+	assert.Empty(t, subChan, "a resumed stream keeps its subscription")
+	assert.Zero(t, replay.Parked())
+}
+
+func TestRequestedBoundingBox(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		expected *BoundingBox
+		status   int
+	}{
+		{name: "None", query: ""},
+		{name: "Box", query: "?minLat=1&minLng=2&maxLat=3&maxLng=4", expected: &BoundingBox{MinLat: 1, MinLng: 2, MaxLat: 3, MaxLng: 4}},
+		{name: "Include missing", query: "?minLat=1&minLng=2&maxLat=3&maxLng=4&includeMissingCoords=true", expected: &BoundingBox{MinLat: 1, MinLng: 2, MaxLat: 3, MaxLng: 4, IncludeMissing: true}},
+		{name: "Malformed", query: "?minLat=1&minLng=2&maxLat=3&maxLng=east", status: http.StatusBadRequest},
+		{name: "Partial", query: "?minLat=1", status: http.StatusBadRequest},
+		{name: "Bad include missing", query: "?minLat=1&minLng=2&maxLat=3&maxLng=4&includeMissingCoords=maybe", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/events"+tt.query, nil)
+			c := e.NewContext(req, httptest.NewRecorder())
+
+			box, err := requestedBoundingBox(c)
+			if tt.status != 0 {
+				var httpErr *echo.HTTPError
+				require.ErrorAs(t, err, &httpErr)
+				assert.Equal(t, tt.status, httpErr.Code)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, box)
+		})
+	}
+}
+
+func TestRequestedFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		geo      bool
+		expected OutputFormat
+		status   int
+	}{
+		{name: "Default", query: "", expected: FormatFull},
+		{name: "Full", query: "?format=full", expected: FormatFull},
+		{name: "Compact", query: "?format=compact", expected: FormatCompact},
+		{name: "Unknown", query: "?format=xml", status: http.StatusBadRequest},
+		{name: "Geo default", query: "", geo: true, expected: FormatFull},
+		{name: "Geo with format", query: "?format=compact", geo: true, status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/events"+tt.query, nil)
+			c := e.NewContext(req, httptest.NewRecorder())
+
+			format, err := requestedFormat(c, tt.geo)
+			if tt.status != 0 {
+				var httpErr *echo.HTTPError
+				require.ErrorAs(t, err, &httpErr)
+				assert.Equal(t, tt.status, httpErr.Code)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, format)
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Readiness records whether the dependencies needed to serve events are up.
+// The zero value is not ready.
+type Readiness struct {
+	kafkaSubscribed atomic.Bool
+	geoipLoaded     atomic.Bool
+	// kafkaIdle is informational, an idle consumer is still ready.
+	kafkaIdle atomic.Bool
+}
+
+func (r *Readiness) SetKafkaSubscribed(ok bool) {
+	r.kafkaSubscribed.Store(ok)
+}
+
+// SetKafkaIdle records whether the consumer has gone a while without a
+// message, while still reading.
+func (r *Readiness) SetKafkaIdle(idle bool) {
+	r.kafkaIdle.Store(idle)
+}
+
+func (r *Readiness) SetGeoIPLoaded(ok bool) {
+	r.geoipLoaded.Store(ok)
+}
+
+// Ready reports whether the consumer has subscribed and the GeoIP database is
+// loaded.
+func (r *Readiness) Ready() bool {
+	return r.kafkaSubscribed.Load() && r.geoipLoaded.Load()
+}
+
+// healthzHandler answers as long as the process can serve HTTP.
+func healthzHandler(c echo.Context) error {
+	return c.String(http.StatusOK, "ok")
+}
+
+func readyzHandler(readiness *Readiness) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		type resp struct {
+			KafkaSubscribed bool `json:"kafka_subscribed"`
+			GeoIPLoaded     bool `json:"geoip_loaded"`
+			KafkaIdle       bool `json:"kafka_idle"`
+		}
+
+		status := http.StatusOK
+		if !readiness.Ready() {
+			status = http.StatusServiceUnavailable
+		}
+		return c.JSON(status, resp{
+			KafkaSubscribed: readiness.kafkaSubscribed.Load(),
+			GeoIPLoaded:     readiness.geoipLoaded.Load(),
+			KafkaIdle:       readiness.kafkaIdle.Load(),
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthz(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	if assert.NoError(t, healthzHandler(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "ok", rec.Body.String())
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name            string
+		kafkaSubscribed bool
+		geoipLoaded     bool
+		expectedStatus  int
+	}{
+		{name: "Nothing ready", expectedStatus: http.StatusServiceUnavailable},
+		{name: "Only Kafka", kafkaSubscribed: true, expectedStatus: http.StatusServiceUnavailable},
+		{name: "Only GeoIP", geoipLoaded: true, expectedStatus: http.StatusServiceUnavailable},
+		{name: "Ready", kafkaSubscribed: true, geoipLoaded: true, expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readiness := &Readiness{}
+			readiness.SetKafkaSubscribed(tt.kafkaSubscribed)
+			readiness.SetGeoIPLoaded(tt.geoipLoaded)
+
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			require.NoError(t, readyzHandler(readiness)(c))
+			assert.Equal(t, tt.expectedStatus, rec.Code)
+
+			var response map[string]bool
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+			assert.Equal(t, tt.kafkaSubscribed, response["kafka_subscribed"])
+			assert.Equal(t, tt.geoipLoaded, response["geoip_loaded"])
+			assert.False(t, response["kafka_idle"])
+		})
+	}
+}
+
+func TestReadyzIdleIsStillReady(t *testing.T) {
+	readiness := &Readiness{}
+	readiness.SetKafkaSubscribed(true)
+	readiness.SetGeoIPLoaded(true)
+	readiness.SetKafkaIdle(true)
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	require.NoError(t, readyzHandler(readiness)(c))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var response map[string]bool
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.True(t, response["kafka_idle"])
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Hub reads events from one channel and gives every subscribed channel its own
+// copy of each. What happens when a subscriber's channel is full is up to that
+// subscriber's BackpressurePolicy, so a slow reader that drops events does not
+// hold up the others.
+type Hub struct {
+	// FlushInterval is how often sinks that buffer output are flushed.
+	// Defaults to one second.
+	FlushInterval time.Duration
+
+	in    chan PostHogEvent
+	clock Clock
+	sinks sync.WaitGroup
+
+	mu   sync.RWMutex
+	subs map[chan PostHogEvent]*hubSubscriber
+}
+
+type hubSubscriber struct {
+	policy  BackpressurePolicy
+	ctx     context.Context
+	cancel  context.CancelFunc
+	dropped atomic.Int64
+}
+
+func NewHub(in chan PostHogEvent) *Hub {
+	return &Hub{
+		in:    in,
+		clock: realClock{},
+		subs:  make(map[chan PostHogEvent]*hubSubscriber),
+	}
+}
+
+// AddSink subscribes a channel with room for buffer events and writes what
+// it receives to sink on a goroutine of its own, so a slow or failing sink
+// does not hold up the others. It returns the channel, to watch how full it
+// gets. The sink is closed once the hub's input is.
+func (h *Hub) AddSink(name string, sink Sink, buffer int, policy BackpressurePolicy) chan PostHogEvent {
+	ch := make(chan PostHogEvent, buffer)
+	h.Subscribe(ch, policy)
+
+	h.sinks.Add(1)
+	go func() {
+		defer h.sinks.Done()
+		runSink(name, sink, ch, h.FlushInterval, h.clock)
+	}()
+	return ch
+}
+
+// Wait blocks until every sink added with AddSink has been closed.
+func (h *Hub) Wait() {
+	h.sinks.Wait()
+}
+
+// Subscribe registers ch to receive every event from now on. The hub owns ch
+// afterwards and closes it on Unsubscribe or once the input is closed.
+func (h *Hub) Subscribe(ch chan PostHogEvent, policy BackpressurePolicy) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs[ch] = &hubSubscriber{policy: policy, ctx: ctx, cancel: cancel}
+}
+
+// Unsubscribe stops sending to ch and closes it. It does not wait for a
+// blocked send to ch to be read.
+func (h *Hub) Unsubscribe(ch chan PostHogEvent) {
+	h.mu.RLock()
+	sub, ok := h.subs[ch]
+	h.mu.RUnlock()
+	if !ok {
+		return
+	}
+	// Unblock Run if it is waiting on ch, so it lets go of the read lock.
+	sub.cancel()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// Dropped returns how many events ch missed because it was full. It is zero
+// for channels that are not subscribed.
+func (h *Hub) Dropped(ch chan PostHogEvent) int64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if sub, ok := h.subs[ch]; ok {
+		return sub.dropped.Load()
+	}
+	return 0
+}
+
+// Run fans events out until the input channel is closed, then closes every
+// subscribed channel.
+func (h *Hub) Run() {
+	for event := range h.in {
+		h.broadcast(event)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch, sub := range h.subs {
+		sub.cancel()
+		close(ch)
+		delete(h.subs, ch)
+	}
+}
+
+func (h *Hub) broadcast(event PostHogEvent) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for ch, sub := range h.subs {
+		sent, evicted, err := send(sub.ctx, sub.policy, ch, event)
+		if err != nil {
+			// Unsubscribed while blocked.
+			continue
+		}
+		sub.dropped.Add(int64(len(evicted)))
+		if !sent {
+			sub.dropped.Add(1)
+		}
+	}
+}
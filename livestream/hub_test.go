@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func drain(ch chan PostHogEvent) []string {
+	var uuids []string
+	for event := range ch {
+		uuids = append(uuids, event.Uuid)
+	}
+	return uuids
+}
+
+func TestHubFansOutToEverySubscriber(t *testing.T) {
+	in := make(chan PostHogEvent)
+	hub := NewHub(in)
+
+	subs := []chan PostHogEvent{
+		make(chan PostHogEvent, 10),
+		make(chan PostHogEvent, 10),
+		make(chan PostHogEvent, 10),
+	}
+	for _, ch := range subs {
+		hub.Subscribe(ch, Block)
+	}
+	go hub.Run()
+
+	for i := 0; i < 5; i++ {
+		in <- PostHogEvent{Uuid: fmt.Sprint(i)}
+	}
+	close(in)
+
+	for _, ch := range subs {
+		assert.Equal(t, []string{"0", "1", "2", "3", "4"}, drain(ch))
+	}
+}
+
+func TestHubSlowSubscriberDoesNotBlockOthers(t *testing.T) {
+	in := make(chan PostHogEvent)
+	hub := NewHub(in)
+
+	fast := make(chan PostHogEvent, 10)
+	slow := make(chan PostHogEvent, 1)
+	hub.Subscribe(fast, Block)
+	hub.Subscribe(slow, DropNewest)
+	go hub.Run()
+
+	for i := 0; i < 5; i++ {
+		select {
+		case in <- PostHogEvent{Uuid: fmt.Sprint(i)}:
+		case <-time.After(time.Second):
+			t.Fatal("Hub blocked on the slow subscriber")
+		}
+	}
+	// Let the last event reach every subscriber before counting.
+	assert.Eventually(t, func() bool { return len(fast) == 5 }, time.Second, time.Millisecond)
+	assert.Equal(t, int64(4), hub.Dropped(slow))
+	close(in)
+
+	assert.Equal(t, []string{"0", "1", "2", "3", "4"}, drain(fast))
+	assert.Equal(t, []string{"0"}, drain(slow))
+}
+
+func TestHubDropOldestSubscriber(t *testing.T) {
+	in := make(chan PostHogEvent)
+	hub := NewHub(in)
+
+	sub := make(chan PostHogEvent, 2)
+	hub.Subscribe(sub, DropOldest)
+	go hub.Run()
+
+	for i := 0; i < 5; i++ {
+		in <- PostHogEvent{Uuid: fmt.Sprint(i)}
+	}
+	close(in)
+
+	assert.Equal(t, []string{"3", "4"}, drain(sub))
+}
+
+func TestHubUnsubscribe(t *testing.T) {
+	in := make(chan PostHogEvent)
+	hub := NewHub(in)
+
+	stays := make(chan PostHogEvent, 10)
+	leaves := make(chan PostHogEvent, 10)
+	hub.Subscribe(stays, Block)
+	hub.Subscribe(leaves, Block)
+	go hub.Run()
+
+	in <- PostHogEvent{Uuid: "1"}
+	assert.Eventually(t, func() bool { return len(leaves) == 1 }, time.Second, time.Millisecond)
+	hub.Unsubscribe(leaves)
+	hub.Unsubscribe(leaves)
+	in <- PostHogEvent{Uuid: "2"}
+	close(in)
+
+	assert.Equal(t, []string{"1"}, drain(leaves))
+	assert.Equal(t, []string{"1", "2"}, drain(stays))
+}
+
+func TestHubUnsubscribeWhileBlocked(t *testing.T) {
+	in := make(chan PostHogEvent)
+	hub := NewHub(in)
+
+	other := make(chan PostHogEvent, 10)
+	stuck := make(chan PostHogEvent)
+	hub.Subscribe(other, Block)
+	hub.Subscribe(stuck, Block)
+	go hub.Run()
+
+	// Nobody reads stuck, so the hub blocks on it until it is unsubscribed.
+	in <- PostHogEvent{Uuid: "1"}
+
+	done := make(chan struct{})
+	go func() {
+		hub.Unsubscribe(stuck)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Unsubscribe deadlocked with a blocked send")
+	}
+
+	in <- PostHogEvent{Uuid: "2"}
+	close(in)
+	assert.Equal(t, []string{"1", "2"}, drain(other))
+}
+
+func TestHubConcurrentSubscribers(t *testing.T) {
+	in := make(chan PostHogEvent)
+	hub := NewHub(in)
+	go hub.Run()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ch := make(chan PostHogEvent, 100)
+			hub.Subscribe(ch, DropNewest)
+			hub.Unsubscribe(ch)
+			// Unsubscribe closed the channel, so this only reads what was buffered.
+			drain(ch)
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		in <- PostHogEvent{Uuid: fmt.Sprint(i)}
+	}
+	wg.Wait()
+	close(in)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math"
+	"math/bits"
+)
+
+const (
+	minHLLPrecision = 4
+	maxHLLPrecision = 16
+)
+
+// hyperLogLog estimates how many distinct strings it has seen in 2^precision
+// bytes, with a relative standard error of 1.04/sqrt(2^precision).
+type hyperLogLog struct {
+	precision uint8
+	seed      maphash.Seed
+	registers []uint8
+}
+
+// newHyperLogLog returns an empty sketch. Sketches can only be merged when they
+// share a seed.
+func newHyperLogLog(precision int, seed maphash.Seed) (*hyperLogLog, error) {
+	if precision < minHLLPrecision || precision > maxHLLPrecision {
+		return nil, fmt.Errorf("HyperLogLog precision must be between %d and %d, got %d", minHLLPrecision, maxHLLPrecision, precision)
+	}
+	return &hyperLogLog{
+		precision: uint8(precision),
+		seed:      seed,
+		registers: make([]uint8, 1<<precision),
+	}, nil
+}
+
+func (h *hyperLogLog) Add(value string) {
+	hash := maphash.String(h.seed, value)
+
+	// The top bits pick a register, the rest give the run of leading zeros.
+	index := hash >> (64 - h.precision)
+	rank := uint8(bits.LeadingZeros64(hash<<h.precision|1<<(h.precision-1))) + 1
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// Merge folds other into h, so h estimates the union of both.
+func (h *hyperLogLog) Merge(other *hyperLogLog) {
+	for i, rank := range other.registers {
+		if rank > h.registers[i] {
+			h.registers[i] = rank
+		}
+	}
+}
+
+func (h *hyperLogLog) Estimate() uint64 {
+	m := float64(len(h.registers))
+
+	sum := 0.0
+	zeros := 0
+	for _, rank := range h.registers {
+		sum += 1 / float64(uint64(1)<<rank)
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	estimate := hllAlpha(len(h.registers)) * m * m / sum
+	// Small cardinalities are estimated better by counting empty registers.
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// RelativeError is the standard error of Estimate as a fraction of the true
+// count.
+func (h *hyperLogLog) RelativeError() float64 {
+	return 1.04 / math.Sqrt(float64(len(h.registers)))
+}
+
+func hllAlpha(m int) float64 {
+	switch m {
+	case 16:
+		return 0.673
+	case 32:
+		return 0.697
+	case 64:
+		return 0.709
+	}
+	return 0.7213 / (1 + 1.079/float64(m))
+}
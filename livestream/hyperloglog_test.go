@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"hash/maphash"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	for _, precision := range []int{8, 10, 14} {
+		for _, distinct := range []int{10, 1000, 100000} {
+			t.Run(fmt.Sprintf("p%d/%d", precision, distinct), func(t *testing.T) {
+				hll, err := newHyperLogLog(precision, maphash.MakeSeed())
+				require.NoError(t, err)
+
+				// Each ID is added twice; repeats must not count.
+				for i := 0; i < distinct; i++ {
+					hll.Add(fmt.Sprintf("user-%d", i))
+					hll.Add(fmt.Sprintf("user-%d", i))
+				}
+
+				// Four standard errors keeps the test from flaking on an
+				// unlucky seed.
+				bound := 4 * hll.RelativeError() * float64(distinct)
+				assert.InDelta(t, distinct, hll.Estimate(), math.Max(bound, 1))
+			})
+		}
+	}
+}
+
+func TestHyperLogLogRelativeError(t *testing.T) {
+	hll, err := newHyperLogLog(10, maphash.MakeSeed())
+	require.NoError(t, err)
+
+	assert.InDelta(t, 0.0325, hll.RelativeError(), 0.0001)
+	assert.Len(t, hll.registers, 1024)
+}
+
+func TestHyperLogLogPrecisionBounds(t *testing.T) {
+	_, err := newHyperLogLog(3, maphash.MakeSeed())
+	assert.Error(t, err)
+	_, err = newHyperLogLog(17, maphash.MakeSeed())
+	assert.Error(t, err)
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	seed := maphash.MakeSeed()
+	a, _ := newHyperLogLog(12, seed)
+	b, _ := newHyperLogLog(12, seed)
+
+	for i := 0; i < 6000; i++ {
+		a.Add(fmt.Sprintf("user-%d", i))
+	}
+	for i := 4000; i < 10000; i++ {
+		b.Add(fmt.Sprintf("user-%d", i))
+	}
+	a.Merge(b)
+
+	assert.InDelta(t, 10000, a.Estimate(), 4*a.RelativeError()*10000)
+}
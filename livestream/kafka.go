@@ -1,12 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
-	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type PostHogEventWrapper struct {
@@ -21,130 +28,1399 @@ type PostHogEvent struct {
 	Token      string                 `json:"api_key,omitempty"`
 	Event      string                 `json:"event"`
 	Properties map[string]interface{} `json:"properties"`
-	Timestamp  string                 `json:"timestamp,omitempty"`
+	Timestamp  time.Time              `json:"timestamp"`
 
 	Uuid       string
 	DistinctId string
 	Lat        float64
 	Lng        float64
+	// City, Region and CountryCode name where the event came from, when the
+	// geolocator knows.
+	City        string
+	Region      string
+	CountryCode string
+	// Topic, Partition and Offset are where in Kafka the event was read
+	// from. Events of one partition reach every sink in offset order, so
+	// sinks can use these to tell a gap or a replay from a reordering.
+	Topic     string
+	Partition int32
+	Offset    int64
+	// PartitionKey is the key the message was produced with, usually the
+	// distinct_id. Empty when the message had no key.
+	PartitionKey string
+	// SessionId and WindowId are copied from the $session_id and $window_id
+	// properties, which stay in place. Empty when missing or not a string.
+	SessionId string
+	WindowId  string
+	// Raw is the message the event was decoded from, byte for byte, when the
+	// consumer keeps it. Only JSON messages are kept. Encoding the event with
+	// encoding/json compacts it, decoding one never sets it, so a producer
+	// can't pass its own off as the original.
+	Raw json.RawMessage `json:"raw,omitempty"`
+
+	// deadLettered is set when the message could not be decoded and was
+	// dead-lettered already, so it is never delivered.
+	deadLettered bool
+}
+
+func (e *PostHogEvent) setGeo(geo GeoResult) {
+	e.Lat, e.Lng = geo.Lat, geo.Lng
+	e.City, e.Region, e.CountryCode = geo.City, geo.Region, geo.CountryCode
+}
+
+var (
+	// ErrMessageTooLarge is the dead-letter error for messages over
+	// MaxMessageSize.
+	ErrMessageTooLarge = errors.New("message too large")
+	// ErrStaleEvent is the dead-letter error for events older than MaxAge.
+	ErrStaleEvent = errors.New("event too old")
+)
+
+// DeadLetterReason says why a message was dead-lettered.
+type DeadLetterReason int
+
+const (
+	// DecodeError means the message could not be decoded.
+	DecodeError DeadLetterReason = iota + 1
+	// NoToken means the event has no project token, so was dropped.
+	NoToken
+	// InvalidToken means the event's token can't belong to a project, so it
+	// was dropped.
+	InvalidToken
+	// Oversized means the message was over MaxMessageSize, so was dropped
+	// without being decoded.
+	Oversized
+	// Stale means the event was older than MaxAge, so was dropped.
+	Stale
+	// GeoError means looking up the event's IP failed. The event was still
+	// delivered, without a location.
+	GeoError
+)
+
+func (r DeadLetterReason) String() string {
+	switch r {
+	case DecodeError:
+		return "decode_error"
+	case NoToken:
+		return "no_token"
+	case InvalidToken:
+		return "invalid_token"
+	case Oversized:
+		return "oversized"
+	case Stale:
+		return "stale"
+	case GeoError:
+		return "geo_error"
+	}
+	return fmt.Sprintf("DeadLetterReason(%d)", int(r))
+}
+
+// DeadLetterEvent is a Kafka message that was not delivered as it was, kept so
+// it can be inspected or replayed later.
+type DeadLetterEvent struct {
+	Reason    DeadLetterReason
+	Raw       []byte
+	Err       error
+	Topic     string
+	Partition int32
+	Offset    kafka.Offset
+	Timestamp time.Time
 }
 
 type KafkaConsumerInterface interface {
 	SubscribeTopics(topics []string, rebalanceCb kafka.RebalanceCb) error
 	ReadMessage(timeout time.Duration) (*kafka.Message, error)
+	CommitMessage(msg *kafka.Message) ([]kafka.TopicPartition, error)
+	Assignment() ([]kafka.TopicPartition, error)
+	Committed(partitions []kafka.TopicPartition, timeoutMs int) ([]kafka.TopicPartition, error)
+	QueryWatermarkOffsets(topic string, partition int32, timeoutMs int) (int64, int64, error)
+	GetMetadata(topic *string, allTopics bool, timeoutMs int) (*kafka.Metadata, error)
+	Assign(partitions []kafka.TopicPartition) error
+	OffsetsForTimes(times []kafka.TopicPartition, timeoutMs int) ([]kafka.TopicPartition, error)
 	Close() error
 }
 
 type KafkaConsumer interface {
-	Consume()
+	Consume(ctx context.Context) error
 	Close()
 }
 
+// defaultIPProperties is where PostHog's own SDKs put the client IP.
+var defaultIPProperties = []string{"$ip"}
+
+const (
+	// kafkaReadTimeout is the default ReadTimeout.
+	kafkaReadTimeout = 500 * time.Millisecond
+
+	initialBackoff    = 500 * time.Millisecond
+	defaultBackoffCap = 30 * time.Second
+
+	lagQueryTimeoutMs    = 5000
+	replayQueryTimeoutMs = 10000
+)
+
 type PostHogKafkaConsumer struct {
 	consumer     KafkaConsumerInterface
-	topic        string
+	topics       []string
 	geolocator   GeoLocator
 	outgoingChan chan PostHogEvent
 	statsChan    chan PostHogEvent
+
+	// CommitEvery sets how many delivered messages are processed between offset
+	// commits. Zero or one commits after every message.
+	CommitEvery int
+	// MaxRetries is how many times a failed subscription or a broker disconnect
+	// is retried before Consume gives up. Zero retries forever.
+	MaxRetries int
+	// BackoffCap is the longest wait between retries. Defaults to 30s.
+	BackoffCap time.Duration
+	// BatchSize and BatchFlushInterval bound the batches sent on
+	// outgoingBatchChan. See EnableBatching.
+	BatchSize          int
+	BatchFlushInterval time.Duration
+	// Backpressure is what happens when outgoingChan is full. The default,
+	// Block, stalls reading from Kafka until there is room.
+	Backpressure BackpressurePolicy
+	// StatsBackpressure is the same for statsChan. The two channels are sent
+	// to independently, see deliver.
+	StatsBackpressure BackpressurePolicy
+	// Workers, when above one, decodes and geolocates messages on that many
+	// goroutines. All messages of a partition go to the same worker, so order
+	// is kept within a partition but not across them. Ignored when batching.
+	Workers int
+	// GeoWorkers, when above one and Workers is not, geolocates messages on
+	// that many goroutines while Consume keeps reading. Events are delivered
+	// in the order they were read. Ignored when batching.
+	GeoWorkers int
+	// Decoder reads message values. Nil means JSONDecoder.
+	Decoder Decoder
+	// Avro, when set, reads the messages framed for Schema Registry instead
+	// of Decoder, so a topic can move to Avro one producer at a time.
+	Avro Decoder
+	// Tokens normalizes event tokens. Events whose token it rejects are
+	// dead-lettered instead of sent. Nil leaves tokens as they are. Events
+	// with no token at all are never sent; see RouteNoToken.
+	Tokens *TokenNormalizer
+	// DeepTokenScan also looks for a token in nested properties when an
+	// event has none in the usual places. See extractToken.
+	DeepTokenScan bool
+	// MaxAge, when positive, drops events whose timestamp is further than
+	// that in the past, so a lagging consumer doesn't stream stale events as
+	// live ones. Events without a timestamp are stamped when read and never
+	// count as stale. Replay ignores it.
+	MaxAge time.Duration
+	// IPProperties are the event properties an IP address is looked for in,
+	// in order, before the wrapper's ip. Nil means defaultIPProperties.
+	IPProperties []string
+	// RightmostIP takes the last valid address of a comma-separated IP list,
+	// rather than the first. See pickIP.
+	RightmostIP bool
+	// FoldPropertyKeys matches the IP and token property keys regardless of
+	// case, for producers that send e.g. $IP or Token.
+	FoldPropertyKeys bool
+	// MaxMessageSize, when positive, is the largest message value in bytes
+	// that is decoded. Larger messages are dead-lettered with
+	// ErrMessageTooLarge instead, so a giant event is never unmarshalled and
+	// fanned out to every client.
+	MaxMessageSize int
+	// Transform, when set, reshapes the properties of every event.
+	Transform *PropertyTransform
+	// Dedupe, when set, drops events whose uuid it has already seen.
+	Dedupe *Deduplicator
+	// KeepRaw sets the Raw of events decoded from JSON, for sinks that need
+	// the original message. Off by default, as it keeps every message in
+	// memory for as long as its event.
+	KeepRaw bool
+	// DecodeErrors, when set, watches the share of messages that fail to
+	// decode.
+	DecodeErrors *DecodeErrorMonitor
+	// ReadTimeout bounds each ReadMessage call so Consume notices a cancelled
+	// context even when the topic is quiet. Defaults to 500ms.
+	ReadTimeout time.Duration
+	// IdleAfter is how many reads in a row must time out before the consumer
+	// counts as idle: a warning is logged and Readiness reports it until the
+	// next message. A consumer that is idle still reads, unlike one that is
+	// stuck. Zero never reports it.
+	IdleAfter int
+
+	outgoingBatchChan chan []PostHogEvent
+	deadLetterChan    chan DeadLetterEvent
+	noTokenChan       chan PostHogEvent
+	readiness         *Readiness
+	clock             Clock
+	logger            *slog.Logger
+	dropped           atomic.Int64
+
+	// lifecycleMu guards cancel, done and closed, so that Close can stop a
+	// Consume or Replay running on another goroutine.
+	lifecycleMu sync.Mutex
+	cancel      context.CancelFunc
+	done        chan struct{}
+	closed      bool
+	releaseOnce sync.Once
+
+	// commitMu guards uncommitted and pending, which workers update.
+	commitMu    sync.Mutex
+	uncommitted int
+	pending     map[partitionKey]*kafka.Message
+}
+
+type partitionKey struct {
+	topic     string
+	partition int32
+}
+
+// eventBatch holds decoded events, and the messages they came from, until the
+// batch is delivered and the messages can be committed.
+type eventBatch struct {
+	events   []PostHogEvent
+	messages []*kafka.Message
+	started  time.Time
+}
+
+// SASLConfig holds the credentials for SASL authentication to Kafka. The zero
+// value disables SASL.
+type SASLConfig struct {
+	Mechanism string
+	Username  string
+	Password  string
+}
+
+// String hides the password so a SASLConfig can be logged safely.
+func (s SASLConfig) String() string {
+	password := ""
+	if s.Password != "" {
+		password = "[redacted]"
+	}
+	return fmt.Sprintf("{Mechanism:%s Username:%s Password:%s}", s.Mechanism, s.Username, password)
+}
+
+func (s SASLConfig) GoString() string {
+	return "SASLConfig" + s.String()
+}
+
+// TLSConfig points librdkafka at the certificates for SSL connections to
+// Kafka, e.g. for brokers signed by a private CA. Empty fields keep
+// librdkafka's defaults.
+type TLSConfig struct {
+	CALocation          string
+	CertificateLocation string
+	KeyLocation         string
+	// EndpointIdentificationAlgorithm is "https" to check the broker's
+	// hostname against its certificate, or "none".
+	EndpointIdentificationAlgorithm string
+}
+
+// OffsetConfig sets where the consumer group starts without a committed
+// offset, and whether librdkafka also commits offsets on its own. The zero
+// value starts at the latest message and only commits what was delivered.
+type OffsetConfig struct {
+	// AutoOffsetReset is "earliest", "latest" or "error". Empty is "latest".
+	AutoOffsetReset string
+	// EnableAutoCommit periodically commits every message read, delivered or
+	// not, on top of Consume's own commits. Meant for one-off backfills.
+	EnableAutoCommit bool
+}
+
+// ConsumerConfig holds the consumer's tuning settings, the kafka.* keys
+// that main copies onto a PostHogKafkaConsumer.
+type ConsumerConfig struct {
+	CommitEvery    int
+	MaxRetries     int
+	BackoffCap     time.Duration
+	Workers        int
+	GeoWorkers     int
+	MaxAge         time.Duration
+	MaxMessageSize int
+	ReadTimeout    time.Duration
+	IdleAfter      int
+	LagInterval    time.Duration
+	// BatchSize, when positive, sends events downstream in batches of up to
+	// that many, flushed after BatchFlushInterval.
+	BatchSize          int
+	BatchFlushInterval time.Duration
+	IPProperties       []string
+	RightmostIP        bool
+	FoldPropertyKeys   bool
+	KeepRaw            bool
+	DeepTokenScan      bool
+	// DedupeWindow, when positive, drops events whose uuid was seen within
+	// it. At most DedupeMaxSize uuids are remembered.
+	DedupeWindow  time.Duration
+	DedupeMaxSize int
+	// DecodeErrorThreshold, DecodeErrorWindow and DecodeErrorMinMessages
+	// configure the DecodeErrorMonitor.
+	DecodeErrorThreshold   float64
+	DecodeErrorWindow      time.Duration
+	DecodeErrorMinMessages int
+	// NoTokenSink is a JSONL file for events without a token. Empty drops
+	// them.
+	NoTokenSink string
 }
 
 func NewPostHogKafkaConsumer(brokers string, securityProtocol string, groupID string, topic string, geolocator GeoLocator, outgoingChan chan PostHogEvent, statsChan chan PostHogEvent) (*PostHogKafkaConsumer, error) {
-	config := &kafka.ConfigMap{
-		"bootstrap.servers":  brokers,
-		"group.id":           groupID,
-		"auto.offset.reset":  "latest",
-		"enable.auto.commit": false,
-		"security.protocol":  securityProtocol,
+	return NewMultiTopicKafkaConsumer(brokers, securityProtocol, SASLConfig{}, TLSConfig{}, OffsetConfig{}, groupID, []string{topic}, geolocator, outgoingChan, statsChan)
+}
+
+// NewMultiTopicKafkaConsumer is like NewPostHogKafkaConsumer but reads from
+// several topics at once. Each event is tagged with the topic it came from.
+func NewMultiTopicKafkaConsumer(brokers string, securityProtocol string, sasl SASLConfig, tls TLSConfig, offsets OffsetConfig, groupID string, topics []string, geolocator GeoLocator, outgoingChan chan PostHogEvent, statsChan chan PostHogEvent) (*PostHogKafkaConsumer, error) {
+	if len(topics) == 0 {
+		return nil, errors.New("at least one topic is required")
 	}
 
-	consumer, err := kafka.NewConsumer(config)
+	consumer, err := kafka.NewConsumer(kafkaConfigMap(brokers, securityProtocol, sasl, tls, offsets, groupID))
 	if err != nil {
 		return nil, err
 	}
 
 	return &PostHogKafkaConsumer{
 		consumer:     consumer,
-		topic:        topic,
+		topics:       topics,
 		geolocator:   geolocator,
 		outgoingChan: outgoingChan,
 		statsChan:    statsChan,
+		clock:        realClock{},
 	}, nil
 }
 
-func (c *PostHogKafkaConsumer) Consume() {
-	err := c.consumer.SubscribeTopics([]string{c.topic}, nil)
-	if err != nil {
-		sentry.CaptureException(err)
-		log.Fatalf("Failed to subscribe to topic: %v", err)
+// kafkaConfigMap builds the librdkafka settings for the consumer. SASL keys
+// are only set when a mechanism is given, SSL keys only when they are set.
+func kafkaConfigMap(brokers string, securityProtocol string, sasl SASLConfig, tls TLSConfig, offsets OffsetConfig, groupID string) *kafka.ConfigMap {
+	offsetReset := offsets.AutoOffsetReset
+	if offsetReset == "" {
+		offsetReset = "latest"
+	}
+	config := &kafka.ConfigMap{
+		"bootstrap.servers":  brokers,
+		"group.id":           groupID,
+		"auto.offset.reset":  offsetReset,
+		"enable.auto.commit": offsets.EnableAutoCommit,
+		"security.protocol":  securityProtocol,
+	}
+
+	if sasl.Mechanism != "" {
+		(*config)["sasl.mechanism"] = sasl.Mechanism
+		(*config)["sasl.username"] = sasl.Username
+		(*config)["sasl.password"] = sasl.Password
+	}
+
+	for key, value := range map[string]string{
+		"ssl.ca.location":                       tls.CALocation,
+		"ssl.certificate.location":              tls.CertificateLocation,
+		"ssl.key.location":                      tls.KeyLocation,
+		"ssl.endpoint.identification.algorithm": tls.EndpointIdentificationAlgorithm,
+	} {
+		if value != "" {
+			(*config)[key] = value
+		}
+	}
+	return config
+}
+
+// parseTopics splits a comma-separated kafka.topic value into topic names.
+func parseTopics(s string) []string {
+	topics := []string{}
+	for _, topic := range strings.Split(s, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// Consume reads messages until ctx is cancelled or delivery fails. On return it
+// commits what was delivered, closes the outgoing channels and the consumer.
+// An error is returned only when Kafka stays unreachable past MaxRetries.
+func (c *PostHogKafkaConsumer) Consume(ctx context.Context) error {
+	ctx, ok := c.start(ctx)
+	if !ok {
+		return nil
+	}
+	defer c.shutdown()
+
+	var pool messagePool
+	if !c.batching() {
+		if c.Workers > 1 {
+			pool = c.startWorkers(ctx, c.Workers)
+		} else if c.GeoWorkers > 1 {
+			pool = c.startGeoWorkers(ctx, c.GeoWorkers)
+		}
+	}
+	if pool != nil {
+		// Runs before shutdown, so workers are done before channels close.
+		defer pool.stop()
+	}
+	batch := &eventBatch{}
+
+	if err := c.subscribe(ctx, c.rebalanceCb(ctx, pool, batch)); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
 	}
 
+	failures := 0
+	idleReads := 0
 	for {
-		msg, err := c.consumer.ReadMessage(-1)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if c.batchDue(batch) {
+			if err := c.deliverBatch(ctx, batch); err != nil {
+				return nil
+			}
+		}
+
+		msg, err := c.consumer.ReadMessage(c.readTimeout())
 		if err != nil {
-			log.Printf("Error consuming message: %v", err)
-			sentry.CaptureException(err)
+			if isIdleRead(err) {
+				idleReads++
+				if idleReads == c.IdleAfter {
+					c.log().Warn("No messages from Kafka, the consumer is idle", "reads", idleReads, "read_timeout", c.readTimeout())
+					c.setIdle(true)
+				}
+				continue
+			}
+			var kafkaErr kafka.Error
+			if errors.As(err, &kafkaErr) {
+				if isBrokerDisconnect(kafkaErr) {
+					captureException(err)
+					if c.MaxRetries > 0 && failures >= c.MaxRetries {
+						return fmt.Errorf("kafka unreachable after %d retries: %w", failures, err)
+					}
+					delay := c.backoff(failures)
+					failures++
+					c.log().Warn("Lost connection to Kafka, retrying", "delay", delay, "error", err)
+					if c.wait(ctx, delay) != nil {
+						return nil
+					}
+					continue
+				}
+			}
+			// Any other error is reported and skipped; msg may be nil here.
+			c.log().Error("Error consuming message", "error", err)
+			captureException(err)
+			continue
+		}
+		if msg == nil {
+			continue
+		}
+		failures = 0
+		if c.IdleAfter > 0 && idleReads >= c.IdleAfter {
+			c.log().Info("Messages from Kafka resumed", "reads", idleReads)
+			c.setIdle(false)
+		}
+		idleReads = 0
+		recordConsumed(msg)
+
+		for _, part := range c.splitMessage(msg) {
+			if c.route(ctx, pool, batch, part) != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// route hands msg to the pool when there is one, and otherwise processes it
+// right away, or adds its event to batch when batching. It fails only if ctx
+// is cancelled.
+func (c *PostHogKafkaConsumer) route(ctx context.Context, pool messagePool, batch *eventBatch, msg *kafka.Message) error {
+	if pool != nil {
+		return pool.dispatch(ctx, msg)
+	}
+	if !c.batching() {
+		return c.process(ctx, msg)
+	}
+
+	phEvent := c.parseMessage(msg)
+	if !c.accept(msg, &phEvent) {
+		// Nothing to deliver, but the message is done with.
+		batch.messages = append(batch.messages, msg)
+		return nil
+	}
+
+	if len(batch.events) == 0 {
+		batch.started = c.now()
+	}
+	batch.events = append(batch.events, phEvent)
+	batch.messages = append(batch.messages, msg)
+	return nil
+}
+
+// process decodes a single message, delivers it and marks it for commit. It
+// fails only if ctx is cancelled while delivering.
+func (c *PostHogKafkaConsumer) process(ctx context.Context, msg *kafka.Message) error {
+	return c.handle(ctx, msg, c.parseMessage(msg))
+}
+
+// handle delivers an event parsed from msg if it is accepted, and marks msg
+// for commit. It fails only if ctx is cancelled while delivering.
+func (c *PostHogKafkaConsumer) handle(ctx context.Context, msg *kafka.Message, phEvent PostHogEvent) error {
+	if c.accept(msg, &phEvent) {
+		if err := c.deliver(ctx, phEvent); err != nil {
+			return err
 		}
+	}
+	// A rejected event has nothing to deliver, but the message is done with.
+	c.markDelivered(msg)
+	return nil
+}
+
+// parseMessage decodes a Kafka message into a PostHogEvent and geolocates it.
+func (c *PostHogKafkaConsumer) parseMessage(msg *kafka.Message) PostHogEvent {
+	if c.oversized(msg) {
+		c.log().Warn("Message too large, not decoding it", append(messageAttrs(msg), "bytes", len(msg.Value), "limit", c.MaxMessageSize)...)
+		oversizedMessages.Inc()
+		c.deadLetter(msg, Oversized, fmt.Errorf("%w: %d bytes, limit is %d", ErrMessageTooLarge, len(msg.Value), c.MaxMessageSize))
+		return PostHogEvent{}
+	}
+
+	decoder := c.decoderFor(msg)
+	wrapperMessage, phEvent, err := decoder.Decode(msg.Value)
+	c.DecodeErrors.Record(err != nil)
+	if _, isJSON := decoder.(JSONDecoder); isJSON && c.KeepRaw && err == nil {
+		phEvent.Raw = msg.Value
+	}
+	if err != nil {
+		c.log().Warn("Error decoding message", append(messageAttrs(msg), "error", err)...)
+		// Payloads can hold personal data, so they are only logged at debug.
+		c.log().Debug("Undecodable message", append(messageAttrs(msg), "data", string(msg.Value))...)
+		decodeErrors.Inc()
+		c.deadLetter(msg, DecodeError, err)
+		phEvent.deadLettered = true
+	}
+
+	// "properties": null decodes to a nil map, which later code could write to.
+	if phEvent.Properties == nil {
+		phEvent.Properties = make(map[string]interface{})
+	}
+
+	// Keep the time the event happened when it has one, so replayed and
+	// batched events stay in order.
+	if phEvent.Timestamp.IsZero() {
+		phEvent.Timestamp = c.now().UTC()
+	}
 
-		var wrapperMessage PostHogEventWrapper
-		err = json.Unmarshal(msg.Value, &wrapperMessage)
+	phEvent.Uuid = wrapperMessage.Uuid
+	phEvent.DistinctId = wrapperMessage.DistinctId
+	if msg.TopicPartition.Topic != nil {
+		phEvent.Topic = *msg.TopicPartition.Topic
+	}
+	phEvent.Partition = msg.TopicPartition.Partition
+	phEvent.Offset = int64(msg.TopicPartition.Offset)
+	phEvent.PartitionKey = string(msg.Key)
+	phEvent.SessionId, _ = phEvent.Properties["$session_id"].(string)
+	phEvent.WindowId, _ = phEvent.Properties["$window_id"].(string)
+
+	// Producers can put the token in a header so it is known without the body.
+	if token := messageHeader(msg, "token"); token != "" {
+		phEvent.Token = token
+	} else if phEvent.Token, err = extractToken(wrapperMessage, phEvent, c.DeepTokenScan, c.FoldPropertyKeys); err != nil {
+		c.log().Warn("No valid token found in event", append(messageAttrs(msg), "uuid", wrapperMessage.Uuid)...)
+		c.log().Debug("Event without a token", append(messageAttrs(msg), "data", string(msg.Value))...)
+	}
+
+	ipStr := pickIP(c.eventIP(wrapperMessage, phEvent), c.RightmostIP)
+
+	if geo, ok := eventGeoProperties(phEvent.Properties); ok {
+		// Already geolocated upstream; a second lookup could only disagree.
+		phEvent.setGeo(geo)
+	} else if ipStr != "" {
+		var geo GeoResult
+		timer := prometheus.NewTimer(geolocationDuration)
+		geo, err = lookupGeo(c.geolocator, ipStr)
+		timer.ObserveDuration()
+		phEvent.setGeo(geo)
 		if err != nil {
-			log.Printf("Error decoding JSON: %v", err)
-			log.Printf("Data: %s", string(msg.Value))
+			geolocations.WithLabelValues("failure").Inc()
+			if errors.Is(err, ErrInvalidIP) { // An invalid IP address is not an error on our side
+				invalidIPs.Inc()
+			} else {
+				captureException(err)
+				c.deadLetter(msg, GeoError, err)
+			}
+		} else {
+			geolocations.WithLabelValues("success").Inc()
+		}
+	}
+
+	// Last, so the transform can't hide the token or IP from the lookups
+	// above.
+	if c.Transform != nil {
+		if phEvent.Properties, err = c.Transform.Apply(phEvent.Properties); err != nil {
+			transformErrors.Inc()
+			c.log().Warn("Failed to transform properties, keeping them as they were", append(messageAttrs(msg), "error", err)...)
 		}
+	}
+
+	return phEvent
+}
+
+// eventIP returns the IP address to geolocate the event with: the first of
+// IPProperties the event has, or the wrapper's ip if it has none of them. A
+// property that is there but empty or not a string stops the search, as
+// producers clear it on purpose for projects that discard IPs.
+func (c *PostHogKafkaConsumer) eventIP(wrapperMessage PostHogEventWrapper, phEvent PostHogEvent) string {
+	keys := c.IPProperties
+	if keys == nil {
+		keys = defaultIPProperties
+	}
+	for _, key := range keys {
+		if value, ok := lookupProperty(phEvent.Properties, key, c.FoldPropertyKeys); ok {
+			ip, _ := value.(string)
+			return ip
+		}
+	}
+	return wrapperMessage.Ip
+}
+
+// accept reports whether a live event should be delivered: it must have been
+// decoded, have a valid token, not be stale and not be a duplicate.
+func (c *PostHogKafkaConsumer) accept(msg *kafka.Message, phEvent *PostHogEvent) bool {
+	return !phEvent.deadLettered && !c.oversized(msg) && c.acceptToken(msg, phEvent) && !c.stale(msg, phEvent) && !c.duplicate(phEvent)
+}
+
+// duplicate reports whether Dedupe has seen the event before, counting it if
+// so.
+func (c *PostHogKafkaConsumer) duplicate(phEvent *PostHogEvent) bool {
+	if !c.Dedupe.Duplicate(phEvent.Uuid) {
+		return false
+	}
+	duplicateEvents.Inc()
+	return true
+}
+
+// oversized reports whether msg is over MaxMessageSize, in which case
+// parseMessage dead-letters it rather than decoding it.
+func (c *PostHogKafkaConsumer) oversized(msg *kafka.Message) bool {
+	return c.MaxMessageSize > 0 && len(msg.Value) > c.MaxMessageSize
+}
 
-		phEvent := PostHogEvent{
-			Timestamp:  time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
-			Token:      "",
-			Event:      "",
-			Properties: make(map[string]interface{}),
+// stale reports whether the event is older than MaxAge, counting and
+// dead-lettering it if so.
+func (c *PostHogKafkaConsumer) stale(msg *kafka.Message, phEvent *PostHogEvent) bool {
+	age := c.now().Sub(phEvent.Timestamp)
+	if c.MaxAge <= 0 || age <= c.MaxAge {
+		return false
+	}
+	staleEvents.Inc()
+	c.deadLetter(msg, Stale, fmt.Errorf("%w: %v old, limit is %v", ErrStaleEvent, age, c.MaxAge))
+	return true
+}
+
+// acceptToken normalizes the event's token. It reports false when the event
+// has no token, after routing it to noTokenChan if set, and when the token is
+// invalid, dead-lettering the message either way.
+func (c *PostHogKafkaConsumer) acceptToken(msg *kafka.Message, phEvent *PostHogEvent) bool {
+	if phEvent.Token == "" {
+		// Without a token the event would be counted against no project.
+		noTokenEvents.Inc()
+		if c.noTokenChan != nil {
+			select {
+			case c.noTokenChan <- *phEvent:
+			default:
+			}
 		}
+		c.deadLetter(msg, NoToken, ErrNoToken)
+		return false
+	}
+	if c.Tokens == nil {
+		return true
+	}
+
+	token, err := c.Tokens.Normalize(phEvent.Token)
+	if err != nil {
+		invalidTokens.Inc()
+		c.log().Warn("Invalid token", append(messageAttrs(msg), "token", phEvent.Token)...)
+		c.deadLetter(msg, InvalidToken, fmt.Errorf("%w %q", err, phEvent.Token))
+		return false
+	}
+	phEvent.Token = token
+	return true
+}
 
-		data := []byte(wrapperMessage.Data)
+// ReplayOptions selects the window of events Replay reads again.
+type ReplayOptions struct {
+	// Start replays every partition of the consumer's topics from the first
+	// message produced at or after it. Ignored when Offsets is set.
+	Start time.Time
+	// Offsets replays only the given partitions, each from its own offset.
+	Offsets []kafka.TopicPartition
+	// End stops each partition at its first message produced after End. The
+	// zero value replays up to the head of each partition as it was when the
+	// replay started.
+	End time.Time
+}
+
+// Replay re-reads a window of past events into the outgoing channels, for
+// debugging. It assigns partitions directly rather than joining the consumer
+// group, and commits nothing, so the live consumers are unaffected. Replay
+// returns once every partition reached the end of the window or ctx is
+// cancelled, and then shuts the consumer down like Consume does.
+func (c *PostHogKafkaConsumer) Replay(ctx context.Context, opts ReplayOptions) error {
+	ctx, ok := c.start(ctx)
+	if !ok {
+		return nil
+	}
+	defer c.shutdown()
 
-		err = json.Unmarshal(data, &phEvent)
+	partitions, err := c.replayOffsets(opts)
+	if err != nil {
+		return err
+	}
+
+	// stopAt holds the high watermark of every partition still being replayed.
+	stopAt := make(map[partitionKey]int64)
+	for _, tp := range partitions {
+		if tp.Topic == nil || tp.Offset == kafka.OffsetEnd {
+			// Nothing was produced after Start on this partition.
+			continue
+		}
+		low, high, err := c.consumer.QueryWatermarkOffsets(*tp.Topic, tp.Partition, replayQueryTimeoutMs)
 		if err != nil {
-			log.Printf("Error decoding JSON: %v", err)
-			log.Printf("Data: %s", string(data))
+			return err
+		}
+		if high <= low || (tp.Offset >= 0 && int64(tp.Offset) >= high) {
+			continue
 		}
+		stopAt[partitionKey{topic: *tp.Topic, partition: tp.Partition}] = high
+	}
+	if len(stopAt) == 0 {
+		return nil
+	}
+
+	if err := c.consumer.Assign(partitions); err != nil {
+		return fmt.Errorf("failed to assign partitions for replay: %w", err)
+	}
 
-		phEvent.Uuid = wrapperMessage.Uuid
-		phEvent.DistinctId = wrapperMessage.DistinctId
+	for len(stopAt) > 0 {
+		if ctx.Err() != nil {
+			return nil
+		}
 
-		if wrapperMessage.Token != "" {
-			phEvent.Token = wrapperMessage.Token
-		} else if phEvent.Token == "" {
-			if tokenValue, ok := phEvent.Properties["token"].(string); ok {
-				phEvent.Token = tokenValue
-			} else {
-				log.Printf("No valid token found in event %s", string(msg.Value))
+		msg, err := c.consumer.ReadMessage(kafkaReadTimeout)
+		if err != nil {
+			if isIdleRead(err) {
+				continue
 			}
+			c.log().Error("Error replaying message", "error", err)
+			captureException(err)
+			continue
+		}
+		if msg == nil || msg.TopicPartition.Topic == nil {
+			continue
+		}
+
+		key := partitionKey{topic: *msg.TopicPartition.Topic, partition: msg.TopicPartition.Partition}
+		high, ok := stopAt[key]
+		if !ok {
+			continue
+		}
+		if !opts.End.IsZero() && msg.Timestamp.After(opts.End) {
+			delete(stopAt, key)
+			continue
 		}
+		recordConsumed(msg)
 
-		var ipStr string = ""
-		if ipValue, ok := phEvent.Properties["$ip"]; ok {
-			if ipProp, ok := ipValue.(string); ok {
-				if ipProp != "" {
-					ipStr = ipProp
+		for _, part := range c.splitMessage(msg) {
+			if phEvent := c.parseMessage(part); !phEvent.deadLettered && !c.oversized(part) && c.acceptToken(part, &phEvent) {
+				if err := c.deliver(ctx, phEvent); err != nil {
+					return nil
 				}
 			}
-		} else {
-			if wrapperMessage.Ip != "" {
-				ipStr = wrapperMessage.Ip
+		}
+		if int64(msg.TopicPartition.Offset) >= high-1 {
+			delete(stopAt, key)
+		}
+	}
+	return nil
+}
+
+// replayOffsets returns the offset each replayed partition starts from,
+// looking them up by time unless opts gives them explicitly.
+func (c *PostHogKafkaConsumer) replayOffsets(opts ReplayOptions) ([]kafka.TopicPartition, error) {
+	if len(opts.Offsets) > 0 {
+		return opts.Offsets, nil
+	}
+	if opts.Start.IsZero() {
+		return nil, errors.New("replay needs a start time or partition offsets")
+	}
+
+	var times []kafka.TopicPartition
+	for _, topic := range c.topics {
+		topic := topic
+		metadata, err := c.consumer.GetMetadata(&topic, false, replayQueryTimeoutMs)
+		if err != nil {
+			return nil, err
+		}
+		for _, partition := range metadata.Topics[topic].Partitions {
+			times = append(times, kafka.TopicPartition{
+				Topic:     &topic,
+				Partition: partition.ID,
+				Offset:    kafka.Offset(opts.Start.UnixMilli()),
+			})
+		}
+	}
+
+	offsets, err := c.consumer.OffsetsForTimes(times, replayQueryTimeoutMs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up offsets for %s: %w", opts.Start, err)
+	}
+	return offsets, nil
+}
+
+// subscribe subscribes to the topics, retrying with exponential backoff.
+func (c *PostHogKafkaConsumer) subscribe(ctx context.Context, rebalanceCb kafka.RebalanceCb) error {
+	for attempt := 0; ; attempt++ {
+		err := c.consumer.SubscribeTopics(c.topics, rebalanceCb)
+		if err == nil {
+			if c.readiness != nil {
+				c.readiness.SetKafkaSubscribed(true)
 			}
+			return nil
+		}
+		captureException(err)
+
+		if c.MaxRetries > 0 && attempt >= c.MaxRetries {
+			return fmt.Errorf("failed to subscribe to topics after %d retries: %w", attempt, err)
 		}
+		delay := c.backoff(attempt)
+		c.log().Warn("Failed to subscribe to topics, retrying", "topics", c.topics, "delay", delay, "error", err)
+		if err := c.wait(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
 
-		if ipStr != "" {
-			phEvent.Lat, phEvent.Lng, err = c.geolocator.Lookup(ipStr)
-			if err != nil && err.Error() != "invalid IP address" { // An invalid IP address is not an error on our side
-				sentry.CaptureException(err)
+// rebalanceCb returns the callback Kafka calls when partitions move between
+// consumers of the group. Before partitions are revoked, every message read
+// so far is processed, including those waiting in pool or batch, and its
+// offset committed, so the next owner starts right after it. Assigning and
+// unassigning is left to the client's defaults.
+//
+// The callback runs inside ReadMessage, on the goroutine running Consume.
+func (c *PostHogKafkaConsumer) rebalanceCb(ctx context.Context, pool messagePool, batch *eventBatch) kafka.RebalanceCb {
+	return func(_ *kafka.Consumer, event kafka.Event) error {
+		switch event := event.(type) {
+		case kafka.AssignedPartitions:
+			c.log().Info("Kafka partitions assigned", "partitions", len(event.Partitions))
+		case kafka.RevokedPartitions:
+			c.log().Info("Kafka partitions revoked", "partitions", len(event.Partitions))
+			if pool != nil {
+				pool.drain()
+			}
+			if len(batch.events) > 0 {
+				// Only fails when ctx is cancelled, and then shutdown commits.
+				_ = c.deliverBatch(ctx, batch)
+			} else {
+				for _, msg := range batch.messages {
+					c.markDelivered(msg)
+				}
+				*batch = eventBatch{}
 			}
+			c.commitPending()
+		}
+		return nil
+	}
+}
+
+// EnableDeadLetters makes Consume send messages it drops, or fails to
+// geolocate, on ch. Sends never block; if ch is full the message is only
+// logged.
+func (c *PostHogKafkaConsumer) EnableDeadLetters(ch chan DeadLetterEvent) {
+	c.deadLetterChan = ch
+}
+
+// deadLetter reports msg on deadLetterChan, if one is set.
+func (c *PostHogKafkaConsumer) deadLetter(msg *kafka.Message, reason DeadLetterReason, err error) {
+	if c.deadLetterChan == nil {
+		return
+	}
+
+	dead := DeadLetterEvent{
+		Reason:    reason,
+		Raw:       msg.Value,
+		Err:       err,
+		Partition: msg.TopicPartition.Partition,
+		Offset:    msg.TopicPartition.Offset,
+		Timestamp: c.now().UTC(),
+	}
+	if msg.TopicPartition.Topic != nil {
+		dead.Topic = *msg.TopicPartition.Topic
+	}
+
+	select {
+	case c.deadLetterChan <- dead:
+	default:
+		c.log().Warn("Dead-letter channel full, dropping message", messageAttrs(msg)...)
+	}
+}
+
+// RouteNoToken makes Consume send events that have no token on ch, instead
+// of only dropping them. Sends never block; if ch is full the event is lost.
+func (c *PostHogKafkaConsumer) RouteNoToken(ch chan PostHogEvent) {
+	c.noTokenChan = ch
+}
+
+// EnableBatching makes Consume send events downstream as slices on batchChan
+// instead of one by one on outgoingChan. A batch is sent once it holds size
+// events or flushInterval has passed since its first event. Every event is
+// still sent individually on statsChan.
+func (c *PostHogKafkaConsumer) EnableBatching(batchChan chan []PostHogEvent, size int, flushInterval time.Duration) {
+	c.outgoingBatchChan = batchChan
+	c.BatchSize = size
+	c.BatchFlushInterval = flushInterval
+}
+
+func (c *PostHogKafkaConsumer) batching() bool {
+	return c.outgoingBatchChan != nil && c.BatchSize > 0
+}
+
+func (c *PostHogKafkaConsumer) batchDue(batch *eventBatch) bool {
+	if len(batch.events) == 0 {
+		return false
+	}
+	if len(batch.events) >= c.BatchSize {
+		return true
+	}
+	return c.BatchFlushInterval > 0 && c.now().Sub(batch.started) >= c.BatchFlushInterval
+}
+
+// readTimeout keeps reads short enough that a partial batch is flushed close
+// to its deadline.
+func (c *PostHogKafkaConsumer) readTimeout() time.Duration {
+	timeout := kafkaReadTimeout
+	if c.ReadTimeout > 0 {
+		timeout = c.ReadTimeout
+	}
+	if c.batching() && c.BatchFlushInterval > 0 {
+		return min(timeout, c.BatchFlushInterval)
+	}
+	return timeout
+}
+
+// setIdle records whether the consumer is idle in Readiness and
+// livestream_kafka_consumer_idle.
+func (c *PostHogKafkaConsumer) setIdle(idle bool) {
+	if c.readiness != nil {
+		c.readiness.SetKafkaIdle(idle)
+	}
+	if idle {
+		consumerIdle.Set(1)
+	} else {
+		consumerIdle.Set(0)
+	}
+}
+
+// deliverBatch sends the batch downstream and resets it.
+func (c *PostHogKafkaConsumer) deliverBatch(ctx context.Context, batch *eventBatch) error {
+	sent, evicted, err := send(ctx, c.Backpressure, c.outgoingBatchChan, batch.events)
+	if err != nil {
+		return err
+	}
+	for _, events := range evicted {
+		c.recordDropped(len(events))
+	}
+	if !sent {
+		c.recordDropped(len(batch.events))
+	} else {
+		for _, phEvent := range batch.events {
+			c.recordSent(phEvent)
+		}
+	}
+
+	for _, phEvent := range batch.events {
+		sent, evicted, err := send(ctx, c.StatsBackpressure, c.statsChan, phEvent)
+		if err != nil {
+			return err
+		}
+		c.recordDropped(len(evicted))
+		if !sent {
+			c.recordDropped(1)
+		}
+	}
+
+	for _, msg := range batch.messages {
+		c.markDelivered(msg)
+	}
+	*batch = eventBatch{}
+	return nil
+}
+
+// backoff returns the delay before the given retry, doubling from
+// initialBackoff up to BackoffCap.
+func (c *PostHogKafkaConsumer) backoff(attempt int) time.Duration {
+	limit := c.BackoffCap
+	if limit <= 0 {
+		limit = defaultBackoffCap
+	}
+
+	delay := initialBackoff
+	for i := 0; i < attempt && delay < limit; i++ {
+		delay *= 2
+	}
+	return min(delay, limit)
+}
+
+func (c *PostHogKafkaConsumer) getClock() Clock {
+	if c.clock == nil {
+		return realClock{}
+	}
+	return c.clock
+}
+
+// decoderFor picks the decoder named by the message's content-type header,
+// falling back to Avro for messages framed for Schema Registry, and to Decoder
+// otherwise.
+func (c *PostHogKafkaConsumer) decoderFor(msg *kafka.Message) Decoder {
+	if decoder, ok := decoderForContentType(messageHeader(msg, "content-type")); ok {
+		return decoder
+	}
+	if c.Avro != nil && isSchemaRegistryFramed(msg.Value) {
+		return c.Avro
+	}
+	if c.Decoder == nil {
+		return JSONDecoder{}
+	}
+	return c.Decoder
+}
+
+// messageHeader returns the value of the message's first header named key,
+// ignoring case, or "" if there is none.
+func messageHeader(msg *kafka.Message, key string) string {
+	for _, header := range msg.Headers {
+		if strings.EqualFold(header.Key, key) {
+			return strings.TrimSpace(string(header.Value))
 		}
+	}
+	return ""
+}
+
+func (c *PostHogKafkaConsumer) log() *slog.Logger {
+	if c.logger == nil {
+		return slog.Default()
+	}
+	return c.logger
+}
+
+func (c *PostHogKafkaConsumer) now() time.Time {
+	return c.getClock().Now()
+}
 
-		c.outgoingChan <- phEvent
-		c.statsChan <- phEvent
+// wait blocks for d or until ctx is cancelled.
+func (c *PostHogKafkaConsumer) wait(ctx context.Context, d time.Duration) error {
+	select {
+	case <-c.getClock().After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
+// isIdleRead reports whether a ReadMessage error only means there was nothing
+// to read: the read timed out, or the consumer is at the end of a partition,
+// as happens on quiet partitions with auto.offset.reset=latest. Neither is
+// worth logging or reporting.
+func isIdleRead(err error) bool {
+	var kafkaErr kafka.Error
+	if !errors.As(err, &kafkaErr) {
+		return false
+	}
+	return kafkaErr.IsTimeout() || kafkaErr.Code() == kafka.ErrPartitionEOF
+}
+
+// isBrokerDisconnect reports whether err means the brokers could not be
+// reached, as opposed to a problem with a single message.
+func isBrokerDisconnect(err kafka.Error) bool {
+	switch err.Code() {
+	case kafka.ErrAllBrokersDown, kafka.ErrTransport, kafka.ErrResolve, kafka.ErrBrokerNotAvailable, kafka.ErrNetworkException:
+		return true
+	}
+	return false
+}
+
+// deliver offers the event to outgoingChan and statsChan independently, each
+// following its own policy, so a full channel never holds the event back from
+// the other one. When a channel is full under Block, deliver waits for it
+// after the other has taken the event or dropped it: a reader that falls
+// behind still stalls reading from Kafka, and so the next event for both, but
+// never the event at hand. Use a drop policy for statsChan to keep a slow
+// stats reader from ever stalling the stream.
+//
+// It fails only if ctx is cancelled while blocked; a dropped event still counts
+// as delivered so its offset gets committed.
+func (c *PostHogKafkaConsumer) deliver(ctx context.Context, phEvent PostHogEvent) error {
+	outgoing, sent := c.offer(c.Backpressure, c.outgoingChan, phEvent)
+	if sent {
+		c.recordSent(phEvent)
+	}
+	stats, _ := c.offer(c.StatsBackpressure, c.statsChan, phEvent)
+
+	// A send on a nil channel never proceeds, so each case is disabled once
+	// its channel has the event.
+	for outgoing != nil || stats != nil {
+		select {
+		case outgoing <- phEvent:
+			outgoing = nil
+			c.recordSent(phEvent)
+		case stats <- phEvent:
+			stats = nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// offer sends v on ch following policy without waiting. It returns ch if v
+// still has to be sent, because ch is full and policy is Block, and otherwise
+// nil along with whether v was sent rather than dropped.
+func (c *PostHogKafkaConsumer) offer(policy BackpressurePolicy, ch chan PostHogEvent, v PostHogEvent) (pending chan PostHogEvent, sent bool) {
+	if policy == Block {
+		select {
+		case ch <- v:
+			return nil, true
+		default:
+			return ch, false
+		}
+	}
+
+	// The drop policies never wait, so send can't fail.
+	sent, evicted, _ := send(context.Background(), policy, ch, v)
+	c.recordDropped(len(evicted))
+	if !sent {
+		c.recordDropped(1)
+	}
+	return nil, sent
+}
+
+// recordSent counts an event sent to the outgoing channel and how long after
+// its timestamp that was. Clocks of the devices sending events can be ahead,
+// so a timestamp in the future counts as no latency.
+func (c *PostHogKafkaConsumer) recordSent(phEvent PostHogEvent) {
+	eventsSent.Inc()
+	latency := c.now().Sub(phEvent.Timestamp)
+	if latency < 0 {
+		futureEvents.Inc()
+		latency = 0
+	}
+	eventLatency.Observe(latency.Seconds())
+}
+
+func (c *PostHogKafkaConsumer) recordDropped(n int) {
+	c.dropped.Add(int64(n))
+	eventsDropped.Add(float64(n))
+}
+
+// Dropped returns how many events were discarded because a downstream channel
+// was full.
+func (c *PostHogKafkaConsumer) Dropped() int64 {
+	return c.dropped.Load()
+}
+
+// markDelivered records msg as safe to commit and commits once CommitEvery
+// messages have been delivered since the last commit.
+func (c *PostHogKafkaConsumer) markDelivered(msg *kafka.Message) {
+	if _, ok := msg.Opaque.(batchedPart); ok {
+		// The Kafka message is only done with once its last event is.
+		return
+	}
+
+	c.commitMu.Lock()
+	defer c.commitMu.Unlock()
+
+	if c.pending == nil {
+		c.pending = make(map[partitionKey]*kafka.Message)
+	}
+
+	key := partitionKey{partition: msg.TopicPartition.Partition}
+	if msg.TopicPartition.Topic != nil {
+		key.topic = *msg.TopicPartition.Topic
+	}
+	c.pending[key] = msg
+	c.uncommitted++
+
+	if c.uncommitted >= max(c.CommitEvery, 1) {
+		c.commitPendingLocked()
+	}
+}
+
+// commitPending commits the latest delivered message of every partition. A
+// partition whose commit fails stays pending and is retried on the next flush.
+func (c *PostHogKafkaConsumer) commitPending() {
+	c.commitMu.Lock()
+	defer c.commitMu.Unlock()
+	c.commitPendingLocked()
+}
+
+func (c *PostHogKafkaConsumer) commitPendingLocked() {
+	for key, msg := range c.pending {
+		if _, err := c.consumer.CommitMessage(msg); err != nil {
+			c.log().Error("Failed to commit offset", append(messageAttrs(msg), "error", err)...)
+			captureException(err)
+			continue
+		}
+		delete(c.pending, key)
+	}
+	c.uncommitted = 0
+}
+
+// PartitionLag is how many messages the consumer group is behind the head
+// of one partition.
+type PartitionLag struct {
+	Topic     string
+	Partition int32
+	Lag       int64
+}
+
+// Lag returns how many messages the consumer group is behind the head of the
+// topic, summed over the partitions assigned to this consumer. Partitions
+// with nothing committed yet are not counted.
+func (c *PostHogKafkaConsumer) Lag() (int64, error) {
+	lags, err := c.PartitionLags()
+	if err != nil {
+		return 0, err
+	}
+
+	var lag int64
+	for _, partition := range lags {
+		lag += partition.Lag
+	}
+	return lag, nil
+}
+
+// PartitionLags returns the lag of each partition assigned to this consumer
+// that has a committed offset, so one partition falling behind shows.
+func (c *PostHogKafkaConsumer) PartitionLags() ([]PartitionLag, error) {
+	partitions, err := c.consumer.Assignment()
+	if err != nil {
+		return nil, err
+	}
+	if len(partitions) == 0 {
+		return nil, nil
+	}
+
+	committed, err := c.consumer.Committed(partitions, lagQueryTimeoutMs)
+	if err != nil {
+		return nil, err
+	}
+
+	var lags []PartitionLag
+	for _, tp := range committed {
+		if tp.Topic == nil || tp.Offset < 0 {
+			continue
+		}
+
+		_, high, err := c.consumer.QueryWatermarkOffsets(*tp.Topic, tp.Partition, lagQueryTimeoutMs)
+		if err != nil {
+			return nil, err
+		}
+		lags = append(lags, PartitionLag{Topic: *tp.Topic, Partition: tp.Partition, Lag: max(high-int64(tp.Offset), 0)})
+	}
+	return lags, nil
+}
+
+// RecordLag refreshes the livestream_kafka_consumer_lag and
+// livestream_kafka_partition_lag gauges every interval until ctx is
+// cancelled.
+func (c *PostHogKafkaConsumer) RecordLag(ctx context.Context, interval time.Duration) {
+	for {
+		if lags, err := c.PartitionLags(); err != nil {
+			c.log().Warn("Failed to compute consumer lag", "error", err)
+		} else {
+			// Partitions that were revoked since the last tick are dropped.
+			partitionLag.Reset()
+			var lag int64
+			for _, partition := range lags {
+				partitionLag.WithLabelValues(partition.Topic, strconv.Itoa(int(partition.Partition))).Set(float64(partition.Lag))
+				lag += partition.Lag
+			}
+			consumerLag.Set(float64(lag))
+		}
+
+		if c.wait(ctx, interval) != nil {
+			return
+		}
+	}
+}
+
+// recordConsumed counts msg as read, in total and for its partition.
+func recordConsumed(msg *kafka.Message) {
+	eventsConsumed.Inc()
+	topic := ""
+	if msg.TopicPartition.Topic != nil {
+		topic = *msg.TopicPartition.Topic
+	}
+	partitionMessages.WithLabelValues(topic, strconv.Itoa(int(msg.TopicPartition.Partition))).Inc()
+}
+
+// start registers a run of Consume or Replay and returns the context it
+// should use, which Close cancels. It returns false once the consumer is
+// closed, as its channels are too.
+func (c *PostHogKafkaConsumer) start(ctx context.Context) (context.Context, bool) {
+	c.lifecycleMu.Lock()
+	defer c.lifecycleMu.Unlock()
+
+	if c.closed || c.done != nil {
+		return ctx, false
+	}
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.done = make(chan struct{})
+	return ctx, true
+}
+
+// shutdown ends a run started with start.
+func (c *PostHogKafkaConsumer) shutdown() {
+	c.release()
+
+	c.lifecycleMu.Lock()
+	defer c.lifecycleMu.Unlock()
+	c.closed = true
+	c.cancel()
+	close(c.done)
+}
+
+// release commits what was delivered, closes the outgoing channels and
+// closes the Kafka consumer, only the first time it is called.
+func (c *PostHogKafkaConsumer) release() {
+	c.releaseOnce.Do(func() {
+		if c.readiness != nil {
+			c.readiness.SetKafkaSubscribed(false)
+		}
+		c.commitPending()
+		for _, ch := range []chan PostHogEvent{c.outgoingChan, c.statsChan, c.noTokenChan} {
+			if ch != nil {
+				close(ch)
+			}
+		}
+		if c.outgoingBatchChan != nil {
+			close(c.outgoingBatchChan)
+		}
+		if c.deadLetterChan != nil {
+			close(c.deadLetterChan)
+		}
+		if err := c.consumer.Close(); err != nil {
+			c.log().Warn("Error closing Kafka consumer", "error", err)
+		}
+	})
+}
+
+// Close stops a running Consume or Replay and waits for it to shut down, so
+// channels are never closed under a send. Without one running it closes the
+// channels and the Kafka consumer itself. It is safe to call more than once
+// and from several goroutines.
 func (c *PostHogKafkaConsumer) Close() {
-	c.consumer.Close()
+	c.lifecycleMu.Lock()
+	c.closed = true
+	cancel, done := c.cancel, c.done
+	c.lifecycleMu.Unlock()
+
+	if done != nil {
+		cancel()
+		<-done
+		return
+	}
+	c.release()
 }
@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
 	"github.com/posthog/posthog/livestream/mocks"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 func TestPostHogKafkaConsumer_Consume(t *testing.T) {
@@ -24,7 +33,7 @@ func TestPostHogKafkaConsumer_Consume(t *testing.T) {
 	// Create PostHogKafkaConsumer
 	consumer := &PostHogKafkaConsumer{
 		consumer:     mockConsumer,
-		topic:        "test-topic",
+		topics:       []string{"test-topic"},
 		geolocator:   mockGeoLocator,
 		outgoingChan: outgoingChan,
 		statsChan:    statsChan,
@@ -47,12 +56,13 @@ func TestPostHogKafkaConsumer_Consume(t *testing.T) {
 
 	// Mock ReadMessage
 	mockConsumer.On("ReadMessage", mock.AnythingOfType("time.Duration")).Return(testMessage, nil).Maybe()
+	mockConsumer.On("CommitMessage", testMessage).Return(nil, nil).Maybe()
 
 	// Mock GeoLocator Lookup
 	mockGeoLocator.On("Lookup", "192.0.2.1").Return(37.7749, -122.4194, nil)
 
 	// Run Consume in a goroutine
-	go consumer.Consume()
+	go consumer.Consume(context.Background())
 
 	// Wait for the message to be processed
 	select {
@@ -84,15 +94,1846 @@ func TestPostHogKafkaConsumer_Consume(t *testing.T) {
 	mockGeoLocator.AssertExpectations(t)
 }
 
+func TestPostHogKafkaConsumer_NoCommitOnFailedDelivery(t *testing.T) {
+	mockConsumer := mocks.NewKafkaConsumerInterface(t)
+
+	// Nobody reads outgoingChan, so delivery blocks until the context is cancelled.
+	outgoingChan := make(chan PostHogEvent)
+	statsChan := make(chan PostHogEvent)
+
+	consumer := &PostHogKafkaConsumer{
+		consumer:     mockConsumer,
+		topics:       []string{"test-topic"},
+		outgoingChan: outgoingChan,
+		statsChan:    statsChan,
+	}
+
+	testMessage := &kafka.Message{
+		Value: []byte(`{"uuid": "test-uuid", "data": "{\"event\": \"test-event\"}", "token": "test-token"}`),
+	}
+
+	read := make(chan struct{})
+	mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.AnythingOfType("kafka.RebalanceCb")).Return(nil)
+	mockConsumer.On("ReadMessage", mock.AnythingOfType("time.Duration")).Return(testMessage, nil).Once().
+		Run(func(mock.Arguments) { close(read) })
+	mockConsumer.On("Close").Return(nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		consumer.Consume(ctx)
+		close(done)
+	}()
+
+	<-read
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Consume did not stop after failed delivery")
+	}
+
+	mockConsumer.AssertNotCalled(t, "CommitMessage", mock.Anything)
+}
+
+func TestPostHogKafkaConsumer_ConsumeStopsOnCancel(t *testing.T) {
+	mockConsumer := mocks.NewKafkaConsumerInterface(t)
+
+	outgoingChan := make(chan PostHogEvent, 1)
+	statsChan := make(chan PostHogEvent, 1)
+
+	consumer := &PostHogKafkaConsumer{
+		consumer:     mockConsumer,
+		topics:       []string{"test-topic"},
+		outgoingChan: outgoingChan,
+		statsChan:    statsChan,
+	}
+
+	topic := "test-topic"
+	testMessage := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: 7},
+		Value:          []byte(`{"data": "{\"event\": \"test-event\"}", "token": "test-token"}`),
+	}
+	timeout := kafka.NewError(kafka.ErrTimedOut, "timed out", false)
+
+	mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.AnythingOfType("kafka.RebalanceCb")).Return(nil)
+	mockConsumer.On("ReadMessage", kafkaReadTimeout).Return(testMessage, nil).Once()
+	mockConsumer.On("ReadMessage", kafkaReadTimeout).Return(nil, timeout)
+	mockConsumer.On("CommitMessage", testMessage).Return(nil, nil).Once()
+	mockConsumer.On("Close").Return(nil).Once()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		consumer.Consume(ctx)
+		close(done)
+	}()
+
+	// Give the consumer a moment to sit idle on read timeouts before stopping it.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * kafkaReadTimeout):
+		t.Fatal("Consume did not return after the context was cancelled")
+	}
+
+	// The delivered event is still buffered and both channels are closed.
+	event, ok := <-outgoingChan
+	assert.True(t, ok)
+	assert.Equal(t, "test-event", event.Event)
+	_, ok = <-outgoingChan
+	assert.False(t, ok)
+	<-statsChan
+	_, ok = <-statsChan
+	assert.False(t, ok)
+}
+
+func TestPostHogKafkaConsumer_MultipleTopics(t *testing.T) {
+	mockConsumer := new(mocks.KafkaConsumerInterface)
+
+	outgoingChan := make(chan PostHogEvent, 2)
+	statsChan := make(chan PostHogEvent, 2)
+
+	consumer := &PostHogKafkaConsumer{
+		consumer:     mockConsumer,
+		topics:       []string{"events-eu", "events-us"},
+		outgoingChan: outgoingChan,
+		statsChan:    statsChan,
+	}
+
+	eu, us := "events-eu", "events-us"
+	messages := []*kafka.Message{
+		{
+			TopicPartition: kafka.TopicPartition{Topic: &eu, Partition: 0},
+			Value:          []byte(`{"uuid": "eu-uuid", "data": "{\"event\": \"test-event\"}", "token": "test-token"}`),
+		},
+		{
+			TopicPartition: kafka.TopicPartition{Topic: &us, Partition: 0},
+			Value:          []byte(`{"uuid": "us-uuid", "data": "{\"event\": \"test-event\"}", "token": "test-token"}`),
+		},
+	}
+
+	mockConsumer.On("SubscribeTopics", []string{"events-eu", "events-us"}, mock.AnythingOfType("kafka.RebalanceCb")).Return(nil).Once()
+	mockConsumer.On("ReadMessage", mock.AnythingOfType("time.Duration")).Return(messages[0], nil).Once()
+	mockConsumer.On("ReadMessage", mock.AnythingOfType("time.Duration")).Return(messages[1], nil).Once()
+	mockConsumer.On("ReadMessage", mock.AnythingOfType("time.Duration")).Return(nil, kafka.NewError(kafka.ErrTimedOut, "timed out", false)).Maybe()
+	mockConsumer.On("CommitMessage", mock.Anything).Return(nil, nil).Maybe()
+	mockConsumer.On("Close").Return(nil).Maybe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Consume(ctx)
+
+	received := map[string]string{}
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-outgoingChan:
+			received[event.Uuid] = event.Topic
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for events")
+		}
+	}
+
+	assert.Equal(t, map[string]string{"eu-uuid": "events-eu", "us-uuid": "events-us"}, received)
+	mockConsumer.AssertCalled(t, "SubscribeTopics", []string{"events-eu", "events-us"}, mock.AnythingOfType("kafka.RebalanceCb"))
+}
+
+func TestPostHogKafkaConsumer_DeadLetters(t *testing.T) {
+	mockConsumer := new(mocks.KafkaConsumerInterface)
+
+	outgoingChan := make(chan PostHogEvent, 3)
+	statsChan := make(chan PostHogEvent, 3)
+	deadLetterChan := make(chan DeadLetterEvent, 3)
+
+	consumer := &PostHogKafkaConsumer{
+		consumer:     mockConsumer,
+		topics:       []string{"test-topic"},
+		outgoingChan: outgoingChan,
+		statsChan:    statsChan,
+		clock:        newFakeClock(),
+	}
+	consumer.EnableDeadLetters(deadLetterChan)
+	noToken := make(chan PostHogEvent, 3)
+	consumer.RouteNoToken(noToken)
+	noTokensBefore := testutil.ToFloat64(noTokenEvents)
+
+	topic := "test-topic"
+	malformed := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 3, Offset: 41},
+		Value:          []byte(`{"uuid": "broken`),
+	}
+	badData := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 3, Offset: 42},
+		Value:          []byte(`{"uuid": "bad-data", "data": "not json", "token": "test-token"}`),
+	}
+	withTokenHeader := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 3, Offset: 43},
+		Value:          []byte(`{"uuid": "broken`),
+		Headers:        []kafka.Header{{Key: "token", Value: []byte("test-token")}},
+	}
+	valid := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 3, Offset: 44},
+		Value:          []byte(`{"uuid": "valid", "data": "{\"event\": \"test-event\"}", "token": "test-token"}`),
+	}
+
+	mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.AnythingOfType("kafka.RebalanceCb")).Return(nil)
+	mockConsumer.On("ReadMessage", mock.AnythingOfType("time.Duration")).Return(malformed, nil).Once()
+	mockConsumer.On("ReadMessage", mock.AnythingOfType("time.Duration")).Return(badData, nil).Once()
+	mockConsumer.On("ReadMessage", mock.AnythingOfType("time.Duration")).Return(withTokenHeader, nil).Once()
+	mockConsumer.On("ReadMessage", mock.AnythingOfType("time.Duration")).Return(valid, nil).Once()
+	mockConsumer.On("ReadMessage", mock.AnythingOfType("time.Duration")).Return(nil, kafka.NewError(kafka.ErrTimedOut, "timed out", false)).Maybe()
+	mockConsumer.On("CommitMessage", mock.Anything).Return(nil, nil).Maybe()
+	mockConsumer.On("Close").Return(nil).Maybe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Consume(ctx)
+
+	for _, expected := range []*kafka.Message{malformed, badData, withTokenHeader} {
+		select {
+		case dead := <-deadLetterChan:
+			assert.Equal(t, expected.Value, dead.Raw)
+			assert.Error(t, dead.Err)
+			assert.Equal(t, "test-topic", dead.Topic)
+			assert.Equal(t, int32(3), dead.Partition)
+			assert.Equal(t, expected.TopicPartition.Offset, dead.Offset)
+			assert.False(t, dead.Timestamp.IsZero())
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for dead-letter event")
+		}
+	}
+
+	// The loop keeps going after the failures, which are never delivered
+	// even with a token.
+	select {
+	case event := <-outgoingChan:
+		assert.Equal(t, "valid", event.Uuid)
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the valid event")
+	}
+	assert.Equal(t, "valid", (<-statsChan).Uuid)
+	assert.Empty(t, deadLetterChan)
+	// The malformed message has no token only because it wasn't decoded.
+	assert.Empty(t, noToken)
+	assert.Equal(t, noTokensBefore, testutil.ToFloat64(noTokenEvents))
+}
+
+func TestPostHogKafkaConsumer_MaxMessageSize(t *testing.T) {
+	value := []byte(`{"uuid": "1", "data": "{\"event\": \"$pageview\"}", "token": "test-token"}`)
+
+	tests := []struct {
+		name      string
+		limit     int
+		delivered bool
+	}{
+		{name: "No limit", limit: 0, delivered: true},
+		{name: "Just under", limit: len(value) + 1, delivered: true},
+		{name: "At the limit", limit: len(value), delivered: true},
+		{name: "Just over", limit: len(value) - 1, delivered: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockConsumer := new(mocks.KafkaConsumerInterface)
+			mockConsumer.On("CommitMessage", mock.Anything).Return(nil, nil).Once()
+			consumer := &PostHogKafkaConsumer{
+				consumer:       mockConsumer,
+				geolocator:     NoOpGeoLocator{},
+				outgoingChan:   make(chan PostHogEvent, 1),
+				statsChan:      make(chan PostHogEvent, 1),
+				MaxMessageSize: tt.limit,
+			}
+			deadLetters := make(chan DeadLetterEvent, 1)
+			consumer.EnableDeadLetters(deadLetters)
+			noToken := make(chan PostHogEvent, 1)
+			consumer.RouteNoToken(noToken)
+
+			require.NoError(t, consumer.process(context.Background(), &kafka.Message{Value: value}))
+			// Committed either way, so an oversized message is not read again.
+			mockConsumer.AssertExpectations(t)
+
+			if tt.delivered {
+				assert.Equal(t, "1", (<-consumer.outgoingChan).Uuid)
+				assert.Empty(t, deadLetters)
+				return
+			}
+			assert.Empty(t, consumer.outgoingChan)
+			assert.Empty(t, consumer.statsChan)
+			// Not mistaken for an event without a token.
+			assert.Empty(t, noToken)
+			dead := <-deadLetters
+			assert.ErrorIs(t, dead.Err, ErrMessageTooLarge)
+			assert.Equal(t, value, dead.Raw)
+		})
+	}
+}
+
+func TestPostHogKafkaConsumer_DeadLetterNil(t *testing.T) {
+	consumer := &PostHogKafkaConsumer{}
+
+	assert.NotPanics(t, func() {
+		consumer.parseMessage(&kafka.Message{Value: []byte("not json")})
+	})
+}
+
+func TestPostHogKafkaConsumer_DeadLetterReasons(t *testing.T) {
+	clock := newFakeClock()
+	old, err := json.Marshal(map[string]interface{}{"event": "$pageview", "timestamp": clock.Now().Add(-time.Hour)})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		value     string
+		reason    DeadLetterReason
+		err       error
+		delivered bool
+	}{
+		{name: "Decode error", value: `{"uuid": "broken`, reason: DecodeError},
+		{name: "No token", value: `{"uuid": "1", "data": "{\"event\": \"$pageview\"}"}`, reason: NoToken, err: ErrNoToken},
+		{name: "Invalid token", value: `{"uuid": "1", "token": "phc_bad token!", "data": "{\"event\": \"$pageview\"}"}`, reason: InvalidToken, err: ErrInvalidToken},
+		{name: "Oversized", value: `{"uuid": "1", "token": "test-token", "data": "` + strings.Repeat("x", 200) + `"}`, reason: Oversized, err: ErrMessageTooLarge},
+		{name: "Stale", value: fmt.Sprintf(`{"uuid": "1", "token": "test-token", "data": %q}`, old), reason: Stale, err: ErrStaleEvent},
+		{name: "Geo error", value: `{"uuid": "1", "token": "test-token", "ip": "192.0.2.1", "data": "{\"event\": \"$pageview\"}"}`, reason: GeoError, delivered: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockConsumer := mocks.NewKafkaConsumerInterface(t)
+			mockConsumer.On("CommitMessage", mock.Anything).Return(nil, nil).Once()
+			mockGeoLocator := new(mocks.GeoLocator)
+			mockGeoLocator.On("Lookup", "192.0.2.1").Return(0.0, 0.0, errors.New("database closed")).Maybe()
+			consumer := &PostHogKafkaConsumer{
+				consumer:       mockConsumer,
+				geolocator:     mockGeoLocator,
+				outgoingChan:   make(chan PostHogEvent, 1),
+				statsChan:      make(chan PostHogEvent, 1),
+				clock:          clock,
+				Tokens:         &TokenNormalizer{MaxLength: maxTokenLength, Pattern: tokenPattern},
+				MaxMessageSize: 200,
+				MaxAge:         10 * time.Minute,
+			}
+			deadLetters := make(chan DeadLetterEvent, 2)
+			consumer.EnableDeadLetters(deadLetters)
+
+			topic := "test-topic"
+			msg := &kafka.Message{
+				TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 3, Offset: 42},
+				Value:          []byte(tt.value),
+			}
+			require.NoError(t, consumer.process(context.Background(), msg))
+
+			require.Len(t, deadLetters, 1)
+			dead := <-deadLetters
+			assert.Equal(t, tt.reason, dead.Reason)
+			assert.Error(t, dead.Err)
+			if tt.err != nil {
+				assert.ErrorIs(t, dead.Err, tt.err)
+			}
+			assert.Equal(t, msg.Value, dead.Raw)
+			assert.Equal(t, "test-topic", dead.Topic)
+			assert.Equal(t, int32(3), dead.Partition)
+			assert.Equal(t, kafka.Offset(42), dead.Offset)
+			assert.Equal(t, tt.delivered, len(consumer.outgoingChan) == 1)
+		})
+	}
+}
+
+func TestDeadLetterReasonString(t *testing.T) {
+	assert.Equal(t, "invalid_token", InvalidToken.String())
+	assert.Equal(t, "geo_error", GeoError.String())
+	assert.Equal(t, "DeadLetterReason(0)", DeadLetterReason(0).String())
+}
+
+func TestParseTopics(t *testing.T) {
+	assert.Equal(t, []string{"events"}, parseTopics("events"))
+	assert.Equal(t, []string{"events-eu", "events-us"}, parseTopics("events-eu, events-us,"))
+	assert.Empty(t, parseTopics(" , "))
+}
+
+func TestPostHogKafkaConsumer_CommitEvery(t *testing.T) {
+	mockConsumer := new(mocks.KafkaConsumerInterface)
+
+	outgoingChan := make(chan PostHogEvent, 10)
+	statsChan := make(chan PostHogEvent, 10)
+
+	consumer := &PostHogKafkaConsumer{
+		consumer:     mockConsumer,
+		topics:       []string{"test-topic"},
+		outgoingChan: outgoingChan,
+		statsChan:    statsChan,
+		CommitEvery:  2,
+	}
+
+	topic := "test-topic"
+	messages := make([]*kafka.Message, 4)
+	for i := range messages {
+		messages[i] = &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: kafka.Offset(i)},
+			Value:          []byte(`{"data": "{\"event\": \"test-event\"}", "token": "test-token"}`),
+		}
+	}
+
+	mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.AnythingOfType("kafka.RebalanceCb")).Return(nil)
+	for _, msg := range messages {
+		mockConsumer.On("ReadMessage", mock.AnythingOfType("time.Duration")).Return(msg, nil).Once()
+	}
+	mockConsumer.EXPECT().ReadMessage(mock.AnythingOfType("time.Duration")).
+		RunAndReturn(func(time.Duration) (*kafka.Message, error) { select {} }).Maybe()
+	committed := make(chan *kafka.Message, len(messages))
+	mockConsumer.On("CommitMessage", mock.Anything).Return(nil, nil).Run(func(args mock.Arguments) {
+		committed <- args.Get(0).(*kafka.Message)
+	})
+
+	go consumer.Consume(context.Background())
+
+	for _, want := range []*kafka.Message{messages[1], messages[3]} {
+		select {
+		case got := <-committed:
+			assert.Equal(t, want.TopicPartition.Offset, got.TopicPartition.Offset)
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for commit")
+		}
+	}
+	assert.Len(t, outgoingChan, 4)
+	assert.Len(t, statsChan, 4)
+	assert.Empty(t, committed)
+}
+
+func TestPostHogKafkaConsumer_RebalanceCommitsOnRevoke(t *testing.T) {
+	mockConsumer := new(mocks.KafkaConsumerInterface)
+	committed := make(chan *kafka.Message, 10)
+	mockConsumer.On("CommitMessage", mock.Anything).Return(nil, nil).Run(func(args mock.Arguments) {
+		committed <- args.Get(0).(*kafka.Message)
+	})
+	consumer := &PostHogKafkaConsumer{consumer: mockConsumer, CommitEvery: 100}
+
+	topic := "test-topic"
+	partitions := []kafka.TopicPartition{{Topic: &topic, Partition: 0}}
+	msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: 7}}
+	consumer.markDelivered(msg)
+
+	rebalance := consumer.rebalanceCb(context.Background(), nil, &eventBatch{})
+	require.NoError(t, rebalance(nil, kafka.AssignedPartitions{Partitions: partitions}))
+	assert.Empty(t, committed)
+
+	require.NoError(t, rebalance(nil, kafka.RevokedPartitions{Partitions: partitions}))
+	require.Len(t, committed, 1)
+	assert.Same(t, msg, <-committed)
+
+	// Nothing new was delivered, so the next revoke has nothing to commit.
+	require.NoError(t, rebalance(nil, kafka.RevokedPartitions{Partitions: partitions}))
+	assert.Empty(t, committed)
+}
+
+func TestPostHogKafkaConsumer_RebalanceDrainsInFlight(t *testing.T) {
+	topic := "test-topic"
+	messages := make([]*kafka.Message, 4)
+	for i := range messages {
+		messages[i] = &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: int32(i % 2), Offset: kafka.Offset(i)},
+			Value:          []byte(`{"data": "{\"event\": \"test-event\"}", "token": "test-token"}`),
+		}
+	}
+	newConsumer := func() (*PostHogKafkaConsumer, *mocks.KafkaConsumerInterface) {
+		mockConsumer := new(mocks.KafkaConsumerInterface)
+		mockConsumer.On("CommitMessage", mock.Anything).Return(nil, nil)
+		return &PostHogKafkaConsumer{
+			consumer:     mockConsumer,
+			geolocator:   NoOpGeoLocator{},
+			outgoingChan: make(chan PostHogEvent, 10),
+			statsChan:    make(chan PostHogEvent, 10),
+			CommitEvery:  100,
+		}, mockConsumer
+	}
+	revoked := kafka.RevokedPartitions{Partitions: []kafka.TopicPartition{{Topic: &topic, Partition: 0}, {Topic: &topic, Partition: 1}}}
+
+	t.Run("Workers", func(t *testing.T) {
+		consumer, mockConsumer := newConsumer()
+		ctx := context.Background()
+		pool := consumer.startWorkers(ctx, 2)
+		defer pool.stop()
+		for _, msg := range messages {
+			require.NoError(t, pool.dispatch(ctx, msg))
+		}
+
+		require.NoError(t, consumer.rebalanceCb(ctx, pool, &eventBatch{})(nil, revoked))
+		assert.Len(t, consumer.outgoingChan, 4)
+		mockConsumer.AssertCalled(t, "CommitMessage", messages[2])
+		mockConsumer.AssertCalled(t, "CommitMessage", messages[3])
+	})
+
+	t.Run("GeoWorkers", func(t *testing.T) {
+		consumer, mockConsumer := newConsumer()
+		ctx := context.Background()
+		pool := consumer.startGeoWorkers(ctx, 2)
+		defer pool.stop()
+		for _, msg := range messages {
+			require.NoError(t, pool.dispatch(ctx, msg))
+		}
+
+		require.NoError(t, consumer.rebalanceCb(ctx, pool, &eventBatch{})(nil, revoked))
+		assert.Len(t, consumer.outgoingChan, 4)
+		mockConsumer.AssertCalled(t, "CommitMessage", messages[2])
+		mockConsumer.AssertCalled(t, "CommitMessage", messages[3])
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		consumer, mockConsumer := newConsumer()
+		batchChan := make(chan []PostHogEvent, 1)
+		consumer.EnableBatching(batchChan, 100, 0)
+		batch := &eventBatch{}
+		for _, msg := range messages {
+			batch.events = append(batch.events, consumer.parseMessage(msg))
+			batch.messages = append(batch.messages, msg)
+		}
+
+		require.NoError(t, consumer.rebalanceCb(context.Background(), nil, batch)(nil, revoked))
+		require.Len(t, batchChan, 1)
+		assert.Len(t, <-batchChan, 4)
+		assert.Empty(t, batch.messages)
+		mockConsumer.AssertCalled(t, "CommitMessage", messages[2])
+		mockConsumer.AssertCalled(t, "CommitMessage", messages[3])
+	})
+}
+
+func TestPostHogKafkaConsumer_Backoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		cap      time.Duration
+		attempt  int
+		expected time.Duration
+	}{
+		{name: "first retry", attempt: 0, expected: 500 * time.Millisecond},
+		{name: "second retry", attempt: 1, expected: time.Second},
+		{name: "doubles", attempt: 5, expected: 16 * time.Second},
+		{name: "default cap", attempt: 6, expected: 30 * time.Second},
+		{name: "stays at cap", attempt: 50, expected: 30 * time.Second},
+		{name: "custom cap", cap: 3 * time.Second, attempt: 3, expected: 3 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consumer := &PostHogKafkaConsumer{BackoffCap: tt.cap}
+			assert.Equal(t, tt.expected, consumer.backoff(tt.attempt))
+		})
+	}
+}
+
+func TestPostHogKafkaConsumer_SubscribeRetries(t *testing.T) {
+	mockConsumer := mocks.NewKafkaConsumerInterface(t)
+	clock := newFakeClock()
+
+	consumer := &PostHogKafkaConsumer{
+		consumer:     mockConsumer,
+		topics:       []string{"test-topic"},
+		outgoingChan: make(chan PostHogEvent),
+		statsChan:    make(chan PostHogEvent),
+		MaxRetries:   3,
+		BackoffCap:   time.Second,
+		clock:        clock,
+	}
+
+	subscribeErr := kafka.NewError(kafka.ErrAllBrokersDown, "all brokers down", false)
+	mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.AnythingOfType("kafka.RebalanceCb")).Return(subscribeErr).Times(4)
+	mockConsumer.On("Close").Return(nil).Once()
+
+	err := consumer.Consume(context.Background())
+
+	assert.ErrorIs(t, err, subscribeErr)
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, time.Second, time.Second}, clock.Waits())
+}
+
+func TestPostHogKafkaConsumer_SubscribeRecovers(t *testing.T) {
+	mockConsumer := mocks.NewKafkaConsumerInterface(t)
+	clock := newFakeClock()
+
+	consumer := &PostHogKafkaConsumer{
+		consumer:     mockConsumer,
+		topics:       []string{"test-topic"},
+		outgoingChan: make(chan PostHogEvent),
+		statsChan:    make(chan PostHogEvent),
+		MaxRetries:   5,
+		clock:        clock,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	subscribeErr := kafka.NewError(kafka.ErrTransport, "transport failure", false)
+	mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.AnythingOfType("kafka.RebalanceCb")).Return(subscribeErr).Twice()
+	mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.AnythingOfType("kafka.RebalanceCb")).Return(nil).Once()
+	mockConsumer.On("ReadMessage", kafkaReadTimeout).Return(nil, kafka.NewError(kafka.ErrTimedOut, "timed out", false)).
+		Run(func(mock.Arguments) { cancel() }).Once()
+	mockConsumer.On("Close").Return(nil).Once()
+
+	err := consumer.Consume(ctx)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, time.Second}, clock.Waits())
+}
+
+func TestPostHogKafkaConsumer_ReadErrorSkipsMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{name: "Kafka error", err: kafka.NewError(kafka.ErrUnknownTopicOrPart, "unknown topic", false)},
+		{name: "Other error", err: errors.New("boom")},
+		{name: "Timeout", err: kafka.NewError(kafka.ErrTimedOut, "timed out", false)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockConsumer := new(mocks.KafkaConsumerInterface)
+
+			outgoingChan := make(chan PostHogEvent, 1)
+			statsChan := make(chan PostHogEvent, 1)
+
+			consumer := &PostHogKafkaConsumer{
+				consumer:     mockConsumer,
+				topics:       []string{"test-topic"},
+				outgoingChan: outgoingChan,
+				statsChan:    statsChan,
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			reads := 0
+			mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.AnythingOfType("kafka.RebalanceCb")).Return(nil)
+			mockConsumer.On("ReadMessage", mock.AnythingOfType("time.Duration")).Return(nil, tt.err).
+				Run(func(mock.Arguments) {
+					// Stop after a few failed reads; the consumer must survive them.
+					if reads++; reads == 3 {
+						cancel()
+					}
+				})
+			mockConsumer.On("Close").Return(nil)
+
+			require.NotPanics(t, func() {
+				assert.NoError(t, consumer.Consume(ctx))
+			})
+
+			mockConsumer.AssertNotCalled(t, "CommitMessage", mock.Anything)
+			_, ok := <-outgoingChan
+			assert.False(t, ok, "no event should have been sent")
+			_, ok = <-statsChan
+			assert.False(t, ok, "no event should have been sent")
+		})
+	}
+}
+
+func TestPostHogKafkaConsumer_IdleReadsAreNotReported(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		reported bool
+	}{
+		{name: "Partition EOF", err: kafka.NewError(kafka.ErrPartitionEOF, "Broker: No more messages", false)},
+		{name: "Timeout", err: kafka.NewError(kafka.ErrTimedOut, "timed out", false)},
+		{name: "Other Kafka error", err: kafka.NewError(kafka.ErrUnknownTopicOrPart, "unknown topic", false), reported: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent := &sentErrors{}
+			defer func(r *ErrorReporter) { reporter = r }(reporter)
+			reporter = NewErrorReporter(time.Minute)
+			reporter.clock = newFakeClock()
+			reporter.send = sent.send
+
+			mockConsumer := new(mocks.KafkaConsumerInterface)
+			consumer := &PostHogKafkaConsumer{
+				consumer:     mockConsumer,
+				topics:       []string{"test-topic"},
+				outgoingChan: make(chan PostHogEvent, 1),
+				statsChan:    make(chan PostHogEvent, 1),
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			reads := 0
+			mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.AnythingOfType("kafka.RebalanceCb")).Return(nil)
+			mockConsumer.On("ReadMessage", mock.AnythingOfType("time.Duration")).Return(nil, tt.err).
+				Run(func(mock.Arguments) {
+					if reads++; reads == 3 {
+						cancel()
+					}
+				})
+			mockConsumer.On("Close").Return(nil)
+
+			require.NoError(t, consumer.Consume(ctx))
+			if tt.reported {
+				assert.Equal(t, []string{tt.err.Error()}, sent.messages)
+			} else {
+				assert.Empty(t, sent.messages)
+			}
+		})
+	}
+}
+
+func TestPostHogKafkaConsumer_IdleAfterTimeouts(t *testing.T) {
+	var buf bytes.Buffer
+	mockConsumer := new(mocks.KafkaConsumerInterface)
+	readiness := &Readiness{}
+	consumer := &PostHogKafkaConsumer{
+		consumer:     mockConsumer,
+		topics:       []string{"test-topic"},
+		geolocator:   NoOpGeoLocator{},
+		outgoingChan: make(chan PostHogEvent, 1),
+		statsChan:    make(chan PostHogEvent, 1),
+		readiness:    readiness,
+		logger:       newLogger(&buf, slog.LevelInfo, "json"),
+		ReadTimeout:  2 * time.Second,
+		IdleAfter:    3,
+	}
+
+	topic := "test-topic"
+	msg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic},
+		Value:          []byte(`{"data": "{\"event\": \"test-event\"}", "token": "test-token"}`),
+	}
+	timeout := kafka.NewError(kafka.ErrTimedOut, "timed out", false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// Whether the consumer was idle when each read started.
+	var idle []bool
+	record := func(mock.Arguments) {
+		idle = append(idle, readiness.kafkaIdle.Load())
+		if len(idle) == 8 {
+			cancel()
+		}
+	}
+	mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.AnythingOfType("kafka.RebalanceCb")).Return(nil)
+	mockConsumer.On("ReadMessage", 2*time.Second).Return(nil, timeout).Times(5).Run(record)
+	mockConsumer.On("ReadMessage", 2*time.Second).Return(msg, nil).Once().Run(record)
+	mockConsumer.On("ReadMessage", 2*time.Second).Return(nil, timeout).Run(record)
+	mockConsumer.On("CommitMessage", msg).Return(nil, nil)
+	mockConsumer.On("Close").Return(nil)
+
+	require.NoError(t, consumer.Consume(ctx))
+	assert.Equal(t, []bool{false, false, false, true, true, true, false, false}, idle)
+
+	var warnings, resumed []map[string]interface{}
+	for _, record := range logRecords(t, &buf) {
+		switch record["msg"] {
+		case "No messages from Kafka, the consumer is idle":
+			warnings = append(warnings, record)
+		case "Messages from Kafka resumed":
+			resumed = append(resumed, record)
+		}
+	}
+	require.Len(t, warnings, 1, "a warning is logged once the threshold is reached, and only then")
+	assert.Equal(t, "WARN", warnings[0]["level"])
+	assert.Equal(t, 3.0, warnings[0]["reads"])
+	require.Len(t, resumed, 1)
+	assert.Equal(t, 5.0, resumed[0]["reads"])
+}
+
+func TestPostHogKafkaConsumer_SubscribeSetsReadiness(t *testing.T) {
+	mockConsumer := new(mocks.KafkaConsumerInterface)
+	readiness := &Readiness{}
+	readiness.SetGeoIPLoaded(true)
+
+	consumer := &PostHogKafkaConsumer{
+		consumer:     mockConsumer,
+		topics:       []string{"test-topic"},
+		outgoingChan: make(chan PostHogEvent),
+		statsChan:    make(chan PostHogEvent),
+		readiness:    readiness,
+		clock:        newFakeClock(),
+	}
+
+	subscribeErr := kafka.NewError(kafka.ErrTransport, "broker down", false)
+	mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.AnythingOfType("kafka.RebalanceCb")).Return(subscribeErr).Once().
+		Run(func(mock.Arguments) { assert.False(t, readiness.Ready()) })
+	mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.AnythingOfType("kafka.RebalanceCb")).Return(nil).Once()
+	mockConsumer.On("ReadMessage", mock.AnythingOfType("time.Duration")).Return(nil, kafka.NewError(kafka.ErrTimedOut, "timed out", false)).Maybe()
+	mockConsumer.On("Close").Return(nil).Maybe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		consumer.Consume(ctx)
+		close(done)
+	}()
+
+	assert.Eventually(t, readiness.Ready, time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+	assert.False(t, readiness.Ready())
+}
+
+func TestPostHogKafkaConsumer_ReadRetriesOnDisconnect(t *testing.T) {
+	mockConsumer := mocks.NewKafkaConsumerInterface(t)
+	clock := newFakeClock()
+
+	consumer := &PostHogKafkaConsumer{
+		consumer:     mockConsumer,
+		topics:       []string{"test-topic"},
+		outgoingChan: make(chan PostHogEvent),
+		statsChan:    make(chan PostHogEvent),
+		MaxRetries:   2,
+		clock:        clock,
+	}
+
+	readErr := kafka.NewError(kafka.ErrAllBrokersDown, "all brokers down", false)
+	mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.AnythingOfType("kafka.RebalanceCb")).Return(nil).Once()
+	mockConsumer.On("ReadMessage", kafkaReadTimeout).Return(nil, kafka.NewError(kafka.ErrTimedOut, "timed out", false)).Once()
+	mockConsumer.On("ReadMessage", kafkaReadTimeout).Return(nil, readErr).Times(3)
+	mockConsumer.On("Close").Return(nil).Once()
+
+	err := consumer.Consume(context.Background())
+
+	assert.ErrorIs(t, err, readErr)
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, time.Second}, clock.Waits())
+}
+
+func TestPostHogKafkaConsumer_BatchesBySize(t *testing.T) {
+	mockConsumer := new(mocks.KafkaConsumerInterface)
+
+	batchChan := make(chan []PostHogEvent, 2)
+	statsChan := make(chan PostHogEvent, 10)
+	consumer := &PostHogKafkaConsumer{
+		consumer:     mockConsumer,
+		topics:       []string{"test-topic"},
+		outgoingChan: make(chan PostHogEvent),
+		statsChan:    statsChan,
+	}
+	consumer.EnableBatching(batchChan, 2, time.Minute)
+
+	topic := "test-topic"
+	for i := 0; i < 4; i++ {
+		msg := &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Offset: kafka.Offset(i)},
+			Value:          []byte(fmt.Sprintf(`{"uuid": "uuid-%d", "data": "{\"event\": \"test-event\"}", "token": "test-token"}`, i)),
+		}
+		mockConsumer.On("ReadMessage", mock.Anything).Return(msg, nil).Once()
+	}
+	mockConsumer.EXPECT().ReadMessage(mock.Anything).
+		RunAndReturn(func(time.Duration) (*kafka.Message, error) { select {} }).Maybe()
+	mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.AnythingOfType("kafka.RebalanceCb")).Return(nil)
+	mockConsumer.On("CommitMessage", mock.Anything).Return(nil, nil)
+
+	go consumer.Consume(context.Background())
+
+	for _, want := range [][]string{{"uuid-0", "uuid-1"}, {"uuid-2", "uuid-3"}} {
+		select {
+		case batch := <-batchChan:
+			require.Len(t, batch, 2)
+			assert.Equal(t, want, []string{batch[0].Uuid, batch[1].Uuid})
+		case <-time.After(time.Second):
+			t.Fatal("Timed out waiting for batch")
+		}
+	}
+	assert.Eventually(t, func() bool { return len(statsChan) == 4 }, time.Second, 10*time.Millisecond)
+}
+
+func TestPostHogKafkaConsumer_BatchFlushInterval(t *testing.T) {
+	mockConsumer := new(mocks.KafkaConsumerInterface)
+	clock := newFakeClock()
+
+	batchChan := make(chan []PostHogEvent, 1)
+	consumer := &PostHogKafkaConsumer{
+		consumer:     mockConsumer,
+		topics:       []string{"test-topic"},
+		outgoingChan: make(chan PostHogEvent),
+		statsChan:    make(chan PostHogEvent, 10),
+		clock:        clock,
+	}
+	consumer.EnableBatching(batchChan, 10, time.Second)
+
+	testMessage := &kafka.Message{
+		Value: []byte(`{"data": "{\"event\": \"test-event\"}", "token": "test-token"}`),
+	}
+	mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.AnythingOfType("kafka.RebalanceCb")).Return(nil)
+	mockConsumer.On("ReadMessage", mock.Anything).Return(testMessage, nil).Twice()
+	mockConsumer.On("ReadMessage", mock.Anything).Return(nil, kafka.NewError(kafka.ErrTimedOut, "timed out", false))
+	mockConsumer.On("CommitMessage", mock.Anything).Return(nil, nil)
+	mockConsumer.On("Close").Return(nil).Maybe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Consume(ctx)
+
+	select {
+	case <-batchChan:
+		t.Fatal("Partial batch flushed before the interval elapsed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+
+	select {
+	case batch := <-batchChan:
+		assert.Len(t, batch, 2)
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for partial batch")
+	}
+}
+
+// replayConsumer serves the same message a fixed number of times and then
+// only times out, without the bookkeeping overhead of a mock.
+type replayConsumer struct {
+	*mocks.KafkaConsumerInterface
+	msg       *kafka.Message
+	remaining atomic.Int64
+}
+
+func (r *replayConsumer) SubscribeTopics([]string, kafka.RebalanceCb) error {
+	return nil
+}
+
+func (r *replayConsumer) ReadMessage(time.Duration) (*kafka.Message, error) {
+	if r.remaining.Add(-1) < 0 {
+		return nil, kafka.NewError(kafka.ErrTimedOut, "timed out", false)
+	}
+	return r.msg, nil
+}
+
+func (r *replayConsumer) CommitMessage(*kafka.Message) ([]kafka.TopicPartition, error) {
+	return nil, nil
+}
+
+func (r *replayConsumer) Close() error {
+	return nil
+}
+
+func benchmarkConsume(b *testing.B, batchSize int) {
+	source := &replayConsumer{
+		msg: &kafka.Message{
+			Value: []byte(`{"uuid": "test-uuid", "distinct_id": "user", "data": "{\"event\": \"$pageview\", \"properties\": {\"$current_url\": \"https://example.com\"}}", "token": "test-token"}`),
+		},
+	}
+	source.remaining.Store(int64(b.N))
+
+	// Unbuffered, like the channels main wires up.
+	outgoingChan := make(chan PostHogEvent)
+	statsChan := make(chan PostHogEvent)
+	consumer := &PostHogKafkaConsumer{
+		consumer:     source,
+		topics:       []string{"test-topic"},
+		outgoingChan: outgoingChan,
+		statsChan:    statsChan,
+		CommitEvery:  1000,
+	}
+
+	var batchChan chan []PostHogEvent
+	if batchSize > 0 {
+		batchChan = make(chan []PostHogEvent)
+		consumer.EnableBatching(batchChan, batchSize, time.Millisecond)
+	}
+
+	go func() {
+		for range statsChan {
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	go consumer.Consume(ctx)
+
+	for received := 0; received < b.N; {
+		select {
+		case <-outgoingChan:
+			received++
+		case batch := <-batchChan:
+			received += len(batch)
+		}
+	}
+}
+
+func BenchmarkConsume_PerMessage(b *testing.B) {
+	benchmarkConsume(b, 0)
+}
+
+func BenchmarkConsume_Batched(b *testing.B) {
+	benchmarkConsume(b, 100)
+}
+
+func TestPostHogKafkaConsumer_Lag(t *testing.T) {
+	mockConsumer := mocks.NewKafkaConsumerInterface(t)
+	consumer := &PostHogKafkaConsumer{consumer: mockConsumer}
+
+	topic := "test-topic"
+	assigned := []kafka.TopicPartition{
+		{Topic: &topic, Partition: 0},
+		{Topic: &topic, Partition: 1},
+		{Topic: &topic, Partition: 2},
+	}
+	mockConsumer.On("Assignment").Return(assigned, nil)
+	mockConsumer.On("Committed", assigned, lagQueryTimeoutMs).Return([]kafka.TopicPartition{
+		{Topic: &topic, Partition: 0, Offset: 90},
+		{Topic: &topic, Partition: 1, Offset: 500},
+		{Topic: &topic, Partition: 2, Offset: kafka.OffsetInvalid},
+	}, nil)
+	mockConsumer.On("QueryWatermarkOffsets", topic, int32(0), lagQueryTimeoutMs).Return(int64(0), int64(100), nil)
+	mockConsumer.On("QueryWatermarkOffsets", topic, int32(1), lagQueryTimeoutMs).Return(int64(0), int64(525), nil)
+
+	lag, err := consumer.Lag()
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(35), lag)
+}
+
+func TestPostHogKafkaConsumer_LagNoAssignment(t *testing.T) {
+	mockConsumer := mocks.NewKafkaConsumerInterface(t)
+	consumer := &PostHogKafkaConsumer{consumer: mockConsumer}
+
+	mockConsumer.On("Assignment").Return([]kafka.TopicPartition{}, nil)
+
+	lag, err := consumer.Lag()
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), lag)
+}
+
+func TestPostHogKafkaConsumer_LagError(t *testing.T) {
+	mockConsumer := mocks.NewKafkaConsumerInterface(t)
+	consumer := &PostHogKafkaConsumer{consumer: mockConsumer}
+
+	topic := "test-topic"
+	assigned := []kafka.TopicPartition{{Topic: &topic, Partition: 0}}
+	mockConsumer.On("Assignment").Return(assigned, nil)
+	mockConsumer.On("Committed", assigned, lagQueryTimeoutMs).Return(nil, errors.New("coordinator unavailable"))
+
+	_, err := consumer.Lag()
+
+	assert.EqualError(t, err, "coordinator unavailable")
+}
+
+func TestPostHogKafkaConsumer_RecordLag(t *testing.T) {
+	mockConsumer := mocks.NewKafkaConsumerInterface(t)
+	consumer := &PostHogKafkaConsumer{consumer: mockConsumer, clock: newFakeClock()}
+
+	topic := "test-topic"
+	assigned := []kafka.TopicPartition{{Topic: &topic, Partition: 0}}
+	ctx, cancel := context.WithCancel(context.Background())
+	mockConsumer.On("Assignment").Return(assigned, nil)
+	mockConsumer.On("Committed", assigned, lagQueryTimeoutMs).Return([]kafka.TopicPartition{{Topic: &topic, Partition: 0, Offset: 10}}, nil)
+	mockConsumer.On("QueryWatermarkOffsets", topic, int32(0), lagQueryTimeoutMs).Return(int64(0), int64(52), nil).
+		Run(func(mock.Arguments) { cancel() })
+
+	consumer.RecordLag(ctx, time.Second)
+
+	assert.Equal(t, float64(42), testutil.ToFloat64(consumerLag))
+}
+
 func TestPostHogKafkaConsumer_Close(t *testing.T) {
 	mockConsumer := new(mocks.KafkaConsumerInterface)
 	consumer := &PostHogKafkaConsumer{
 		consumer: mockConsumer,
 	}
 
-	mockConsumer.On("Close").Return(nil)
+	mockConsumer.On("Close").Return(nil).Once()
 
 	consumer.Close()
 
 	mockConsumer.AssertExpectations(t)
 }
+
+func TestPostHogKafkaConsumer_CloseTwice(t *testing.T) {
+	mockConsumer := new(mocks.KafkaConsumerInterface)
+	outgoingChan := make(chan PostHogEvent)
+	statsChan := make(chan PostHogEvent)
+	consumer := &PostHogKafkaConsumer{
+		consumer:     mockConsumer,
+		outgoingChan: outgoingChan,
+		statsChan:    statsChan,
+	}
+
+	mockConsumer.On("Close").Return(nil).Once()
+
+	assert.NotPanics(t, func() {
+		consumer.Close()
+		consumer.Close()
+	})
+
+	_, ok := <-outgoingChan
+	assert.False(t, ok)
+	// A consumer that has been closed does not start again.
+	assert.NoError(t, consumer.Consume(context.Background()))
+	mockConsumer.AssertExpectations(t)
+}
+
+func TestPostHogKafkaConsumer_CloseWhileSending(t *testing.T) {
+	mockConsumer := new(mocks.KafkaConsumerInterface)
+	// Nobody reads outgoingChan, so Consume is stuck sending the first event.
+	outgoingChan := make(chan PostHogEvent)
+	statsChan := make(chan PostHogEvent, 10)
+	consumer := &PostHogKafkaConsumer{
+		consumer:     mockConsumer,
+		topics:       []string{"test-topic"},
+		geolocator:   NoOpGeoLocator{},
+		outgoingChan: outgoingChan,
+		statsChan:    statsChan,
+	}
+
+	topic := "test-topic"
+	msg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic},
+		Value:          []byte(`{"uuid": "1", "token": "test-token", "data": "{\"event\": \"$pageview\", \"properties\": {}}"}`),
+	}
+	reading := make(chan struct{})
+	var once sync.Once
+	mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.Anything).Return(nil)
+	mockConsumer.On("ReadMessage", mock.Anything).Return(msg, nil).Run(func(mock.Arguments) { once.Do(func() { close(reading) }) })
+	mockConsumer.On("Close").Return(nil).Once()
+
+	done := make(chan error)
+	go func() { done <- consumer.Consume(context.Background()) }()
+	<-reading
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			consumer.Close()
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Consume did not return after Close")
+	}
+	_, ok := <-outgoingChan
+	assert.False(t, ok)
+	mockConsumer.AssertExpectations(t)
+}
+
+func TestKafkaConfigMap(t *testing.T) {
+	config := kafkaConfigMap("localhost:9092", "PLAINTEXT", SASLConfig{}, TLSConfig{}, OffsetConfig{}, "livestream")
+
+	assert.Equal(t, kafka.ConfigMap{
+		"bootstrap.servers":  "localhost:9092",
+		"group.id":           "livestream",
+		"auto.offset.reset":  "latest",
+		"enable.auto.commit": false,
+		"security.protocol":  "PLAINTEXT",
+	}, *config)
+}
+
+func TestKafkaConfigMapOffsets(t *testing.T) {
+	offsets := OffsetConfig{AutoOffsetReset: "earliest", EnableAutoCommit: true}
+	config := kafkaConfigMap("localhost:9092", "PLAINTEXT", SASLConfig{}, TLSConfig{}, offsets, "livestream")
+
+	assert.Equal(t, "earliest", (*config)["auto.offset.reset"])
+	assert.Equal(t, true, (*config)["enable.auto.commit"])
+}
+
+func TestKafkaConfigMapSASL(t *testing.T) {
+	sasl := SASLConfig{Mechanism: "SCRAM-SHA-512", Username: "livestream", Password: "hunter2"}
+	config := kafkaConfigMap("kafka:9096", "SASL_SSL", sasl, TLSConfig{}, OffsetConfig{}, "livestream")
+
+	assert.Equal(t, "SASL_SSL", (*config)["security.protocol"])
+	assert.Equal(t, "SCRAM-SHA-512", (*config)["sasl.mechanism"])
+	assert.Equal(t, "livestream", (*config)["sasl.username"])
+	assert.Equal(t, "hunter2", (*config)["sasl.password"])
+}
+
+func TestKafkaConfigMapTLS(t *testing.T) {
+	tls := TLSConfig{
+		CALocation:                      "/etc/kafka/ca.pem",
+		CertificateLocation:             "/etc/kafka/client.pem",
+		KeyLocation:                     "/etc/kafka/client.key",
+		EndpointIdentificationAlgorithm: "https",
+	}
+	config := kafkaConfigMap("kafka:9093", "SSL", SASLConfig{}, tls, OffsetConfig{}, "livestream")
+
+	assert.Equal(t, "SSL", (*config)["security.protocol"])
+	assert.Equal(t, "/etc/kafka/ca.pem", (*config)["ssl.ca.location"])
+	assert.Equal(t, "/etc/kafka/client.pem", (*config)["ssl.certificate.location"])
+	assert.Equal(t, "/etc/kafka/client.key", (*config)["ssl.key.location"])
+	assert.Equal(t, "https", (*config)["ssl.endpoint.identification.algorithm"])
+
+	// Only the settings given are passed on.
+	config = kafkaConfigMap("kafka:9093", "SSL", SASLConfig{}, TLSConfig{CALocation: "/etc/kafka/ca.pem"}, OffsetConfig{}, "livestream")
+	assert.Equal(t, "/etc/kafka/ca.pem", (*config)["ssl.ca.location"])
+	assert.NotContains(t, *config, "ssl.certificate.location")
+	assert.NotContains(t, *config, "ssl.endpoint.identification.algorithm")
+}
+
+func TestSASLConfigRedactsPassword(t *testing.T) {
+	sasl := SASLConfig{Mechanism: "SCRAM-SHA-512", Username: "livestream", Password: "hunter2"}
+
+	for _, formatted := range []string{fmt.Sprint(sasl), fmt.Sprintf("%v", sasl), fmt.Sprintf("%+v", sasl), fmt.Sprintf("%#v", sasl), fmt.Sprintf("%+v", Config{SASL: sasl})} {
+		assert.NotContains(t, formatted, "hunter2")
+		assert.Contains(t, formatted, "livestream")
+	}
+}
+
+func TestPostHogKafkaConsumer_NoOpGeoLocator(t *testing.T) {
+	consumer := &PostHogKafkaConsumer{geolocator: NoOpGeoLocator{}}
+	consumer.EnableDeadLetters(make(chan DeadLetterEvent, 1))
+
+	phEvent := consumer.parseMessage(&kafka.Message{
+		Value: []byte(`{"uuid": "test-uuid", "ip": "81.2.69.142", "data": "{\"event\": \"$pageview\"}", "token": "test-token"}`),
+	})
+
+	assert.Equal(t, "$pageview", phEvent.Event)
+	assert.Zero(t, phEvent.Lat)
+	assert.Zero(t, phEvent.Lng)
+	assert.Empty(t, consumer.deadLetterChan)
+}
+
+// fakeKafkaConsumer serves messages from in-memory partitions, starting each
+// partition from wherever Assign seeked it to.
+type fakeKafkaConsumer struct {
+	mocks.KafkaConsumerInterface
+	topic      string
+	partitions [][]*kafka.Message
+	positions  map[int32]int64
+	next       int
+	committed  int
+}
+
+func newFakeKafkaConsumer(topic string, start time.Time, partitions ...[]string) *fakeKafkaConsumer {
+	f := &fakeKafkaConsumer{topic: topic}
+	for p, uuids := range partitions {
+		var msgs []*kafka.Message
+		for offset, uuid := range uuids {
+			value, _ := json.Marshal(PostHogEventWrapper{Uuid: uuid, Ip: "192.0.2.1", Token: "token", Data: `{"event": "$pageview"}`})
+			msgs = append(msgs, &kafka.Message{
+				TopicPartition: kafka.TopicPartition{Topic: &f.topic, Partition: int32(p), Offset: kafka.Offset(offset)},
+				Value:          value,
+				Timestamp:      start.Add(time.Duration(offset) * time.Minute),
+			})
+		}
+		f.partitions = append(f.partitions, msgs)
+	}
+	return f
+}
+
+func (f *fakeKafkaConsumer) GetMetadata(topic *string, allTopics bool, timeoutMs int) (*kafka.Metadata, error) {
+	metadata := kafka.TopicMetadata{Topic: f.topic}
+	for p := range f.partitions {
+		metadata.Partitions = append(metadata.Partitions, kafka.PartitionMetadata{ID: int32(p)})
+	}
+	return &kafka.Metadata{Topics: map[string]kafka.TopicMetadata{f.topic: metadata}}, nil
+}
+
+func (f *fakeKafkaConsumer) OffsetsForTimes(times []kafka.TopicPartition, timeoutMs int) ([]kafka.TopicPartition, error) {
+	offsets := make([]kafka.TopicPartition, len(times))
+	for i, tp := range times {
+		offsets[i] = tp
+		offsets[i].Offset = kafka.OffsetEnd
+		for _, msg := range f.partitions[tp.Partition] {
+			if msg.Timestamp.UnixMilli() >= int64(tp.Offset) {
+				offsets[i].Offset = msg.TopicPartition.Offset
+				break
+			}
+		}
+	}
+	return offsets, nil
+}
+
+func (f *fakeKafkaConsumer) QueryWatermarkOffsets(topic string, partition int32, timeoutMs int) (int64, int64, error) {
+	return 0, int64(len(f.partitions[partition])), nil
+}
+
+func (f *fakeKafkaConsumer) Assign(partitions []kafka.TopicPartition) error {
+	f.positions = make(map[int32]int64)
+	for _, tp := range partitions {
+		switch tp.Offset {
+		case kafka.OffsetEnd:
+			f.positions[tp.Partition] = int64(len(f.partitions[tp.Partition]))
+		case kafka.OffsetBeginning:
+			f.positions[tp.Partition] = 0
+		default:
+			f.positions[tp.Partition] = int64(tp.Offset)
+		}
+	}
+	return nil
+}
+
+// SubscribeTopics assigns every partition from its first message.
+func (f *fakeKafkaConsumer) SubscribeTopics(topics []string, rebalanceCb kafka.RebalanceCb) error {
+	f.positions = make(map[int32]int64)
+	for p := range f.partitions {
+		f.positions[int32(p)] = 0
+	}
+	return nil
+}
+
+// ReadMessage reads the assigned partitions round-robin, reporting a timeout
+// once all of them are exhausted.
+func (f *fakeKafkaConsumer) ReadMessage(timeout time.Duration) (*kafka.Message, error) {
+	for range f.partitions {
+		p := f.next
+		f.next = (f.next + 1) % len(f.partitions)
+
+		position, ok := f.positions[int32(p)]
+		if !ok || position >= int64(len(f.partitions[p])) {
+			continue
+		}
+		f.positions[int32(p)]++
+		return f.partitions[p][position], nil
+	}
+	return nil, kafka.NewError(kafka.ErrTimedOut, "timed out", false)
+}
+
+func (f *fakeKafkaConsumer) CommitMessage(msg *kafka.Message) ([]kafka.TopicPartition, error) {
+	f.committed++
+	return nil, nil
+}
+
+func (f *fakeKafkaConsumer) Close() error {
+	return nil
+}
+
+func TestPostHogKafkaConsumer_KafkaPosition(t *testing.T) {
+	fake := newFakeKafkaConsumer("events", time.Now(), []string{"a0", "a1"}, []string{"b0", "b1", "b2"})
+	consumer := &PostHogKafkaConsumer{
+		consumer:     fake,
+		topics:       []string{"events"},
+		geolocator:   NoOpGeoLocator{},
+		outgoingChan: make(chan PostHogEvent),
+		statsChan:    make(chan PostHogEvent, 10),
+	}
+
+	positions := make(map[string][2]int64)
+	for _, event := range consumeAll(t, consumer, 5) {
+		assert.Equal(t, "events", event.Topic)
+		positions[event.Uuid] = [2]int64{int64(event.Partition), event.Offset}
+	}
+	assert.Equal(t, map[string][2]int64{
+		"a0": {0, 0}, "a1": {0, 1},
+		"b0": {1, 0}, "b1": {1, 1}, "b2": {1, 2},
+	}, positions)
+}
+
+func TestPostHogKafkaConsumer_PartitionKey(t *testing.T) {
+	consumer := &PostHogKafkaConsumer{geolocator: NoOpGeoLocator{}}
+	value := []byte(`{"uuid": "1", "distinct_id": "user1", "token": "token", "data": "{\"event\": \"$pageview\"}"}`)
+
+	phEvent := consumer.parseMessage(&kafka.Message{Key: []byte("user1"), Value: value})
+	assert.Equal(t, "user1", phEvent.PartitionKey)
+
+	for _, key := range [][]byte{nil, {}} {
+		phEvent = consumer.parseMessage(&kafka.Message{Key: key, Value: value})
+		assert.Empty(t, phEvent.PartitionKey)
+	}
+}
+
+func TestPostHogKafkaConsumer_Replay(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	topic := "events"
+
+	tests := []struct {
+		name     string
+		opts     ReplayOptions
+		expected []string
+	}{
+		{
+			name:     "From timestamp to head",
+			opts:     ReplayOptions{Start: start.Add(2 * time.Minute)},
+			expected: []string{"a2", "a3", "b2"},
+		},
+		{
+			name:     "From timestamp to end timestamp",
+			opts:     ReplayOptions{Start: start.Add(time.Minute), End: start.Add(2 * time.Minute)},
+			expected: []string{"a1", "a2", "b1", "b2"},
+		},
+		{
+			name:     "From explicit offsets",
+			opts:     ReplayOptions{Offsets: []kafka.TopicPartition{{Topic: &topic, Partition: 1, Offset: 1}}},
+			expected: []string{"b1", "b2"},
+		},
+		{
+			name:     "From after the head",
+			opts:     ReplayOptions{Start: start.Add(time.Hour)},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeKafkaConsumer("events", start, []string{"a0", "a1", "a2", "a3"}, []string{"b0", "b1", "b2"})
+			outgoingChan := make(chan PostHogEvent, 10)
+			consumer := &PostHogKafkaConsumer{
+				consumer:     fake,
+				topics:       []string{"events"},
+				geolocator:   NoOpGeoLocator{},
+				outgoingChan: outgoingChan,
+				statsChan:    make(chan PostHogEvent, 10),
+			}
+
+			require.NoError(t, consumer.Replay(context.Background(), tt.opts))
+
+			var replayed []string
+			for event := range outgoingChan {
+				replayed = append(replayed, event.Uuid)
+			}
+			assert.ElementsMatch(t, tt.expected, replayed)
+			assert.Zero(t, fake.committed, "a replay must not move the group's offsets")
+		})
+	}
+}
+
+func TestPostHogKafkaConsumer_ReplayNeedsStart(t *testing.T) {
+	consumer := &PostHogKafkaConsumer{
+		consumer:     newFakeKafkaConsumer("events", time.Now()),
+		outgoingChan: make(chan PostHogEvent),
+		statsChan:    make(chan PostHogEvent),
+	}
+
+	assert.Error(t, consumer.Replay(context.Background(), ReplayOptions{}))
+}
+
+func TestPostHogKafkaConsumer_SessionContext(t *testing.T) {
+	tests := []struct {
+		name       string
+		properties string
+		sessionId  string
+		windowId   string
+	}{
+		{
+			name:       "Both",
+			properties: `{\"$session_id\": \"session1\", \"$window_id\": \"window1\"}`,
+			sessionId:  "session1",
+			windowId:   "window1",
+		},
+		{
+			name:       "Session only",
+			properties: `{\"$session_id\": \"session1\"}`,
+			sessionId:  "session1",
+		},
+		{
+			name:       "Missing",
+			properties: `{\"url\": \"https://example.com\"}`,
+		},
+		{
+			name:       "Not strings",
+			properties: `{\"$session_id\": 42, \"$window_id\": null}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consumer := &PostHogKafkaConsumer{geolocator: NoOpGeoLocator{}}
+			value := `{"uuid": "1", "token": "test-token", "data": "{\"event\": \"$pageview\", \"properties\": ` + tt.properties + `}"}`
+
+			phEvent := consumer.parseMessage(&kafka.Message{Value: []byte(value)})
+			assert.Equal(t, tt.sessionId, phEvent.SessionId)
+			assert.Equal(t, tt.windowId, phEvent.WindowId)
+			if tt.sessionId != "" {
+				assert.Equal(t, tt.sessionId, phEvent.Properties["$session_id"])
+			}
+		})
+	}
+
+	t.Run("No properties", func(t *testing.T) {
+		consumer := &PostHogKafkaConsumer{geolocator: NoOpGeoLocator{}}
+		phEvent := consumer.parseMessage(&kafka.Message{Value: []byte(`{"uuid": "1", "token": "test-token", "data": "{\"event\": \"$pageview\"}"}`)})
+		assert.Empty(t, phEvent.SessionId)
+		assert.Empty(t, phEvent.WindowId)
+	})
+}
+
+func TestPostHogKafkaConsumer_IPProperties(t *testing.T) {
+	tests := []struct {
+		name         string
+		ipProperties []string
+		foldCase     bool
+		properties   string
+		expected     string
+	}{
+		{name: "Default", properties: `{\"$ip\": \"192.0.2.1\"}`, expected: "192.0.2.1"},
+		{name: "Default falls back to wrapper", properties: `{\"client_ip\": \"192.0.2.1\"}`, expected: "198.51.100.1"},
+		{name: "Custom key", ipProperties: []string{"client_ip"}, properties: `{\"client_ip\": \"192.0.2.1\", \"$ip\": \"192.0.2.2\"}`, expected: "192.0.2.1"},
+		{name: "Tried in order", ipProperties: []string{"client_ip", "$ip"}, properties: `{\"$ip\": \"192.0.2.2\"}`, expected: "192.0.2.2"},
+		{name: "Wrapper last", ipProperties: []string{"client_ip", "$ip"}, properties: `{}`, expected: "198.51.100.1"},
+		{name: "Forwarded list", properties: `{\"$ip\": \"unknown, 192.0.2.1, 198.51.100.2\"}`, expected: "192.0.2.1"},
+		{name: "Discarded", ipProperties: []string{"client_ip", "$ip"}, properties: `{\"client_ip\": null, \"$ip\": \"192.0.2.2\"}`, expected: ""},
+		{name: "Other case", properties: `{\"$IP\": \"192.0.2.1\"}`, expected: "198.51.100.1"},
+		{name: "Other case folded", foldCase: true, properties: `{\"$IP\": \"192.0.2.1\"}`, expected: "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockGeoLocator := mocks.NewGeoLocator(t)
+			if tt.expected != "" {
+				mockGeoLocator.On("Lookup", tt.expected).Return(37.7749, -122.4194, nil).Once()
+			}
+			consumer := &PostHogKafkaConsumer{geolocator: mockGeoLocator, IPProperties: tt.ipProperties, FoldPropertyKeys: tt.foldCase}
+			value := `{"uuid": "1", "ip": "198.51.100.1", "token": "test-token", "data": "{\"event\": \"$pageview\", \"properties\": ` + tt.properties + `}"}`
+
+			phEvent := consumer.parseMessage(&kafka.Message{Value: []byte(value)})
+			if tt.expected != "" {
+				assert.Equal(t, 37.7749, phEvent.Lat)
+			} else {
+				assert.Zero(t, phEvent.Lat)
+			}
+		})
+	}
+}
+
+func TestPostHogKafkaConsumer_ParseMessageShapes(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{
+			name:  "Wrapped",
+			value: `{"uuid": "test-uuid", "distinct_id": "user1", "ip": "192.0.2.1", "token": "test-token", "data": "{\"event\": \"$pageview\", \"properties\": {\"url\": \"https://example.com\"}}"}`,
+		},
+		{
+			name:  "Bare",
+			value: `{"uuid": "test-uuid", "distinct_id": "user1", "ip": "192.0.2.1", "api_key": "test-token", "event": "$pageview", "properties": {"url": "https://example.com"}}`,
+		},
+		{
+			name:  "Bare with non-string data",
+			value: `{"uuid": "test-uuid", "distinct_id": "user1", "ip": "192.0.2.1", "api_key": "test-token", "event": "$pageview", "properties": {"url": "https://example.com"}, "data": {"extra": true}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockGeoLocator := new(mocks.GeoLocator)
+			mockGeoLocator.On("Lookup", "192.0.2.1").Return(37.7749, -122.4194, nil)
+			consumer := &PostHogKafkaConsumer{geolocator: mockGeoLocator}
+			deadLetters := make(chan DeadLetterEvent, 2)
+			consumer.EnableDeadLetters(deadLetters)
+
+			phEvent := consumer.parseMessage(&kafka.Message{Value: []byte(tt.value)})
+
+			assert.Equal(t, "test-uuid", phEvent.Uuid)
+			assert.Equal(t, "user1", phEvent.DistinctId)
+			assert.Equal(t, "test-token", phEvent.Token)
+			assert.Equal(t, "$pageview", phEvent.Event)
+			assert.Equal(t, "https://example.com", phEvent.Properties["url"])
+			assert.Equal(t, 37.7749, phEvent.Lat)
+			assert.Empty(t, deadLetters)
+		})
+	}
+}
+
+func TestPostHogKafkaConsumer_InvalidTokens(t *testing.T) {
+	mockConsumer := new(mocks.KafkaConsumerInterface)
+	outgoingChan := make(chan PostHogEvent, 10)
+	deadLetters := make(chan DeadLetterEvent, 10)
+	consumer := &PostHogKafkaConsumer{
+		consumer:     mockConsumer,
+		topics:       []string{"test-topic"},
+		geolocator:   NoOpGeoLocator{},
+		outgoingChan: outgoingChan,
+		statsChan:    make(chan PostHogEvent, 10),
+		Tokens:       &TokenNormalizer{MaxLength: maxTokenLength, Pattern: tokenPattern},
+	}
+	consumer.EnableDeadLetters(deadLetters)
+	noToken := make(chan PostHogEvent, 10)
+	consumer.RouteNoToken(noToken)
+
+	topic := "test-topic"
+	message := func(offset int, token string) *kafka.Message {
+		value, _ := json.Marshal(PostHogEventWrapper{Uuid: fmt.Sprint(offset), Token: token, Data: `{"event": "$pageview"}`})
+		return &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Offset: kafka.Offset(offset)}, Value: value}
+	}
+	messages := []*kafka.Message{
+		message(0, " phc_padded\t"),
+		message(1, ""),
+		message(2, "phc_bad token!"),
+		message(3, "phc_valid"),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.Anything).Return(nil)
+	for _, msg := range messages {
+		mockConsumer.On("ReadMessage", mock.Anything).Return(msg, nil).Once()
+	}
+	mockConsumer.On("ReadMessage", mock.Anything).Run(func(mock.Arguments) { cancel() }).Return(nil, kafka.NewError(kafka.ErrTimedOut, "timed out", false))
+	mockConsumer.On("CommitMessage", mock.Anything).Return(nil, nil)
+	mockConsumer.On("Close").Return(nil)
+
+	require.NoError(t, consumer.Consume(ctx))
+
+	var tokens []string
+	for event := range outgoingChan {
+		tokens = append(tokens, event.Token)
+	}
+	assert.Equal(t, []string{"phc_padded", "phc_valid"}, tokens)
+
+	var reasons []DeadLetterReason
+	var rejected []kafka.Offset
+	for dead := range deadLetters {
+		reasons = append(reasons, dead.Reason)
+		rejected = append(rejected, dead.Offset)
+	}
+	assert.Equal(t, []DeadLetterReason{NoToken, InvalidToken}, reasons)
+	assert.Equal(t, []kafka.Offset{1, 2}, rejected)
+
+	// An event without a token is not invalid, just unattributable.
+	var noTokenUuids []string
+	for event := range noToken {
+		noTokenUuids = append(noTokenUuids, event.Uuid)
+	}
+	assert.Equal(t, []string{"1"}, noTokenUuids)
+	// Rejected messages are still committed past.
+	mockConsumer.AssertCalled(t, "CommitMessage", messages[3])
+}
+
+func TestPostHogKafkaConsumer_ExistingGeoProperties(t *testing.T) {
+	mockGeoLocator := new(mocks.GeoLocator)
+	mockGeoLocator.On("Lookup", "192.0.2.1").Return(37.7749, -122.4194, nil).Once()
+	consumer := &PostHogKafkaConsumer{geolocator: mockGeoLocator}
+
+	enriched := consumer.parseMessage(&kafka.Message{
+		Value: []byte(`{"uuid": "1", "ip": "192.0.2.1", "token": "test-token", "data": "{\"event\": \"$pageview\", \"properties\": {\"$geoip_latitude\": 51.5142, \"$geoip_longitude\": -0.0931, \"$geoip_city_name\": \"London\"}}"}`),
+	})
+	assert.Equal(t, 51.5142, enriched.Lat)
+	assert.Equal(t, -0.0931, enriched.Lng)
+
+	plain := consumer.parseMessage(&kafka.Message{
+		Value: []byte(`{"uuid": "2", "ip": "192.0.2.1", "token": "test-token", "data": "{\"event\": \"$pageview\", \"properties\": {\"$geoip_city_name\": \"London\"}}"}`),
+	})
+	assert.Equal(t, 37.7749, plain.Lat)
+	assert.Equal(t, -122.4194, plain.Lng)
+
+	// Only the event without coordinates was looked up.
+	mockGeoLocator.AssertExpectations(t)
+}
+
+func TestPostHogKafkaConsumer_GeoNames(t *testing.T) {
+	locator, err := NewMaxMindGeoLocator("testdata/city.mmdb")
+	require.NoError(t, err)
+	consumer := &PostHogKafkaConsumer{geolocator: locator}
+
+	phEvent := consumer.parseMessage(&kafka.Message{
+		Value: []byte(`{"uuid": "1", "ip": "81.2.69.142", "token": "test-token", "data": "{\"event\": \"$pageview\"}"}`),
+	})
+
+	assert.Equal(t, 51.5142, phEvent.Lat)
+	assert.Equal(t, "London", phEvent.City)
+	assert.Equal(t, "England", phEvent.Region)
+	assert.Equal(t, "GB", phEvent.CountryCode)
+
+	geoEvent := convertToResponseGeoEvent(phEvent)
+	assert.Equal(t, "London", geoEvent.City)
+	assert.Equal(t, "GB", geoEvent.CountryCode)
+}
+
+func TestPostHogKafkaConsumer_DropsEventsWithoutToken(t *testing.T) {
+	consumer := &PostHogKafkaConsumer{geolocator: NoOpGeoLocator{}}
+
+	phEvent := consumer.parseMessage(&kafka.Message{Value: []byte(`{"uuid": "1", "data": "{\"event\": \"$pageview\"}"}`)})
+
+	assert.Empty(t, phEvent.Token)
+	assert.False(t, consumer.acceptToken(&kafka.Message{}, &phEvent))
+}
+
+func TestPostHogKafkaConsumer_NoProperties(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{name: "Missing", value: `{"uuid": "1", "token": "test-token", "data": "{\"event\": \"$pageview\"}"}`},
+		{name: "Null", value: `{"uuid": "1", "token": "test-token", "data": "{\"event\": \"$pageview\", \"properties\": null}"}`},
+		{name: "Empty", value: `{"uuid": "1", "token": "test-token", "data": "{\"event\": \"$pageview\", \"properties\": {}}"}`},
+		{name: "Bare with null", value: `{"uuid": "1", "api_key": "test-token", "event": "$pageview", "properties": null}`},
+		{name: "Undecodable", value: `{"uuid": "1", "token": "test-token", "data": "{\"event\": \"$pageview\", \"properties\": null"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consumer := &PostHogKafkaConsumer{geolocator: NoOpGeoLocator{}}
+
+			phEvent := consumer.parseMessage(&kafka.Message{Value: []byte(tt.value)})
+
+			require.NotNil(t, phEvent.Properties)
+			assert.Empty(t, phEvent.Properties)
+			assert.NotPanics(t, func() { phEvent.Properties["enriched"] = true })
+		})
+	}
+}
+
+func TestPostHogKafkaConsumer_MaxAge(t *testing.T) {
+	clock := newFakeClock()
+	consumer := &PostHogKafkaConsumer{geolocator: NoOpGeoLocator{}, clock: clock, MaxAge: 10 * time.Minute}
+
+	tests := []struct {
+		name      string
+		timestamp time.Time
+		accepted  bool
+	}{
+		{name: "Recent", timestamp: clock.Now().Add(-time.Minute), accepted: true},
+		{name: "Just inside", timestamp: clock.Now().Add(-10 * time.Minute), accepted: true},
+		{name: "Just outside", timestamp: clock.Now().Add(-10*time.Minute - time.Millisecond), accepted: false},
+		{name: "Future", timestamp: clock.Now().Add(time.Hour), accepted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(map[string]interface{}{"event": "$pageview", "timestamp": tt.timestamp})
+			require.NoError(t, err)
+			value, err := json.Marshal(PostHogEventWrapper{Uuid: "1", Token: "token", Data: string(data)})
+			require.NoError(t, err)
+			msg := &kafka.Message{Value: value}
+
+			before := testutil.ToFloat64(staleEvents)
+			phEvent := consumer.parseMessage(msg)
+			assert.Equal(t, tt.accepted, consumer.accept(msg, &phEvent))
+			if tt.accepted {
+				assert.Equal(t, before, testutil.ToFloat64(staleEvents))
+			} else {
+				assert.Equal(t, before+1, testutil.ToFloat64(staleEvents))
+			}
+		})
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		consumer := &PostHogKafkaConsumer{clock: clock}
+		phEvent := PostHogEvent{Token: "token", Timestamp: clock.Now().Add(-24 * time.Hour)}
+		assert.True(t, consumer.accept(&kafka.Message{}, &phEvent))
+	})
+}
+
+func TestPostHogKafkaConsumer_Headers(t *testing.T) {
+	protobuf := protobufEvent(t, "proto-uuid", "user1", "", "body-token", "$pageview", nil, time.UnixMilli(1714566600000))
+	jsonBody := []byte(`{"uuid": "json-uuid", "token": "body-token", "data": "{\"event\": \"$pageview\"}"}`)
+
+	tests := []struct {
+		name          string
+		decoder       Decoder
+		value         []byte
+		headers       []kafka.Header
+		expectedUuid  string
+		expectedToken string
+	}{
+		{
+			name:          "No headers",
+			value:         jsonBody,
+			expectedUuid:  "json-uuid",
+			expectedToken: "body-token",
+		},
+		{
+			name:          "Token header wins over body",
+			value:         jsonBody,
+			headers:       []kafka.Header{{Key: "token", Value: []byte("header-token")}},
+			expectedUuid:  "json-uuid",
+			expectedToken: "header-token",
+		},
+		{
+			name:          "Header names ignore case",
+			value:         jsonBody,
+			headers:       []kafka.Header{{Key: "Token", Value: []byte("header-token")}},
+			expectedUuid:  "json-uuid",
+			expectedToken: "header-token",
+		},
+		{
+			name:          "Empty token header is ignored",
+			value:         jsonBody,
+			headers:       []kafka.Header{{Key: "token", Value: []byte("")}},
+			expectedUuid:  "json-uuid",
+			expectedToken: "body-token",
+		},
+		{
+			name:          "Content type picks protobuf",
+			value:         protobuf,
+			headers:       []kafka.Header{{Key: "content-type", Value: []byte("application/x-protobuf")}},
+			expectedUuid:  "proto-uuid",
+			expectedToken: "body-token",
+		},
+		{
+			name:          "Content type wins over configured decoder",
+			decoder:       ProtobufDecoder{},
+			value:         jsonBody,
+			headers:       []kafka.Header{{Key: "Content-Type", Value: []byte("application/json; charset=utf-8")}, {Key: "token", Value: []byte("header-token")}},
+			expectedUuid:  "json-uuid",
+			expectedToken: "header-token",
+		},
+		{
+			name:          "Unknown content type uses configured decoder",
+			decoder:       ProtobufDecoder{},
+			value:         protobuf,
+			headers:       []kafka.Header{{Key: "content-type", Value: []byte("application/avro")}},
+			expectedUuid:  "proto-uuid",
+			expectedToken: "body-token",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consumer := &PostHogKafkaConsumer{geolocator: NoOpGeoLocator{}, Decoder: tt.decoder}
+			deadLetters := make(chan DeadLetterEvent, 1)
+			consumer.EnableDeadLetters(deadLetters)
+
+			phEvent := consumer.parseMessage(&kafka.Message{Value: tt.value, Headers: tt.headers})
+
+			assert.Equal(t, tt.expectedUuid, phEvent.Uuid)
+			assert.Equal(t, tt.expectedToken, phEvent.Token)
+			assert.Equal(t, "$pageview", phEvent.Event)
+			assert.Empty(t, deadLetters)
+		})
+	}
+}
+
+func TestPostHogKafkaConsumer_KeepRaw(t *testing.T) {
+	value := []byte(`{"uuid": "1",  "token": "test-token", "data": "{\"event\": \"$pageview\", \"properties\": {\"url\": \"https://example.com\"}}"}`)
+
+	consumer := &PostHogKafkaConsumer{geolocator: NoOpGeoLocator{}}
+	phEvent := consumer.parseMessage(&kafka.Message{Value: value})
+	assert.Nil(t, phEvent.Raw)
+	line, err := json.Marshal(phEvent)
+	require.NoError(t, err)
+	assert.NotContains(t, string(line), `"raw"`)
+
+	consumer.KeepRaw = true
+	phEvent = consumer.parseMessage(&kafka.Message{Value: value})
+	assert.Equal(t, value, []byte(phEvent.Raw))
+
+	// Encoded events carry it compacted, but otherwise unchanged.
+	line, err = json.Marshal(phEvent)
+	require.NoError(t, err)
+	var encoded struct {
+		Raw json.RawMessage `json:"raw"`
+	}
+	require.NoError(t, json.Unmarshal(line, &encoded))
+	assert.JSONEq(t, string(value), string(encoded.Raw))
+
+	// Decoding never sets it, neither from an encoded event nor from what a
+	// producer put in the event.
+	var decoded PostHogEvent
+	require.NoError(t, json.Unmarshal(line, &decoded))
+	assert.Nil(t, decoded.Raw)
+	forged := []byte(`{"uuid": "1", "token": "test-token", "data": "{\"event\": \"$pageview\", \"raw\": {\"event\": \"forged\"}}"}`)
+	consumer.KeepRaw = false
+	phEvent = consumer.parseMessage(&kafka.Message{Value: forged})
+	assert.Equal(t, "$pageview", phEvent.Event)
+	assert.Nil(t, phEvent.Raw)
+	consumer.KeepRaw = true
+
+	// Protobuf messages have no JSON to keep.
+	protobuf := protobufEvent(t, "proto-uuid", "user1", "", "test-token", "$pageview", nil, time.UnixMilli(1714566600000))
+	phEvent = consumer.parseMessage(&kafka.Message{Value: protobuf, Headers: []kafka.Header{{Key: "content-type", Value: []byte("application/x-protobuf")}}})
+	assert.Equal(t, "proto-uuid", phEvent.Uuid)
+	assert.Nil(t, phEvent.Raw)
+}
+
+func TestPostHogKafkaConsumer_Dedupe(t *testing.T) {
+	clock := newFakeClock()
+	consumer := &PostHogKafkaConsumer{geolocator: NoOpGeoLocator{}, clock: clock, Dedupe: NewDeduplicator(5*time.Minute, 0, clock)}
+	msg := &kafka.Message{Value: []byte(`{"uuid": "1", "token": "token", "data": "{\"event\": \"$pageview\"}"}`)}
+
+	accept := func() bool {
+		t.Helper()
+		phEvent := consumer.parseMessage(msg)
+		return consumer.accept(msg, &phEvent)
+	}
+
+	before := testutil.ToFloat64(duplicateEvents)
+	assert.True(t, accept())
+	clock.Advance(time.Minute)
+	assert.False(t, accept(), "redelivered within the window")
+	assert.Equal(t, before+1, testutil.ToFloat64(duplicateEvents))
+
+	clock.Advance(5 * time.Minute)
+	assert.True(t, accept(), "sent again after the window")
+	assert.Equal(t, before+1, testutil.ToFloat64(duplicateEvents))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
+)
+
+// serverFullRetryAfter is how long clients turned away by MaxConnections are
+// told to wait before reconnecting.
+const serverFullRetryAfter = 5 * time.Second
+
+// errServerFull is returned by Acquire when the server holds MaxConnections.
+var errServerFull = echo.NewHTTPError(http.StatusServiceUnavailable, "too many connections to this server")
+
+// ClientLimiter caps how many streaming connections a single IP or token can
+// hold open, and how fast each connection is sent events. Zero disables a
+// limit. A nil *ClientLimiter allows everything.
+type ClientLimiter struct {
+	PerIP           int
+	PerToken        int
+	EventsPerSecond float64
+	// MaxConnections caps the streaming connections of the whole server, so
+	// a rush of clients is turned away before it runs the process out of
+	// file descriptors.
+	MaxConnections int
+
+	mu     sync.Mutex
+	total  int
+	ips    map[string]int
+	tokens map[string]int
+}
+
+func NewClientLimiter(perIP int, perToken int, eventsPerSecond float64) *ClientLimiter {
+	return &ClientLimiter{
+		PerIP:           perIP,
+		PerToken:        perToken,
+		EventsPerSecond: eventsPerSecond,
+		ips:             make(map[string]int),
+		tokens:          make(map[string]int),
+	}
+}
+
+// Acquire takes a connection slot for ip and token, returning a 503 error if
+// the server is at MaxConnections and a 429 error if ip or token is at its
+// limit. Every successful Acquire must be paired with a Release once the
+// connection closes.
+func (l *ClientLimiter) Acquire(ip string, token string) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.MaxConnections > 0 && l.total >= l.MaxConnections {
+		return errServerFull
+	}
+	if l.PerIP > 0 && l.ips[ip] >= l.PerIP {
+		return echo.NewHTTPError(http.StatusTooManyRequests, "too many connections from this IP")
+	}
+	if token != "" && l.PerToken > 0 && l.tokens[token] >= l.PerToken {
+		return echo.NewHTTPError(http.StatusTooManyRequests, "too many connections for this token")
+	}
+
+	l.total++
+	l.ips[ip]++
+	if token != "" {
+		l.tokens[token]++
+	}
+	return nil
+}
+
+// clientIPExtractor reads the client IP the limits count. With no trusted
+// proxies it is the address of the connection, as X-Forwarded-For and
+// X-Real-IP can be forged to dodge the per-IP limit or use up someone else's.
+// Behind trusted proxies it is the nearest untrusted address in
+// X-Forwarded-For.
+func clientIPExtractor(trustedProxies []*net.IPNet) echo.IPExtractor {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range trustedProxies {
+		options = append(options, echo.TrustIPRange(proxy))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// acquire is Acquire for the client of c, telling it when to try again if
+// the server is full.
+func (l *ClientLimiter) acquire(c echo.Context, token string) error {
+	err := l.Acquire(c.RealIP(), token)
+	if errors.Is(err, errServerFull) {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(serverFullRetryAfter.Seconds())))
+	}
+	return err
+}
+
+// Connections returns how many connections hold a slot.
+func (l *ClientLimiter) Connections() int {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total
+}
+
+// Release frees the slot taken by Acquire. Counts that drop to zero are
+// removed so closed connections leave nothing behind.
+func (l *ClientLimiter) Release(ip string, token string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.total = max(l.total-1, 0)
+	decrement(l.ips, ip)
+	if token != "" {
+		decrement(l.tokens, token)
+	}
+}
+
+func decrement(counts map[string]int, key string) {
+	if counts[key] <= 1 {
+		delete(counts, key)
+		return
+	}
+	counts[key]--
+}
+
+// EventLimit returns a rate limiter for a new subscription, or nil when
+// events are not capped. It allows bursts of up to one second's worth.
+func (l *ClientLimiter) EventLimit() *rate.Limiter {
+	if l == nil || l.EventsPerSecond <= 0 {
+		return nil
+	}
+	burst := max(int(math.Ceil(l.EventsPerSecond)), 1)
+	return rate.NewLimiter(rate.Limit(l.EventsPerSecond), burst)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestClientLimiterPerIP(t *testing.T) {
+	limiter := NewClientLimiter(3, 0, 0)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, limiter.Acquire("192.0.2.1", "token"))
+	}
+
+	err := limiter.Acquire("192.0.2.1", "token")
+	var httpErr *echo.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusTooManyRequests, httpErr.Code)
+
+	// Other IPs are unaffected.
+	assert.NoError(t, limiter.Acquire("192.0.2.2", "token"))
+
+	limiter.Release("192.0.2.1", "token")
+	assert.NoError(t, limiter.Acquire("192.0.2.1", "token"))
+}
+
+func TestClientLimiterPerToken(t *testing.T) {
+	limiter := NewClientLimiter(0, 2, 0)
+
+	require.NoError(t, limiter.Acquire("192.0.2.1", "token1"))
+	require.NoError(t, limiter.Acquire("192.0.2.2", "token1"))
+	assert.Error(t, limiter.Acquire("192.0.2.3", "token1"))
+	assert.NoError(t, limiter.Acquire("192.0.2.3", "token2"))
+
+	// Connections without a token only count against their IP.
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, limiter.Acquire("192.0.2.4", ""))
+	}
+}
+
+func TestClientLimiterMaxConnections(t *testing.T) {
+	limiter := NewClientLimiter(0, 0, 0)
+	limiter.MaxConnections = 2
+
+	require.NoError(t, limiter.Acquire("192.0.2.1", "token1"))
+	require.NoError(t, limiter.Acquire("192.0.2.2", "token2"))
+
+	// The limit is for the whole server, whatever the IP and token.
+	err := limiter.Acquire("192.0.2.3", "token3")
+	var httpErr *echo.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusServiceUnavailable, httpErr.Code)
+	assert.Equal(t, 2, limiter.Connections())
+
+	limiter.Release("192.0.2.1", "token1")
+	assert.Equal(t, 1, limiter.Connections())
+	assert.NoError(t, limiter.Acquire("192.0.2.3", "token3"))
+}
+
+func TestClientLimiterReleaseCleansUp(t *testing.T) {
+	limiter := NewClientLimiter(5, 5, 0)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, limiter.Acquire("192.0.2.1", "token"))
+	}
+	for i := 0; i < 3; i++ {
+		limiter.Release("192.0.2.1", "token")
+	}
+
+	assert.Empty(t, limiter.ips)
+	assert.Empty(t, limiter.tokens)
+}
+
+func TestClientLimiterNil(t *testing.T) {
+	var limiter *ClientLimiter
+
+	assert.NoError(t, limiter.Acquire("192.0.2.1", "token"))
+	limiter.Release("192.0.2.1", "token")
+	assert.Nil(t, limiter.EventLimit())
+	assert.Zero(t, limiter.Connections())
+}
+
+func TestClientLimiterEventLimit(t *testing.T) {
+	assert.Nil(t, NewClientLimiter(0, 0, 0).EventLimit())
+
+	limit := NewClientLimiter(0, 0, 2.5).EventLimit()
+	require.NotNil(t, limit)
+	assert.Equal(t, rate.Limit(2.5), limit.Limit())
+	assert.Equal(t, 3, limit.Burst())
+}
+
+func TestWsHandlerConnectionLimit(t *testing.T) {
+	e := echo.New()
+	// Requests from httptest all come from 127.0.0.1.
+	e.GET("/ws", wsHandler(make(chan Subscription, 10), make(chan Subscription, 10), NewClientLimiter(2, 0, 0), nil))
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?geo=true"
+	for i := 0; i < 2; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		defer conn.Close()
+	}
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+func TestWsHandlerConnectionLimitIgnoresForwardedFor(t *testing.T) {
+	e := echo.New()
+	e.IPExtractor = clientIPExtractor(nil)
+	e.GET("/ws", wsHandler(make(chan Subscription, 10), make(chan Subscription, 10), NewClientLimiter(2, 0, 0), nil))
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	// A new forged address on every connection still counts as 127.0.0.1.
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?geo=true"
+	dial := func(ip string) (*websocket.Conn, *http.Response, error) {
+		return websocket.DefaultDialer.Dial(url, http.Header{"X-Forwarded-For": {ip}, "X-Real-Ip": {ip}})
+	}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		conn, _, err := dial(ip)
+		require.NoError(t, err)
+		defer conn.Close()
+	}
+
+	_, resp, err := dial("192.0.2.3")
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+func TestClientIPExtractor(t *testing.T) {
+	request := func(remoteAddr, forwardedFor string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/events", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		return req
+	}
+
+	direct := clientIPExtractor(nil)
+	assert.Equal(t, "10.0.0.1", direct(request("10.0.0.1:1234", "192.0.2.1")))
+
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	behindProxy := clientIPExtractor([]*net.IPNet{proxies})
+	assert.Equal(t, "192.0.2.1", behindProxy(request("10.0.0.1:1234", "192.0.2.1")))
+	// Only the proxies are trusted, not whoever connects.
+	assert.Equal(t, "198.51.100.1", behindProxy(request("198.51.100.1:1234", "192.0.2.1")))
+	// A forged entry in front of what the proxy appended is skipped.
+	assert.Equal(t, "192.0.2.1", behindProxy(request("10.0.0.1:1234", "203.0.113.9, 192.0.2.1")))
+}
+
+func TestFilterRunRateLimit(t *testing.T) {
+	subChan := make(chan Subscription)
+	unSubChan := make(chan Subscription)
+	inboundChan := make(chan PostHogEvent)
+
+	filter := NewFilter(subChan, unSubChan, inboundChan)
+	go filter.Run()
+	defer close(inboundChan)
+
+	eventChan := make(chan interface{}, 100)
+	subChan <- Subscription{
+		ClientId:    "1",
+		Token:       "token1",
+		RateLimit:   rate.NewLimiter(rate.Every(time.Hour), 5),
+		EventChan:   eventChan,
+		ShouldClose: &atomic.Bool{},
+	}
+
+	for i := 0; i < 20; i++ {
+		inboundChan <- PostHogEvent{Token: "token1", Event: "$pageview"}
+	}
+	// A round trip through the filter makes sure every event was handled.
+	unSubChan <- Subscription{ClientId: "1", Token: "token1"}
+
+	assert.Len(t, eventChan, 5)
+}
+
+func TestEventsHandlerMaxConnections(t *testing.T) {
+	viper.Set("jwt.secret", "test-secret")
+
+	limiter := NewClientLimiter(0, 0, 0)
+	limiter.MaxConnections = 2
+	e := echo.New()
+	e.GET("/events", eventsHandler(make(chan Subscription, 10), make(chan Subscription, 10), limiter, nil, nil, 0, realClock{}))
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	connect := func() *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+createProjectToken(t, 1, "test-token"))
+		resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	first := connect()
+	require.Equal(t, http.StatusOK, first.StatusCode)
+	second := connect()
+	require.Equal(t, http.StatusOK, second.StatusCode)
+	defer second.Body.Close()
+
+	rejected := connect()
+	rejected.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, rejected.StatusCode)
+	assert.Equal(t, "5", rejected.Header.Get("Retry-After"))
+	assert.Equal(t, 2, limiter.Connections())
+
+	// Closing a connection frees its slot.
+	first.Body.Close()
+	require.Eventually(t, func() bool { return limiter.Connections() == 1 }, time.Second, time.Millisecond)
+	third := connect()
+	defer third.Body.Close()
+	assert.Equal(t, http.StatusOK, third.StatusCode)
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"log"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/golang-lru/v2/expirable"
@@ -9,32 +9,82 @@ import (
 
 const (
 	COUNTER_TTL = time.Second * 60
+	// COUNTER_BUCKETS is how many slices COUNTER_TTL is split into for the
+	// rolling per-token counts.
+	COUNTER_BUCKETS = 60
+	// MAX_EVENT_NAMES bounds how many distinct event names each bucket of
+	// the top events counter tracks.
+	MAX_EVENT_NAMES = 1000
+	// UNIQUES_BUCKETS is kept small because every bucket holds a HyperLogLog
+	// per token.
+	UNIQUES_BUCKETS = 6
+	// UNKNOWN_COUNTRY is where events without a country code are counted.
+	UNKNOWN_COUNTRY = "unknown"
 )
 
 type Stats struct {
 	Store       map[string]*expirable.LRU[string, string]
 	GlobalStore *expirable.LRU[string, string]
 	Counter     *SlidingWindowCounter
+	TokenCounts *RollingCounts
+	EventCounts *RollingCounts
+	// CountryCounts counts events per ISO country code.
+	CountryCounts *RollingCounts
+	Uniques       *RollingUniques
+	// ActiveTokens, when set, tracks which tokens are sending events.
+	ActiveTokens *ActiveTokens
 }
 
-func newStatsKeeper() *Stats {
-	return &Stats{
-		Store:       make(map[string]*expirable.LRU[string, string]),
-		GlobalStore: expirable.NewLRU[string, string](0, nil, COUNTER_TTL),
-		Counter:     NewSlidingWindowCounter(COUNTER_TTL),
+// newStatsKeeper returns empty stats. hllPrecision sets the size of the
+// per-token unique user sketches, 2^hllPrecision bytes each.
+func newStatsKeeper(hllPrecision int) (*Stats, error) {
+	uniques, err := NewRollingUniques(COUNTER_TTL, UNIQUES_BUCKETS, hllPrecision, realClock{})
+	if err != nil {
+		return nil, err
 	}
+
+	stats := &Stats{
+		Store:         make(map[string]*expirable.LRU[string, string]),
+		GlobalStore:   expirable.NewLRU[string, string](0, nil, COUNTER_TTL),
+		Counter:       NewSlidingWindowCounter(COUNTER_TTL),
+		TokenCounts:   NewRollingCounts(COUNTER_TTL, COUNTER_BUCKETS, realClock{}),
+		EventCounts:   NewRollingCounts(COUNTER_TTL, COUNTER_BUCKETS, realClock{}),
+		CountryCounts: NewRollingCounts(COUNTER_TTL, COUNTER_BUCKETS, realClock{}),
+		Uniques:       uniques,
+	}
+	stats.EventCounts.MaxKeys = MAX_EVENT_NAMES
+	return stats, nil
+}
+
+// Write counts an event. Stats is run as a sink of the consumer's stats
+// channel rather than of the hub, so that batched events are counted too.
+func (ts *Stats) Write(event PostHogEvent) error {
+	ts.Counter.Increment()
+	ts.TokenCounts.Add(event.Token)
+	ts.EventCounts.Add(event.Event)
+	ts.CountryCounts.Add(countryKey(event.CountryCode))
+	ts.Uniques.Add(event.Token, event.DistinctId)
+	if ts.ActiveTokens != nil {
+		ts.ActiveTokens.Add(event.Token)
+	}
+	token := event.Token
+	if _, ok := ts.Store[token]; !ok {
+		ts.Store[token] = expirable.NewLRU[string, string](0, nil, COUNTER_TTL)
+	}
+	ts.Store[token].Add(event.DistinctId, "1")
+	ts.GlobalStore.Add(event.DistinctId, "1")
+	return nil
+}
+
+func (ts *Stats) Close() error {
+	return nil
 }
 
-func (ts *Stats) keepStats(statsChan chan PostHogEvent) {
-	log.Println("starting stats keeper...")
-
-	for event := range statsChan {
-		ts.Counter.Increment()
-		token := event.Token
-		if _, ok := ts.Store[token]; !ok {
-			ts.Store[token] = expirable.NewLRU[string, string](0, nil, COUNTER_TTL)
-		}
-		ts.Store[token].Add(event.DistinctId, "1")
-		ts.GlobalStore.Add(event.DistinctId, "1")
+// countryKey is the CountryCounts key for an event's country code.
+func countryKey(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return UNKNOWN_COUNTRY
 	}
+	return code
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+var logFormats = []string{"text", "json"}
+
+// parseLogLevel parses the log.level config value: debug, info, warn or error.
+func parseLogLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q", s)
+	}
+	return level, nil
+}
+
+// newLogger returns a logger writing records at level and above to w, as
+// logfmt-style text or as one JSON object per line.
+func newLogger(w io.Writer, level slog.Level, format string) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, opts))
+	}
+	return slog.New(slog.NewTextHandler(w, opts))
+}
+
+// messageAttrs identifies where a Kafka message came from in log records.
+func messageAttrs(msg *kafka.Message) []any {
+	topic := ""
+	if msg.TopicPartition.Topic != nil {
+		topic = *msg.TopicPartition.Topic
+	}
+	return []any{
+		slog.String("topic", topic),
+		slog.Int("partition", int(msg.TopicPartition.Partition)),
+		slog.Int64("offset", int64(msg.TopicPartition.Offset)),
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// logRecords decodes the records a JSON slog handler wrote to buf.
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for input, expected := range map[string]slog.Level{
+		"debug": slog.LevelDebug,
+		"INFO":  slog.LevelInfo,
+		" warn": slog.LevelWarn,
+		"error": slog.LevelError,
+	} {
+		level, err := parseLogLevel(input)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, level)
+	}
+
+	_, err := parseLogLevel("verbose")
+	assert.Error(t, err)
+}
+
+func TestDecodeErrorLogging(t *testing.T) {
+	topic := "test-topic"
+	msg := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 3, Offset: 42},
+		Value:          []byte(`{"uuid": "1", "token": "test-token", "data": "{\"event\": \"$pageview\", \"properties\": {\"email\": \"jane@example.com\""}`),
+	}
+
+	t.Run("Info", func(t *testing.T) {
+		var buf bytes.Buffer
+		consumer := &PostHogKafkaConsumer{geolocator: NoOpGeoLocator{}, logger: newLogger(&buf, slog.LevelInfo, "json")}
+
+		consumer.parseMessage(msg)
+
+		records := logRecords(t, &buf)
+		require.Len(t, records, 1)
+		assert.Equal(t, "WARN", records[0]["level"])
+		assert.Equal(t, "Error decoding message", records[0]["msg"])
+		assert.Equal(t, "test-topic", records[0]["topic"])
+		assert.Equal(t, 3.0, records[0]["partition"])
+		assert.Equal(t, 42.0, records[0]["offset"])
+		assert.NotEmpty(t, records[0]["error"])
+		assert.NotContains(t, buf.String(), "jane@example.com")
+	})
+
+	t.Run("Debug", func(t *testing.T) {
+		var buf bytes.Buffer
+		consumer := &PostHogKafkaConsumer{geolocator: NoOpGeoLocator{}, logger: newLogger(&buf, slog.LevelDebug, "json")}
+
+		consumer.parseMessage(msg)
+
+		records := logRecords(t, &buf)
+		require.Len(t, records, 2)
+		assert.Equal(t, "DEBUG", records[1]["level"])
+		assert.Equal(t, 42.0, records[1]["offset"])
+		assert.Contains(t, records[1]["data"], "jane@example.com")
+	})
+}
+
+func TestInvalidTokenLogging(t *testing.T) {
+	var buf bytes.Buffer
+	consumer := &PostHogKafkaConsumer{Tokens: &TokenNormalizer{MaxLength: maxTokenLength, Pattern: tokenPattern}, logger: newLogger(&buf, slog.LevelInfo, "json")}
+
+	topic := "test-topic"
+	msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Offset: 7}}
+	assert.False(t, consumer.acceptToken(msg, &PostHogEvent{Token: "bad token"}))
+
+	records := logRecords(t, &buf)
+	require.Len(t, records, 1)
+	assert.Equal(t, "WARN", records[0]["level"])
+	assert.Equal(t, "bad token", records[0]["token"])
+	assert.Equal(t, 7.0, records[0]["offset"])
+}
@@ -1,106 +1,234 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"strconv"
-	"strings"
-	"sync/atomic"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/getsentry/sentry-go"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/viper"
 )
 
 func main() {
-	loadConfigs()
+	loadConfigs(os.Args[1:])
 
-	isProd := viper.GetBool("prod")
+	build := buildInfo()
+	log.Printf("Starting livestream %s (commit %s, built %s)", build.Version, build.Commit, build.BuildTime)
 
-	err := sentry.Init(sentry.ClientOptions{
-		Dsn:              viper.GetString("sentry.dsn"),
-		Debug:            isProd,
-		AttachStacktrace: true,
-	})
-	if err != nil {
-		sentry.CaptureException(err)
-		log.Fatalf("sentry.Init: %s", err)
-	}
-	// Flush buffered events before the program terminates.
-	// Set the timeout to the maximum duration the program can afford to wait.
-	defer sentry.Flush(2 * time.Second)
+	if viper.GetBool("sentry.enabled") {
+		err := sentry.Init(sentryOptions(viper.GetViper()))
+		if err != nil {
+			log.Fatalf("sentry.Init: %s", err)
+		}
 
-	mmdb := viper.GetString("mmdb.path")
-	if mmdb == "" {
-		sentry.CaptureException(errors.New("mmdb.path must be set"))
-		log.Fatal("mmdb.path must be set")
-	}
-	brokers := viper.GetString("kafka.brokers")
-	if brokers == "" {
-		sentry.CaptureException(errors.New("kafka.brokers must be set"))
-		log.Fatal("kafka.brokers must be set")
+		// Flush buffered events before the program terminates.
+		// Set the timeout to the maximum duration the program can afford to wait.
+		defer sentry.Flush(2 * time.Second)
+	} else {
+		reporter.Disabled = true
+		log.Println("Sentry is disabled, errors are only logged")
 	}
-	topic := viper.GetString("kafka.topic")
-	if topic == "" {
-		sentry.CaptureException(errors.New("kafka.topic must be set"))
-		log.Fatal("kafka.topic must be set")
+	reporter.Interval = viper.GetDuration("sentry.dedupe_interval")
+
+	cfg, err := newConfig(viper.GetViper())
+	if err != nil {
+		captureException(err)
+		log.Fatalf("Invalid configuration:\n%v", err)
 	}
-	groupID := viper.GetString("kafka.group_id")
-	if groupID == "" {
-		sentry.CaptureException(errors.New("kafka.group_id must be set"))
-		log.Fatal("kafka.group_id must be set")
+	// The log package's output goes through this logger too.
+	slog.SetDefault(newLogger(os.Stderr, cfg.LogLevel, cfg.LogFormat))
+	mmdb := cfg.MMDBPath
+
+	readiness := &Readiness{}
+
+	var geolocator GeoLocator = NoOpGeoLocator{}
+	if mmdb != "" {
+		geolocator, err = newMaxMindGeoLocation(mmdb, cfg.MMDBFallbackPath, cfg.GeoIP)
+		if err != nil {
+			captureException(err)
+			log.Fatal(err)
+		}
+	} else {
+		log.Println("mmdb.path is not set, events will not be geolocated")
 	}
+	readiness.SetGeoIPLoaded(true)
 
-	geolocator, err := NewMaxMindGeoLocator(mmdb)
+	stats, err := newStatsKeeper(cfg.HLLPrecision)
 	if err != nil {
-		sentry.CaptureException(err)
-		log.Fatalf("Failed to open MMDB: %v", err)
+		captureException(err)
+		log.Fatalf("Failed to create stats keeper: %v", err)
 	}
 
-	stats := newStatsKeeper()
+	channelBuffer := cfg.ChannelBuffer
+
+	phEventChan := make(chan PostHogEvent, channelBuffer)
+	stats.ActiveTokens = NewActiveTokens(cfg.ActiveTokenTTL, cfg.MaxActiveTokens, cfg.PinnedTokens)
 
-	phEventChan := make(chan PostHogEvent)
-	statsChan := make(chan PostHogEvent)
+	statsChan := make(chan PostHogEvent, cfg.StatsBuffer)
 	subChan := make(chan Subscription)
 	unSubChan := make(chan Subscription)
 
-	go stats.keepStats(statsChan)
+	go runSink("stats", stats, statsChan, 0, realClock{})
 
-	kafkaSecurityProtocol := "SSL"
-	if !isProd {
-		kafkaSecurityProtocol = "PLAINTEXT"
+	var consumer *PostHogKafkaConsumer
+	if cfg.EventsFile != "" {
+		log.Printf("Reading events from %s instead of Kafka", cfg.EventsFile)
+		consumer, err = NewFileKafkaConsumer(cfg.EventsFile, cfg.EventsRealtime, geolocator, phEventChan, statsChan)
+	} else {
+		consumer, err = NewMultiTopicKafkaConsumer(cfg.Brokers, cfg.SecurityProtocol, cfg.SASL, cfg.TLS, cfg.Offsets, cfg.GroupID, cfg.Topics, geolocator, phEventChan, statsChan)
 	}
-	consumer, err := NewPostHogKafkaConsumer(brokers, kafkaSecurityProtocol, groupID, topic, geolocator, phEventChan, statsChan)
 	if err != nil {
-		sentry.CaptureException(err)
+		captureException(err)
 		log.Fatalf("Failed to create Kafka consumer: %v", err)
 	}
-	defer consumer.Close()
-	go consumer.Consume()
+	consumer.CommitEvery = cfg.Consumer.CommitEvery
+	consumer.MaxRetries = cfg.Consumer.MaxRetries
+	consumer.BackoffCap = cfg.Consumer.BackoffCap
+	consumer.Backpressure = cfg.Backpressure
+	consumer.StatsBackpressure = cfg.StatsBackpressure
+	consumer.Tokens = cfg.Tokens
+	consumer.DeepTokenScan = cfg.Consumer.DeepTokenScan
+	consumer.Decoder = cfg.Decoder
+	consumer.Avro = cfg.Avro
+	consumer.Transform = cfg.Transform
+	consumer.Workers = cfg.Consumer.Workers
+	consumer.GeoWorkers = cfg.Consumer.GeoWorkers
+	consumer.MaxAge = cfg.Consumer.MaxAge
+	consumer.MaxMessageSize = cfg.Consumer.MaxMessageSize
+	consumer.DecodeErrors = NewDecodeErrorMonitor(cfg.Consumer.DecodeErrorThreshold, cfg.Consumer.DecodeErrorWindow, realClock{})
+	consumer.DecodeErrors.MinMessages = cfg.Consumer.DecodeErrorMinMessages
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "livestream_decode_error_ratio",
+		Help: "Share of Kafka messages within kafka.decode_errors.window that could not be decoded, from 0 to 1.",
+	}, consumer.DecodeErrors.Rate)
+	consumer.IPProperties = cfg.Consumer.IPProperties
+	consumer.RightmostIP = cfg.Consumer.RightmostIP
+	consumer.FoldPropertyKeys = cfg.Consumer.FoldPropertyKeys
+	consumer.KeepRaw = cfg.Consumer.KeepRaw
+	if cfg.Consumer.DedupeWindow > 0 {
+		consumer.Dedupe = NewDeduplicator(cfg.Consumer.DedupeWindow, cfg.Consumer.DedupeMaxSize, realClock{})
+	}
+	consumer.ReadTimeout = cfg.Consumer.ReadTimeout
+	consumer.IdleAfter = cfg.Consumer.IdleAfter
+	if path := cfg.Consumer.NoTokenSink; path != "" {
+		out, err := openSinkOutput(path)
+		if err != nil {
+			captureException(err)
+			log.Fatalf("Failed to open no-token sink: %v", err)
+		}
+		noTokenChan := make(chan PostHogEvent, sinkBuffer)
+		consumer.RouteNoToken(noTokenChan)
+		go runSink("no_token", NewJSONLSink(out), noTokenChan, cfg.Sinks.FlushInterval, realClock{})
+	}
+	consumer.readiness = readiness
 
-	filter := NewFilter(subChan, unSubChan, phEventChan)
+	var phBatchChan chan []PostHogEvent
+	if cfg.Consumer.BatchSize > 0 {
+		phBatchChan = make(chan []PostHogEvent, channelBuffer)
+		consumer.EnableBatching(phBatchChan, cfg.Consumer.BatchSize, cfg.Consumer.BatchFlushInterval)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		if err := consumer.Consume(ctx); err != nil {
+			captureException(err)
+			log.Fatalf("Kafka consumer stopped: %v", err)
+		}
+	}()
+	go consumer.RecordLag(ctx, cfg.Consumer.LagInterval)
+
+	// Every output of the stream is a sink of the hub. The filter gets every
+	// event, waiting for it like the consumer would.
+	hub := NewHub(phEventChan)
+	hub.FlushInterval = cfg.Sinks.FlushInterval
+	filter := NewFilter(subChan, unSubChan, make(chan PostHogEvent))
+	filterChan := hub.AddSink("filter", filter, channelBuffer, Block)
+
+	var sinkChan chan PostHogEvent
+	if path := cfg.Sinks.JSONL; path != "" {
+		out, err := openSinkOutput(path)
+		if err != nil {
+			captureException(err)
+			log.Fatalf("Failed to open JSONL sink: %v", err)
+		}
+		sinkChan = hub.AddSink("jsonl", NewJSONLSink(out), cfg.Sinks.Buffer, DropNewest)
+	}
+	var webhookChan chan PostHogEvent
+	if webhookCfg := cfg.Sinks.Webhook; webhookCfg.URL != "" {
+		webhook := NewWebhookSink(webhookCfg.URL, webhookCfg.Timeout)
+		webhook.BatchSize = webhookCfg.BatchSize
+		webhook.Interval = webhookCfg.FlushInterval
+		webhook.MaxRetries = webhookCfg.MaxRetries
+		if path := webhookCfg.DeadLetter; path != "" {
+			out, err := openSinkOutput(path)
+			if err != nil {
+				captureException(err)
+				log.Fatalf("Failed to open webhook dead letter file: %v", err)
+			}
+			webhook.DeadLetter = NewJSONLSink(out)
+		}
+		webhookChan = hub.AddSink("webhook", webhook, cfg.Sinks.Buffer, DropNewest)
+	}
+	go hub.Run()
+
+	channels := map[string]func() float64{
+		"outgoing": channelFillRatio(phEventChan),
+		"stats":    channelFillRatio(statsChan),
+		"filter":   channelFillRatio(filterChan),
+	}
+	if phBatchChan != nil {
+		channels["batch"] = channelFillRatio(phBatchChan)
+	}
+	if sinkChan != nil {
+		channels["sink"] = channelFillRatio(sinkChan)
+	}
+	if webhookChan != nil {
+		channels["webhook"] = channelFillRatio(webhookChan)
+	}
+	go recordChannelFill(ctx, realClock{}, cfg.ChannelFillInterval, channels)
+
+	filter.inboundBatchChan = phBatchChan
+	filter.geohashPrecision = cfg.Stream.GeohashPrecision
+	filter.hideCoordinates = cfg.Stream.HideCoordinates
+	filter.includePartitionKey = cfg.Stream.IncludePartitionKey
+	filter.includeRaw = cfg.Stream.IncludeRaw
+	filter.sampler = cfg.Sampler
+	filter.distinctIds = cfg.DistinctIds
+	filter.properties = NewPropertyFilter(cfg.Stream.PropertyAllowlist, cfg.Stream.PropertyDenylist)
+	filter.properties.FoldCase = cfg.Consumer.FoldPropertyKeys
 	go filter.Run()
 
+	limiter := NewClientLimiter(cfg.Stream.MaxConnectionsPerIP, cfg.Stream.MaxConnectionsPerToken, cfg.Stream.MaxEventsPerSecond)
+	limiter.MaxConnections = cfg.Stream.MaxConnections
+
 	// Echo instance
 	e := echo.New()
+	e.IPExtractor = clientIPExtractor(cfg.Stream.TrustedProxies)
+	// Cancelled by Shutdown, once every event has been dispatched.
+	requestsCtx, cancelRequests := context.WithCancelCause(context.Background())
+	e.Server.BaseContext = func(net.Listener) context.Context { return requestsCtx }
 
 	// Middleware
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 	e.Use(middleware.RequestID())
-	e.Use(middleware.GzipWithConfig(middleware.GzipConfig{
-		Level: 9, // Set compression level to maximum
-	}))
-
-	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{"*"},
-		AllowMethods: []string{http.MethodGet, http.MethodHead},
-	}))
+	e.Use(gzipMiddleware())
+
+	registerCORS(e, cfg.CORS)
+	wsUpgrader.CheckOrigin = cfg.CORS.checkOrigin
 	e.File("/", "./index.html")
 
 	// Routes
@@ -110,88 +238,32 @@ func main() {
 
 	e.GET("/stats", statsHandler(stats))
 
-	e.GET("/events", func(c echo.Context) error {
-		e.Logger.Printf("SSE client connected, ip: %v", c.RealIP())
+	e.GET("/stats/tokens", tokenCountsHandler(stats))
 
-		var teamId string
-		eventType := c.QueryParam("eventType")
-		distinctId := c.QueryParam("distinctId")
-		geo := c.QueryParam("geo")
+	e.GET("/stats/events", topEventsHandler(stats))
 
-		teamIdInt := 0
-		token := ""
-		geoOnly := false
+	e.GET("/stats/uniques", uniquesHandler(stats))
 
-		if strings.ToLower(geo) == "true" || geo == "1" {
-			geoOnly = true
-		} else {
-			teamId = ""
+	e.GET("/stats/geo", geoCountsHandler(stats))
 
-			authHeader := c.Request().Header.Get("Authorization")
-			if authHeader == "" {
-				return errors.New("authorization header is required")
-			}
+	e.GET("/stats/subscribers", subscribersHandler(filter))
 
-			claims, err := decodeAuthToken(authHeader)
-			if err != nil {
-				return err
-			}
-			teamId = strconv.Itoa(int(claims["team_id"].(float64)))
-			token = fmt.Sprint(claims["api_token"])
+	e.GET("/tokens/active", activeTokensHandler(stats.ActiveTokens))
 
-			if teamId == "" {
-				return errors.New("teamId is required unless geo=true")
-			}
-		}
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
 
-		eventTypes := []string{}
-		if eventType != "" {
-			eventTypes = strings.Split(eventType, ",")
-		}
+	e.GET("/healthz", healthzHandler)
 
-		subscription := Subscription{
-			TeamId:      teamIdInt,
-			Token:       token,
-			ClientId:    c.Response().Header().Get(echo.HeaderXRequestID),
-			DistinctId:  distinctId,
-			Geo:         geoOnly,
-			EventTypes:  eventTypes,
-			EventChan:   make(chan interface{}, 100),
-			ShouldClose: &atomic.Bool{},
-		}
+	e.GET("/version", versionHandler)
 
-		subChan <- subscription
+	e.GET("/readyz", readyzHandler(readiness))
 
-		w := c.Response()
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
+	registerPprof(e, cfg.Pprof)
 
-		for {
-			select {
-			case <-c.Request().Context().Done():
-				e.Logger.Printf("SSE client disconnected, ip: %v", c.RealIP())
-				filter.unSubChan <- subscription
-				subscription.ShouldClose.Store(true)
-				return nil
-			case payload := <-subscription.EventChan:
-				jsonData, err := json.Marshal(payload)
-				if err != nil {
-					sentry.CaptureException(err)
-					log.Println("Error marshalling payload", err)
-					continue
-				}
+	replay := NewReplayBuffers(cfg.Stream.ReplaySize, cfg.Stream.ReplayTTL, cfg.Stream.ReplayMaxParked)
+	e.GET("/events", eventsHandler(subChan, filter.unSubChan, limiter, cfg.Authorizer, replay, cfg.Stream.SSEHeartbeat, realClock{}))
 
-				event := Event{
-					Data: jsonData,
-				}
-				if err := event.WriteTo(w); err != nil {
-					return err
-				}
-				w.Flush()
-			}
-		}
-	})
+	e.GET("/ws", wsHandler(subChan, filter.unSubChan, limiter, cfg.Authorizer))
 
 	e.GET("/jwt", func(c echo.Context) error {
 		authHeader := c.Request().Header.Get("Authorization")
@@ -234,5 +306,99 @@ func main() {
 		}
 	})
 
-	e.Logger.Fatal(e.Start(":8080"))
+	go func() {
+		if err := e.Start(cfg.ListenAddress); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	log.Printf("Received %v, shutting down", <-signals)
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), cfg.ShutdownGracePeriod)
+	defer cancelShutdown()
+	if err := Shutdown(shutdownCtx, e.Server, cancelRequests, consumer, hub); err != nil {
+		captureException(err)
+		log.Printf("Shutdown did not finish within shutdown.grace_period: %v", err)
+		sentry.Flush(2 * time.Second)
+		os.Exit(1)
+	}
+	log.Println("Shut down cleanly")
+}
+
+// newMaxMindGeoLocation opens the MMDB at mmdb, followed by the one at
+// fallbackPath when it is set, and fronted by a cache when geo.CacheSize is
+// set. Both databases are reloaded whenever the process gets SIGHUP.
+//
+// A database that can't be opened is an error if geo.Required is set. Otherwise
+// it is reported and left out, and without the one at mmdb events are not
+// geolocated at all, so a failed database update doesn't stop the stream.
+func newMaxMindGeoLocation(mmdb string, fallbackPath string, geo GeoIPConfig) (GeoLocator, error) {
+	maxmind, err := NewMaxMindGeoLocator(mmdb)
+	if err != nil {
+		err = fmt.Errorf("failed to open MMDB: %w", err)
+		if geo.Required {
+			return nil, err
+		}
+		captureException(err)
+		log.Printf("Events will not be geolocated, %v", err)
+		return NoOpGeoLocator{}, nil
+	}
+
+	// Each database retries its own read errors, before a chain moves on to
+	// the next one.
+	primary := NewRetryingGeoLocator(maxmind, geo.Retries, geo.RetryBackoff)
+
+	var geolocator GeoLocator = primary
+	databases := map[string]*MaxMindLocator{mmdb: maxmind}
+	if fallbackPath != "" {
+		fallback, err := NewMaxMindGeoLocator(fallbackPath)
+		switch {
+		case err == nil:
+			geolocator = NewChainedGeoLocator(
+				GeoProvider{Name: "primary", GeoLocator: primary},
+				GeoProvider{Name: "fallback", GeoLocator: NewRetryingGeoLocator(fallback, geo.Retries, geo.RetryBackoff)},
+			)
+			databases[fallbackPath] = fallback
+		case geo.Required:
+			return nil, fmt.Errorf("failed to open fallback MMDB: %w", err)
+		default:
+			err = fmt.Errorf("failed to open fallback MMDB: %w", err)
+			captureException(err)
+			log.Printf("Geolocating without a fallback, %v", err)
+		}
+	}
+
+	var cache *CachingGeoLocator
+	if geo.CacheSize > 0 {
+		// The cache goes in front of the whole chain, so the fallback's
+		// answers are cached as well.
+		cache, err = NewCachingGeoLocator(geolocator, geo.CacheSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create GeoIP cache: %w", err)
+		}
+		geolocator = cache
+	}
+
+	// Reload the MMDB in place on SIGHUP, e.g. after the weekly database update.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			for path, db := range databases {
+				if err := db.Reload(path); err != nil {
+					captureException(err)
+					log.Printf("Failed to reload MMDB from %s, keeping the current one: %v", path, err)
+					continue
+				}
+				log.Printf("Reloaded MMDB from %s", path)
+			}
+			if cache != nil {
+				cache.Purge()
+			}
+		}
+	}()
+
+	return geolocator, nil
 }
@@ -10,6 +10,8 @@ import (
 
 	"github.com/hashicorp/golang-lru/v2/expirable"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -59,3 +61,291 @@ func TestStatsHandler(t *testing.T) {
 		assert.Equal(t, 1, response["users_on_product"])
 	}
 }
+
+func TestTokenCountsHandler(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/stats/tokens", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	stats := &Stats{TokenCounts: NewRollingCounts(time.Minute, 60, newFakeClock())}
+	stats.TokenCounts.Add("token1")
+	stats.TokenCounts.Add("token1")
+	stats.TokenCounts.Add("token2")
+
+	if assert.NoError(t, tokenCountsHandler(stats)(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var response map[string]int
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		assert.Equal(t, map[string]int{"token1": 2, "token2": 1}, response)
+	}
+}
+
+func TestTopEventsHandler(t *testing.T) {
+	stats := &Stats{EventCounts: NewRollingCounts(time.Minute, 60, newFakeClock())}
+	for event, n := range map[string]int{"$pageview": 30, "$autocapture": 20, "$pageleave": 10, "$identify": 5} {
+		for i := 0; i < n; i++ {
+			stats.EventCounts.Add(event)
+		}
+	}
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedEvents []string
+	}{
+		{name: "Default", query: "", expectedStatus: http.StatusOK, expectedEvents: []string{"$pageview", "$autocapture", "$pageleave", "$identify"}},
+		{name: "Top two", query: "?n=2", expectedStatus: http.StatusOK, expectedEvents: []string{"$pageview", "$autocapture"}},
+		{name: "Invalid", query: "?n=zero", expectedStatus: http.StatusBadRequest},
+		{name: "Negative", query: "?n=-1", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			e.GET("/stats/events", topEventsHandler(stats))
+			req := httptest.NewRequest(http.MethodGet, "/stats/events"+tt.query, nil)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.expectedStatus, rec.Code)
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+
+			var response struct {
+				WindowSeconds int `json:"window_seconds"`
+				Events        []struct {
+					Event string `json:"event"`
+					Count int    `json:"count"`
+				} `json:"events"`
+			}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+			assert.Equal(t, 60, response.WindowSeconds)
+
+			events := []string{}
+			for _, event := range response.Events {
+				events = append(events, event.Event)
+			}
+			assert.Equal(t, tt.expectedEvents, events)
+			assert.Equal(t, 30, response.Events[0].Count)
+		})
+	}
+}
+
+func TestUniquesHandler(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/stats/uniques", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	uniques, err := NewRollingUniques(time.Minute, 6, 10, newFakeClock())
+	require.NoError(t, err)
+	uniques.Add("token1", "user1")
+	uniques.Add("token1", "user2")
+	uniques.Add("token1", "user1")
+	stats := &Stats{Uniques: uniques}
+
+	if assert.NoError(t, uniquesHandler(stats)(c)) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var response map[string]UniquesEstimate
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		assert.Equal(t, uint64(2), response["token1"].Estimate)
+		assert.InDelta(t, 0.0325, response["token1"].RelativeError, 0.0001)
+	}
+}
+
+func TestGeoCountsHandler(t *testing.T) {
+	stats, err := newStatsKeeper(10)
+	require.NoError(t, err)
+
+	statsChan := make(chan PostHogEvent, 10)
+	for _, code := range []string{"GB", "US", "gb", "DE", "", "US", "GB"} {
+		statsChan <- PostHogEvent{Token: "token1", DistinctId: "user", CountryCode: code}
+	}
+	close(statsChan)
+	runSink("stats", stats, statsChan, 0, realClock{})
+
+	e := echo.New()
+	e.GET("/stats/geo", geoCountsHandler(stats))
+	req := httptest.NewRequest(http.MethodGet, "/stats/geo", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var response map[string]int
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, map[string]int{"GB": 3, "US": 2, "DE": 1, "unknown": 1}, response)
+}
+
+func TestGeoCountsExpire(t *testing.T) {
+	clock := newFakeClock()
+	stats := &Stats{CountryCounts: NewRollingCounts(time.Minute, 60, clock)}
+	stats.CountryCounts.Add(countryKey("FR"))
+	clock.Advance(30 * time.Second)
+	stats.CountryCounts.Add(countryKey("JP"))
+
+	clock.Advance(45 * time.Second)
+	assert.Equal(t, map[string]int{"JP": 1}, stats.CountryCounts.Counts())
+
+	clock.Advance(time.Minute)
+	assert.Empty(t, stats.CountryCounts.Counts())
+}
+
+func TestActiveTokensHandler(t *testing.T) {
+	clock := newFakeClock()
+	tokens := NewActiveTokens(time.Minute, 0, []string{"phc_pinned"})
+	tokens.clock = clock
+
+	e := echo.New()
+	e.GET("/tokens/active", activeTokensHandler(tokens))
+	get := func() (int, []TokenActivity) {
+		req := httptest.NewRequest(http.MethodGet, "/tokens/active", nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var response struct {
+			WindowSeconds int             `json:"window_seconds"`
+			Tokens        []TokenActivity `json:"tokens"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		return response.WindowSeconds, response.Tokens
+	}
+
+	window, active := get()
+	assert.Equal(t, 60, window)
+	assert.Equal(t, []TokenActivity{{Token: "phc_pinned", Pinned: true}}, active)
+
+	for i := 0; i < 3; i++ {
+		tokens.Add("phc_live")
+	}
+	lastSeen := clock.Now()
+
+	clock.Advance(30 * time.Second)
+	_, active = get()
+	require.Len(t, active, 2)
+	assert.Equal(t, "phc_live", active[0].Token)
+	assert.Equal(t, 3, active[0].Count)
+	assert.False(t, active[0].Pinned)
+	if assert.NotNil(t, active[0].LastSeen) {
+		assert.True(t, lastSeen.Equal(*active[0].LastSeen))
+	}
+	assert.Equal(t, "phc_pinned", active[1].Token)
+
+	clock.Advance(30 * time.Second)
+	_, active = get()
+	assert.Equal(t, []TokenActivity{{Token: "phc_pinned", Pinned: true}}, active)
+}
+
+func TestSubscribersHandler(t *testing.T) {
+	viper.Set("jwt.secret", "test-secret")
+
+	subChan := make(chan Subscription)
+	unSubChan := make(chan Subscription)
+	filter := NewFilter(subChan, unSubChan, make(chan PostHogEvent))
+	go filter.Run()
+
+	e := echo.New()
+	e.Use(middleware.RequestID())
+	e.GET("/events", eventsHandler(subChan, unSubChan, nil, nil, nil, 0, realClock{}))
+	e.GET("/stats/subscribers", subscribersHandler(filter))
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	type counts struct {
+		Total     int            `json:"total"`
+		AllTokens int            `json:"all_tokens"`
+		Tokens    map[string]int `json:"tokens"`
+	}
+	get := func() counts {
+		resp, err := http.Get(server.URL + "/stats/subscribers")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var response counts
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+		return response
+	}
+	connect := func(token string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+createProjectToken(t, 1, token))
+		resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp
+	}
+
+	assert.Equal(t, counts{Tokens: map[string]int{}}, get())
+
+	first := connect("phc_a")
+	second := connect("phc_a")
+	third := connect("phc_b")
+	defer third.Body.Close()
+	require.Eventually(t, func() bool { return get().Total == 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, counts{Total: 3, Tokens: map[string]int{"phc_a": 2, "phc_b": 1}}, get())
+
+	// Dropping the connection without a goodbye still unsubscribes.
+	first.Body.Close()
+	require.Eventually(t, func() bool { return get().Total == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, counts{Total: 2, Tokens: map[string]int{"phc_a": 1, "phc_b": 1}}, get())
+
+	second.Body.Close()
+	require.Eventually(t, func() bool { return get().Total == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, counts{Total: 1, Tokens: map[string]int{"phc_b": 1}}, get())
+}
+
+func TestNewMaxMindGeoLocationNotRequired(t *testing.T) {
+	// A missing and a corrupt database.
+	for _, path := range []string{"testdata/missing.mmdb", "testdata/README.md"} {
+		geolocator, err := newMaxMindGeoLocation(path, "", GeoIPConfig{})
+		require.NoError(t, err, path)
+		assert.Equal(t, NoOpGeoLocator{}, geolocator, path)
+
+		lat, lng, err := geolocator.Lookup("81.2.69.142")
+		assert.NoError(t, err)
+		assert.Zero(t, lat)
+		assert.Zero(t, lng)
+	}
+
+	// A broken fallback is left out.
+	geolocator, err := newMaxMindGeoLocation("testdata/city.mmdb", "testdata/missing.mmdb", GeoIPConfig{})
+	require.NoError(t, err)
+	assert.IsType(t, &RetryingGeoLocator{}, geolocator)
+}
+
+func TestNewMaxMindGeoLocationCachesFallback(t *testing.T) {
+	geolocator, err := newMaxMindGeoLocation("testdata/city.mmdb", "testdata/fallback.mmdb", GeoIPConfig{Required: true, CacheSize: 10})
+	require.NoError(t, err)
+	require.IsType(t, &CachingGeoLocator{}, geolocator)
+	hits, misses := cacheLookups()
+
+	// Only the fallback knows this network.
+	for i := 0; i < 2; i++ {
+		lat, lng, err := geolocator.Lookup("89.160.20.113")
+		require.NoError(t, err)
+		assert.Equal(t, 58.4167, lat)
+		assert.Equal(t, 15.6167, lng)
+	}
+	newHits, newMisses := cacheLookups()
+	assert.Equal(t, hits+1, newHits)
+	assert.Equal(t, misses+1, newMisses)
+
+	cache := geolocator.(*CachingGeoLocator)
+
+	// Each database retries on its own, underneath the cache.
+	require.IsType(t, &ChainedGeoLocator{}, cache.locator)
+	for _, provider := range cache.locator.(*ChainedGeoLocator).providers {
+		assert.IsType(t, &RetryingGeoLocator{}, provider.GeoLocator, provider.Name)
+	}
+}
+
+func TestNewMaxMindGeoLocationRequired(t *testing.T) {
+	_, err := newMaxMindGeoLocation("testdata/missing.mmdb", "", GeoIPConfig{Required: true})
+	assert.ErrorContains(t, err, "failed to open MMDB")
+
+	_, err = newMaxMindGeoLocation("testdata/city.mmdb", "testdata/missing.mmdb", GeoIPConfig{Required: true})
+	assert.ErrorContains(t, err, "failed to open fallback MMDB")
+}
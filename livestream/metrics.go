@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are registered on the default Prometheus registry and served on
+// /metrics.
+var (
+	eventsConsumed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_events_consumed_total",
+		Help: "Messages read from Kafka.",
+	})
+	partitionMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "livestream_kafka_partition_messages_total",
+		Help: "Messages read from Kafka per topic and partition.",
+	}, []string{"topic", "partition"})
+	eventsSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_events_sent_total",
+		Help: "Events sent to the outgoing channel.",
+	})
+	eventsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_events_dropped_total",
+		Help: "Events discarded because a downstream channel was full.",
+	})
+	decodeErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_decode_errors_total",
+		Help: "Kafka messages that could not be decoded.",
+	})
+	schemaRegistryFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "livestream_schema_registry_fetches_total",
+		Help: "Avro schemas fetched from Schema Registry by result, success or failure. Each schema is fetched once.",
+	}, []string{"result"})
+	batchedMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_kafka_batched_messages_total",
+		Help: "Kafka messages holding several events, as a JSON array or one after another, that were split into one event each.",
+	})
+	oversizedMessages = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_oversized_messages_total",
+		Help: "Kafka messages dead-lettered without decoding because they were over kafka.max_message_bytes.",
+	})
+	invalidTokens = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_invalid_tokens_total",
+		Help: "Events dead-lettered because their token failed validation.",
+	})
+	staleEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_stale_events_dropped_total",
+		Help: "Events dropped because they were older than kafka.max_event_age.",
+	})
+	transformErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_transform_errors_total",
+		Help: "Events whose properties kafka.transform failed on, which were sent untransformed.",
+	})
+	duplicateEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_duplicate_events_dropped_total",
+		Help: "Events dropped because their uuid was already seen within kafka.dedupe.window.",
+	})
+	eventsSampledOut = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_events_sampled_out_total",
+		Help: "Events of sampled tokens not streamed to clients. They still count in stats.",
+	})
+	noTokenEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_no_token_events_total",
+		Help: "Events held back from clients because they carry no token.",
+	})
+	geolocations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "livestream_geolocations_total",
+		Help: "IP lookups by result, success or failure.",
+	}, []string{"result"})
+	geoProviderLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "livestream_geoip_provider_lookups_total",
+		Help: "IP lookups per provider of a chain, by result. A failure is an error or 0,0, after which the next provider is asked.",
+	}, []string{"provider", "result"})
+	eventLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "livestream_event_latency_seconds",
+		Help: "Time from an event's timestamp to it being sent to the outgoing channel.",
+		// 10ms to about 5.5 minutes, beyond which the consumer is badly behind.
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 16),
+	})
+	futureEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_event_future_timestamps_total",
+		Help: "Events sent with a timestamp ahead of the local clock, observed as zero latency.",
+	})
+	geolocationDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "livestream_geolocation_duration_seconds",
+		Help: "Time taken by each IP lookup, cached or not.",
+		// 10µs to about 160ms; an in-memory MaxMind lookup takes a few µs.
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 8),
+	})
+	invalidIPs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_geolocation_invalid_ips_total",
+		Help: "IP lookups that failed because the IP could not be parsed. They also count as failures.",
+	})
+	geoRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_geoip_retries_total",
+		Help: "IP lookups retried after an error other than an invalid IP.",
+	})
+	geoLookupErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "livestream_geoip_lookup_errors_total",
+		Help: "IP lookups that still failed after their retries, not counting invalid IPs.",
+	})
+	geoCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "livestream_geoip_cache_lookups_total",
+		Help: "Lookups in the geolocation cache by result, hit or miss. The hit rate is hits over both.",
+	}, []string{"result"})
+	geoCacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "livestream_geoip_cache_entries",
+		Help: "IPs currently in the geolocation cache, up to mmdb.cache_size.",
+	})
+	activeSubscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "livestream_active_subscribers",
+		Help: "Clients currently subscribed to the event stream.",
+	})
+	parkedStreams = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "livestream_parked_streams",
+		Help: "SSE streams kept subscribed while waiting for their client to reconnect.",
+	})
+	consumerLag = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "livestream_kafka_consumer_lag",
+		Help: "Messages the consumer group is behind the head of its topics, as of the last RecordLag tick.",
+	})
+	partitionLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "livestream_kafka_partition_lag",
+		Help: "Messages the consumer group is behind the head of each assigned partition with a committed offset, as of the last RecordLag tick.",
+	}, []string{"topic", "partition"})
+	consumerIdle = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "livestream_kafka_consumer_idle",
+		Help: "1 while kafka.idle_after_timeouts reads in a row have timed out, 0 once a message arrives.",
+	})
+	sinkErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "livestream_sink_errors_total",
+		Help: "Failed writes, flushes and closes per sink.",
+	}, []string{"sink"})
+	channelFill = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "livestream_channel_fill_ratio",
+		Help: "How full each internal channel's buffer is, from 0 to 1. Unbuffered channels report 0.",
+	}, []string{"channel"})
+)
+
+// channelFillRatio returns a func reporting len(ch)/cap(ch).
+func channelFillRatio[T any](ch chan T) func() float64 {
+	return func() float64 {
+		if cap(ch) == 0 {
+			return 0
+		}
+		return float64(len(ch)) / float64(cap(ch))
+	}
+}
+
+// recordChannelFill refreshes livestream_channel_fill_ratio for every named
+// channel each interval until ctx is cancelled.
+func recordChannelFill(ctx context.Context, clock Clock, interval time.Duration, channels map[string]func() float64) {
+	for {
+		for name, fill := range channels {
+			channelFill.WithLabelValues(name).Set(fill())
+		}
+
+		select {
+		case <-clock.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/labstack/echo/v4"
+	"github.com/posthog/posthog/livestream/mocks"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// scrapeMetrics fetches /metrics and returns every sample keyed by its name
+// and labels, as written in the exposition format.
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	t.Helper()
+
+	e := echo.New()
+	e.GET("/metrics", echo.WrapHandler(promhttp.Handler()))
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		require.NoError(t, err)
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	mockConsumer := new(mocks.KafkaConsumerInterface)
+	mockGeoLocator := new(mocks.GeoLocator)
+
+	outgoingChan := make(chan PostHogEvent, 2)
+	statsChan := make(chan PostHogEvent, 10)
+
+	consumer := &PostHogKafkaConsumer{
+		consumer:     mockConsumer,
+		topics:       []string{"test-topic"},
+		geolocator:   mockGeoLocator,
+		outgoingChan: outgoingChan,
+		statsChan:    statsChan,
+		Backpressure: DropNewest,
+	}
+
+	messages := []*kafka.Message{
+		{Value: []byte(`{"uuid": "1", "ip": "192.0.2.1", "data": "{\"event\": \"$pageview\"}", "token": "test-token"}`)},
+		{Value: []byte(`{"uuid": "2", "ip": "not-an-ip", "data": "{\"event\": \"$pageview\"}", "token": "test-token"}`)},
+		{Value: []byte(`{"uuid": "3", "data": "{\"event\": \"$pageview\"}", "token": "test-token"}`)},
+		{Value: []byte(`{"uuid": "4", "data": "not json", "token": "test-token"}`)},
+	}
+
+	read := make(chan struct{})
+	mockConsumer.On("SubscribeTopics", []string{"test-topic"}, mock.AnythingOfType("kafka.RebalanceCb")).Return(nil)
+	for _, msg := range messages {
+		mockConsumer.On("ReadMessage", mock.AnythingOfType("time.Duration")).Return(msg, nil).Once()
+	}
+	mockConsumer.On("ReadMessage", mock.AnythingOfType("time.Duration")).Return(nil, kafka.NewError(kafka.ErrTimedOut, "timed out", false)).
+		Run(func(mock.Arguments) {
+			select {
+			case <-read:
+			default:
+				close(read)
+			}
+		})
+	mockConsumer.On("CommitMessage", mock.Anything).Return(nil, nil).Maybe()
+	mockConsumer.On("Close").Return(nil).Maybe()
+	mockGeoLocator.On("Lookup", "192.0.2.1").Return(37.7749, -122.4194, nil)
+	mockGeoLocator.On("Lookup", "not-an-ip").Return(0.0, 0.0, ErrInvalidIP)
+
+	before := scrapeMetrics(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Consume(ctx)
+
+	select {
+	case <-read:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for messages to be consumed")
+	}
+
+	after := scrapeMetrics(t)
+	delta := func(name string) float64 { return after[name] - before[name] }
+
+	assert.Equal(t, 4.0, delta("livestream_events_consumed_total"))
+	// The undecodable message isn't delivered, and outgoingChan holds two
+	// events, so the third is dropped.
+	assert.Equal(t, 2.0, delta("livestream_events_sent_total"))
+	assert.Equal(t, 1.0, delta("livestream_events_dropped_total"))
+	assert.Equal(t, 1.0, delta("livestream_decode_errors_total"))
+	assert.Equal(t, 1.0, delta(`livestream_geolocations_total{result="success"}`))
+	assert.Equal(t, 1.0, delta(`livestream_geolocations_total{result="failure"}`))
+	assert.Equal(t, 1.0, delta("livestream_geolocation_invalid_ips_total"))
+	// One observation per lookup, whatever its result.
+	assert.Equal(t, 2.0, delta("livestream_geolocation_duration_seconds_count"))
+	assert.Equal(t, 2.0, delta(`livestream_geolocation_duration_seconds_bucket{le="+Inf"}`))
+}
+
+func TestMetricsEventLatency(t *testing.T) {
+	clock := newFakeClock()
+	consumer := &PostHogKafkaConsumer{
+		outgoingChan: make(chan PostHogEvent, 2),
+		statsChan:    make(chan PostHogEvent, 2),
+		clock:        clock,
+	}
+
+	before := scrapeMetrics(t)
+	require.NoError(t, consumer.deliver(context.Background(), PostHogEvent{Timestamp: clock.Now().Add(-3 * time.Second)}))
+	// Ahead of the local clock, so clamped to zero.
+	require.NoError(t, consumer.deliver(context.Background(), PostHogEvent{Timestamp: clock.Now().Add(time.Minute)}))
+	after := scrapeMetrics(t)
+	delta := func(name string) float64 { return after[name] - before[name] }
+
+	assert.Equal(t, 2.0, delta("livestream_event_latency_seconds_count"))
+	assert.InDelta(t, 3.0, delta("livestream_event_latency_seconds_sum"), 1e-9)
+	assert.Equal(t, 1.0, delta(`livestream_event_latency_seconds_bucket{le="0.01"}`))
+	assert.Equal(t, 1.0, delta(`livestream_event_latency_seconds_bucket{le="2.56"}`))
+	assert.Equal(t, 2.0, delta(`livestream_event_latency_seconds_bucket{le="5.12"}`))
+	assert.Equal(t, 1.0, delta("livestream_event_future_timestamps_total"))
+}
+
+func TestMetricsGeoCache(t *testing.T) {
+	mockLocator := mocks.NewGeoLocator(t)
+	mockLocator.On("Lookup", "192.0.2.1").Return(37.7749, -122.4194, nil).Once()
+	mockLocator.On("Lookup", "192.0.2.2").Return(51.5142, -0.0931, nil).Once()
+	locator, err := NewCachingGeoLocator(mockLocator, 10)
+	require.NoError(t, err)
+
+	before := scrapeMetrics(t)
+	for i := 0; i < 3; i++ {
+		_, _, err := locator.Lookup("192.0.2.1")
+		require.NoError(t, err)
+	}
+	_, _, err = locator.Lookup("192.0.2.2")
+	require.NoError(t, err)
+	after := scrapeMetrics(t)
+	delta := func(name string) float64 { return after[name] - before[name] }
+
+	assert.Equal(t, 2.0, delta(`livestream_geoip_cache_lookups_total{result="hit"}`))
+	assert.Equal(t, 2.0, delta(`livestream_geoip_cache_lookups_total{result="miss"}`))
+	assert.Equal(t, 2.0, after["livestream_geoip_cache_entries"])
+
+	locator.Purge()
+	assert.Equal(t, 0.0, scrapeMetrics(t)["livestream_geoip_cache_entries"])
+}
+
+func TestMetricsPerPartition(t *testing.T) {
+	fake := newFakeKafkaConsumer("partitioned", time.Now(), []string{"a0", "a1", "a2"}, []string{"b0"})
+	consumer := &PostHogKafkaConsumer{
+		consumer:     fake,
+		topics:       []string{"partitioned"},
+		geolocator:   NoOpGeoLocator{},
+		outgoingChan: make(chan PostHogEvent),
+		statsChan:    make(chan PostHogEvent, 4),
+	}
+
+	before := scrapeMetrics(t)
+	consumeAll(t, consumer, 4)
+	after := scrapeMetrics(t)
+	delta := func(name string) float64 { return after[name] - before[name] }
+
+	assert.Equal(t, 3.0, delta(`livestream_kafka_partition_messages_total{partition="0",topic="partitioned"}`))
+	assert.Equal(t, 1.0, delta(`livestream_kafka_partition_messages_total{partition="1",topic="partitioned"}`))
+}
+
+func TestMetricsPartitionLag(t *testing.T) {
+	mockConsumer := mocks.NewKafkaConsumerInterface(t)
+	consumer := &PostHogKafkaConsumer{consumer: mockConsumer, clock: newFakeClock()}
+
+	topic := "lagging"
+	assigned := []kafka.TopicPartition{{Topic: &topic, Partition: 0}, {Topic: &topic, Partition: 1}}
+	ctx, cancel := context.WithCancel(context.Background())
+	mockConsumer.On("Assignment").Return(assigned, nil)
+	mockConsumer.On("Committed", assigned, lagQueryTimeoutMs).Return([]kafka.TopicPartition{
+		{Topic: &topic, Partition: 0, Offset: 100},
+		{Topic: &topic, Partition: 1, Offset: 10},
+	}, nil)
+	mockConsumer.On("QueryWatermarkOffsets", topic, int32(0), lagQueryTimeoutMs).Return(int64(0), int64(100), nil)
+	mockConsumer.On("QueryWatermarkOffsets", topic, int32(1), lagQueryTimeoutMs).Return(int64(0), int64(510), nil).
+		Run(func(mock.Arguments) { cancel() })
+
+	consumer.RecordLag(ctx, time.Second)
+
+	metrics := scrapeMetrics(t)
+	assert.Equal(t, 0.0, metrics[`livestream_kafka_partition_lag{partition="0",topic="lagging"}`])
+	assert.Equal(t, 500.0, metrics[`livestream_kafka_partition_lag{partition="1",topic="lagging"}`])
+	assert.Equal(t, 500.0, metrics["livestream_kafka_consumer_lag"])
+}
+
+func TestMetricsActiveSubscribers(t *testing.T) {
+	subChan := make(chan Subscription)
+	unSubChan := make(chan Subscription)
+	inboundChan := make(chan PostHogEvent)
+
+	filter := NewFilter(subChan, unSubChan, inboundChan)
+	go filter.Run()
+	defer close(inboundChan)
+
+	before := scrapeMetrics(t)["livestream_active_subscribers"]
+
+	subChan <- Subscription{ClientId: "1", Token: "token1", EventChan: make(chan interface{}), ShouldClose: &atomic.Bool{}}
+	subChan <- Subscription{ClientId: "2", Token: "token2", EventChan: make(chan interface{}), ShouldClose: &atomic.Bool{}}
+	unSubChan <- Subscription{ClientId: "1", Token: "token1"}
+	// Unknown clients do not change the count.
+	unSubChan <- Subscription{ClientId: "3", Token: "token1"}
+	// A final round trip makes sure the last unsubscribe was handled.
+	subChan <- Subscription{ClientId: "4", Token: "token2", EventChan: make(chan interface{}), ShouldClose: &atomic.Bool{}}
+	unSubChan <- Subscription{ClientId: "4", Token: "token2"}
+	subChan <- Subscription{ClientId: "5", Token: "token3", EventChan: make(chan interface{}), ShouldClose: &atomic.Bool{}}
+	unSubChan <- Subscription{ClientId: "5", Token: "token3"}
+
+	assert.Eventually(t, func() bool {
+		return scrapeMetrics(t)["livestream_active_subscribers"]-before == 1
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRecordChannelFill(t *testing.T) {
+	full := make(chan PostHogEvent, 4)
+	for i := 0; i < 3; i++ {
+		full <- PostHogEvent{}
+	}
+	unbuffered := make(chan PostHogEvent)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	recordChannelFill(ctx, newFakeClock(), time.Second, map[string]func() float64{
+		"test_full":       channelFillRatio(full),
+		"test_unbuffered": channelFillRatio(unbuffered),
+	})
+
+	samples := scrapeMetrics(t)
+	assert.Equal(t, 0.75, samples[`livestream_channel_fill_ratio{channel="test_full"}`])
+	assert.Equal(t, 0.0, samples[`livestream_channel_fill_ratio{channel="test_unbuffered"}`])
+
+	<-full
+	<-full
+	recordChannelFill(ctx, newFakeClock(), time.Second, map[string]func() float64{
+		"test_full": channelFillRatio(full),
+	})
+	assert.Equal(t, 0.25, scrapeMetrics(t)[`livestream_channel_fill_ratio{channel="test_full"}`])
+}
@@ -0,0 +1,129 @@
+// Code generated by mockery v2.44.1. DO NOT EDIT.
+
+package mocks
+
+import (
+	time "time"
+
+	mock "github.com/stretchr/testify/mock"
+)
+
+// Clock is an autogenerated mock type for the Clock type
+type Clock struct {
+	mock.Mock
+}
+
+type Clock_Expecter struct {
+	mock *mock.Mock
+}
+
+func (_m *Clock) EXPECT() *Clock_Expecter {
+	return &Clock_Expecter{mock: &_m.Mock}
+}
+
+// After provides a mock function with given fields: d
+func (_m *Clock) After(d time.Duration) <-chan time.Time {
+	ret := _m.Called(d)
+
+	if len(ret) == 0 {
+		panic("no return value specified for After")
+	}
+
+	var r0 <-chan time.Time
+	if rf, ok := ret.Get(0).(func(time.Duration) <-chan time.Time); ok {
+		r0 = rf(d)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(<-chan time.Time)
+		}
+	}
+
+	return r0
+}
+
+// Clock_After_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'After'
+type Clock_After_Call struct {
+	*mock.Call
+}
+
+// After is a helper method to define mock.On call
+//   - d time.Duration
+func (_e *Clock_Expecter) After(d interface{}) *Clock_After_Call {
+	return &Clock_After_Call{Call: _e.mock.On("After", d)}
+}
+
+func (_c *Clock_After_Call) Run(run func(d time.Duration)) *Clock_After_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(time.Duration))
+	})
+	return _c
+}
+
+func (_c *Clock_After_Call) Return(_a0 <-chan time.Time) *Clock_After_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *Clock_After_Call) RunAndReturn(run func(time.Duration) <-chan time.Time) *Clock_After_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Now provides a mock function with given fields:
+func (_m *Clock) Now() time.Time {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for Now")
+	}
+
+	var r0 time.Time
+	if rf, ok := ret.Get(0).(func() time.Time); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(time.Time)
+	}
+
+	return r0
+}
+
+// Clock_Now_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Now'
+type Clock_Now_Call struct {
+	*mock.Call
+}
+
+// Now is a helper method to define mock.On call
+func (_e *Clock_Expecter) Now() *Clock_Now_Call {
+	return &Clock_Now_Call{Call: _e.mock.On("Now")}
+}
+
+func (_c *Clock_Now_Call) Run(run func()) *Clock_Now_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *Clock_Now_Call) Return(_a0 time.Time) *Clock_Now_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *Clock_Now_Call) RunAndReturn(run func() time.Time) *Clock_Now_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// NewClock creates a new instance of Clock. It also registers a testing interface on the mock and a cleanup function to assert the mocks expectations.
+// The first argument is typically a *testing.T value.
+func NewClock(t interface {
+	mock.TestingT
+	Cleanup(func())
+}) *Clock {
+	mock := &Clock{}
+	mock.Mock.Test(t)
+
+	t.Cleanup(func() { mock.AssertExpectations(t) })
+
+	return mock
+}
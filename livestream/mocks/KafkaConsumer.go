@@ -2,7 +2,11 @@
 
 package mocks
 
-import mock "github.com/stretchr/testify/mock"
+import (
+	context "context"
+
+	mock "github.com/stretchr/testify/mock"
+)
 
 // KafkaConsumer is an autogenerated mock type for the KafkaConsumer type
 type KafkaConsumer struct {
@@ -49,9 +53,22 @@ func (_c *KafkaConsumer_Close_Call) RunAndReturn(run func()) *KafkaConsumer_Clos
 	return _c
 }
 
-// Consume provides a mock function with given fields:
-func (_m *KafkaConsumer) Consume() {
-	_m.Called()
+// Consume provides a mock function with given fields: ctx
+func (_m *KafkaConsumer) Consume(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Consume")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
 }
 
 // KafkaConsumer_Consume_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Consume'
@@ -60,23 +77,24 @@ type KafkaConsumer_Consume_Call struct {
 }
 
 // Consume is a helper method to define mock.On call
-func (_e *KafkaConsumer_Expecter) Consume() *KafkaConsumer_Consume_Call {
-	return &KafkaConsumer_Consume_Call{Call: _e.mock.On("Consume")}
+//   - ctx context.Context
+func (_e *KafkaConsumer_Expecter) Consume(ctx interface{}) *KafkaConsumer_Consume_Call {
+	return &KafkaConsumer_Consume_Call{Call: _e.mock.On("Consume", ctx)}
 }
 
-func (_c *KafkaConsumer_Consume_Call) Run(run func()) *KafkaConsumer_Consume_Call {
+func (_c *KafkaConsumer_Consume_Call) Run(run func(ctx context.Context)) *KafkaConsumer_Consume_Call {
 	_c.Call.Run(func(args mock.Arguments) {
-		run()
+		run(args[0].(context.Context))
 	})
 	return _c
 }
 
-func (_c *KafkaConsumer_Consume_Call) Return() *KafkaConsumer_Consume_Call {
-	_c.Call.Return()
+func (_c *KafkaConsumer_Consume_Call) Return(_a0 error) *KafkaConsumer_Consume_Call {
+	_c.Call.Return(_a0)
 	return _c
 }
 
-func (_c *KafkaConsumer_Consume_Call) RunAndReturn(run func()) *KafkaConsumer_Consume_Call {
+func (_c *KafkaConsumer_Consume_Call) RunAndReturn(run func(context.Context) error) *KafkaConsumer_Consume_Call {
 	_c.Call.Return(run)
 	return _c
 }
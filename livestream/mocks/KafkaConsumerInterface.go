@@ -22,6 +22,109 @@ func (_m *KafkaConsumerInterface) EXPECT() *KafkaConsumerInterface_Expecter {
 	return &KafkaConsumerInterface_Expecter{mock: &_m.Mock}
 }
 
+// Assign provides a mock function with given fields: partitions
+func (_m *KafkaConsumerInterface) Assign(partitions []kafka.TopicPartition) error {
+	ret := _m.Called(partitions)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Assign")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func([]kafka.TopicPartition) error); ok {
+		r0 = rf(partitions)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// KafkaConsumerInterface_Assign_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Assign'
+type KafkaConsumerInterface_Assign_Call struct {
+	*mock.Call
+}
+
+// Assign is a helper method to define mock.On call
+//   - partitions []kafka.TopicPartition
+func (_e *KafkaConsumerInterface_Expecter) Assign(partitions interface{}) *KafkaConsumerInterface_Assign_Call {
+	return &KafkaConsumerInterface_Assign_Call{Call: _e.mock.On("Assign", partitions)}
+}
+
+func (_c *KafkaConsumerInterface_Assign_Call) Run(run func(partitions []kafka.TopicPartition)) *KafkaConsumerInterface_Assign_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].([]kafka.TopicPartition))
+	})
+	return _c
+}
+
+func (_c *KafkaConsumerInterface_Assign_Call) Return(_a0 error) *KafkaConsumerInterface_Assign_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *KafkaConsumerInterface_Assign_Call) RunAndReturn(run func([]kafka.TopicPartition) error) *KafkaConsumerInterface_Assign_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Assignment provides a mock function with given fields:
+func (_m *KafkaConsumerInterface) Assignment() ([]kafka.TopicPartition, error) {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for Assignment")
+	}
+
+	var r0 []kafka.TopicPartition
+	var r1 error
+	if rf, ok := ret.Get(0).(func() ([]kafka.TopicPartition, error)); ok {
+		return rf()
+	}
+	if rf, ok := ret.Get(0).(func() []kafka.TopicPartition); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]kafka.TopicPartition)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// KafkaConsumerInterface_Assignment_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Assignment'
+type KafkaConsumerInterface_Assignment_Call struct {
+	*mock.Call
+}
+
+// Assignment is a helper method to define mock.On call
+func (_e *KafkaConsumerInterface_Expecter) Assignment() *KafkaConsumerInterface_Assignment_Call {
+	return &KafkaConsumerInterface_Assignment_Call{Call: _e.mock.On("Assignment")}
+}
+
+func (_c *KafkaConsumerInterface_Assignment_Call) Run(run func()) *KafkaConsumerInterface_Assignment_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *KafkaConsumerInterface_Assignment_Call) Return(_a0 []kafka.TopicPartition, _a1 error) *KafkaConsumerInterface_Assignment_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *KafkaConsumerInterface_Assignment_Call) RunAndReturn(run func() ([]kafka.TopicPartition, error)) *KafkaConsumerInterface_Assignment_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // Close provides a mock function with given fields:
 func (_m *KafkaConsumerInterface) Close() error {
 	ret := _m.Called()
@@ -67,6 +170,307 @@ func (_c *KafkaConsumerInterface_Close_Call) RunAndReturn(run func() error) *Kaf
 	return _c
 }
 
+// CommitMessage provides a mock function with given fields: msg
+func (_m *KafkaConsumerInterface) CommitMessage(msg *kafka.Message) ([]kafka.TopicPartition, error) {
+	ret := _m.Called(msg)
+
+	if len(ret) == 0 {
+		panic("no return value specified for CommitMessage")
+	}
+
+	var r0 []kafka.TopicPartition
+	var r1 error
+	if rf, ok := ret.Get(0).(func(*kafka.Message) ([]kafka.TopicPartition, error)); ok {
+		return rf(msg)
+	}
+	if rf, ok := ret.Get(0).(func(*kafka.Message) []kafka.TopicPartition); ok {
+		r0 = rf(msg)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]kafka.TopicPartition)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(*kafka.Message) error); ok {
+		r1 = rf(msg)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// KafkaConsumerInterface_CommitMessage_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'CommitMessage'
+type KafkaConsumerInterface_CommitMessage_Call struct {
+	*mock.Call
+}
+
+// CommitMessage is a helper method to define mock.On call
+//   - msg *kafka.Message
+func (_e *KafkaConsumerInterface_Expecter) CommitMessage(msg interface{}) *KafkaConsumerInterface_CommitMessage_Call {
+	return &KafkaConsumerInterface_CommitMessage_Call{Call: _e.mock.On("CommitMessage", msg)}
+}
+
+func (_c *KafkaConsumerInterface_CommitMessage_Call) Run(run func(msg *kafka.Message)) *KafkaConsumerInterface_CommitMessage_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(*kafka.Message))
+	})
+	return _c
+}
+
+func (_c *KafkaConsumerInterface_CommitMessage_Call) Return(_a0 []kafka.TopicPartition, _a1 error) *KafkaConsumerInterface_CommitMessage_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *KafkaConsumerInterface_CommitMessage_Call) RunAndReturn(run func(*kafka.Message) ([]kafka.TopicPartition, error)) *KafkaConsumerInterface_CommitMessage_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Committed provides a mock function with given fields: partitions, timeoutMs
+func (_m *KafkaConsumerInterface) Committed(partitions []kafka.TopicPartition, timeoutMs int) ([]kafka.TopicPartition, error) {
+	ret := _m.Called(partitions, timeoutMs)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Committed")
+	}
+
+	var r0 []kafka.TopicPartition
+	var r1 error
+	if rf, ok := ret.Get(0).(func([]kafka.TopicPartition, int) ([]kafka.TopicPartition, error)); ok {
+		return rf(partitions, timeoutMs)
+	}
+	if rf, ok := ret.Get(0).(func([]kafka.TopicPartition, int) []kafka.TopicPartition); ok {
+		r0 = rf(partitions, timeoutMs)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]kafka.TopicPartition)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func([]kafka.TopicPartition, int) error); ok {
+		r1 = rf(partitions, timeoutMs)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// KafkaConsumerInterface_Committed_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Committed'
+type KafkaConsumerInterface_Committed_Call struct {
+	*mock.Call
+}
+
+// Committed is a helper method to define mock.On call
+//   - partitions []kafka.TopicPartition
+//   - timeoutMs int
+func (_e *KafkaConsumerInterface_Expecter) Committed(partitions interface{}, timeoutMs interface{}) *KafkaConsumerInterface_Committed_Call {
+	return &KafkaConsumerInterface_Committed_Call{Call: _e.mock.On("Committed", partitions, timeoutMs)}
+}
+
+func (_c *KafkaConsumerInterface_Committed_Call) Run(run func(partitions []kafka.TopicPartition, timeoutMs int)) *KafkaConsumerInterface_Committed_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].([]kafka.TopicPartition), args[1].(int))
+	})
+	return _c
+}
+
+func (_c *KafkaConsumerInterface_Committed_Call) Return(_a0 []kafka.TopicPartition, _a1 error) *KafkaConsumerInterface_Committed_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *KafkaConsumerInterface_Committed_Call) RunAndReturn(run func([]kafka.TopicPartition, int) ([]kafka.TopicPartition, error)) *KafkaConsumerInterface_Committed_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// GetMetadata provides a mock function with given fields: topic, allTopics, timeoutMs
+func (_m *KafkaConsumerInterface) GetMetadata(topic *string, allTopics bool, timeoutMs int) (*kafka.Metadata, error) {
+	ret := _m.Called(topic, allTopics, timeoutMs)
+
+	if len(ret) == 0 {
+		panic("no return value specified for GetMetadata")
+	}
+
+	var r0 *kafka.Metadata
+	var r1 error
+	if rf, ok := ret.Get(0).(func(*string, bool, int) (*kafka.Metadata, error)); ok {
+		return rf(topic, allTopics, timeoutMs)
+	}
+	if rf, ok := ret.Get(0).(func(*string, bool, int) *kafka.Metadata); ok {
+		r0 = rf(topic, allTopics, timeoutMs)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*kafka.Metadata)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(*string, bool, int) error); ok {
+		r1 = rf(topic, allTopics, timeoutMs)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// KafkaConsumerInterface_GetMetadata_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'GetMetadata'
+type KafkaConsumerInterface_GetMetadata_Call struct {
+	*mock.Call
+}
+
+// GetMetadata is a helper method to define mock.On call
+//   - topic *string
+//   - allTopics bool
+//   - timeoutMs int
+func (_e *KafkaConsumerInterface_Expecter) GetMetadata(topic interface{}, allTopics interface{}, timeoutMs interface{}) *KafkaConsumerInterface_GetMetadata_Call {
+	return &KafkaConsumerInterface_GetMetadata_Call{Call: _e.mock.On("GetMetadata", topic, allTopics, timeoutMs)}
+}
+
+func (_c *KafkaConsumerInterface_GetMetadata_Call) Run(run func(topic *string, allTopics bool, timeoutMs int)) *KafkaConsumerInterface_GetMetadata_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(*string), args[1].(bool), args[2].(int))
+	})
+	return _c
+}
+
+func (_c *KafkaConsumerInterface_GetMetadata_Call) Return(_a0 *kafka.Metadata, _a1 error) *KafkaConsumerInterface_GetMetadata_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *KafkaConsumerInterface_GetMetadata_Call) RunAndReturn(run func(*string, bool, int) (*kafka.Metadata, error)) *KafkaConsumerInterface_GetMetadata_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// OffsetsForTimes provides a mock function with given fields: times, timeoutMs
+func (_m *KafkaConsumerInterface) OffsetsForTimes(times []kafka.TopicPartition, timeoutMs int) ([]kafka.TopicPartition, error) {
+	ret := _m.Called(times, timeoutMs)
+
+	if len(ret) == 0 {
+		panic("no return value specified for OffsetsForTimes")
+	}
+
+	var r0 []kafka.TopicPartition
+	var r1 error
+	if rf, ok := ret.Get(0).(func([]kafka.TopicPartition, int) ([]kafka.TopicPartition, error)); ok {
+		return rf(times, timeoutMs)
+	}
+	if rf, ok := ret.Get(0).(func([]kafka.TopicPartition, int) []kafka.TopicPartition); ok {
+		r0 = rf(times, timeoutMs)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]kafka.TopicPartition)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func([]kafka.TopicPartition, int) error); ok {
+		r1 = rf(times, timeoutMs)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// KafkaConsumerInterface_OffsetsForTimes_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'OffsetsForTimes'
+type KafkaConsumerInterface_OffsetsForTimes_Call struct {
+	*mock.Call
+}
+
+// OffsetsForTimes is a helper method to define mock.On call
+//   - times []kafka.TopicPartition
+//   - timeoutMs int
+func (_e *KafkaConsumerInterface_Expecter) OffsetsForTimes(times interface{}, timeoutMs interface{}) *KafkaConsumerInterface_OffsetsForTimes_Call {
+	return &KafkaConsumerInterface_OffsetsForTimes_Call{Call: _e.mock.On("OffsetsForTimes", times, timeoutMs)}
+}
+
+func (_c *KafkaConsumerInterface_OffsetsForTimes_Call) Run(run func(times []kafka.TopicPartition, timeoutMs int)) *KafkaConsumerInterface_OffsetsForTimes_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].([]kafka.TopicPartition), args[1].(int))
+	})
+	return _c
+}
+
+func (_c *KafkaConsumerInterface_OffsetsForTimes_Call) Return(_a0 []kafka.TopicPartition, _a1 error) *KafkaConsumerInterface_OffsetsForTimes_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *KafkaConsumerInterface_OffsetsForTimes_Call) RunAndReturn(run func([]kafka.TopicPartition, int) ([]kafka.TopicPartition, error)) *KafkaConsumerInterface_OffsetsForTimes_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// QueryWatermarkOffsets provides a mock function with given fields: topic, partition, timeoutMs
+func (_m *KafkaConsumerInterface) QueryWatermarkOffsets(topic string, partition int32, timeoutMs int) (int64, int64, error) {
+	ret := _m.Called(topic, partition, timeoutMs)
+
+	if len(ret) == 0 {
+		panic("no return value specified for QueryWatermarkOffsets")
+	}
+
+	var r0 int64
+	var r1 int64
+	var r2 error
+	if rf, ok := ret.Get(0).(func(string, int32, int) (int64, int64, error)); ok {
+		return rf(topic, partition, timeoutMs)
+	}
+	if rf, ok := ret.Get(0).(func(string, int32, int) int64); ok {
+		r0 = rf(topic, partition, timeoutMs)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	if rf, ok := ret.Get(1).(func(string, int32, int) int64); ok {
+		r1 = rf(topic, partition, timeoutMs)
+	} else {
+		r1 = ret.Get(1).(int64)
+	}
+
+	if rf, ok := ret.Get(2).(func(string, int32, int) error); ok {
+		r2 = rf(topic, partition, timeoutMs)
+	} else {
+		r2 = ret.Error(2)
+	}
+
+	return r0, r1, r2
+}
+
+// KafkaConsumerInterface_QueryWatermarkOffsets_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'QueryWatermarkOffsets'
+type KafkaConsumerInterface_QueryWatermarkOffsets_Call struct {
+	*mock.Call
+}
+
+// QueryWatermarkOffsets is a helper method to define mock.On call
+//   - topic string
+//   - partition int32
+//   - timeoutMs int
+func (_e *KafkaConsumerInterface_Expecter) QueryWatermarkOffsets(topic interface{}, partition interface{}, timeoutMs interface{}) *KafkaConsumerInterface_QueryWatermarkOffsets_Call {
+	return &KafkaConsumerInterface_QueryWatermarkOffsets_Call{Call: _e.mock.On("QueryWatermarkOffsets", topic, partition, timeoutMs)}
+}
+
+func (_c *KafkaConsumerInterface_QueryWatermarkOffsets_Call) Run(run func(topic string, partition int32, timeoutMs int)) *KafkaConsumerInterface_QueryWatermarkOffsets_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string), args[1].(int32), args[2].(int))
+	})
+	return _c
+}
+
+func (_c *KafkaConsumerInterface_QueryWatermarkOffsets_Call) Return(_a0 int64, _a1 int64, _a2 error) *KafkaConsumerInterface_QueryWatermarkOffsets_Call {
+	_c.Call.Return(_a0, _a1, _a2)
+	return _c
+}
+
+func (_c *KafkaConsumerInterface_QueryWatermarkOffsets_Call) RunAndReturn(run func(string, int32, int) (int64, int64, error)) *KafkaConsumerInterface_QueryWatermarkOffsets_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // ReadMessage provides a mock function with given fields: timeout
 func (_m *KafkaConsumerInterface) ReadMessage(timeout time.Duration) (*kafka.Message, error) {
 	ret := _m.Called(timeout)
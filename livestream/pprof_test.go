@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func pprofStatus(e *echo.Echo, path string, auth func(*http.Request)) int {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if auth != nil {
+		auth(req)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestPprofDisabled(t *testing.T) {
+	e := echo.New()
+	registerPprof(e, PprofConfig{})
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/cmdline"} {
+		assert.Equal(t, http.StatusNotFound, pprofStatus(e, path, nil), path)
+	}
+}
+
+func TestPprofEnabled(t *testing.T) {
+	e := echo.New()
+	registerPprof(e, PprofConfig{Enabled: true})
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/pprof/goroutine?debug=1", "/debug/pprof/cmdline", "/debug/pprof/symbol"} {
+		assert.Equal(t, http.StatusOK, pprofStatus(e, path, nil), path)
+	}
+}
+
+func TestPprofBasicAuth(t *testing.T) {
+	e := echo.New()
+	registerPprof(e, PprofConfig{Enabled: true, Username: "admin", Password: "secret"})
+
+	assert.Equal(t, http.StatusUnauthorized, pprofStatus(e, "/debug/pprof/heap", nil))
+	assert.Equal(t, http.StatusUnauthorized, pprofStatus(e, "/debug/pprof/heap", func(req *http.Request) {
+		req.SetBasicAuth("admin", "wrong")
+	}))
+	assert.Equal(t, http.StatusOK, pprofStatus(e, "/debug/pprof/heap", func(req *http.Request) {
+		req.SetBasicAuth("admin", "secret")
+	}))
+}
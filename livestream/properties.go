@@ -0,0 +1,91 @@
+package main
+
+import "strings"
+
+// defaultDeniedProperties are stripped from events sent to clients unless the
+// deny list is configured otherwise.
+var defaultDeniedProperties = []string{"$ip"}
+
+// PropertyFilter decides which event properties are streamed to clients. When
+// the allow list is empty every property not on the deny list is kept.
+type PropertyFilter struct {
+	allow map[string]struct{}
+	deny  map[string]struct{}
+	// denyFolded holds the deny list in lower case, for FoldCase.
+	denyFolded map[string]struct{}
+
+	// FoldCase denies keys differing only in case from one on the deny list,
+	// e.g. $IP, to match a consumer that folds property keys.
+	FoldCase bool
+}
+
+func NewPropertyFilter(allow []string, deny []string) *PropertyFilter {
+	folded := make([]string, len(deny))
+	for i, key := range deny {
+		folded[i] = strings.ToLower(key)
+	}
+	return &PropertyFilter{allow: toSet(allow), deny: toSet(deny), denyFolded: toSet(folded)}
+}
+
+func toSet(keys []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		set[key] = struct{}{}
+	}
+	return set
+}
+
+func (f *PropertyFilter) denied(key string) bool {
+	if _, denied := f.deny[key]; denied {
+		return true
+	}
+	if f.FoldCase {
+		_, denied := f.denyFolded[strings.ToLower(key)]
+		return denied
+	}
+	return false
+}
+
+// Apply returns a copy of props holding only the permitted keys. props itself
+// is never modified, since the same map is shared with the stats path. A nil
+// filter returns props unchanged.
+func (f *PropertyFilter) Apply(props map[string]interface{}) map[string]interface{} {
+	if f == nil || props == nil {
+		return props
+	}
+
+	filtered := make(map[string]interface{}, len(props))
+	for key, value := range props {
+		if f.denied(key) {
+			continue
+		}
+		if len(f.allow) > 0 {
+			if _, allowed := f.allow[key]; !allowed {
+				continue
+			}
+		}
+		filtered[key] = value
+	}
+	return filtered
+}
+
+// lookupProperty returns the value of key in props. With foldCase, when key
+// itself is missing a key differing only in case is used instead, for
+// producers that send e.g. $IP. Of several such keys the smallest wins, so
+// the choice doesn't change from one event to the next.
+func lookupProperty(props map[string]interface{}, key string, foldCase bool) (interface{}, bool) {
+	if value, ok := props[key]; ok || !foldCase {
+		return value, ok
+	}
+
+	match := ""
+	for k := range props {
+		if strings.EqualFold(k, key) && (match == "" || k < match) {
+			match = k
+		}
+	}
+	if match == "" {
+		return nil, false
+	}
+	return props[match], true
+}
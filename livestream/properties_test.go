@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPropertyFilterApply(t *testing.T) {
+	props := map[string]interface{}{
+		"$ip":              "192.0.2.1",
+		"$current_url":     "https://example.com",
+		"$browser":         "Firefox",
+		"email":            "user@example.com",
+		"$geoip_city_name": "London",
+	}
+
+	tests := []struct {
+		name     string
+		allow    []string
+		deny     []string
+		expected []string
+	}{
+		{
+			name:     "Default deny",
+			deny:     defaultDeniedProperties,
+			expected: []string{"$current_url", "$browser", "email", "$geoip_city_name"},
+		},
+		{
+			name:     "Deny list",
+			deny:     []string{"$ip", "email"},
+			expected: []string{"$current_url", "$browser", "$geoip_city_name"},
+		},
+		{
+			name:     "Allow list",
+			allow:    []string{"$current_url", "$browser", "missing"},
+			expected: []string{"$current_url", "$browser"},
+		},
+		{
+			name:     "Deny wins over allow",
+			allow:    []string{"$current_url", "$ip"},
+			deny:     []string{"$ip"},
+			expected: []string{"$current_url"},
+		},
+		{
+			name:     "Nothing configured",
+			expected: []string{"$ip", "$current_url", "$browser", "email", "$geoip_city_name"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filtered := NewPropertyFilter(tt.allow, tt.deny).Apply(props)
+
+			keys := []string{}
+			for key := range filtered {
+				keys = append(keys, key)
+			}
+			assert.ElementsMatch(t, tt.expected, keys)
+			assert.Len(t, props, 5, "the original properties must not be modified")
+		})
+	}
+}
+
+func TestPropertyFilterFoldCase(t *testing.T) {
+	props := map[string]interface{}{"$IP": "192.0.2.1", "Email": "user@example.com", "$browser": "Firefox"}
+
+	filter := NewPropertyFilter(nil, []string{"$ip", "email"})
+	assert.Len(t, filter.Apply(props), 3)
+
+	filter.FoldCase = true
+	assert.Equal(t, map[string]interface{}{"$browser": "Firefox"}, filter.Apply(props))
+}
+
+func TestPropertyFilterNil(t *testing.T) {
+	var filter *PropertyFilter
+	props := map[string]interface{}{"$ip": "192.0.2.1"}
+
+	assert.Equal(t, props, filter.Apply(props))
+	assert.Nil(t, NewPropertyFilter(nil, []string{"$ip"}).Apply(nil))
+}
+
+func TestLookupProperty(t *testing.T) {
+	props := map[string]interface{}{"$ip": "1.1.1.1", "$IP": "2.2.2.2", "TOKEN": "phc_b", "Token": "phc_a"}
+
+	tests := []struct {
+		name     string
+		key      string
+		foldCase bool
+		expected interface{}
+	}{
+		{name: "Exact", key: "$ip", expected: "1.1.1.1"},
+		{name: "Exact wins over folding", key: "$ip", foldCase: true, expected: "1.1.1.1"},
+		{name: "Other case", key: "token"},
+		{name: "Other case folded", key: "token", foldCase: true, expected: "phc_b"},
+		{name: "Missing", key: "$session_id", foldCase: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, ok := lookupProperty(props, tt.key, tt.foldCase)
+			assert.Equal(t, tt.expected != nil, ok)
+			assert.Equal(t, tt.expected, value)
+		})
+	}
+}
+
+func TestFilterRunStripsProperties(t *testing.T) {
+	subChan := make(chan Subscription)
+	unSubChan := make(chan Subscription)
+	inboundChan := make(chan PostHogEvent)
+
+	filter := NewFilter(subChan, unSubChan, inboundChan)
+	filter.properties = NewPropertyFilter(nil, []string{"$ip", "email"})
+	go filter.Run()
+	defer close(inboundChan)
+
+	eventChan := make(chan interface{}, 1)
+	subChan <- Subscription{ClientId: "1", Token: "token1", EventChan: eventChan, ShouldClose: &atomic.Bool{}}
+
+	// The consumer sends the same event to the filter and the stats keeper.
+	event := PostHogEvent{
+		Token: "token1",
+		Event: "$pageview",
+		Properties: map[string]interface{}{
+			"$ip":          "192.0.2.1",
+			"email":        "user@example.com",
+			"$current_url": "https://example.com",
+		},
+	}
+	statsChan := make(chan PostHogEvent, 1)
+	statsChan <- event
+	inboundChan <- event
+
+	payload, err := json.Marshal(<-eventChan)
+	require.NoError(t, err)
+	assert.NotContains(t, string(payload), "$ip")
+	assert.NotContains(t, string(payload), "user@example.com")
+	assert.Contains(t, string(payload), "https://example.com")
+
+	stats := <-statsChan
+	assert.Equal(t, "192.0.2.1", stats.Properties["$ip"])
+	assert.Equal(t, "user@example.com", stats.Properties["email"])
+}
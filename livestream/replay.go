@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplayBuffers lets SSE clients pick up where they left off after a
+// reconnect. Every stream numbers its events and keeps the most recent ones.
+// When a client disconnects its stream is parked: the subscription stays live
+// and keeps collecting events until the client reconnects with the
+// Last-Event-ID header, or TTL passes and it is unsubscribed.
+type ReplayBuffers struct {
+	// Size is how many of a stream's most recent events are kept.
+	Size int
+	// TTL is how long a parked stream waits for its client.
+	TTL time.Duration
+	// MaxParked caps how many streams can be parked at once. Streams that
+	// disconnect beyond it are unsubscribed right away.
+	MaxParked int
+
+	mu     sync.Mutex
+	clock  Clock
+	parked map[string]*ReplayStream
+}
+
+func NewReplayBuffers(size int, ttl time.Duration, maxParked int) *ReplayBuffers {
+	return &ReplayBuffers{
+		Size:      size,
+		TTL:       ttl,
+		MaxParked: maxParked,
+		clock:     realClock{},
+		parked:    make(map[string]*ReplayStream),
+	}
+}
+
+// ReplayStream is the numbered history of the events sent on one SSE stream.
+type ReplayStream struct {
+	Id  string
+	sub Subscription
+
+	mu     sync.Mutex
+	size   int
+	seq    uint64
+	recent []replayedEvent
+
+	resume  chan struct{}
+	stopped chan struct{}
+}
+
+type replayedEvent struct {
+	seq  uint64
+	data []byte
+}
+
+// NewStream starts the history of a new stream for sub. A nil ReplayBuffers
+// still numbers events, it just keeps none of them.
+func (r *ReplayBuffers) NewStream(sub Subscription) *ReplayStream {
+	size := 0
+	if r != nil && r.Size > 0 {
+		size = r.Size
+	}
+	return &ReplayStream{Id: sub.ClientId, sub: sub, size: size}
+}
+
+// Subscription is the subscription the stream's events come from.
+func (s *ReplayStream) Subscription() Subscription {
+	return s.sub
+}
+
+// Add marshals payload, numbers it and keeps it for replay, returning the
+// SSE event to send.
+func (s *ReplayStream) Add(payload interface{}) (Event, error) {
+	data, err := marshalPayload(payload)
+	if err != nil {
+		return Event{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	if s.size > 0 {
+		event := replayedEvent{seq: s.seq, data: data}
+		if len(s.recent) < s.size {
+			s.recent = append(s.recent, event)
+		} else {
+			s.recent[(s.seq-1)%uint64(s.size)] = event
+		}
+	}
+	return Event{ID: []byte(s.eventId(s.seq)), Data: data}, nil
+}
+
+// Since returns the kept events that came after seq, oldest first.
+func (s *ReplayStream) Since(seq uint64) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []Event
+	oldest := 0
+	if len(s.recent) == s.size && s.size > 0 {
+		oldest = int(s.seq % uint64(s.size))
+	}
+	for i := range s.recent {
+		event := s.recent[(oldest+i)%len(s.recent)]
+		if event.seq > seq {
+			events = append(events, Event{ID: []byte(s.eventId(event.seq)), Data: event.data})
+		}
+	}
+	return events
+}
+
+func (s *ReplayStream) eventId(seq uint64) string {
+	return s.Id + ":" + strconv.FormatUint(seq, 10)
+}
+
+// parseEventId splits an event id made by ReplayStream into the stream's id
+// and the event's number.
+func parseEventId(id string) (string, uint64, error) {
+	i := strings.LastIndexByte(id, ':')
+	if i < 0 {
+		return "", 0, fmt.Errorf("event id %q has no sequence number", id)
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("event id %q has no sequence number", id)
+	}
+	return id[:i], seq, nil
+}
+
+// Resume takes back the parked stream lastEventId belongs to, along with the
+// events the client has not seen yet. It returns nil when there is no such
+// stream, or it filters events differently from sub, which then needs a
+// stream of its own.
+func (r *ReplayBuffers) Resume(lastEventId string, sub Subscription) (*ReplayStream, []Event) {
+	if r == nil || lastEventId == "" {
+		return nil, nil
+	}
+	id, seq, err := parseEventId(lastEventId)
+	if err != nil {
+		return nil, nil
+	}
+
+	r.mu.Lock()
+	stream, ok := r.parked[id]
+	if !ok || !sameFilters(stream.sub, sub) {
+		r.mu.Unlock()
+		return nil, nil
+	}
+	delete(r.parked, id)
+	r.mu.Unlock()
+
+	close(stream.resume)
+	<-stream.stopped
+	return stream, stream.Since(seq)
+}
+
+// sameFilters reports whether a and b let through the same events, in the
+// same shape.
+func sameFilters(a, b Subscription) bool {
+	return a.TeamId == b.TeamId &&
+		a.Token == b.Token &&
+		a.DistinctId == b.DistinctId &&
+		slices.Equal(a.EventTypes, b.EventTypes) &&
+		(a.Box == nil) == (b.Box == nil) && (a.Box == nil || *a.Box == *b.Box) &&
+		a.Geo == b.Geo &&
+		a.Format == b.Format
+}
+
+// Park keeps collecting the events of a stream whose client went away, for
+// Resume to hand back. Once TTL passes the subscription is sent to unSubChan.
+// Park returns false if the stream cannot be parked, in which case
+// unsubscribing is up to the caller.
+func (r *ReplayBuffers) Park(stream *ReplayStream, unSubChan chan Subscription) bool {
+	if r == nil || r.Size <= 0 || r.TTL <= 0 {
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, taken := r.parked[stream.Id]; taken || len(r.parked) >= r.MaxParked {
+		return false
+	}
+	stream.resume = make(chan struct{})
+	stream.stopped = make(chan struct{})
+	r.parked[stream.Id] = stream
+	parkedStreams.Inc()
+
+	go r.collect(stream, unSubChan)
+	return true
+}
+
+// collect adds the events of a parked stream to its history until the stream
+// is resumed or expires.
+func (r *ReplayBuffers) collect(stream *ReplayStream, unSubChan chan Subscription) {
+	defer close(stream.stopped)
+	defer parkedStreams.Dec()
+
+	expired := r.clock.After(r.TTL)
+	for {
+		select {
+		case <-stream.resume:
+			return
+		case payload := <-stream.sub.EventChan:
+			if _, err := stream.Add(payload); err != nil {
+				captureException(err)
+			}
+		case <-expired:
+			r.mu.Lock()
+			resumed := r.parked[stream.Id] != stream
+			if !resumed {
+				delete(r.parked, stream.Id)
+			}
+			r.mu.Unlock()
+			if resumed {
+				// Resume got to it first and is waiting for us to stop.
+				return
+			}
+			unSubChan <- stream.sub
+			stream.sub.ShouldClose.Store(true)
+			return
+		}
+	}
+}
+
+// Parked returns how many streams are waiting for their client.
+func (r *ReplayBuffers) Parked() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.parked)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func replayData(events []Event) []string {
+	data := []string{}
+	for _, event := range events {
+		data = append(data, string(event.ID)+" "+string(event.Data))
+	}
+	return data
+}
+
+func TestReplayStreamKeepsRecentEvents(t *testing.T) {
+	stream := NewReplayBuffers(3, time.Minute, 1).NewStream(Subscription{ClientId: "abc"})
+	for i := 1; i <= 5; i++ {
+		event, err := stream.Add(i)
+		require.NoError(t, err)
+		assert.Equal(t, "abc:"+string(event.Data), string(event.ID))
+	}
+
+	assert.Equal(t, []string{"abc:3 3", "abc:4 4", "abc:5 5"}, replayData(stream.Since(0)))
+	assert.Equal(t, []string{"abc:5 5"}, replayData(stream.Since(4)))
+	assert.Empty(t, stream.Since(5))
+}
+
+func TestReplayStreamDisabled(t *testing.T) {
+	var replay *ReplayBuffers
+	stream := replay.NewStream(Subscription{ClientId: "abc"})
+	event, err := stream.Add("x")
+	require.NoError(t, err)
+	assert.Equal(t, "abc:1", string(event.ID))
+	assert.Empty(t, stream.Since(0))
+
+	assert.False(t, replay.Park(stream, make(chan Subscription)))
+	resumed, _ := replay.Resume("abc:1", Subscription{})
+	assert.Nil(t, resumed)
+}
+
+func TestParseEventId(t *testing.T) {
+	id, seq, err := parseEventId("a:b:42")
+	require.NoError(t, err)
+	assert.Equal(t, "a:b", id)
+	assert.Equal(t, uint64(42), seq)
+
+	for _, bad := range []string{"", "abc", "abc:", "abc:-1", "abc:x"} {
+		_, _, err := parseEventId(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestReplayBuffersResume(t *testing.T) {
+	replay := NewReplayBuffers(10, time.Minute, 10)
+	sub := Subscription{ClientId: "abc", Token: "token1", EventChan: make(chan interface{}, 10), ShouldClose: &atomic.Bool{}}
+	stream := replay.NewStream(sub)
+	_, err := stream.Add("seen")
+	require.NoError(t, err)
+	require.True(t, replay.Park(stream, make(chan Subscription)))
+	assert.False(t, replay.Park(stream, make(chan Subscription)), "already parked")
+
+	// Only a stream with the same filters can be resumed.
+	for _, other := range []Subscription{
+		{Token: "token2"},
+		{Token: "token1", Geo: true},
+		{Token: "token1", TeamId: 2},
+		{Token: "token1", DistinctId: "user1"},
+		{Token: "token1", EventTypes: []string{"$pageview"}},
+		{Token: "token1", Box: &BoundingBox{MaxLat: 1, MaxLng: 1}},
+		{Token: "token1", Format: FormatCompact},
+	} {
+		resumed, _ := replay.Resume("abc:1", other)
+		assert.Nil(t, resumed, "%+v", other)
+	}
+	resumed, _ := replay.Resume("xyz:1", sub)
+	assert.Nil(t, resumed)
+
+	resumed, missed := replay.Resume("abc:0", sub)
+	require.Same(t, stream, resumed)
+	assert.Equal(t, []string{`abc:1 "seen"`}, replayData(missed))
+	assert.Zero(t, replay.Parked())
+	assert.False(t, sub.ShouldClose.Load())
+}
+
+func TestReplayBuffersExpire(t *testing.T) {
+	replay := NewReplayBuffers(10, time.Minute, 10)
+	replay.clock = newFakeClock()
+	unSubChan := make(chan Subscription, 1)
+	sub := Subscription{ClientId: "abc", Token: "token1", EventChan: make(chan interface{}), ShouldClose: &atomic.Bool{}}
+	require.True(t, replay.Park(replay.NewStream(sub), unSubChan))
+
+	// The fake clock's After fires right away, so the stream expires.
+	assert.Equal(t, "abc", (<-unSubChan).ClientId)
+	assert.Eventually(t, sub.ShouldClose.Load, time.Second, time.Millisecond)
+	assert.Zero(t, replay.Parked())
+
+	resumed, _ := replay.Resume("abc:1", sub)
+	assert.Nil(t, resumed)
+}
+
+func TestReplayBuffersMaxParked(t *testing.T) {
+	replay := NewReplayBuffers(10, time.Minute, 1)
+	newSub := func(id string) Subscription {
+		return Subscription{ClientId: id, EventChan: make(chan interface{}), ShouldClose: &atomic.Bool{}}
+	}
+	assert.True(t, replay.Park(replay.NewStream(newSub("a")), make(chan Subscription)))
+	assert.False(t, replay.Park(replay.NewStream(newSub("b")), make(chan Subscription)))
+}
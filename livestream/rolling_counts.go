@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// RollingCounts counts occurrences per key over a sliding window. The window
+// is split into a ring of fixed-size buckets; a bucket is reset the next time
+// its slot comes around, so old counts expire without a background sweep.
+type RollingCounts struct {
+	// MaxKeys bounds how many keys each bucket tracks, zero meaning no bound.
+	// When a bucket is full a new key replaces the least counted one and
+	// inherits its count (the Space-Saving algorithm), so frequent keys are
+	// never lost but rare ones may be overcounted.
+	MaxKeys int
+
+	mu         sync.Mutex
+	clock      Clock
+	bucketSize time.Duration
+	buckets    []countBucket
+}
+
+type countBucket struct {
+	// start is the beginning of the period the bucket currently counts.
+	start  time.Time
+	counts map[string]int
+}
+
+// NewRollingCounts returns counts over window, kept in the given number of
+// buckets. Counts expire one bucket at a time, so more buckets make expiry
+// smoother at the cost of memory.
+func NewRollingCounts(window time.Duration, buckets int, clock Clock) *RollingCounts {
+	buckets = max(buckets, 1)
+	return &RollingCounts{
+		clock:      clock,
+		bucketSize: max(window/time.Duration(buckets), 1),
+		buckets:    make([]countBucket, buckets),
+	}
+}
+
+// Window is how far back Counts looks.
+func (r *RollingCounts) Window() time.Duration {
+	return r.bucketSize * time.Duration(len(r.buckets))
+}
+
+func (r *RollingCounts) Add(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bucket := r.current(r.clock.Now())
+	if _, ok := bucket.counts[key]; !ok && r.MaxKeys > 0 && len(bucket.counts) >= r.MaxKeys {
+		minKey, minCount := "", 0
+		for k, n := range bucket.counts {
+			if minKey == "" || n < minCount {
+				minKey, minCount = k, n
+			}
+		}
+		delete(bucket.counts, minKey)
+		bucket.counts[key] = minCount
+	}
+	bucket.counts[key]++
+}
+
+// KeyCount is one entry of a Top result.
+type KeyCount struct {
+	Key   string
+	Count int
+}
+
+// Top returns the n most counted keys within the window, most counted first.
+// Ties are ordered by key.
+func (r *RollingCounts) Top(n int) []KeyCount {
+	counts := r.Counts()
+
+	top := make([]KeyCount, 0, len(counts))
+	for key, count := range counts {
+		top = append(top, KeyCount{Key: key, Count: count})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Key < top[j].Key
+	})
+
+	if n >= 0 && n < len(top) {
+		top = top[:n]
+	}
+	return top
+}
+
+// Counts returns the count of every key seen within the window.
+func (r *RollingCounts) Counts() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.clock.Now()
+	counts := make(map[string]int)
+	for _, bucket := range r.buckets {
+		if !r.live(bucket, now) {
+			continue
+		}
+		for key, n := range bucket.counts {
+			counts[key] += n
+		}
+	}
+	return counts
+}
+
+// current returns the bucket for now, clearing it if it still holds counts
+// from an earlier lap of the ring.
+func (r *RollingCounts) current(now time.Time) *countBucket {
+	start := now.Truncate(r.bucketSize)
+	bucket := &r.buckets[int(start.UnixNano()/int64(r.bucketSize))%len(r.buckets)]
+	if !bucket.start.Equal(start) || bucket.counts == nil {
+		bucket.start = start
+		bucket.counts = make(map[string]int)
+	}
+	return bucket
+}
+
+func (r *RollingCounts) live(bucket countBucket, now time.Time) bool {
+	return bucket.counts != nil && now.Sub(bucket.start) < r.Window()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollingCounts(t *testing.T) {
+	clock := newFakeClock()
+	counts := NewRollingCounts(time.Minute, 60, clock)
+
+	assert.Equal(t, time.Minute, counts.Window())
+	assert.Empty(t, counts.Counts())
+
+	counts.Add("token1")
+	counts.Add("token1")
+	counts.Add("token2")
+	assert.Equal(t, map[string]int{"token1": 2, "token2": 1}, counts.Counts())
+
+	clock.Advance(30 * time.Second)
+	counts.Add("token1")
+	assert.Equal(t, map[string]int{"token1": 3, "token2": 1}, counts.Counts())
+
+	// The first three events fall out of the window, the later one stays.
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, map[string]int{"token1": 1}, counts.Counts())
+
+	clock.Advance(30 * time.Second)
+	assert.Empty(t, counts.Counts())
+}
+
+func TestRollingCountsReusesBuckets(t *testing.T) {
+	clock := newFakeClock()
+	counts := NewRollingCounts(10*time.Second, 10, clock)
+
+	counts.Add("token1")
+
+	// Exactly one lap later the same slot is reused and must start from zero.
+	clock.Advance(10 * time.Second)
+	counts.Add("token2")
+	assert.Equal(t, map[string]int{"token2": 1}, counts.Counts())
+
+	// Many laps later nothing old survives either.
+	clock.Advance(time.Hour)
+	counts.Add("token3")
+	assert.Equal(t, map[string]int{"token3": 1}, counts.Counts())
+}
+
+func TestRollingCountsExpiresPerBucket(t *testing.T) {
+	clock := newFakeClock()
+	counts := NewRollingCounts(4*time.Second, 4, clock)
+
+	for i := 0; i < 4; i++ {
+		counts.Add("token1")
+		clock.Advance(time.Second)
+	}
+	// The first second's bucket has just expired.
+	assert.Equal(t, map[string]int{"token1": 3}, counts.Counts())
+
+	clock.Advance(2 * time.Second)
+	assert.Equal(t, map[string]int{"token1": 1}, counts.Counts())
+}
+
+func TestRollingCountsTop(t *testing.T) {
+	clock := newFakeClock()
+	counts := NewRollingCounts(time.Minute, 60, clock)
+
+	// A skewed distribution: a few heavy events and a long tail.
+	for event, n := range map[string]int{"$pageview": 500, "$autocapture": 200, "$pageleave": 100, "$identify": 100} {
+		for i := 0; i < n; i++ {
+			counts.Add(event)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		counts.Add(fmt.Sprintf("custom-%d", i))
+	}
+
+	assert.Equal(t, []KeyCount{
+		{Key: "$pageview", Count: 500},
+		{Key: "$autocapture", Count: 200},
+		{Key: "$identify", Count: 100},
+		{Key: "$pageleave", Count: 100},
+	}, counts.Top(4))
+	assert.Len(t, counts.Top(1000), 54)
+	assert.Empty(t, NewRollingCounts(time.Minute, 60, clock).Top(10))
+}
+
+func TestRollingCountsMaxKeys(t *testing.T) {
+	clock := newFakeClock()
+	counts := NewRollingCounts(time.Minute, 60, clock)
+	counts.MaxKeys = 10
+
+	// Heavy hitters interleaved with a high-cardinality tail.
+	for i := 0; i < 1000; i++ {
+		counts.Add("$pageview")
+		if i%2 == 0 {
+			counts.Add("$autocapture")
+		}
+		counts.Add(fmt.Sprintf("custom-%d", i))
+	}
+
+	all := counts.Counts()
+	assert.LessOrEqual(t, len(all), 10)
+
+	top := counts.Top(2)
+	assert.Equal(t, "$pageview", top[0].Key)
+	assert.Equal(t, "$autocapture", top[1].Key)
+	// Space-Saving may overcount a key but never undercounts a kept one.
+	assert.GreaterOrEqual(t, top[0].Count, 1000)
+	assert.GreaterOrEqual(t, top[1].Count, 500)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// RollingUniques estimates the number of distinct values per key over a
+// sliding window. Like RollingCounts it keeps a ring of buckets, each holding
+// one HyperLogLog per key, and merges the live buckets on read. Memory per key
+// is at most buckets * 2^precision bytes.
+type RollingUniques struct {
+	mu         sync.Mutex
+	clock      Clock
+	precision  int
+	seed       maphash.Seed
+	bucketSize time.Duration
+	buckets    []uniquesBucket
+}
+
+type uniquesBucket struct {
+	start    time.Time
+	sketches map[string]*hyperLogLog
+}
+
+// UniquesEstimate is the approximate distinct count for one key.
+type UniquesEstimate struct {
+	Estimate      uint64  `json:"estimate"`
+	RelativeError float64 `json:"relative_error"`
+}
+
+func NewRollingUniques(window time.Duration, buckets int, precision int, clock Clock) (*RollingUniques, error) {
+	// Validate the precision up front rather than on the first Add.
+	if _, err := newHyperLogLog(precision, maphash.MakeSeed()); err != nil {
+		return nil, err
+	}
+
+	buckets = max(buckets, 1)
+	return &RollingUniques{
+		clock:      clock,
+		precision:  precision,
+		seed:       maphash.MakeSeed(),
+		bucketSize: max(window/time.Duration(buckets), 1),
+		buckets:    make([]uniquesBucket, buckets),
+	}, nil
+}
+
+func (r *RollingUniques) Window() time.Duration {
+	return r.bucketSize * time.Duration(len(r.buckets))
+}
+
+// Add records value as seen for key.
+func (r *RollingUniques) Add(key string, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bucket := r.current(r.clock.Now())
+	sketch, ok := bucket.sketches[key]
+	if !ok {
+		// The precision was validated by NewRollingUniques.
+		sketch, _ = newHyperLogLog(r.precision, r.seed)
+		bucket.sketches[key] = sketch
+	}
+	sketch.Add(value)
+}
+
+// Estimates returns the approximate number of distinct values seen for every
+// key within the window.
+func (r *RollingUniques) Estimates() map[string]UniquesEstimate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.clock.Now()
+	merged := make(map[string]*hyperLogLog)
+	for _, bucket := range r.buckets {
+		if bucket.sketches == nil || now.Sub(bucket.start) >= r.Window() {
+			continue
+		}
+		for key, sketch := range bucket.sketches {
+			if _, ok := merged[key]; !ok {
+				merged[key], _ = newHyperLogLog(r.precision, r.seed)
+			}
+			merged[key].Merge(sketch)
+		}
+	}
+
+	estimates := make(map[string]UniquesEstimate, len(merged))
+	for key, sketch := range merged {
+		estimates[key] = UniquesEstimate{Estimate: sketch.Estimate(), RelativeError: sketch.RelativeError()}
+	}
+	return estimates
+}
+
+func (r *RollingUniques) current(now time.Time) *uniquesBucket {
+	start := now.Truncate(r.bucketSize)
+	bucket := &r.buckets[int(start.UnixNano()/int64(r.bucketSize))%len(r.buckets)]
+	if !bucket.start.Equal(start) || bucket.sketches == nil {
+		bucket.start = start
+		bucket.sketches = make(map[string]*hyperLogLog)
+	}
+	return bucket
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollingUniques(t *testing.T) {
+	clock := newFakeClock()
+	uniques, err := NewRollingUniques(time.Minute, 6, 12, clock)
+	require.NoError(t, err)
+
+	for i := 0; i < 5000; i++ {
+		uniques.Add("token1", fmt.Sprintf("user-%d", i))
+	}
+	uniques.Add("token2", "user-1")
+
+	// The same users seen again later in the window are not new uniques.
+	clock.Advance(30 * time.Second)
+	for i := 0; i < 5000; i++ {
+		uniques.Add("token1", fmt.Sprintf("user-%d", i))
+	}
+
+	estimates := uniques.Estimates()
+	require.Contains(t, estimates, "token1")
+	assert.InDelta(t, 5000, estimates["token1"].Estimate, 4*estimates["token1"].RelativeError*5000)
+	assert.InDelta(t, 0.01625, estimates["token1"].RelativeError, 0.0001)
+	assert.Equal(t, uint64(1), estimates["token2"].Estimate)
+
+	// Only the later half remains.
+	clock.Advance(40 * time.Second)
+	estimates = uniques.Estimates()
+	assert.InDelta(t, 5000, estimates["token1"].Estimate, 4*estimates["token1"].RelativeError*5000)
+	assert.NotContains(t, estimates, "token2")
+
+	clock.Advance(time.Minute)
+	assert.Empty(t, uniques.Estimates())
+}
+
+func TestRollingUniquesInvalidPrecision(t *testing.T) {
+	_, err := NewRollingUniques(time.Minute, 6, 20, newFakeClock())
+	assert.Error(t, err)
+}
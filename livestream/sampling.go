@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// TokenSampler streams only a share of the events of high-volume tokens, so
+// they don't swamp their subscribers. Which events are kept depends only on
+// the event, so every subscriber, and every instance, sees the same ones.
+// Stats are kept from every event regardless.
+type TokenSampler struct {
+	// every maps a token to N, keeping one in N of its events.
+	every map[string]uint64
+}
+
+// ParseTokenSampler reads "token:N" specs, each keeping one in N events of
+// that token. Tokens without a spec are not sampled. It returns nil when there
+// are no specs.
+func ParseTokenSampler(specs []string) (*TokenSampler, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	every := make(map[string]uint64, len(specs))
+	for _, spec := range specs {
+		i := strings.LastIndexByte(spec, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("expected token:N, got %q", spec)
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(spec[i+1:]), 10, 64)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("expected a positive N in %q", spec)
+		}
+		every[strings.TrimSpace(spec[:i])] = n
+	}
+	return &TokenSampler{every: every}, nil
+}
+
+// Keep reports whether the event is streamed. A nil sampler keeps everything.
+func (s *TokenSampler) Keep(event PostHogEvent) bool {
+	if s == nil {
+		return true
+	}
+	n, ok := s.every[event.Token]
+	if !ok || n == 1 {
+		return true
+	}
+
+	h := fnv.New64a()
+	if event.Uuid != "" {
+		h.Write([]byte(event.Uuid))
+	} else {
+		// Not as stable as the uuid, but the same for every subscriber.
+		h.Write([]byte(event.DistinctId))
+		h.Write([]byte(event.Event))
+		h.Write([]byte(strconv.FormatInt(event.Timestamp.UnixNano(), 10)))
+	}
+	return h.Sum64()%n == 0
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTokenSampler(t *testing.T) {
+	sampler, err := ParseTokenSampler([]string{"phc_big:10", " phc_huge : 100 "})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"phc_big": 10, "phc_huge": 100}, sampler.every)
+
+	sampler, err = ParseTokenSampler(nil)
+	require.NoError(t, err)
+	assert.Nil(t, sampler)
+	assert.True(t, sampler.Keep(PostHogEvent{Token: "phc_big"}))
+
+	for _, spec := range []string{"phc_big", ":10", "phc_big:0", "phc_big:-1", "phc_big:ten"} {
+		_, err := ParseTokenSampler([]string{spec})
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestTokenSamplerKeepRate(t *testing.T) {
+	sampler, err := ParseTokenSampler([]string{"phc_big:10", "phc_huge:100", "phc_one:1"})
+	require.NoError(t, err)
+
+	const events = 100000
+	kept := map[string]int{}
+	for i := 0; i < events; i++ {
+		id := uuid.Must(uuid.NewV4()).String()
+		for _, token := range []string{"phc_big", "phc_huge", "phc_one", "phc_small"} {
+			if sampler.Keep(PostHogEvent{Token: token, Uuid: id}) {
+				kept[token]++
+			}
+		}
+	}
+
+	assert.InEpsilon(t, events/10, kept["phc_big"], 0.1)
+	assert.InEpsilon(t, events/100, kept["phc_huge"], 0.2)
+	assert.Equal(t, events, kept["phc_one"])
+	assert.Equal(t, events, kept["phc_small"])
+}
+
+func TestTokenSamplerDeterministic(t *testing.T) {
+	sampler, err := ParseTokenSampler([]string{"phc_big:3"})
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		event := PostHogEvent{Token: "phc_big", Uuid: uuid.Must(uuid.NewV4()).String()}
+		keep := sampler.Keep(event)
+		for j := 0; j < 3; j++ {
+			assert.Equal(t, keep, sampler.Keep(event))
+		}
+	}
+}
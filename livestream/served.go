@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 
 	"github.com/hashicorp/golang-lru/v2/expirable"
 	"github.com/labstack/echo/v4"
@@ -60,3 +61,113 @@ func statsHandler(stats *Stats) func(c echo.Context) error {
 		return c.JSON(http.StatusOK, siteStats)
 	}
 }
+
+// tokenCountsHandler returns how many events each token sent within the last
+// COUNTER_TTL, as {token: count}.
+func tokenCountsHandler(stats *Stats) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, stats.TokenCounts.Counts())
+	}
+}
+
+// activeTokensHandler lists the tokens that sent events within the
+// tokens.active_ttl, and the pinned ones, with when each was last seen and
+// how many events it sent since it became active.
+func activeTokensHandler(tokens *ActiveTokens) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		type resp struct {
+			WindowSeconds int             `json:"window_seconds"`
+			Tokens        []TokenActivity `json:"tokens"`
+		}
+
+		snapshot := tokens.Snapshot()
+		if snapshot == nil {
+			snapshot = []TokenActivity{}
+		}
+		return c.JSON(http.StatusOK, resp{
+			WindowSeconds: int(tokens.TTL.Seconds()),
+			Tokens:        snapshot,
+		})
+	}
+}
+
+// subscribersHandler returns how many clients are streaming events, in total
+// and for each token. Clients streaming every token are only in the total and
+// all_tokens.
+func subscribersHandler(filter *Filter) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		type resp struct {
+			Total     int            `json:"total"`
+			AllTokens int            `json:"all_tokens"`
+			Tokens    map[string]int `json:"tokens"`
+		}
+
+		tokens := filter.Subscribers()
+		total := 0
+		for _, n := range tokens {
+			total += n
+		}
+		allTokens := tokens[""]
+		delete(tokens, "")
+		return c.JSON(http.StatusOK, resp{
+			Total:     total,
+			AllTokens: allTokens,
+			Tokens:    tokens,
+		})
+	}
+}
+
+const (
+	defaultTopEvents = 10
+	maxTopEvents     = 100
+)
+
+// topEventsHandler returns the n most common event names within the last
+// COUNTER_TTL, most common first. n defaults to 10 and is capped at 100.
+func topEventsHandler(stats *Stats) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		type eventCount struct {
+			Event string `json:"event"`
+			Count int    `json:"count"`
+		}
+		type resp struct {
+			WindowSeconds int          `json:"window_seconds"`
+			Events        []eventCount `json:"events"`
+		}
+
+		n := defaultTopEvents
+		if param := c.QueryParam("n"); param != "" {
+			parsed, err := strconv.Atoi(param)
+			if err != nil || parsed < 1 {
+				return echo.NewHTTPError(http.StatusBadRequest, "n must be a positive integer")
+			}
+			n = min(parsed, maxTopEvents)
+		}
+
+		events := []eventCount{}
+		for _, top := range stats.EventCounts.Top(n) {
+			events = append(events, eventCount{Event: top.Key, Count: top.Count})
+		}
+		return c.JSON(http.StatusOK, resp{
+			WindowSeconds: int(stats.EventCounts.Window().Seconds()),
+			Events:        events,
+		})
+	}
+}
+
+// geoCountsHandler returns how many events came from each country within the
+// last COUNTER_TTL, as {countryCode: count}. Events without a country are
+// counted under "unknown".
+func geoCountsHandler(stats *Stats) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, stats.CountryCounts.Counts())
+	}
+}
+
+// uniquesHandler returns the approximate number of distinct users per token
+// within the last COUNTER_TTL, with the estimate's relative error.
+func uniquesHandler(stats *Stats) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, stats.Uniques.Estimates())
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// errShuttingDown is the cause request contexts are cancelled with once the
+// server drains, telling streaming handlers to send what is buffered for
+// their client and return.
+var errShuttingDown = errors.New("server is shutting down")
+
+// shuttingDown reports whether ctx was cancelled because the server is
+// shutting down, rather than because the client went away.
+func shuttingDown(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errShuttingDown)
+}
+
+// Shutdown drains the service in order:
+//
+//  1. the server stops accepting connections,
+//  2. the consumer stops, and every event it read goes through the hub's
+//     sinks, the filter included, to the subscriptions,
+//  3. the requests are cancelled with errShuttingDown, so streaming handlers
+//     send what is buffered for their client and return.
+//
+// server's requests must have a base context that cancelRequests cancels.
+// If ctx runs out first, the remaining connections are closed and ctx's
+// error is returned.
+func Shutdown(ctx context.Context, server *http.Server, cancelRequests context.CancelCauseFunc, consumer KafkaConsumer, hub *Hub) error {
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.Shutdown(ctx)
+	}()
+
+	drained := make(chan struct{})
+	go func() {
+		consumer.Close()
+		hub.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+	}
+	cancelRequests(errShuttingDown)
+
+	if err := <-stopped; err != nil {
+		server.Close()
+		return err
+	}
+	return nil
+}
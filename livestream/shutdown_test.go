@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/posthog/posthog/livestream/mocks"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// newDrainableServer starts e with request contexts cancelled by the returned
+// func, the way main sets it up.
+func newDrainableServer(t *testing.T, e *echo.Echo) (*httptest.Server, context.CancelCauseFunc) {
+	t.Helper()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	server := httptest.NewUnstartedServer(e)
+	server.Config.BaseContext = func(net.Listener) context.Context { return ctx }
+	server.Start()
+	t.Cleanup(server.Close)
+	return server, cancel
+}
+
+func TestShutdownDrainsThenExits(t *testing.T) {
+	viper.Set("jwt.secret", "test-secret")
+
+	inbound := make(chan PostHogEvent)
+	hub := NewHub(inbound)
+	filter := NewFilter(make(chan Subscription), make(chan Subscription), make(chan PostHogEvent))
+	hub.AddSink("filter", filter, 10, Block)
+	go hub.Run()
+	go filter.Run()
+
+	e := echo.New()
+	e.GET("/events", eventsHandler(filter.subChan, filter.unSubChan, nil, nil, nil, 0, realClock{}))
+	server, cancelRequests := newDrainableServer(t, e)
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+createProjectToken(t, 1, "token1"))
+	resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+
+	inbound <- PostHogEvent{Token: "token1", Uuid: "1"}
+	assert.Contains(t, readSSEEvents(t, reader, 1)[0][1], `"uuid":"1"`)
+
+	// The consumer hands over what it still had when it is closed.
+	consumer := new(mocks.KafkaConsumer)
+	consumer.On("Close").Run(func(mock.Arguments) {
+		inbound <- PostHogEvent{Token: "token1", Uuid: "2"}
+		inbound <- PostHogEvent{Token: "token1", Uuid: "3"}
+		close(inbound)
+	}).Once()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- Shutdown(ctx, server.Config, cancelRequests, consumer, hub) }()
+
+	events := readSSEEvents(t, reader, 2)
+	assert.Contains(t, events[0][1], `"uuid":"2"`)
+	assert.Contains(t, events[1][1], `"uuid":"3"`)
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err, "the stream ends cleanly")
+	assert.Equal(t, "\n", string(rest), "nothing after the last event")
+
+	require.NoError(t, <-done)
+	consumer.AssertExpectations(t)
+}
+
+func TestShutdownTimesOut(t *testing.T) {
+	started := make(chan struct{})
+	stuck := make(chan struct{})
+	defer close(stuck)
+
+	e := echo.New()
+	e.GET("/stuck", func(c echo.Context) error {
+		close(started)
+		<-stuck
+		return nil
+	})
+	server, cancelRequests := newDrainableServer(t, e)
+	go http.Get(server.URL + "/stuck")
+	<-started
+
+	consumer := new(mocks.KafkaConsumer)
+	consumer.On("Close").Once()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := Shutdown(ctx, server.Config, cancelRequests, consumer, NewHub(make(chan PostHogEvent)))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	consumer.AssertExpectations(t)
+}
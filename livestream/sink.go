@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSinkFlushInterval = time.Second
+	// sinkBuffer is the default for how many events can wait for the sink
+	// before new ones are skipped.
+	sinkBuffer = 1000
+)
+
+// SinkConfig sets up the JSONL and webhook sinks. Empty paths and URLs leave
+// a sink out.
+type SinkConfig struct {
+	JSONL         string
+	FlushInterval time.Duration
+	Buffer        int
+	Webhook       WebhookConfig
+}
+
+// WebhookConfig holds the sink.webhook.* settings.
+type WebhookConfig struct {
+	URL           string
+	BatchSize     int
+	FlushInterval time.Duration
+	Timeout       time.Duration
+	MaxRetries    int
+	DeadLetter    string
+}
+
+// Sink is an output for the event stream, such as the filter that feeds SSE
+// and WebSocket clients. Sinks are run with runSink: Write is only ever called
+// from one goroutine and Close once after the last Write. An error from one
+// sink is counted and reported, and does not affect the others.
+type Sink interface {
+	Write(event PostHogEvent) error
+	Close() error
+}
+
+// Flusher is implemented by sinks that buffer output. runSink flushes them
+// every flush interval, so a quiet stream is not held back in a buffer.
+type Flusher interface {
+	Flush() error
+}
+
+// FlushScheduler is implemented by flushers that want flushing on an
+// interval of their own. A zero interval keeps runSink's.
+type FlushScheduler interface {
+	FlushInterval() time.Duration
+}
+
+// runSink writes events to sink until the channel is closed, then flushes and
+// closes the sink. name labels the sink's errors.
+func runSink(name string, sink Sink, events <-chan PostHogEvent, flushInterval time.Duration, clock Clock) {
+	flusher, _ := sink.(Flusher)
+	if scheduler, ok := sink.(FlushScheduler); ok && scheduler.FlushInterval() > 0 {
+		flushInterval = scheduler.FlushInterval()
+	}
+	if flushInterval <= 0 {
+		flushInterval = defaultSinkFlushInterval
+	}
+
+	var flush <-chan time.Time
+	if flusher != nil {
+		flush = clock.After(flushInterval)
+	}
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				if flusher != nil {
+					sinkError(name, flusher.Flush())
+				}
+				sinkError(name, sink.Close())
+				return
+			}
+			sinkError(name, sink.Write(event))
+		case <-flush:
+			sinkError(name, flusher.Flush())
+			flush = clock.After(flushInterval)
+		}
+	}
+}
+
+func sinkError(name string, err error) {
+	if err == nil {
+		return
+	}
+	sinkErrors.WithLabelValues(name).Inc()
+	log.Printf("Sink %s failed: %v", name, err)
+	captureException(fmt.Errorf("sink %s: %w", name, err))
+}
+
+// JSONLSink writes every event it receives as one line of JSON, for piping
+// the stream into other tools while debugging. Output is buffered until
+// Flush. A failed write drops the events it held, so a broken sink never
+// holds up the stream.
+type JSONLSink struct {
+	out      io.Writer
+	w        *bufio.Writer
+	buffered int
+	dropped  atomic.Int64
+}
+
+func NewJSONLSink(out io.Writer) *JSONLSink {
+	return &JSONLSink{
+		out: out,
+		w:   bufio.NewWriter(out),
+	}
+}
+
+// openSinkOutput opens the sink.jsonl setting: "-" is stdout, anything else
+// a file that is appended to.
+func openSinkOutput(path string) (io.Writer, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+}
+
+func (s *JSONLSink) Write(event PostHogEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		s.dropped.Add(1)
+		return fmt.Errorf("encoding event %s: %w", event.Uuid, err)
+	}
+
+	s.buffered++
+	if _, err := s.w.Write(append(line, '\n')); err != nil {
+		return s.fail(err)
+	}
+	return nil
+}
+
+func (s *JSONLSink) Flush() error {
+	if err := s.w.Flush(); err != nil {
+		return s.fail(err)
+	}
+	s.buffered = 0
+	return nil
+}
+
+// Close flushes what is left. The output itself is left open, as it may be
+// stdout.
+func (s *JSONLSink) Close() error {
+	return s.Flush()
+}
+
+// fail drops whatever is buffered. bufio.Writer keeps returning the first
+// error forever, so the writer is reset to try the output again next time.
+func (s *JSONLSink) fail(err error) error {
+	n := s.buffered
+	s.dropped.Add(int64(n))
+	s.buffered = 0
+	s.w.Reset(s.out)
+	return fmt.Errorf("dropped %d events: %w", n, err)
+}
+
+// Dropped returns how many events were not written because encoding or
+// writing them failed.
+func (s *JSONLSink) Dropped() int64 {
+	return s.dropped.Load()
+}
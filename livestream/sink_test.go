@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONLSink(t *testing.T) {
+	var out bytes.Buffer
+	sink := NewJSONLSink(&out)
+
+	for _, uuid := range []string{"1", "2", "3"} {
+		require.NoError(t, sink.Write(PostHogEvent{Uuid: uuid, Token: "token", Event: "$pageview", Properties: map[string]interface{}{"url": "https://example.com"}}))
+	}
+	assert.Empty(t, out.String(), "output is buffered until flushed")
+	require.NoError(t, sink.Close())
+
+	var uuids []string
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var event PostHogEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event), "line %q is not valid JSON", scanner.Text())
+		assert.Equal(t, "$pageview", event.Event)
+		assert.Equal(t, "https://example.com", event.Properties["url"])
+		uuids = append(uuids, event.Uuid)
+	}
+	assert.Equal(t, []string{"1", "2", "3"}, uuids)
+	assert.Zero(t, sink.Dropped())
+}
+
+// syncBuffer is a bytes.Buffer safe to read while the sink writes to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRunSinkFlushesPeriodically(t *testing.T) {
+	var out syncBuffer
+	events := make(chan PostHogEvent)
+	defer close(events)
+	go runSink("jsonl", NewJSONLSink(&out), events, 10*time.Millisecond, realClock{})
+
+	events <- PostHogEvent{Uuid: "1"}
+
+	assert.Eventually(t, func() bool {
+		return bytes.Contains([]byte(out.String()), []byte(`"Uuid":"1"`))
+	}, time.Second, 5*time.Millisecond)
+}
+
+type failingWriter struct {
+	fail bool
+	bytes.Buffer
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.fail {
+		return 0, errors.New("disk full")
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestJSONLSinkDropsOnWriteError(t *testing.T) {
+	out := &failingWriter{fail: true}
+	sink := NewJSONLSink(out)
+
+	require.NoError(t, sink.Write(PostHogEvent{Uuid: "1"}))
+	require.NoError(t, sink.Write(PostHogEvent{Uuid: "2"}))
+	assert.ErrorContains(t, sink.Flush(), "dropped 2 events")
+
+	assert.Equal(t, int64(2), sink.Dropped())
+	assert.Empty(t, out.String())
+
+	// The sink recovers once the output works again.
+	out.fail = false
+	require.NoError(t, sink.Write(PostHogEvent{Uuid: "3"}))
+	require.NoError(t, sink.Flush())
+
+	assert.Equal(t, int64(2), sink.Dropped())
+	assert.Contains(t, out.String(), `"Uuid":"3"`)
+}
+
+// fakeSink records what it is given and fails writes of the events in fail.
+type fakeSink struct {
+	mu     sync.Mutex
+	uuids  []string
+	fail   map[string]bool
+	closed bool
+}
+
+func (s *fakeSink) Write(event PostHogEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail[event.Uuid] {
+		return errors.New("sink unavailable")
+	}
+	s.uuids = append(s.uuids, event.Uuid)
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func TestHubSinks(t *testing.T) {
+	in := make(chan PostHogEvent)
+	hub := NewHub(in)
+
+	healthy := &fakeSink{}
+	failing := &fakeSink{fail: map[string]bool{"1": true, "2": true}}
+	hub.AddSink("healthy", healthy, 10, Block)
+	hub.AddSink("failing", failing, 10, Block)
+	go hub.Run()
+
+	for _, uuid := range []string{"1", "2", "3"} {
+		in <- PostHogEvent{Uuid: uuid}
+	}
+	close(in)
+	hub.Wait()
+
+	assert.Equal(t, []string{"1", "2", "3"}, healthy.uuids)
+	assert.True(t, healthy.closed)
+	assert.Equal(t, []string{"3"}, failing.uuids)
+	assert.True(t, failing.closed)
+	assert.Equal(t, 2.0, testutil.ToFloat64(sinkErrors.WithLabelValues("failing")))
+	assert.Zero(t, testutil.ToFloat64(sinkErrors.WithLabelValues("healthy")))
+}
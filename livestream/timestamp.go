@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// timestampLayout is the format PostHog uses for event timestamps, and the one
+// sent to clients.
+const timestampLayout = "2006-01-02T15:04:05.000Z"
+
+// UnmarshalJSON decodes the event, parsing its timestamp from RFC 3339,
+// timestampLayout or milliseconds since the epoch. A timestamp in any other
+// form is ignored, leaving Timestamp as it was. Raw is never decoded.
+func (e *PostHogEvent) UnmarshalJSON(data []byte) error {
+	type alias PostHogEvent
+	aux := struct {
+		*alias
+		Timestamp json.RawMessage `json:"timestamp"`
+		// Raw shadows the event's, so that it is read and thrown away.
+		Raw json.RawMessage `json:"raw"`
+	}{alias: (*alias)(e)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if ts, ok := parseTimestamp(aux.Timestamp); ok {
+		e.Timestamp = ts
+	}
+	return nil
+}
+
+// parseTimestamp parses a JSON timestamp value. It reports false when raw is
+// empty, null or in no format it knows.
+func parseTimestamp(raw json.RawMessage) (time.Time, bool) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return time.Time{}, false
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		// Not a string, so it should be a number of milliseconds.
+		s = string(raw)
+	}
+
+	for _, layout := range []string{time.RFC3339Nano, timestampLayout} {
+		if ts, err := time.Parse(layout, s); err == nil {
+			return ts.UTC(), true
+		}
+	}
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(ms).UTC(), true
+	}
+	return time.Time{}, false
+}
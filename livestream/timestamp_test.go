@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostHogEventUnmarshalTimestamp(t *testing.T) {
+	fallback := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		data     string
+		expected time.Time
+	}{
+		{
+			name:     "RFC3339",
+			data:     `{"event": "$pageview", "timestamp": "2023-06-01T12:30:45+02:00"}`,
+			expected: time.Date(2023, 6, 1, 10, 30, 45, 0, time.UTC),
+		},
+		{
+			name:     "RFC3339 with nanoseconds",
+			data:     `{"event": "$pageview", "timestamp": "2023-06-01T12:30:45.123456789Z"}`,
+			expected: time.Date(2023, 6, 1, 12, 30, 45, 123456789, time.UTC),
+		},
+		{
+			name:     "PostHog layout",
+			data:     `{"event": "$pageview", "timestamp": "2023-06-01T12:30:45.250Z"}`,
+			expected: time.Date(2023, 6, 1, 12, 30, 45, 250000000, time.UTC),
+		},
+		{
+			name:     "Epoch milliseconds",
+			data:     `{"event": "$pageview", "timestamp": 1685622645250}`,
+			expected: time.Date(2023, 6, 1, 12, 30, 45, 250000000, time.UTC),
+		},
+		{
+			name:     "Epoch milliseconds as string",
+			data:     `{"event": "$pageview", "timestamp": "1685622645250"}`,
+			expected: time.Date(2023, 6, 1, 12, 30, 45, 250000000, time.UTC),
+		},
+		{
+			name:     "Missing",
+			data:     `{"event": "$pageview"}`,
+			expected: fallback,
+		},
+		{
+			name:     "Null",
+			data:     `{"event": "$pageview", "timestamp": null}`,
+			expected: fallback,
+		},
+		{
+			name:     "Unparseable",
+			data:     `{"event": "$pageview", "timestamp": "last tuesday"}`,
+			expected: fallback,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			event := PostHogEvent{Timestamp: fallback}
+			require.NoError(t, json.Unmarshal([]byte(tt.data), &event))
+
+			assert.Equal(t, "$pageview", event.Event)
+			assert.True(t, tt.expected.Equal(event.Timestamp), "expected %s, got %s", tt.expected, event.Timestamp)
+		})
+	}
+}
+
+func TestPostHogKafkaConsumer_ParseMessageTimestamp(t *testing.T) {
+	clock := newFakeClock()
+	consumer := &PostHogKafkaConsumer{clock: clock}
+
+	withTimestamp := consumer.parseMessage(&kafka.Message{Value: []byte(`{"data": "{\"event\": \"$pageview\", \"timestamp\": \"2023-06-01T12:30:45.250Z\"}"}`)})
+	assert.Equal(t, time.Date(2023, 6, 1, 12, 30, 45, 250000000, time.UTC), withTimestamp.Timestamp)
+
+	withoutTimestamp := consumer.parseMessage(&kafka.Message{Value: []byte(`{"data": "{\"event\": \"$pageview\"}"}`)})
+	assert.Equal(t, clock.Now().UTC(), withoutTimestamp.Timestamp)
+}
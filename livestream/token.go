@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+const maxTokenLength = 64
+
+// tokenPattern matches PostHog project API tokens, e.g. phc_abc123.
+var tokenPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrNoToken means an event carries no project token at all.
+	ErrNoToken = errors.New("no token found")
+)
+
+// validateToken checks that token looks like a project API token.
+func validateToken(token string) error {
+	if token == "" || len(token) > maxTokenLength || !tokenPattern.MatchString(token) {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// maxTokenScanDepth is how many levels of nested properties a deep scan
+// looks through.
+const maxTokenScanDepth = 5
+
+// extractToken finds the project token of an event. Only the known places are
+// looked at: the wrapper's token if set, then the event's api_key, then its
+// token property. A token key nested deeper, e.g. in $set, is usually an
+// unrelated user property, so it is only used when deep is set and nothing
+// was found in the known places. foldCase matches property keys regardless of
+// case, see lookupProperty.
+func extractToken(wrapper PostHogEventWrapper, event PostHogEvent, deep, foldCase bool) (string, error) {
+	if wrapper.Token != "" {
+		return wrapper.Token, nil
+	}
+	if event.Token != "" {
+		return event.Token, nil
+	}
+	value, _ := lookupProperty(event.Properties, "token", foldCase)
+	if token, ok := value.(string); ok && token != "" {
+		return token, nil
+	}
+	if deep {
+		if token, ok := findNestedToken(event.Properties, foldCase); ok {
+			return token, nil
+		}
+	}
+	return "", ErrNoToken
+}
+
+// findNestedToken returns the first non-empty string under a token or api_key
+// key in the nested objects of props, breadth first and in key order, down
+// to maxTokenScanDepth.
+func findNestedToken(props map[string]interface{}, foldCase bool) (string, bool) {
+	level := []map[string]interface{}{props}
+	for depth := 0; depth < maxTokenScanDepth && len(level) > 0; depth++ {
+		var next []map[string]interface{}
+		for _, obj := range level {
+			// The top level's token was already looked at by extractToken,
+			// but not its api_key.
+			for _, key := range []string{"token", "api_key"} {
+				value, _ := lookupProperty(obj, key, foldCase)
+				if token, ok := value.(string); ok && token != "" {
+					return token, true
+				}
+			}
+			keys := maps.Keys(obj)
+			slices.Sort(keys)
+			for _, key := range keys {
+				if nested, ok := obj[key].(map[string]interface{}); ok {
+					next = append(next, nested)
+				}
+			}
+		}
+		level = next
+	}
+	return "", false
+}
+
+// TokenNormalizer cleans up the tokens events arrive with, so padding or case
+// differences don't split one project's stats, and rejects tokens that can't
+// belong to a project.
+type TokenNormalizer struct {
+	// Lowercase folds tokens to lower case. Project tokens are case
+	// sensitive, so this is only safe when every producer's are lower case.
+	Lowercase bool
+	// MaxLength is the longest valid token. Zero means no limit.
+	MaxLength int
+	// Pattern must match the whole token. Nil accepts any non-empty token.
+	Pattern *regexp.Regexp
+}
+
+// Normalize trims token, lowercases it if configured, and validates the
+// result. On failure it returns the cleaned token along with ErrInvalidToken.
+func (n *TokenNormalizer) Normalize(token string) (string, error) {
+	token = strings.TrimSpace(token)
+	if n.Lowercase {
+		token = strings.ToLower(token)
+	}
+
+	if token == "" || (n.MaxLength > 0 && len(token) > n.MaxLength) || (n.Pattern != nil && !n.Pattern.MatchString(token)) {
+		return token, ErrInvalidToken
+	}
+	return token, nil
+}
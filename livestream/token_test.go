@@ -0,0 +1,190 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateToken(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{name: "Project token", token: "phc_5d7Sz2GbBNkHYVrFp0Lqx1mW", valid: true},
+		{name: "Legacy token", token: "sTMFPsFhdP1Ssg", valid: true},
+		{name: "Hyphenated", token: "test-token", valid: true},
+		{name: "Empty", token: ""},
+		{name: "Whitespace", token: "phc_ abc"},
+		{name: "Special characters", token: "phc_abc;drop"},
+		{name: "Too long", token: strings.Repeat("a", maxTokenLength+1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateToken(tt.token)
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestTokenNormalizer(t *testing.T) {
+	// defaults accepts what validateToken does.
+	defaults := &TokenNormalizer{MaxLength: maxTokenLength, Pattern: tokenPattern}
+	tests := []struct {
+		name       string
+		normalizer *TokenNormalizer
+		token      string
+		expected   string
+		valid      bool
+	}{
+		{name: "Valid", normalizer: defaults, token: "phc_AbC123", expected: "phc_AbC123", valid: true},
+		{name: "Padded", normalizer: defaults, token: "  phc_abc123\n", expected: "phc_abc123", valid: true},
+		{name: "Case kept by default", normalizer: defaults, token: "PHC_ABC", expected: "PHC_ABC", valid: true},
+		{name: "Lowercased", normalizer: &TokenNormalizer{Lowercase: true, Pattern: tokenPattern}, token: " PHC_ABC ", expected: "phc_abc", valid: true},
+		{name: "Empty", normalizer: defaults, token: ""},
+		{name: "Only whitespace", normalizer: defaults, token: "   "},
+		{name: "Invalid characters", normalizer: defaults, token: "phc_abc;drop", expected: "phc_abc;drop"},
+		{name: "Too long", normalizer: &TokenNormalizer{MaxLength: 4}, token: "phc_a", expected: "phc_a"},
+		{name: "Custom pattern", normalizer: &TokenNormalizer{Pattern: regexp.MustCompile(`^phc_[a-z0-9]+$`)}, token: "sTMFPsFhdP1Ssg", expected: "sTMFPsFhdP1Ssg"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := tt.normalizer.Normalize(tt.token)
+			assert.Equal(t, tt.expected, token)
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestExtractToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		wrapper  PostHogEventWrapper
+		event    PostHogEvent
+		expected string
+		err      error
+	}{
+		{
+			name:     "Wrapper token",
+			wrapper:  PostHogEventWrapper{Token: "wrapper-token"},
+			event:    PostHogEvent{Token: "api-key", Properties: map[string]interface{}{"token": "property-token"}},
+			expected: "wrapper-token",
+		},
+		{
+			name:     "Event api_key",
+			event:    PostHogEvent{Token: "api-key", Properties: map[string]interface{}{"token": "property-token"}},
+			expected: "api-key",
+		},
+		{
+			name:     "Property token",
+			event:    PostHogEvent{Properties: map[string]interface{}{"token": "property-token"}},
+			expected: "property-token",
+		},
+		{
+			name:  "No token",
+			event: PostHogEvent{Properties: map[string]interface{}{}},
+			err:   ErrNoToken,
+		},
+		{
+			name:  "Non-string property token",
+			event: PostHogEvent{Properties: map[string]interface{}{"token": 42.0}},
+			err:   ErrNoToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := extractToken(tt.wrapper, tt.event, false, false)
+			assert.Equal(t, tt.expected, token)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestExtractTokenNested(t *testing.T) {
+	// A user property that happens to be called token.
+	incidental := PostHogEvent{Properties: map[string]interface{}{
+		"$set": map[string]interface{}{"token": "password-reset-token"},
+	}}
+	known := PostHogEvent{Properties: map[string]interface{}{
+		"token": "phc_real",
+		"$set":  map[string]interface{}{"token": "password-reset-token"},
+	}}
+
+	_, err := extractToken(PostHogEventWrapper{}, incidental, false, false)
+	assert.ErrorIs(t, err, ErrNoToken)
+
+	for _, deep := range []bool{false, true} {
+		token, err := extractToken(PostHogEventWrapper{}, known, deep, false)
+		assert.NoError(t, err)
+		assert.Equal(t, "phc_real", token, "deep=%v", deep)
+	}
+
+	token, err := extractToken(PostHogEventWrapper{}, incidental, true, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "password-reset-token", token)
+}
+
+func TestExtractTokenFoldCase(t *testing.T) {
+	event := PostHogEvent{Properties: map[string]interface{}{"Token": "phc_upper"}}
+
+	_, err := extractToken(PostHogEventWrapper{}, event, false, false)
+	assert.ErrorIs(t, err, ErrNoToken)
+
+	token, err := extractToken(PostHogEventWrapper{}, event, false, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "phc_upper", token)
+
+	nested := PostHogEvent{Properties: map[string]interface{}{"$set": map[string]interface{}{"API_KEY": "phc_nested"}}}
+	token, err = extractToken(PostHogEventWrapper{}, nested, true, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "phc_nested", token)
+}
+
+func TestFindNestedToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		props    map[string]interface{}
+		expected string
+	}{
+		{
+			name:     "Shallowest wins",
+			props:    map[string]interface{}{"a": map[string]interface{}{"b": map[string]interface{}{"token": "deep"}}, "z": map[string]interface{}{"api_key": "shallow"}},
+			expected: "shallow",
+		},
+		{
+			name:     "Key order breaks ties",
+			props:    map[string]interface{}{"b": map[string]interface{}{"token": "second"}, "a": map[string]interface{}{"token": "first"}},
+			expected: "first",
+		},
+		{
+			name:  "Too deep",
+			props: map[string]interface{}{"1": map[string]interface{}{"2": map[string]interface{}{"3": map[string]interface{}{"4": map[string]interface{}{"5": map[string]interface{}{"token": "lost"}}}}}},
+		},
+		{
+			name:  "Not a string",
+			props: map[string]interface{}{"a": map[string]interface{}{"token": 42.0}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, ok := findNestedToken(tt.props, false)
+			assert.Equal(t, tt.expected != "", ok)
+			assert.Equal(t, tt.expected, token)
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"text/template"
+)
+
+// PropertyTransform reshapes the properties of every event before it is
+// delivered, so deployments can rename, drop or derive properties without a
+// fork. It is a text/template run on the properties that renders the new
+// ones as a JSON object, e.g.
+//
+//	{{ . | omit "$set" | rename "$current_url" "url" | json }}
+//
+// Besides the builtins, the template can use:
+//
+//	omit KEY PROPS         PROPS without KEY
+//	rename FROM TO PROPS   PROPS with FROM moved to TO, if there
+//	set KEY VALUE PROPS    PROPS with KEY set to VALUE
+//	json VALUE             VALUE encoded as JSON
+type PropertyTransform struct {
+	tmpl *template.Template
+}
+
+var transformFuncs = template.FuncMap{
+	"omit": func(key string, props map[string]interface{}) map[string]interface{} {
+		props = maps.Clone(props)
+		delete(props, key)
+		return props
+	},
+	"rename": func(from, to string, props map[string]interface{}) map[string]interface{} {
+		value, ok := props[from]
+		if !ok {
+			return props
+		}
+		props = maps.Clone(props)
+		delete(props, from)
+		props[to] = value
+		return props
+	},
+	"set": func(key string, value interface{}, props map[string]interface{}) map[string]interface{} {
+		props = maps.Clone(props)
+		if props == nil {
+			props = make(map[string]interface{})
+		}
+		props[key] = value
+		return props
+	},
+	"json": func(value interface{}) (string, error) {
+		b, err := json.Marshal(value)
+		return string(b), err
+	},
+}
+
+// ParsePropertyTransform parses text, and checks that it turns properties
+// into a JSON object by running it on none. An empty text transforms
+// nothing, and returns a nil transform.
+func ParsePropertyTransform(text string) (*PropertyTransform, error) {
+	if text == "" {
+		return nil, nil
+	}
+
+	tmpl, err := template.New("transform").Option("missingkey=zero").Funcs(transformFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	t := &PropertyTransform{tmpl: tmpl}
+	if _, err := t.Apply(map[string]interface{}{}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Apply returns the transformed props. props itself is not modified. A nil
+// transform returns props unchanged.
+func (t *PropertyTransform) Apply(props map[string]interface{}) (map[string]interface{}, error) {
+	if t == nil {
+		return props, nil
+	}
+
+	var out bytes.Buffer
+	if err := t.tmpl.Execute(&out, props); err != nil {
+		return props, err
+	}
+	var transformed map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &transformed); err != nil {
+		return props, fmt.Errorf("transform must render a JSON object: %w", err)
+	}
+	if transformed == nil {
+		return props, errors.New("transform must render a JSON object, not null")
+	}
+	return transformed, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/posthog/posthog/livestream/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPropertyTransform(t *testing.T) {
+	props := func() map[string]interface{} {
+		return map[string]interface{}{"$current_url": "https://example.com", "$ip": "192.0.2.1", "$browser": "Firefox"}
+	}
+
+	tests := []struct {
+		name     string
+		text     string
+		expected map[string]interface{}
+	}{
+		{
+			name:     "Rename",
+			text:     `{{ . | rename "$current_url" "url" | json }}`,
+			expected: map[string]interface{}{"url": "https://example.com", "$ip": "192.0.2.1", "$browser": "Firefox"},
+		},
+		{
+			name:     "Rename missing",
+			text:     `{{ . | rename "$pathname" "path" | json }}`,
+			expected: props(),
+		},
+		{
+			name:     "Drop",
+			text:     `{{ . | omit "$ip" | omit "$browser" | json }}`,
+			expected: map[string]interface{}{"$current_url": "https://example.com"},
+		},
+		{
+			name:     "Derived",
+			text:     `{{ . | set "is_firefox" (eq (index . "$browser") "Firefox") | json }}`,
+			expected: map[string]interface{}{"$current_url": "https://example.com", "$ip": "192.0.2.1", "$browser": "Firefox", "is_firefox": true},
+		},
+		{
+			name:     "Written out",
+			text:     `{"browser": {{ index . "$browser" | json }}}`,
+			expected: map[string]interface{}{"browser": "Firefox"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transform, err := ParsePropertyTransform(tt.text)
+			require.NoError(t, err)
+
+			original := props()
+			transformed, err := transform.Apply(original)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, transformed)
+			assert.Equal(t, props(), original, "the input is not modified")
+		})
+	}
+}
+
+func TestParsePropertyTransformErrors(t *testing.T) {
+	for _, text := range []string{
+		`{{ . | omit }}`,
+		`{{ . | unknown "a" | json }}`,
+		`{{ . }}`,
+		`null`,
+		`["not", "an", "object"]`,
+	} {
+		_, err := ParsePropertyTransform(text)
+		assert.Error(t, err, text)
+	}
+}
+
+func TestPropertyTransformUnset(t *testing.T) {
+	transform, err := ParsePropertyTransform("")
+	require.NoError(t, err)
+	assert.Nil(t, transform)
+
+	props := map[string]interface{}{"a": 1.0}
+	transformed, err := transform.Apply(props)
+	assert.NoError(t, err)
+	assert.Equal(t, props, transformed)
+}
+
+func TestPostHogKafkaConsumer_Transform(t *testing.T) {
+	transform, err := ParsePropertyTransform(`{{ . | omit "$ip" | omit "token" | rename "$current_url" "url" | json }}`)
+	require.NoError(t, err)
+	geolocator := mocks.NewGeoLocator(t)
+	geolocator.On("Lookup", "192.0.2.1").Return(37.7749, -122.4194, nil).Once()
+	consumer := &PostHogKafkaConsumer{geolocator: geolocator, Transform: transform}
+	value := `{"uuid": "1", "data": "{\"event\": \"$pageview\", \"properties\": {\"$ip\": \"192.0.2.1\", \"token\": \"phc_test\", \"$current_url\": \"https://example.com\"}}"}`
+
+	phEvent := consumer.parseMessage(&kafka.Message{Value: []byte(value)})
+
+	// The token and IP were found before they were dropped.
+	assert.Equal(t, "phc_test", phEvent.Token)
+	assert.Equal(t, 37.7749, phEvent.Lat)
+	assert.Equal(t, map[string]interface{}{"url": "https://example.com"}, phEvent.Properties)
+}
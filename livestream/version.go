@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = ""
+	commit    = ""
+	buildTime = ""
+)
+
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+}
+
+// buildInfo returns the values injected at build time. Without them, the
+// commit and time go build recorded from the checkout are used when there are
+// any, and "dev" or "unknown" otherwise.
+func buildInfo() BuildInfo {
+	info := BuildInfo{Version: version, Commit: commit, BuildTime: buildTime}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildTime == "":
+				info.BuildTime = setting.Value
+			}
+		}
+	}
+
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildTime == "" {
+		info.BuildTime = "unknown"
+	}
+	return info
+}
+
+func versionHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, buildInfo())
+}
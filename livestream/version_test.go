@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setBuildInfo stands in for the -X ldflags for the length of the test.
+func setBuildInfo(t *testing.T, v, c, b string) {
+	t.Helper()
+	oldVersion, oldCommit, oldBuildTime := version, commit, buildTime
+	version, commit, buildTime = v, c, b
+	t.Cleanup(func() { version, commit, buildTime = oldVersion, oldCommit, oldBuildTime })
+}
+
+func getVersion(t *testing.T) BuildInfo {
+	t.Helper()
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/version", nil), rec)
+
+	require.NoError(t, versionHandler(c))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var info BuildInfo
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &info))
+	return info
+}
+
+func TestVersionHandler(t *testing.T) {
+	setBuildInfo(t, "1.2.3", "0123456789abcdef", "2024-05-01T12:00:00Z")
+
+	assert.Equal(t, BuildInfo{Version: "1.2.3", Commit: "0123456789abcdef", BuildTime: "2024-05-01T12:00:00Z"}, getVersion(t))
+}
+
+func TestVersionHandlerDefaults(t *testing.T) {
+	setBuildInfo(t, "", "", "")
+
+	// Test binaries carry no VCS information.
+	assert.Equal(t, BuildInfo{Version: "dev", Commit: "unknown", BuildTime: "unknown"}, getVersion(t))
+}
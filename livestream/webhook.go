@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultWebhookBatchSize  = 100
+	defaultWebhookTimeout    = 5 * time.Second
+	defaultWebhookMaxRetries = 3
+	defaultWebhookBackoff    = 500 * time.Millisecond
+)
+
+// errWebhookRejected is a response the webhook would answer the same way
+// again, so the batch is not retried.
+var errWebhookRejected = errors.New("webhook rejected the batch")
+
+// WebhookSink POSTs events to a URL as JSON arrays of up to BatchSize. A
+// batch that still fails after MaxRetries goes to DeadLetter, when set.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+	clock  Clock
+
+	// BatchSize is how many events are sent at most per request. Defaults
+	// to 100.
+	BatchSize int
+	// Interval is how often runSink flushes the batch. Defaults to the
+	// interval of runSink.
+	Interval time.Duration
+	// MaxRetries is how often a batch is sent again after a network error, a
+	// 429 or a 5xx response, doubling Backoff each time.
+	MaxRetries int
+	Backoff    time.Duration
+	// DeadLetter receives the events of batches that could not be sent.
+	DeadLetter Sink
+
+	batch   []PostHogEvent
+	dropped atomic.Int64
+}
+
+// NewWebhookSink sends to url, giving up on a request after timeout.
+func NewWebhookSink(url string, timeout time.Duration) *WebhookSink {
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	return &WebhookSink{
+		url:        url,
+		client:     &http.Client{Timeout: timeout},
+		clock:      realClock{},
+		BatchSize:  defaultWebhookBatchSize,
+		MaxRetries: defaultWebhookMaxRetries,
+		Backoff:    defaultWebhookBackoff,
+	}
+}
+
+func (s *WebhookSink) Write(event PostHogEvent) error {
+	s.batch = append(s.batch, event)
+	if len(s.batch) < max(s.BatchSize, 1) {
+		return nil
+	}
+	return s.Flush()
+}
+
+func (s *WebhookSink) FlushInterval() time.Duration {
+	return s.Interval
+}
+
+// Flush sends the buffered events. It blocks while the batch is retried, so
+// runSink holds back further events meanwhile.
+func (s *WebhookSink) Flush() error {
+	if len(s.batch) == 0 {
+		return nil
+	}
+	batch := s.batch
+	s.batch = nil
+
+	body, err := json.Marshal(batch)
+	if err == nil {
+		err = s.send(body)
+	}
+	if err != nil {
+		s.dropped.Add(int64(len(batch)))
+		return errors.Join(fmt.Errorf("dropped %d events: %w", len(batch), err), s.deadLetter(batch))
+	}
+	return nil
+}
+
+// Close sends what is left and closes DeadLetter.
+func (s *WebhookSink) Close() error {
+	err := s.Flush()
+	if s.DeadLetter != nil {
+		err = errors.Join(err, s.DeadLetter.Close())
+	}
+	return err
+}
+
+// Dropped returns how many events could not be sent.
+func (s *WebhookSink) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// send POSTs body, retrying failures the webhook may recover from.
+func (s *WebhookSink) send(body []byte) error {
+	backoff := s.Backoff
+	for attempt := 0; ; attempt++ {
+		err := s.post(body)
+		if err == nil || errors.Is(err, errWebhookRejected) || attempt >= s.MaxRetries {
+			return err
+		}
+		<-s.clock.After(backoff)
+		backoff *= 2
+	}
+}
+
+func (s *WebhookSink) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %w", errWebhookRejected, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	// Drained so the connection can be reused.
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return fmt.Errorf("%w: %s", errWebhookRejected, resp.Status)
+}
+
+// deadLetter writes batch to DeadLetter and flushes it.
+func (s *WebhookSink) deadLetter(batch []PostHogEvent) error {
+	if s.DeadLetter == nil {
+		return nil
+	}
+	for _, event := range batch {
+		if err := s.DeadLetter.Write(event); err != nil {
+			return fmt.Errorf("dead letter: %w", err)
+		}
+	}
+	if flusher, ok := s.DeadLetter.(Flusher); ok {
+		if err := flusher.Flush(); err != nil {
+			return fmt.Errorf("dead letter: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookServer records the uuids of every batch it is sent, answering with
+// the statuses in order and 200 once they run out.
+type webhookServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	batches  [][]string
+}
+
+func newWebhookServer(t *testing.T, statuses ...int) *webhookServer {
+	s := &webhookServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var events []PostHogEvent
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&events))
+		uuids := make([]string, len(events))
+		for i, event := range events {
+			uuids[i] = event.Uuid
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.batches = append(s.batches, uuids)
+		status := http.StatusOK
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *webhookServer) Batches() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]string(nil), s.batches...)
+}
+
+func TestWebhookSinkBatches(t *testing.T) {
+	server := newWebhookServer(t)
+	sink := NewWebhookSink(server.URL, time.Second)
+	sink.clock = newFakeClock()
+	sink.BatchSize = 2
+
+	for _, uuid := range []string{"1", "2", "3", "4", "5"} {
+		require.NoError(t, sink.Write(PostHogEvent{Uuid: uuid}))
+	}
+	assert.Equal(t, [][]string{{"1", "2"}, {"3", "4"}}, server.Batches())
+
+	require.NoError(t, sink.Close())
+	assert.Equal(t, [][]string{{"1", "2"}, {"3", "4"}, {"5"}}, server.Batches())
+	assert.Zero(t, sink.Dropped())
+}
+
+func TestWebhookSinkRetriesServerErrors(t *testing.T) {
+	server := newWebhookServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	clock := newFakeClock()
+	sink := NewWebhookSink(server.URL, time.Second)
+	sink.clock = clock
+
+	require.NoError(t, sink.Write(PostHogEvent{Uuid: "1"}))
+	require.NoError(t, sink.Flush())
+
+	assert.Equal(t, [][]string{{"1"}, {"1"}, {"1"}}, server.Batches())
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, time.Second}, clock.Waits())
+	assert.Zero(t, sink.Dropped())
+}
+
+func TestWebhookSinkDeadLettersAfterMaxRetries(t *testing.T) {
+	server := newWebhookServer(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+	sink := NewWebhookSink(server.URL, time.Second)
+	sink.clock = newFakeClock()
+	sink.MaxRetries = 2
+	var dead bytes.Buffer
+	sink.DeadLetter = NewJSONLSink(&dead)
+
+	require.NoError(t, sink.Write(PostHogEvent{Uuid: "1"}))
+	require.NoError(t, sink.Write(PostHogEvent{Uuid: "2"}))
+	assert.ErrorContains(t, sink.Flush(), "dropped 2 events")
+
+	assert.Len(t, server.Batches(), 3)
+	assert.Equal(t, int64(2), sink.Dropped())
+	assert.Contains(t, dead.String(), `"Uuid":"1"`)
+	assert.Contains(t, dead.String(), `"Uuid":"2"`)
+
+	// The next batch goes through once the webhook is back.
+	require.NoError(t, sink.Write(PostHogEvent{Uuid: "3"}))
+	require.NoError(t, sink.Flush())
+	assert.Equal(t, []string{"3"}, server.Batches()[3])
+}
+
+func TestWebhookSinkDoesNotRetryClientErrors(t *testing.T) {
+	server := newWebhookServer(t, http.StatusBadRequest)
+	clock := newFakeClock()
+	sink := NewWebhookSink(server.URL, time.Second)
+	sink.clock = clock
+
+	require.NoError(t, sink.Write(PostHogEvent{Uuid: "1"}))
+	assert.ErrorIs(t, sink.Flush(), errWebhookRejected)
+
+	assert.Len(t, server.Batches(), 1)
+	assert.Empty(t, clock.Waits())
+	assert.Equal(t, int64(1), sink.Dropped())
+}
+
+func TestWebhookSinkFlushInterval(t *testing.T) {
+	server := newWebhookServer(t)
+	sink := NewWebhookSink(server.URL, time.Second)
+	sink.Interval = 10 * time.Millisecond
+
+	events := make(chan PostHogEvent)
+	defer close(events)
+	go runSink("webhook", sink, events, time.Hour, realClock{})
+
+	events <- PostHogEvent{Uuid: "1"}
+
+	assert.Eventually(t, func() bool {
+		return len(server.Batches()) == 1
+	}, time.Second, 5*time.Millisecond)
+}
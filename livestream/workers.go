@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// workerQueueSize is how many messages can wait for each worker before
+// Consume stops reading from Kafka.
+const workerQueueSize = 100
+
+// messagePool processes messages off the goroutine reading them from Kafka.
+type messagePool interface {
+	// dispatch hands msg to the pool. It fails only if ctx is cancelled
+	// while the pool is full.
+	dispatch(ctx context.Context, msg *kafka.Message) error
+	// drain waits until every message dispatched so far is processed. It
+	// must be called from the goroutine that dispatches.
+	drain()
+	// stop waits for the pool to finish what is queued.
+	stop()
+}
+
+// workerPool processes messages on several goroutines, each owning a share of
+// the partitions.
+type workerPool struct {
+	queues []chan *kafka.Message
+	wg     sync.WaitGroup
+	// inflight counts dispatched messages not yet processed.
+	inflight sync.WaitGroup
+}
+
+// startWorkers starts n workers that process messages until stop is called.
+func (c *PostHogKafkaConsumer) startWorkers(ctx context.Context, n int) *workerPool {
+	pool := &workerPool{queues: make([]chan *kafka.Message, n)}
+	for i := range pool.queues {
+		queue := make(chan *kafka.Message, workerQueueSize)
+		pool.queues[i] = queue
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			c.work(ctx, queue, &pool.inflight)
+		}()
+	}
+	return pool
+}
+
+// work processes queued messages in order. Once a delivery fails the rest of
+// the queue is skipped, so that nothing later in a partition is committed
+// ahead of the message that was not delivered.
+func (c *PostHogKafkaConsumer) work(ctx context.Context, queue <-chan *kafka.Message, inflight *sync.WaitGroup) {
+	failed := false
+	for msg := range queue {
+		if !failed && c.process(ctx, msg) != nil {
+			failed = true
+		}
+		inflight.Done()
+	}
+}
+
+// dispatch queues msg on the worker that owns its partition. It fails only if
+// ctx is cancelled while that worker's queue is full.
+func (p *workerPool) dispatch(ctx context.Context, msg *kafka.Message) error {
+	queue := p.queues[p.workerFor(msg)]
+	p.inflight.Add(1)
+	select {
+	case queue <- msg:
+		return nil
+	case <-ctx.Done():
+		p.inflight.Done()
+		return ctx.Err()
+	}
+}
+
+// drain waits for the workers to process every message dispatched so far. It
+// must be called from the goroutine that dispatches.
+func (p *workerPool) drain() {
+	p.inflight.Wait()
+}
+
+func (p *workerPool) workerFor(msg *kafka.Message) int {
+	h := fnv.New32a()
+	if msg.TopicPartition.Topic != nil {
+		h.Write([]byte(*msg.TopicPartition.Topic))
+	}
+	return int((h.Sum32() + uint32(msg.TopicPartition.Partition)) % uint32(len(p.queues)))
+}
+
+// stop waits for the workers to finish what is queued.
+func (p *workerPool) stop() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowGeoLocator takes a random while per lookup, so that workers finish out
+// of order.
+type slowGeoLocator struct {
+	max time.Duration
+}
+
+func (g slowGeoLocator) Lookup(string) (float64, float64, error) {
+	time.Sleep(time.Duration(rand.Int63n(int64(g.max))))
+	return 1, 1, nil
+}
+
+// partitionedUuids returns messages named partition-offset, n per partition.
+func partitionedUuids(partitions, n int) [][]string {
+	uuids := make([][]string, partitions)
+	for p := range uuids {
+		for i := 0; i < n; i++ {
+			uuids[p] = append(uuids[p], fmt.Sprintf("%d-%d", p, i))
+		}
+	}
+	return uuids
+}
+
+// consumeAll runs Consume until every one of total events came out, and
+// returns them in the order they were delivered.
+func consumeAll(t testing.TB, consumer *PostHogKafkaConsumer, total int) []PostHogEvent {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- consumer.Consume(ctx)
+	}()
+
+	var events []PostHogEvent
+	for len(events) < total {
+		select {
+		case event := <-consumer.outgoingChan:
+			events = append(events, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out after %d of %d events", len(events), total)
+		}
+	}
+	cancel()
+	require.NoError(t, <-done)
+	return events
+}
+
+func TestPostHogKafkaConsumer_WorkersKeepPartitionOrder(t *testing.T) {
+	const partitions, perPartition = 4, 50
+
+	fake := newFakeKafkaConsumer("events", time.Now(), partitionedUuids(partitions, perPartition)...)
+	consumer := &PostHogKafkaConsumer{
+		consumer:     fake,
+		topics:       []string{"events"},
+		geolocator:   slowGeoLocator{max: 200 * time.Microsecond},
+		outgoingChan: make(chan PostHogEvent),
+		statsChan:    make(chan PostHogEvent, partitions*perPartition),
+		Workers:      3,
+	}
+
+	events := consumeAll(t, consumer, partitions*perPartition)
+
+	next := make([]int64, partitions)
+	for _, event := range events {
+		assert.Equal(t, next[event.Partition], event.Offset, "partition %d out of order", event.Partition)
+		assert.Equal(t, fmt.Sprintf("%d-%d", event.Partition, event.Offset), event.Uuid)
+		next[event.Partition] = event.Offset + 1
+	}
+	assert.Equal(t, []int64{perPartition, perPartition, perPartition, perPartition}, next)
+	assert.Equal(t, partitions*perPartition, fake.committed)
+}
+
+func TestWorkerPoolWorkerFor(t *testing.T) {
+	pool := &workerPool{queues: make([]chan *kafka.Message, 4)}
+	topic := "events"
+
+	first := pool.workerFor(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 2, Offset: 1}})
+	second := pool.workerFor(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 2, Offset: 9}})
+	assert.Equal(t, first, second)
+
+	seen := make(map[int]bool)
+	for p := int32(0); p < 4; p++ {
+		seen[pool.workerFor(&kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: p}})] = true
+	}
+	assert.Len(t, seen, 4, "consecutive partitions should spread over the workers")
+}
+
+func BenchmarkConsumeWorkers(b *testing.B) {
+	for _, workers := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			const partitions = 8
+			fake := newFakeKafkaConsumer("events", time.Now(), partitionedUuids(partitions, b.N/partitions+1)...)
+			consumer := &PostHogKafkaConsumer{
+				consumer:     fake,
+				topics:       []string{"events"},
+				geolocator:   slowGeoLocator{max: 50 * time.Microsecond},
+				outgoingChan: make(chan PostHogEvent, 1000),
+				statsChan:    make(chan PostHogEvent, 1000),
+				CommitEvery:  1000,
+				Workers:      workers,
+			}
+			go func() {
+				for range consumer.statsChan {
+				}
+			}()
+
+			b.ResetTimer()
+			consumeAll(b, consumer, b.N)
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// wsWriteWait bounds how long a single frame may take to write.
+	wsWriteWait = 10 * time.Second
+	// wsPongWait is how long the client has to answer a ping before the
+	// connection is considered dead.
+	wsPongWait = 60 * time.Second
+	// wsPingPeriod must be shorter than wsPongWait.
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+var wsUpgrader = websocket.Upgrader{
+	// Same policy as the CORS headers; main sets it from cors.allowed_origins.
+	CheckOrigin: CORSConfig{}.checkOrigin,
+	// Negotiate permessage-deflate with clients that offer it.
+	EnableCompression: true,
+}
+
+// wsHandler streams the same events as /events over a WebSocket, one JSON
+// text frame per event. It accepts the same query params and headers, and
+// shares the connection limits and API key checks.
+func wsHandler(subChan chan Subscription, unSubChan chan Subscription, limiter *ClientLimiter, auth Authorizer) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		subscription, err := newSubscription(c, auth)
+		if err != nil {
+			return err
+		}
+
+		if err := limiter.acquire(c, subscription.Token); err != nil {
+			return err
+		}
+		defer limiter.Release(c.RealIP(), subscription.Token)
+		subscription.RateLimit = limiter.EventLimit()
+
+		conn, err := wsUpgrader.Upgrade(c.Response(), c.Request(), nil)
+		if err != nil {
+			// Upgrade has already written the error response.
+			return nil
+		}
+		defer conn.Close()
+
+		log.Printf("WebSocket client connected, ip: %v", c.RealIP())
+		ctx := c.Request().Context()
+		select {
+		case subChan <- subscription:
+		case <-ctx.Done():
+			return nil
+		}
+		defer func() {
+			if shuttingDown(ctx) {
+				// The filter has stopped, there is nothing to unsubscribe from.
+				return
+			}
+			unSubChan <- subscription
+			subscription.ShouldClose.Store(true)
+			log.Printf("WebSocket client disconnected, ip: %v", c.RealIP())
+		}()
+
+		// Clients send nothing but control frames, so the read loop is only
+		// there to process pongs and notice the connection closing.
+		closed := make(chan struct{})
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		ping := time.NewTicker(wsPingPeriod)
+		defer ping.Stop()
+
+		for {
+			select {
+			case <-closed:
+				return nil
+			case <-ctx.Done():
+				if shuttingDown(ctx) {
+					// Send what is buffered, then tell the client why the
+					// connection ends.
+					for len(subscription.EventChan) > 0 {
+						conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+						if err := conn.WriteJSON(<-subscription.EventChan); err != nil {
+							return nil
+						}
+					}
+					message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+					conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(wsWriteWait))
+				}
+				return nil
+			case <-ping.C:
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+					return nil
+				}
+			case payload := <-subscription.EventChan:
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				if err := conn.WriteJSON(payload); err != nil {
+					if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+						captureException(err)
+						log.Println("Error writing WebSocket frame", err)
+					}
+					return nil
+				}
+			}
+		}
+	}
+}
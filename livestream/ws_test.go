@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createProjectToken(t *testing.T, teamId int, apiToken string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"aud":       ExpectedScope,
+		"exp":       time.Now().Add(time.Hour).Unix(),
+		"team_id":   teamId,
+		"api_token": apiToken,
+	})
+	tokenString, err := token.SignedString([]byte(viper.GetString("jwt.secret")))
+	require.NoError(t, err)
+	return tokenString
+}
+
+func TestWsHandler(t *testing.T) {
+	viper.Set("jwt.secret", "test-secret")
+
+	subChan := make(chan Subscription)
+	filterUnSubChan := make(chan Subscription)
+	inboundChan := make(chan PostHogEvent)
+	filter := NewFilter(subChan, filterUnSubChan, inboundChan)
+	go filter.Run()
+
+	// The handler unsubscribes through unSubChan so the test can see it.
+	unSubChan := make(chan Subscription, 1)
+
+	e := echo.New()
+	e.Use(middleware.RequestID())
+	e.GET("/ws", wsHandler(subChan, unSubChan, nil, nil))
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+createProjectToken(t, 1, "test-token"))
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?event=$pageview"
+	conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	// Keep publishing until the subscription is registered and the event
+	// comes through. Filtered events must never arrive.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(inboundChan)
+		for {
+			select {
+			case <-stop:
+				return
+			case inboundChan <- PostHogEvent{Token: "test-token", Event: "$autocapture", Uuid: "filtered"}:
+			}
+			select {
+			case <-stop:
+				return
+			case inboundChan <- PostHogEvent{Token: "test-token", Event: "$pageview", Uuid: "forwarded"}:
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	var received ResponsePostHogEvent
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	require.NoError(t, conn.ReadJSON(&received))
+	assert.Equal(t, "forwarded", received.Uuid)
+	assert.Equal(t, "$pageview", received.Event)
+
+	require.NoError(t, conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+	conn.Close()
+
+	select {
+	case sub := <-unSubChan:
+		assert.Equal(t, "test-token", sub.Token)
+		assert.True(t, sub.ShouldClose.Load())
+	case <-time.After(time.Second):
+		t.Fatal("Subscription was not removed after disconnect")
+	}
+}
+
+func TestWsHandlerRequiresAuthorization(t *testing.T) {
+	e := echo.New()
+	e.GET("/ws", wsHandler(make(chan Subscription), make(chan Subscription), nil, nil))
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	require.Error(t, err)
+	require.NotNil(t, resp)
+	assert.NotEqual(t, http.StatusSwitchingProtocols, resp.StatusCode)
+}